@@ -0,0 +1,151 @@
+package apnstest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+//apns.Clock whose time only moves when Advance is called, so tests can
+//step through framing timeouts, acceptance windows and backoff without sleeping
+//Set as APNSConfig.Clock
+//THREADSAFE
+type FakeClock struct {
+	//Mutex to sync access to everything below
+	lock *sync.Mutex
+	now  time.Time
+	//timers and tickers which haven't fired or been stopped
+	pending []*fakeTimer
+}
+
+//Create a fake clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		lock: new(sync.Mutex),
+		now:  now,
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) apns.Timer {
+	return c.start(&fakeTimer{clock: c, c: make(chan time.Time, 1)}, d)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) apns.Ticker {
+	return fakeTicker{c.start(&fakeTimer{clock: c, c: make(chan time.Time, 1), period: d}, d)}
+}
+
+//f is called from Advance, before it returns
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) apns.Timer {
+	return c.start(&fakeTimer{clock: c, f: f}, d)
+}
+
+//Number of timers and tickers waiting to fire
+func (c *FakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
+
+//Move the time forward by d, firing the timers due on the way in order
+//Timer channels are buffered like the time package's, so a tick nobody
+//has received yet is dropped rather than blocking
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	until := c.now.Add(d)
+	c.lock.Unlock()
+	for {
+		c.lock.Lock()
+		sort.SliceStable(c.pending, func(i, j int) bool {
+			return c.pending[i].deadline.Before(c.pending[j].deadline)
+		})
+		if len(c.pending) == 0 || c.pending[0].deadline.After(until) {
+			c.now = until
+			c.lock.Unlock()
+			return
+		}
+		t := c.pending[0]
+		c.now = t.deadline
+		if t.period > 0 {
+			t.deadline = t.deadline.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+		now := c.now
+		c.lock.Unlock()
+
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+//Schedule a timer d from now
+func (c *FakeClock) start(t *fakeTimer, d time.Duration) *fakeTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t.deadline = c.now.Add(d)
+	c.pending = append(c.pending, t)
+	return t
+}
+
+//Remove a timer from pending, returning whether it was there
+//lock must be held
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, pending := range c.pending {
+		if pending == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//Timer or ticker made by a FakeClock
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	f        func()
+	deadline time.Time
+	//interval between ticks, 0 for timers
+	period time.Duration
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	active := t.clock.remove(t)
+	t.deadline = t.clock.now.Add(d)
+	t.clock.pending = append(t.clock.pending, t)
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
@@ -0,0 +1,252 @@
+package apnstest
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestFakeClockShouldFireTimersInOrder(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(10 * time.Millisecond)
+	ticker := clock.NewTicker(3 * time.Millisecond)
+	var fired []time.Duration
+	clock.AfterFunc(5*time.Millisecond, func() { fired = append(fired, clock.Now().Sub(start)) })
+	stopped := clock.NewTimer(time.Millisecond)
+	if !stopped.Stop() {
+		t.Error("Expected stopping a pending timer to return true")
+	}
+
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case <-timer.Chan():
+		t.Error("Expected the timer not to fire before its deadline")
+	case <-stopped.Chan():
+		t.Error("Expected a stopped timer not to fire")
+	default:
+	}
+	if len(fired) != 1 || fired[0] != 5*time.Millisecond {
+		t.Errorf("Expected the func to be called at 5ms but got %v", fired)
+	}
+	if tick := <-ticker.Chan(); tick.Sub(start) != 3*time.Millisecond {
+		t.Errorf("Expected the first tick at 3ms but got %v", tick.Sub(start))
+	}
+
+	clock.Advance(time.Millisecond)
+	if fire := <-timer.Chan(); !fire.Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("Expected the timer to fire at 10ms but got %v", fire.Sub(start))
+	}
+	ticker.Stop()
+	if clock.Pending() != 0 || !clock.Now().Equal(start.Add(10*time.Millisecond)) {
+		t.Errorf("Expected nothing pending at 10ms but got %v at %v", clock.Pending(), clock.Now().Sub(start))
+	}
+}
+
+func TestFakeClockShouldDriveAcceptanceWindow(t *testing.T) {
+	server, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	recorder := NewRecorder(server)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := server.Config()
+	config.FramingTimeout = -1
+	config.AcceptanceWindow = 5000
+	config.Clock = clock
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	result := conn.SendR(&apns.Payload{
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001",
+		AlertText: "Hi",
+	})
+	recorder.AssertSent(t, WithAlertText("Hi"))
+	//the acceptance timer is started once the write has finished
+	for conn.LastFlushTime().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(4999 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatalf("Expected no result before the acceptance window passed but got %v", err)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected the payload to be accepted but got %v", err)
+		}
+	default:
+		t.Error("Expected the payload to be accepted once the acceptance window passed")
+	}
+}
+
+func TestFakeClockShouldTimestampLiveActivities(t *testing.T) {
+	server, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	recorder := NewRecorder(server)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	config := server.Config()
+	config.FramingTimeout = -1
+	config.Clock = clock
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	conn.SendChannel <- &apns.Payload{
+		Token:    "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001",
+		PushType: apns.PUSH_TYPE_LIVE_ACTIVITY,
+		Event:    apns.LIVE_ACTIVITY_EVENT_END,
+	}
+	recorder.AssertSent(t, WithAPSField("timestamp", clock.Now().Unix()))
+}
+
+func TestFakeClockShouldDriveThrottleWindows(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	throttle, err := apns.NewThrottle(&apns.ThrottleConfig{
+		Topic:  func(payload *apns.Payload) string { return payload.Category },
+		Limit:  1,
+		Window: 1000,
+		Clock:  clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	send := throttle.Middleware(func(payload *apns.Payload) error {
+		sent++
+		return nil
+	})
+
+	send(&apns.Payload{Category: "a"})
+	clock.Advance(999 * time.Millisecond)
+	send(&apns.Payload{Category: "a"})
+	if sent != 1 {
+		t.Errorf("Expected the second payload to be throttled within the window but sent %v", sent)
+	}
+	clock.Advance(time.Millisecond)
+	send(&apns.Payload{Category: "a"})
+	if sent != 2 {
+		t.Errorf("Expected a payload to be sent in the next window but sent %v", sent)
+	}
+}
+
+//Wait for the go-routine under test to start n timers
+func waitForPending(t *testing.T, clock *FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clock.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v pending timers, have %v", n, clock.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockShouldDriveFeedbackPolls(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	polls := make(chan time.Time, 10)
+	connects := 0
+	poller, err := apns.NewFeedbackPoller(&apns.FeedbackPollerConfig{
+		FeedbackConfig: &apns.APNSFeedbackServiceConfig{},
+		Interval:       600,
+		RetryInterval:  60,
+		Clock:          clock,
+		Connect: func(config *apns.APNSFeedbackServiceConfig) (*list.List, error) {
+			polls <- clock.Now()
+			connects++
+			if connects == 1 {
+				return nil, errors.New("Feedback service unavailable")
+			}
+			return list.New(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop()
+
+	start := <-polls
+	//retried after RetryInterval, then polled every Interval
+	for _, wait := range []time.Duration{60 * time.Second, 600 * time.Second} {
+		waitForPending(t, clock, 1)
+		clock.Advance(wait - time.Second)
+		select {
+		case <-polls:
+			t.Fatalf("Expected no poll before %v", wait)
+		default:
+		}
+		clock.Advance(time.Second)
+		if poll := <-polls; poll.Sub(start) != wait {
+			t.Errorf("Expected a poll %v after the last but got one after %v", wait, poll.Sub(start))
+		}
+		start = start.Add(wait)
+	}
+}
+
+func TestFakeClockShouldDriveWebhookRetries(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	attempts := make(chan string, 10)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		attempts <- string(body)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	emitter, err := apns.NewWebhookEmitter(&apns.WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     1,
+		RetryInterval: 1000,
+		Clock:         clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+
+	emitter.ReportAppleError(&apns.AppleError{ErrorCode: 8, ErrorString: "INVALID_TOKEN"},
+		&apns.Payload{Token: "aa"})
+	first := <-attempts
+	if !strings.Contains(first, `"timestamp":"2026-01-01T00:00:00Z"`) {
+		t.Errorf("Expected the event to be timestamped by the clock but got %v", first)
+	}
+
+	waitForPending(t, clock, 1)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-attempts:
+		t.Fatal("Expected no retry before RetryInterval")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if retry := <-attempts; retry != first {
+		t.Errorf("Expected the batch to be retried but got %v", retry)
+	}
+}
@@ -0,0 +1,272 @@
+package apnstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Notification with its JSON payload decoded, for assertions
+type RecordedNotification struct {
+	*Notification
+	//The aps dictionary
+	APS map[string]interface{}
+	//Everything outside the aps dictionary
+	CustomFields map[string]interface{}
+}
+
+//Alert text, whether the alert is a string or a dictionary with a body
+func (n *RecordedNotification) AlertText() string {
+	switch alert := n.APS["alert"].(type) {
+	case string:
+		return alert
+	case map[string]interface{}:
+		body, _ := alert["body"].(string)
+		return body
+	}
+	return ""
+}
+
+//Badge number, and whether the notification has one
+func (n *RecordedNotification) Badge() (int, bool) {
+	badge, ok := n.APS["badge"].(float64)
+	return int(badge), ok
+}
+
+//Sound, "" if the notification has none
+func (n *RecordedNotification) Sound() string {
+	sound, _ := n.APS["sound"].(string)
+	return sound
+}
+
+//Category, "" if the notification has none
+func (n *RecordedNotification) Category() string {
+	category, _ := n.APS["category"].(string)
+	return category
+}
+
+//Summary used in assertion failures
+func (n *RecordedNotification) String() string {
+	return fmt.Sprintf("token %v priority %v expiration %v %s",
+		n.Token, n.Priority, n.ExpirationTime, n.Payload)
+}
+
+//Decode a notification's payload
+func decodeNotification(n *Notification) *RecordedNotification {
+	recorded := &RecordedNotification{
+		Notification: n,
+		APS:          map[string]interface{}{},
+		CustomFields: map[string]interface{}{},
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(n.Payload, &fields); err != nil {
+		return recorded
+	}
+	for key, value := range fields {
+		if aps, ok := value.(map[string]interface{}); ok && key == "aps" {
+			recorded.APS = aps
+		} else {
+			recorded.CustomFields[key] = value
+		}
+	}
+	return recorded
+}
+
+//Checks a recorded notification
+type Matcher func(n *RecordedNotification) bool
+
+//Match notifications sent to token
+func ToToken(token string) Matcher {
+	token = strings.ToLower(token)
+	return func(n *RecordedNotification) bool {
+		return n.Token == token
+	}
+}
+
+//Match notifications with alert text (see RecordedNotification.AlertText)
+func WithAlertText(text string) Matcher {
+	return func(n *RecordedNotification) bool {
+		return n.AlertText() == text
+	}
+}
+
+//Match notifications with a badge number
+func WithBadge(badge int) Matcher {
+	return func(n *RecordedNotification) bool {
+		b, ok := n.Badge()
+		return ok && b == badge
+	}
+}
+
+//Match notifications with a sound
+func WithSound(sound string) Matcher {
+	return func(n *RecordedNotification) bool {
+		return n.Sound() == sound
+	}
+}
+
+//Match notifications with a category
+func WithCategory(category string) Matcher {
+	return func(n *RecordedNotification) bool {
+		return n.Category() == category
+	}
+}
+
+//Match notifications with an aps field, e.g. "content-available"
+//value is compared after a round trip through JSON, so 1 matches 1.0
+func WithAPSField(key string, value interface{}) Matcher {
+	return withField(func(n *RecordedNotification) map[string]interface{} { return n.APS }, key, value)
+}
+
+//Match notifications with a custom field outside the aps dictionary
+//value is compared after a round trip through JSON, so structs match the maps they decode to
+func WithCustomField(key string, value interface{}) Matcher {
+	return withField(func(n *RecordedNotification) map[string]interface{} { return n.CustomFields }, key, value)
+}
+
+//Match a field of the map fields returns against value after a JSON round trip
+func withField(fields func(n *RecordedNotification) map[string]interface{}, key string, value interface{}) Matcher {
+	var expected interface{}
+	if b, err := json.Marshal(value); err == nil {
+		json.Unmarshal(b, &expected)
+	}
+	return func(n *RecordedNotification) bool {
+		actual, ok := fields(n)[key]
+		return ok && reflect.DeepEqual(actual, expected)
+	}
+}
+
+//Match notifications sent with a priority
+func WithPriority(priority uint8) Matcher {
+	return func(n *RecordedNotification) bool {
+		return n.Priority == priority
+	}
+}
+
+//Match notifications sent with an expiration time
+func WithExpirationTime(expirationTime uint32) Matcher {
+	return func(n *RecordedNotification) bool {
+		return n.ExpirationTime == expirationTime
+	}
+}
+
+//Subset of testing.TB used for assertions
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+//Captures the notifications a server reads, decoded, for application tests
+//to assert exactly what would have been pushed
+type Recorder struct {
+	//number of milliseconds AssertSent waits for a match, defaults to 1000
+	WaitTimeout int
+	//Mutex to sync access to notifications
+	lock *sync.Mutex
+	//Notifications recorded, oldest first
+	notifications []*RecordedNotification
+}
+
+//Record the notifications server reads from now on
+//Replaces the server's notification handler
+func NewRecorder(server *Server) *Recorder {
+	r := &Recorder{
+		WaitTimeout: 1000,
+		lock:        new(sync.Mutex),
+	}
+	server.SetNotificationHandler(r.Record)
+	return r
+}
+
+//Record a notification, for use as or from a notification handler
+func (r *Recorder) Record(n *Notification) {
+	recorded := decodeNotification(n)
+	r.lock.Lock()
+	r.notifications = append(r.notifications, recorded)
+	r.lock.Unlock()
+}
+
+//Notifications recorded so far, oldest first
+func (r *Recorder) Notifications() []*RecordedNotification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*RecordedNotification(nil), r.notifications...)
+}
+
+//Notifications recorded so far matching every matcher, oldest first
+func (r *Recorder) Find(matchers ...Matcher) []*RecordedNotification {
+	var found []*RecordedNotification
+	for _, n := range r.Notifications() {
+		if matchesAll(n, matchers) {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+//Forget the notifications recorded so far
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	r.notifications = nil
+	r.lock.Unlock()
+}
+
+//Assert a notification matching every matcher is recorded within WaitTimeout
+//Returns the first match, nil if there isn't one
+func (r *Recorder) AssertSent(t TestingT, matchers ...Matcher) *RecordedNotification {
+	t.Helper()
+	deadline := time.Now().Add(time.Duration(r.WaitTimeout) * time.Millisecond)
+	for {
+		if found := r.Find(matchers...); len(found) > 0 {
+			return found[0]
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Expected a matching notification but got:\n%v", r.summary())
+			return nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//Assert no notification matching every matcher has been recorded
+//Doesn't wait, so check AssertSent for something sent afterwards first
+func (r *Recorder) AssertNotSent(t TestingT, matchers ...Matcher) {
+	t.Helper()
+	if found := r.Find(matchers...); len(found) > 0 {
+		t.Errorf("Expected no matching notification but got %v", found[0])
+	}
+}
+
+//Assert exactly count notifications have been recorded
+func (r *Recorder) AssertCount(t TestingT, count int) {
+	t.Helper()
+	if notifications := r.Notifications(); len(notifications) != count {
+		t.Errorf("Expected %v notifications but got %v:\n%v", count, len(notifications), r.summary())
+	}
+}
+
+//Every notification recorded, one per line
+func (r *Recorder) summary() string {
+	notifications := r.Notifications()
+	if len(notifications) == 0 {
+		return "no notifications"
+	}
+	lines := make([]string, len(notifications))
+	for i, n := range notifications {
+		lines[i] = n.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Whether a notification matches every matcher
+func matchesAll(n *RecordedNotification, matchers []Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher(n) {
+			return false
+		}
+	}
+	return true
+}
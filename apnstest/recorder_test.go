@@ -0,0 +1,96 @@
+package apnstest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+//TestingT that keeps failures instead of failing the test
+type fakeT struct {
+	failures []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestRecorderShouldDecodeNotifications(t *testing.T) {
+	server, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	recorder := NewRecorder(server)
+
+	config := server.Config()
+	config.FramingTimeout = -1
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001"
+	conn.SendChannel <- &apns.Payload{
+		Token:          token,
+		AlertBody:      apns.APSAlertBody{Title: "Order", Body: "Shipped"},
+		Badge:          apns.NewBadgeNumber(3),
+		Sound:          "ping.aiff",
+		Category:       "ORDER",
+		Priority:       10,
+		ExpirationTime: 1700000000,
+		CustomFields: map[string]interface{}{
+			"order": struct {
+				ID int `json:"id"`
+			}{42},
+		},
+	}
+	conn.SendChannel <- &apns.Payload{Token: token, AlertText: "Delivered"}
+
+	n := recorder.AssertSent(t, ToToken(token), WithAlertText("Shipped"), WithBadge(3),
+		WithSound("ping.aiff"), WithCategory("ORDER"), WithPriority(10),
+		WithExpirationTime(1700000000), WithCustomField("order", map[string]int{"id": 42}))
+	if n == nil {
+		return
+	}
+	if title := n.APS["alert"].(map[string]interface{})["title"]; title != "Order" {
+		t.Errorf("Expected alert title Order but got %v", title)
+	}
+	recorder.AssertSent(t, WithAlertText("Delivered"))
+	recorder.AssertCount(t, 2)
+	recorder.AssertNotSent(t, WithAlertText("Lost"))
+
+	if found := recorder.Find(ToToken(token)); len(found) != 2 || found[1].AlertText() != "Delivered" {
+		t.Errorf("Expected to find both notifications oldest first but got %v", found)
+	}
+	recorder.Reset()
+	recorder.AssertCount(t, 0)
+}
+
+func TestRecorderAssertionsShouldFail(t *testing.T) {
+	recorder := &Recorder{WaitTimeout: 10, lock: new(sync.Mutex)}
+	recorder.Record(&Notification{Token: "01", Payload: []byte(`{"aps":{"alert":"hi","badge":1},"id":7}`)})
+
+	fake := &fakeT{}
+	if n := recorder.AssertSent(fake, WithAlertText("bye")); n != nil {
+		t.Errorf("Expected no match but got %v", n)
+	}
+	recorder.AssertNotSent(fake, WithBadge(1), WithCustomField("id", 7))
+	recorder.AssertCount(fake, 2)
+	if len(fake.failures) != 3 {
+		t.Errorf("Expected 3 failures but got %v", fake.failures)
+	}
+
+	fake = &fakeT{}
+	recorder.AssertSent(fake, WithAPSField("badge", 1), WithCustomField("id", 7.0))
+	recorder.AssertNotSent(fake, WithBadge(2))
+	recorder.AssertNotSent(fake, WithAPSField("sound", ""))
+	if len(fake.failures) != 0 {
+		t.Errorf("Expected no failures but got %v", fake.failures)
+	}
+}
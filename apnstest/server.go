@@ -0,0 +1,405 @@
+//Package providing a mock APNS gateway speaking the binary protocol over TLS,
+//for integration tests, load tests and benchmarks without Apple's sandbox
+package apnstest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/frame"
+)
+
+//Notification read by the server
+type Notification struct {
+	//Device token, hex encoded
+	Token string
+	//JSON payload
+	Payload []byte
+	//Message ID the connection sent it with
+	ID uint32
+	//Expiration and priority, 0 if they weren't sent
+	ExpirationTime uint32
+	Priority       uint8
+	//Whether an expiration of 0 was sent, so Apple wouldn't store it
+	ExpireImmediately bool
+	//When the server finished reading it
+	ReceivedAt time.Time
+}
+
+//Config for creating a mock gateway
+type ServerConfig struct {
+	//keep every notification read for Notifications(), defaults to false
+	//leave off for load tests so memory doesn't grow
+	Record bool
+	//respond to tokens made with ErrorToken with the error they ask for, defaults to false
+	//so integration tests can exercise specific failure paths deterministically
+	ErrorTokens bool
+	//address to listen on, defaults to a random local port ("127.0.0.1:0")
+	Addr string
+	//host names and IPs the server's certificate is valid for besides
+	//localhost and 127.0.0.1, for clients connecting from other machines
+	Hosts []string
+}
+
+//Make a token the server responds to with an Apple error code (see
+//apns.APPLE_PUSH_RESPONSES) once it has read after more notifications on the
+//same connection, when ServerConfig.ErrorTokens is set
+//The token is zeros apart from its last byte, the code, and the byte before
+//it, after (so real looking tokens aren't mistaken for one), e.g. a
+//token ending in "0008" is rejected with INVALID_TOKEN straight away, and one
+//ending in "050a" gets SHUTDOWN once 5 more have been read.
+//SHUTDOWN carries the id of the last notification read, as Apple processed
+//everything up to it; other codes carry the id of the token's notification
+//and it and the notifications read after it are dropped.
+//The server closes the connection after writing the error
+func ErrorToken(code uint8, after uint8) string {
+	return fmt.Sprintf("%060x%02x%02x", 0, after, code)
+}
+
+//Error the server will respond with on a connection
+type pendingError struct {
+	code uint8
+	id   uint32
+	//number of further notifications to read first
+	after uint8
+}
+
+//Error asked for by a token made with ErrorToken, nil if there isn't one
+func errorForNotification(n *Notification) *pendingError {
+	token, err := hex.DecodeString(n.Token)
+	if err != nil || len(token) < 2 {
+		return nil
+	}
+	for _, b := range token[:len(token)-2] {
+		if b != 0 {
+			return nil
+		}
+	}
+	code := token[len(token)-1]
+	if _, ok := apns.APPLE_PUSH_RESPONSES[code]; !ok || code == 0 ||
+		code == apns.CONNECTION_CLOSED_DISCONNECT || code == apns.CONNECTION_CLOSED_UNKNOWN {
+		return nil
+	}
+	return &pendingError{code: code, id: n.ID, after: token[len(token)-2]}
+}
+
+//Mock APNS gateway listening on a local port
+type Server struct {
+	//config
+	config *ServerConfig
+	//TLS listener client connections are accepted on
+	listener net.Listener
+	//CA the client verifies the server against
+	rootCAs *x509.CertPool
+	//the CA's certificate
+	rootCAPEM []byte
+	//client certificate and key, any client certificate is accepted
+	clientCertPEM []byte
+	clientKeyPEM  []byte
+	//Number of notifications read
+	received atomic.Uint64
+	//Mutex to sync access to everything below
+	lock *sync.Mutex
+	//Notifications read, oldest first (Record only)
+	notifications []*Notification
+	//called with each notification read
+	handler func(n *Notification)
+	//open client connections
+	conns map[net.Conn]bool
+	//Boolean saying Close has been called
+	closed bool
+	//Tracks the accept and connection go-routines so Close can wait for them
+	wg *sync.WaitGroup
+}
+
+//Start a mock gateway, on a random local port unless ServerConfig.Addr is set
+func NewServer(config *ServerConfig) (*Server, error) {
+	if config == nil {
+		config = &ServerConfig{}
+	}
+
+	caCert, caKey, err := newCertificate(nil, nil, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	serverCert, serverKey, err := newCertificate(caCert, caKey, false, config.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	clientCert, clientKey, err := newCertificate(caCert, caKey, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPair, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}))
+	if err != nil {
+		return nil, err
+	}
+	clientKeyBytes, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	listener, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		//apple requires a client certificate
+		ClientAuth: tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:        config,
+		listener:      listener,
+		rootCAs:       x509.NewCertPool(),
+		rootCAPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+		clientCertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Raw}),
+		clientKeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: clientKeyBytes}),
+		lock:          new(sync.Mutex),
+		conns:         make(map[net.Conn]bool),
+		wg:            new(sync.WaitGroup),
+	}
+	s.rootCAs.AddCert(caCert)
+
+	s.wg.Add(1)
+	go s.acceptListener()
+
+	return s, nil
+}
+
+//Connection config pointing at the server, with a client certificate it accepts
+//A new config is returned each time so it can be changed freely
+func (s *Server) Config() *apns.APNSConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &apns.APNSConfig{
+		GatewayHost:      host,
+		GatewayPort:      port,
+		CertificateBytes: s.clientCertPEM,
+		KeyBytes:         s.clientKeyPEM,
+		RootCAs:          s.rootCAs,
+	}
+}
+
+//Pool holding the CA generated at startup which signed the server's certificate,
+//for tests dialing the server themselves (Config already sets it as RootCAs)
+func (s *Server) RootCAs() *x509.CertPool {
+	return s.rootCAs
+}
+
+//PEM of the CA generated at startup, for clients in other processes to
+//verify the server against (see APNSConfig.RootCAs)
+func (s *Server) RootCAPEM() []byte {
+	return s.rootCAPEM
+}
+
+//Address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+//Number of notifications read
+func (s *Server) Received() uint64 {
+	return s.received.Load()
+}
+
+//Notifications read so far, oldest first (ServerConfig.Record only)
+func (s *Server) Notifications() []*Notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Notification(nil), s.notifications...)
+}
+
+//Set a function called with each notification as it's read, nil to remove it
+//Called from the go-routine reading the notification's connection
+func (s *Server) SetNotificationHandler(handler func(n *Notification)) {
+	s.lock.Lock()
+	s.handler = handler
+	s.lock.Unlock()
+}
+
+//Stop listening and close every client connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+//go-routine to accept client connections
+func (s *Server) acceptListener() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.closed {
+			//accepted just before Close
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go s.connListener(conn)
+	}
+}
+
+//go-routine to read notifications from a client connection until it closes
+func (s *Server) connListener(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	var pending *pendingError
+	for {
+		n, err := readNotification(reader)
+		if err != nil {
+			return
+		}
+
+		if pending == nil && s.config.ErrorTokens {
+			pending = errorForNotification(n)
+		} else if pending != nil {
+			pending.after--
+			if pending.code == 10 {
+				pending.id = n.ID
+			}
+		}
+		//SHUTDOWN comes after processing, other errors reject the token's
+		//notification and everything after it
+		if pending == nil || pending.code == 10 {
+			s.receive(n)
+		}
+		if pending != nil && pending.after == 0 {
+			conn.Write(frame.AppendErrorResponse(nil, pending.code, pending.id))
+			return
+		}
+	}
+}
+
+//Count and record a notification and pass it to the handler
+func (s *Server) receive(n *Notification) {
+	s.received.Add(1)
+
+	s.lock.Lock()
+	if s.config.Record {
+		s.notifications = append(s.notifications, n)
+	}
+	handler := s.handler
+	s.lock.Unlock()
+	if handler != nil {
+		handler(n)
+	}
+}
+
+//Read one notification frame (command 2)
+func readNotification(reader io.Reader) (*Notification, error) {
+	b, err := frame.ReadFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	items, err := frame.ParseFrame(b)
+	if err != nil {
+		return nil, err
+	}
+	notification, err := frame.ParseNotification(items)
+	if err != nil {
+		return nil, err
+	}
+	return &Notification{
+		Token:             hex.EncodeToString(notification.Token),
+		Payload:           notification.Payload,
+		ID:                notification.ID,
+		ExpirationTime:    notification.ExpirationTime,
+		Priority:          notification.Priority,
+		ExpireImmediately: notification.ExpireImmediately,
+		ReceivedAt:        time.Now(),
+	}, nil
+}
+
+//Generate a certificate for 127.0.0.1, localhost and hosts signed by parent,
+//or a self signed CA
+func newCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool,
+	hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "apnstest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
@@ -0,0 +1,198 @@
+package apnstest
+
+import (
+	"crypto/tls"
+	"strconv"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestServerShouldReadNotifications(t *testing.T) {
+	server, err := NewServer(&ServerConfig{Record: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := server.Config()
+	config.FramingTimeout = -1
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001"
+	conn.SendChannel <- &apns.Payload{Token: token, AlertText: "hi", Priority: 10}
+	conn.SendChannel <- &apns.Payload{Token: token, AlertText: "there"}
+
+	deadline := time.Now().Add(time.Second)
+	for server.Received() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for notifications, received %v", server.Received())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn.Disconnect()
+	if connectionClose := <-conn.CloseChannel; connectionClose.Error != nil {
+		t.Errorf("Expected a clean close but got %v", connectionClose.Error)
+	}
+
+	notifications := server.Notifications()
+	if len(notifications) != 2 {
+		t.Fatalf("Expected 2 notifications but got %v", len(notifications))
+	}
+	first := notifications[0]
+	if first.Token != token || string(first.Payload) != `{"aps":{"alert":"hi"}}` ||
+		first.ID != 1 || first.Priority != 10 {
+		t.Errorf("Expected first notification to be decoded but got %+v", first)
+	}
+	if notifications[1].ID != 2 {
+		t.Errorf("Expected second notification to have id 2 but got %v", notifications[1].ID)
+	}
+}
+
+//Send payloads until the connection closes, returning the ones it accepted and the close
+func sendUntilClosed(t *testing.T, conn *apns.APNSConnection, payloads []*apns.Payload) ([]*apns.Payload, *apns.ConnectionClose) {
+	var sent []*apns.Payload
+	for _, p := range payloads {
+		select {
+		case conn.SendChannel <- p:
+			sent = append(sent, p)
+		case connectionClose := <-conn.CloseChannel:
+			return sent, connectionClose
+		}
+	}
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		return sent, connectionClose
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the server to close the connection")
+		return nil, nil
+	}
+}
+
+func TestServerShouldRejectErrorTokens(t *testing.T) {
+	server, err := NewServer(&ServerConfig{Record: true, ErrorTokens: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := server.Config()
+	config.FramingTimeout = -1
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001"
+	payloads := []*apns.Payload{
+		{Token: token, AlertText: "0"},
+		{Token: ErrorToken(8, 1), AlertText: "1"},
+		{Token: token, AlertText: "2"},
+		{Token: token, AlertText: "3"},
+	}
+	sent, connectionClose := sendUntilClosed(t, conn, payloads)
+
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 8 {
+		t.Fatalf("Expected INVALID_TOKEN but got %+v", connectionClose.Error)
+	}
+	if connectionClose.ErrorPayload != payloads[1] {
+		t.Errorf("Expected error payload to be the error token's but got %+v", connectionClose.ErrorPayload)
+	}
+	if len(connectionClose.UnsentPayloads) != len(sent)-2 {
+		t.Fatalf("Expected %v unsent payloads but got %v", len(sent)-2, len(connectionClose.UnsentPayloads))
+	}
+	for i, p := range connectionClose.UnsentPayloads {
+		if p != sent[i+2] {
+			t.Errorf("Expected unsent payload %v to be %v but got %v", i, sent[i+2].AlertText, p.AlertText)
+		}
+	}
+	if notifications := server.Notifications(); len(notifications) != 1 || notifications[0].ID != 1 {
+		t.Errorf("Expected only the first notification to be received but got %v", len(notifications))
+	}
+}
+
+func TestServerShouldShutdownAfterErrorToken(t *testing.T) {
+	server, err := NewServer(&ServerConfig{ErrorTokens: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := server.Config()
+	config.FramingTimeout = -1
+	conn, err := apns.NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000001"
+	payloads := []*apns.Payload{{Token: ErrorToken(10, 2), AlertText: "0"}}
+	for i := 1; i < 5; i++ {
+		payloads = append(payloads, &apns.Payload{Token: token, AlertText: strconv.Itoa(i)})
+	}
+	sent, connectionClose := sendUntilClosed(t, conn, payloads)
+
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 10 {
+		t.Fatalf("Expected SHUTDOWN but got %+v", connectionClose.Error)
+	}
+	//shutdown identifies the last notification processed
+	if connectionClose.Error.MessageID != 3 || connectionClose.ErrorPayload != payloads[2] {
+		t.Errorf("Expected shutdown after the third payload but got id %v", connectionClose.Error.MessageID)
+	}
+	if len(connectionClose.UnsentPayloads) != len(sent)-3 {
+		t.Errorf("Expected %v unsent payloads but got %v", len(sent)-3, len(connectionClose.UnsentPayloads))
+	}
+	if server.Received() != 3 {
+		t.Errorf("Expected 3 notifications to be received but got %v", server.Received())
+	}
+}
+
+func TestErrorTokenShouldOnlyMatchAppleErrors(t *testing.T) {
+	if n := errorForNotification(&Notification{Token: ErrorToken(8, 3), ID: 7}); n == nil ||
+		n.code != 8 || n.after != 3 || n.id != 7 {
+		t.Errorf("Expected INVALID_TOKEN after 3 but got %+v", n)
+	}
+	for _, code := range []uint8{0, 9, apns.CONNECTION_CLOSED_DISCONNECT, apns.CONNECTION_CLOSED_UNKNOWN} {
+		if n := errorForNotification(&Notification{Token: ErrorToken(code, 0)}); n != nil {
+			t.Errorf("Expected no error for code %v but got %+v", code, n)
+		}
+	}
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede00000008"
+	if n := errorForNotification(&Notification{Token: token}); n != nil {
+		t.Errorf("Expected no error for a real token but got %+v", n)
+	}
+}
+
+func TestServerShouldOnlyBeTrustedWithItsCA(t *testing.T) {
+	server, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := server.Config()
+	config.RootCAs = nil
+	if _, err := apns.NewAPNSConnection(config); err == nil {
+		t.Error("Expected the server's certificate not to verify against the system roots")
+	}
+
+	clientCert, err := tls.X509KeyPair(server.clientCertPEM, server.clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", server.Addr(), &tls.Config{
+		RootCAs:      server.RootCAs(),
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Errorf("Expected the server's certificate to verify against its CA but got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package apns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//What became of a payload a connection was given, see AuditRecord
+type AuditOutcome string
+
+const (
+	//Apple is taken to have accepted the payload (see APNSConfig.OnAccepted)
+	AUDIT_OUTCOME_ACCEPTED AuditOutcome = "accepted"
+	//The payload was rejected before being written, or by Apple
+	AUDIT_OUTCOME_REJECTED AuditOutcome = "rejected"
+	//The connection closed before the payload was written, or while Apple
+	//might still have rejected it
+	AUDIT_OUTCOME_UNDELIVERED AuditOutcome = "undelivered"
+	//The payload was dropped before being written: a duplicate, collapsed,
+	//cancelled or dropped by SendMiddleware
+	AUDIT_OUTCOME_DROPPED AuditOutcome = "dropped"
+)
+
+//Record of one notification attempt, for compliance grade audit trails
+//Passed by value and holds no references to the payload, so sinks can keep it as is
+//Tokens and payloads are hashed so the trail doesn't hold personal data
+type AuditRecord struct {
+	//When the outcome was known
+	Time time.Time `json:"time"`
+	//Id of the connection the payload was sent on (see APNSConnection.ID)
+	ConnectionID string `json:"connection_id"`
+	//SHA-256 of the lower case device token, hex encoded
+	TokenHash string `json:"token_hash"`
+	//Topic the payload was sent to, see APNSConfig.AuditTopic
+	Topic string `json:"topic,omitempty"`
+	//SHA-256 of the JSON the payload was framed with, hex encoded, "" if it
+	//wasn't framed (e.g. it was collapsed, cancelled or couldn't be marshalled)
+	PayloadHash string `json:"payload_hash,omitempty"`
+	//The payload's UUID, if it had one
+	UUID string `json:"uuid,omitempty"`
+	//What became of the payload
+	Outcome AuditOutcome `json:"outcome"`
+	//Why the payload wasn't accepted, "" if it was or it was dropped as a duplicate
+	Error string `json:"error,omitempty"`
+}
+
+//Receives a record of every payload's outcome (see APNSConfig.AuditSink)
+//Called from the connection's go-routines so it must not block on the connection
+//Errors are logged at LOG_LEVEL_ERROR
+type AuditSink interface {
+	Record(record AuditRecord) error
+}
+
+//Function used as an AuditSink
+type AuditSinkFunc func(record AuditRecord) error
+
+func (f AuditSinkFunc) Record(record AuditRecord) error {
+	return f(record)
+}
+
+//AuditSink writing each record as a line of JSON, e.g. to an append only file
+//THREADSAFE (so one sink can be shared by a pool's connections)
+type JSONAuditSink struct {
+	//Mutex to sync access to encoder
+	lock    *sync.Mutex
+	encoder *json.Encoder
+}
+
+//Create an audit sink writing JSON lines to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{
+		lock:    new(sync.Mutex),
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (s *JSONAuditSink) Record(record AuditRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.encoder.Encode(&record)
+}
+
+//Hex encoded SHA-256 of a device token, the same for either case of hex
+func auditTokenHash(token string) string {
+	return auditHash([]byte(strings.ToLower(token)))
+}
+
+//Hex encoded SHA-256 of b
+func auditHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,127 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditSinkShouldRecordEveryOutcome(t *testing.T) {
+	socket := newMockConnAppleError(3, 3, 8)
+	lock := new(sync.Mutex)
+	records := map[string]AuditRecord{}
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AuditSink: AuditSinkFunc(func(record AuditRecord) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if _, ok := records[record.UUID]; ok {
+				t.Errorf("Expected one record per payload but got a second for %v", record.UUID)
+			}
+			records[record.UUID] = record
+			return nil
+		}),
+		AuditTopic: func(payload *Payload) string {
+			return "com.example.app"
+		},
+	})
+
+	payloads := append([]*Payload{{Token: "zz", AlertText: "hi"}}, testTokens(3)...)
+	for i, p := range payloads {
+		p.UUID = []string{"bad", "accepted", "rejected", "unsent"}[i]
+		apn.SendChannel <- p
+	}
+	<-apn.CloseChannel
+
+	lock.Lock()
+	defer lock.Unlock()
+	for uuid, outcome := range map[string]AuditOutcome{
+		"bad":      AUDIT_OUTCOME_REJECTED,
+		"accepted": AUDIT_OUTCOME_ACCEPTED,
+		"rejected": AUDIT_OUTCOME_REJECTED,
+		"unsent":   AUDIT_OUTCOME_UNDELIVERED,
+	} {
+		if records[uuid].Outcome != outcome {
+			t.Errorf("Expected %v to be recorded as %v but got %+v", uuid, outcome, records[uuid])
+		}
+	}
+	accepted := records["accepted"]
+	payloadBytes, _ := payloads[1].Marshal(2048)
+	if accepted.TokenHash != auditTokenHash(strings.ToUpper(payloads[1].Token)) ||
+		accepted.PayloadHash != auditHash(payloadBytes) || accepted.Topic != "com.example.app" ||
+		accepted.ConnectionID != apn.ID() || accepted.Error != "" || accepted.Time.IsZero() {
+		t.Errorf("Expected hashes, topic and connection for the accepted payload but got %+v", accepted)
+	}
+	if records["rejected"].Error != "INVALID_TOKEN" || records["unsent"].Error != ErrConnectionClosed.Error() {
+		t.Errorf("Expected the reasons to be recorded but got %+v and %+v", records["rejected"], records["unsent"])
+	}
+	if strings.Contains(records["bad"].TokenHash, "zz") || records["bad"].PayloadHash != "" {
+		t.Errorf("Expected the rejected token to be hashed and no payload hash as it was never framed but got %+v",
+			records["bad"])
+	}
+	if records["rejected"].PayloadHash == "" || records["unsent"].PayloadHash == "" {
+		t.Errorf("Expected framed payloads to have payload hashes but got %+v and %+v",
+			records["rejected"], records["unsent"])
+	}
+}
+
+//Marshals each payload differently every time
+type countingMarshaler struct {
+	calls int
+}
+
+func (m *countingMarshaler) Marshal(p *Payload, maxPayloadSize int) ([]byte, error) {
+	m.calls++
+	return []byte(`{"aps":{"alert":"call ` + strconv.Itoa(m.calls) + `"}}`), nil
+}
+
+func TestAuditSinkShouldHashTheFramedPayload(t *testing.T) {
+	socket := newMockConnPool()
+	var records []AuditRecord
+	marshaler := &countingMarshaler{}
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		PayloadMarshaler:          marshaler,
+		AuditSink: AuditSinkFunc(func(record AuditRecord) error {
+			records = append(records, record)
+			return nil
+		}),
+	})
+	apn.SendChannel <- testTokens(1)[0]
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if marshaler.calls != 1 {
+		t.Errorf("Expected the payload to be marshalled once but it was marshalled %v times", marshaler.calls)
+	}
+	if len(records) != 1 || len(written) != 1 || records[0].PayloadHash != auditHash([]byte(written[0].Payload)) {
+		t.Errorf("Expected the hash of the payload as written but got %+v", records)
+	}
+}
+
+func TestJSONAuditSinkShouldWriteLines(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewJSONAuditSink(&b)
+	sink.Record(AuditRecord{TokenHash: "ab", Outcome: AUDIT_OUTCOME_ACCEPTED})
+	sink.Record(AuditRecord{TokenHash: "cd", Outcome: AUDIT_OUTCOME_REJECTED, Error: "INVALID_TOKEN"})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	var record AuditRecord
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &record) != nil ||
+		record.Outcome != AUDIT_OUTCOME_REJECTED || record.Error != "INVALID_TOKEN" {
+		t.Errorf("Expected a JSON line per record but got %q", b.String())
+	}
+	if !strings.Contains(lines[0], `"token_hash":"ab"`) || strings.Contains(lines[0], `"error"`) {
+		t.Errorf("Expected snake case fields without empty ones but got %v", lines[0])
+	}
+}
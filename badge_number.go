@@ -43,11 +43,20 @@ func (b *BadgeNumber) Set(number int) error {
 	return nil
 }
 
+// Unset badge numbers are marshalled as null so they
+// stay unset when unmarshalled
 func (b BadgeNumber) MarshalJSON() ([]byte, error) {
+	if !b.set {
+		return []byte("null"), nil
+	}
 	return []byte(strconv.Itoa(b.number)), nil
 }
 
 func (b *BadgeNumber) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		b.UnSet()
+		return nil
+	}
 	val, err := strconv.ParseInt(string(data), 10, 32)
 	if err != nil {
 		return errors.New("Error unmarshalling BadgeNumber, cannot convert []byte to int32")
@@ -81,6 +81,28 @@ func TestBadgeNumberUnmarshalJSON(t *testing.T) {
 		t.Error("Resulting BadgeNumber should be set")
 	}
 	if ts.Number.Number() != 11 {
-		t.Error("Expected number to be 11, got %d", ts.Number.Number())
+		t.Errorf("Expected number to be 11, got %d", ts.Number.Number())
+	}
+}
+
+func TestUnsetBadgeNumberShouldStayUnsetThroughJSON(t *testing.T) {
+	type TestStruct struct {
+		Number BadgeNumber
+	}
+
+	jsonData, err := json.Marshal(TestStruct{})
+	if err != nil {
+		t.Fatalf("Error marshalling BadgeNumber: %s", err.Error())
+	}
+	if string(jsonData) != "{\"Number\":null}" {
+		t.Errorf("Expected unset BadgeNumber to be null but got %s", jsonData)
+	}
+
+	ts := TestStruct{Number: NewBadgeNumber(3)}
+	if err := json.Unmarshal(jsonData, &ts); err != nil {
+		t.Fatalf("Error unmarshalling to BadgeNumber: %s", err.Error())
+	}
+	if ts.Number.IsSet() {
+		t.Error("Resulting BadgeNumber should be unset")
 	}
 }
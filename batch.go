@@ -0,0 +1,92 @@
+package apns
+
+import (
+	"errors"
+)
+
+//Result of sending a batch of payloads, folded from each payload's SendR result
+//so callers don't have to tally them (see APNSConnection.SendBatch)
+type BatchSummary struct {
+	//number of payloads in the batch
+	Sent int
+	//number of payloads Apple is taken to have accepted
+	Accepted int
+	//number of payloads which weren't accepted, for any reason
+	Failed int
+	//number of failures by the error code Apple returned (see APPLE_PUSH_RESPONSES)
+	FailedByCode map[uint8]int
+	//number of payloads rejected before being written (see PayloadError)
+	Rejected int
+	//number of payloads collapsed or cancelled before being written
+	Dropped int
+	//tokens Apple reported invalid, or that aren't valid tokens, in batch order
+	InvalidTokens []string
+	//number of payloads written with their alert text truncated to fit MaxPayloadSize
+	Truncated int
+	//payloads the connection closed before Apple took, in batch order, to resend
+	Unsent []*Payload
+}
+
+func newBatchSummary(size int) *BatchSummary {
+	return &BatchSummary{
+		Sent:         size,
+		FailedByCode: make(map[uint8]int),
+	}
+}
+
+//Fold a payload's result into the summary, nil for accepted
+//truncated is whether the payload was over MaxPayloadSize before being marshalled
+func (s *BatchSummary) add(p *Payload, err error, truncated bool) {
+	var appleError *AppleError
+	var payloadError *PayloadError
+	switch {
+	case err == nil:
+		s.Accepted++
+	case errors.As(err, &appleError):
+		s.FailedByCode[appleError.ErrorCode]++
+		//8 is INVALID_TOKEN
+		if appleError.ErrorCode == 8 {
+			s.InvalidTokens = append(s.InvalidTokens, p.Token)
+		}
+	case errors.As(err, &payloadError):
+		s.Rejected++
+		if errors.Is(err, ErrBadTokenEncoding) || errors.Is(err, ErrBadTokenLength) {
+			s.InvalidTokens = append(s.InvalidTokens, p.Token)
+		}
+		//never written, so never truncated
+		truncated = false
+	case errors.Is(err, ErrPayloadCollapsed) || errors.Is(err, ErrPayloadCancelled):
+		s.Dropped++
+		truncated = false
+	case errors.Is(err, ErrConnectionClosed):
+		s.Unsent = append(s.Unsent, p)
+		truncated = false
+	}
+	if err != nil {
+		s.Failed++
+	}
+	if truncated {
+		s.Truncated++
+	}
+}
+
+//Send payloads with SendR, flush them and wait for every result
+//Returns once each payload has been accepted or failed, which is
+//AcceptanceWindow after the last is written unless the connection closes first
+func (c *APNSConnection) SendBatch(payloads []*Payload) *BatchSummary {
+	results := make([]<-chan error, len(payloads))
+	truncated := make([]bool, len(payloads))
+	for i, payload := range payloads {
+		if remaining, err := payload.RemainingBytes(c.config.MaxPayloadSize); err == nil && remaining < 0 {
+			truncated[i] = true
+		}
+		results[i] = c.SendR(payload)
+	}
+	c.Flush()
+
+	summary := newBatchSummary(len(payloads))
+	for i, result := range results {
+		summary.add(payloads[i], <-result, truncated[i])
+	}
+	return summary
+}
@@ -0,0 +1,57 @@
+package apns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSendBatchShouldSummariseResults(t *testing.T) {
+	//the third payload written (id 3) is rejected as an invalid token
+	socket := newMockConnAppleError(3, 3, 8)
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          5000,
+	})
+	payloads := testTokens(4)
+	payloads[0].Token = "zz"
+	payloads[1].AlertText = strings.Repeat("a", 3000)
+
+	summary := apn.SendBatch(payloads)
+	if summary.Sent != 4 || summary.Accepted != 1 || summary.Failed != 3 {
+		t.Errorf("Expected 1 of 4 payloads accepted but got %+v", summary)
+	}
+	if !reflect.DeepEqual(summary.FailedByCode, map[uint8]int{8: 1}) || summary.Rejected != 1 {
+		t.Errorf("Expected one INVALID_TOKEN and one rejected payload but got %+v", summary)
+	}
+	if !reflect.DeepEqual(summary.InvalidTokens, []string{"zz", payloads[2].Token}) {
+		t.Errorf("Expected both bad tokens but got %v", summary.InvalidTokens)
+	}
+	if summary.Truncated != 1 {
+		t.Errorf("Expected the long alert to be truncated but got %v", summary.Truncated)
+	}
+	if len(summary.Unsent) != 1 || summary.Unsent[0] != payloads[3] {
+		t.Errorf("Expected the payload written after the error to be unsent but got %v", summary.Unsent)
+	}
+}
+
+func TestSendBatchShouldReportUnsentAfterClose(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	payloads := testTokens(2)
+	summary := apn.SendBatch(payloads)
+	if summary.Failed != 2 || !reflect.DeepEqual(summary.Unsent, payloads) {
+		t.Errorf("Expected every payload unsent but got %+v", summary)
+	}
+}
@@ -0,0 +1,264 @@
+//Package providing an apns.OutboxStore on bbolt, an embedded pure go
+//key/value store, for durable sends without cgo or external services
+package boltoutbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	apns "github.com/joekarl/go-libapns"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	//Bucket holding records waiting to be sent, keyed by big endian sequence number
+	pendingBucket = []byte("apns_outbox_pending")
+	//Bucket holding records apple rejected
+	failedBucket = []byte("apns_outbox_failed")
+)
+
+//Outbox store in a bbolt database
+//Sent records are deleted straight away, failed records are kept in
+//their own bucket until PurgeFailed is called
+type Store struct {
+	//how payloads are compressed when they're appended, defaults to
+	//apns.OUTBOX_COMPRESSION_NONE, set before the store is used
+	//records are read whatever they were written with
+	Compression apns.OutboxCompression
+	db          *bolt.DB
+	//whether we opened the db and so should close it
+	ownsDB bool
+}
+
+//Record apple rejected
+type FailedRecord struct {
+	//Record id
+	ID string
+	//The rejected payload
+	Payload *apns.Payload
+	//Why it was rejected
+	Reason string
+}
+
+//Stored form of a failed record
+type failedValue struct {
+	Payload []byte
+	Reason  string
+}
+
+//Open (creating if needed) a bbolt database file to use as an outbox
+//The database is closed when the store is closed
+func Open(path string, options *bolt.Options) (*Store, error) {
+	db, err := bolt.Open(path, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.ownsDB = true
+	return s, nil
+}
+
+//Use an already open bbolt database as an outbox
+//The caller is responsible for closing the database
+func New(db *bolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(pendingBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(failedBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Append(payload *apns.Payload) (string, error) {
+	payloadBytes, err := apns.MarshalOutboxPayloadCompressed(payload, s.Compression)
+	if err != nil {
+		return "", err
+	}
+
+	var id uint64
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(recordKey(id), payloadBytes)
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(id, 10), nil
+}
+
+func (s *Store) MarkSent(id string) error {
+	key, err := parseRecordID(id)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+		if b.Get(key) == nil {
+			return errors.New("Unknown outbox record " + id)
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *Store) MarkFailed(id string, reason error) error {
+	key, err := parseRecordID(id)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket)
+		payloadBytes := pending.Get(key)
+		if payloadBytes == nil {
+			return errors.New("Unknown outbox record " + id)
+		}
+
+		value := failedValue{Payload: payloadBytes}
+		if reason != nil {
+			value.Reason = reason.Error()
+		}
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(failedBucket).Put(key, valueBytes); err != nil {
+			return err
+		}
+		return pending.Delete(key)
+	})
+}
+
+//Iterates over pending records in a read transaction
+//held open until the iterator is closed
+func (s *Store) PendingIterator() (apns.OutboxIterator, error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingIterator{
+		tx:     tx,
+		cursor: tx.Bucket(pendingBucket).Cursor(),
+	}, nil
+}
+
+//Records apple rejected, oldest first
+func (s *Store) Failed() ([]*FailedRecord, error) {
+	var records []*FailedRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(failedBucket).ForEach(func(k, v []byte) error {
+			value := failedValue{}
+			if err := json.Unmarshal(v, &value); err != nil {
+				return err
+			}
+			payload, err := apns.UnmarshalOutboxPayload(value.Payload)
+			if err != nil {
+				return err
+			}
+			id := strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+			payload.OutboxID = id
+			records = append(records, &FailedRecord{
+				ID:      id,
+				Payload: payload,
+				Reason:  value.Reason,
+			})
+			return nil
+		})
+	})
+	return records, err
+}
+
+//Delete all failed records
+func (s *Store) PurgeFailed() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(failedBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(failedBucket)
+		return err
+	})
+}
+
+//Close the database if it was opened by Open
+func (s *Store) Close() error {
+	if s.ownsDB {
+		return s.db.Close()
+	}
+	return nil
+}
+
+//Keys are big endian so the bucket iterates in append order
+func recordKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func parseRecordID(id string) ([]byte, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid outbox record id " + id)
+	}
+	return recordKey(n), nil
+}
+
+type pendingIterator struct {
+	tx      *bolt.Tx
+	cursor  *bolt.Cursor
+	started bool
+	payload *apns.Payload
+	err     error
+}
+
+func (i *pendingIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+
+	var k, v []byte
+	if i.started {
+		k, v = i.cursor.Next()
+	} else {
+		k, v = i.cursor.First()
+		i.started = true
+	}
+	if k == nil {
+		return false
+	}
+
+	i.payload, i.err = apns.UnmarshalOutboxPayload(v)
+	if i.err != nil {
+		return false
+	}
+	i.payload.OutboxID = strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+	return true
+}
+
+func (i *pendingIterator) Payload() *apns.Payload {
+	return i.payload
+}
+
+func (i *pendingIterator) Err() error {
+	return i.err
+}
+
+func (i *pendingIterator) Close() error {
+	return i.tx.Rollback()
+}
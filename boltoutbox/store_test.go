@@ -0,0 +1,127 @@
+package boltoutbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func openTestStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "outbox.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreTracksPendingPayloads(t *testing.T) {
+	s := openTestStore(t)
+	defer s.Close()
+
+	ids := make([]string, 3)
+	for i := range ids {
+		var err error
+		ids[i], err = s.Append(&apns.Payload{AlertText: string(rune('a' + i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.MarkSent(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkSent(ids[0]); err == nil {
+		t.Error("Expected error marking a record twice")
+	}
+	if err := s.MarkFailed(ids[1], errors.New("INVALID_TOKEN")); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := s.PendingIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []*apns.Payload
+	for iter.Next() {
+		pending = append(pending, iter.Payload())
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+	iter.Close()
+
+	if len(pending) != 1 || pending[0].AlertText != "c" || pending[0].OutboxID != ids[2] {
+		t.Errorf("Expected only payload c pending but got %+v", pending)
+	}
+
+	failed, err := s.Failed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ID != ids[1] || failed[0].Reason != "INVALID_TOKEN" {
+		t.Errorf("Expected payload b failed but got %+v", failed)
+	}
+
+	if err := s.PurgeFailed(); err != nil {
+		t.Fatal(err)
+	}
+	if failed, _ := s.Failed(); len(failed) != 0 {
+		t.Errorf("Expected failed records purged but got %v", len(failed))
+	}
+}
+
+func TestStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	s, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.Append(&apns.Payload{AlertText: "durable"})
+	s.Close()
+
+	s, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var replayed []*apns.Payload
+	n, err := apns.ReplayOutbox(s, func(p *apns.Payload) error {
+		replayed = append(replayed, p)
+		return nil
+	})
+	if err != nil || n != 1 || replayed[0].OutboxID != id || replayed[0].AlertText != "durable" {
+		t.Errorf("Expected durable payload to be replayed but got %v, %v", replayed, err)
+	}
+}
+
+func TestStoreShouldReadRecordsWhateverTheirCompression(t *testing.T) {
+	s := openTestStore(t)
+	defer s.Close()
+
+	plainID, _ := s.Append(&apns.Payload{AlertText: "plain"})
+	s.Compression = apns.OUTBOX_COMPRESSION_GZIP
+	compressedID, _ := s.Append(&apns.Payload{AlertText: "compressed"})
+	failedID, _ := s.Append(&apns.Payload{AlertText: "failed"})
+	if err := s.MarkFailed(failedID, errors.New("INVALID_TOKEN")); err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []*apns.Payload
+	if _, err := apns.ReplayOutbox(s, func(p *apns.Payload) error {
+		replayed = append(replayed, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0].OutboxID != plainID || replayed[0].AlertText != "plain" ||
+		replayed[1].OutboxID != compressedID || replayed[1].AlertText != "compressed" {
+		t.Errorf("Expected both pending payloads to be replayed but got %v", replayed)
+	}
+	failed, err := s.Failed()
+	if err != nil || len(failed) != 1 || failed[0].Payload.AlertText != "failed" {
+		t.Errorf("Expected the compressed failed record to be read but got %v, %v", failed, err)
+	}
+}
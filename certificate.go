@@ -0,0 +1,96 @@
+package apns
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+var (
+	//Extension marking a certificate as allowed to push to the sandbox gateway
+	oidAPNSDevelopment = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 1}
+	//Extension marking a certificate as allowed to push to the production gateway
+	oidAPNSProduction = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 2}
+	//Extension listing the topics a certificate can push to
+	oidAPNSTopics = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+	//Subject attribute holding the app's bundle id
+	oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+)
+
+//Details of an APNS client certificate, for checking which app and gateways
+//it's for and when it needs renewing
+type CertificateInfo struct {
+	//Subject's common name, e.g. "Apple Push Services: com.example.app"
+	CommonName string
+	//Bundle id of the app the certificate was issued for, "" if it has none
+	BundleID string
+	//Topics the certificate can push to, from its topics extension, or just the
+	//bundle id if it doesn't have one
+	Topics []string
+	//Whether the certificate can push to the sandbox gateway
+	Sandbox bool
+	//Whether the certificate can push to the production gateway
+	Production bool
+	//When the certificate is valid from and until
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+//Whether the certificate can push to both the sandbox and production gateways
+func (i *CertificateInfo) Universal() bool {
+	return i.Sandbox && i.Production
+}
+
+//Parse the details of the first certificate in cert.pem bytes (see APNSConfig.CertificateBytes)
+func ParseCertificateInfo(certificateBytes []byte) (*CertificateInfo, error) {
+	var block *pem.Block
+	for rest := certificateBytes; ; {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("Invalid certificate bytes. Should be PEM with a CERTIFICATE block")
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &CertificateInfo{
+		CommonName: cert.Subject.CommonName,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+	}
+	for _, name := range cert.Subject.Names {
+		if bundleID, ok := name.Value.(string); ok && name.Type.Equal(oidUserID) {
+			info.BundleID = bundleID
+		}
+	}
+	for _, extension := range cert.Extensions {
+		switch {
+		case extension.Id.Equal(oidAPNSDevelopment):
+			info.Sandbox = true
+		case extension.Id.Equal(oidAPNSProduction):
+			info.Production = true
+		case extension.Id.Equal(oidAPNSTopics):
+			//a sequence of topics, each followed by a sequence of its kinds ("app", "voip", ...)
+			var items []asn1.RawValue
+			if _, err := asn1.Unmarshal(extension.Value, &items); err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				if item.Class == asn1.ClassUniversal && item.Tag == asn1.TagUTF8String {
+					info.Topics = append(info.Topics, string(item.Bytes))
+				}
+			}
+		}
+	}
+	if len(info.Topics) == 0 && info.BundleID != "" {
+		info.Topics = []string{info.BundleID}
+	}
+	return info, nil
+}
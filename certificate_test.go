@@ -0,0 +1,84 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//cert.pem bytes for a push certificate with the given extensions
+func testPushCertificate(t *testing.T, bundleID string, extensions []pkix.Extension) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "Apple Push Services: " + bundleID,
+			ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: bundleID}},
+		},
+		NotBefore:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:        time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestParseCertificateInfoShouldReadPushExtensions(t *testing.T) {
+	null := []byte{5, 0}
+	topics, err := asn1.Marshal([]interface{}{
+		asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("com.example.app")},
+		[]asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte("app")}},
+		asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("com.example.app.voip")},
+		[]asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte("voip")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	universal := testPushCertificate(t, "com.example.app", []pkix.Extension{
+		{Id: oidAPNSDevelopment, Value: null},
+		{Id: oidAPNSProduction, Value: null},
+		{Id: oidAPNSTopics, Value: topics},
+	})
+
+	info, err := ParseCertificateInfo(append([]byte("Bag Attributes\n"), universal...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CommonName != "Apple Push Services: com.example.app" || info.BundleID != "com.example.app" {
+		t.Errorf("Expected the subject's names but got %+v", info)
+	}
+	if !reflect.DeepEqual(info.Topics, []string{"com.example.app", "com.example.app.voip"}) {
+		t.Errorf("Expected both topics but got %v", info.Topics)
+	}
+	if !info.Universal() || !info.NotAfter.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected a universal certificate expiring in 2027 but got %+v", info)
+	}
+
+	sandbox := testPushCertificate(t, "com.example.dev", []pkix.Extension{{Id: oidAPNSDevelopment, Value: null}})
+	info, err = ParseCertificateInfo(sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Sandbox || info.Production || info.Universal() ||
+		!reflect.DeepEqual(info.Topics, []string{"com.example.dev"}) {
+		t.Errorf("Expected a sandbox certificate for its bundle id but got %+v", info)
+	}
+
+	if _, err := ParseCertificateInfo([]byte("not a certificate")); err == nil {
+		t.Error("Expected an error for bytes without a certificate")
+	}
+}
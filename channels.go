@@ -0,0 +1,233 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+//Config for managing broadcast push channels
+type ChannelClientConfig struct {
+	//bytes for cert.pem : required unless HTTPClient or Credentials is supplied
+	CertificateBytes []byte
+	//bytes for key.pem : required unless HTTPClient or Credentials is supplied
+	KeyBytes []byte
+	//TLS setup shared with push and feedback connections, replaces
+	//CertificateBytes and KeyBytes when supplied, defaults to none
+	Credentials *Credentials
+	//bundle id of the app the channels belong to : required
+	BundleID string
+	//apple channel management host, defaults to "api-manage-broadcast.push.apple.com"
+	//use "api-manage-broadcast.sandbox.push.apple.com" (port 2195) for development
+	GatewayHost string
+	//apple channel management port, defaults to "2196"
+	GatewayPort string
+	//number of seconds to wait for each request before bailing, defaults to 10
+	RequestTimeout int
+	//client used for requests, defaults to an HTTP/2 client using the certificate
+	HTTPClient *http.Client
+}
+
+//Broadcast push channel
+type Channel struct {
+	//Id used to send broadcast pushes to the channel
+	ID string
+	//Whether Apple stores the most recent message for offline devices
+	//(see MESSAGE_STORAGE_POLICY_*), not returned by ReadAllChannels
+	MessageStoragePolicy int
+	//Push type the channel carries, not returned by ReadAllChannels
+	PushType string
+}
+
+const (
+	//Messages aren't stored for offline devices
+	MESSAGE_STORAGE_POLICY_NONE = 0
+	//The most recent message is stored for offline devices
+	MESSAGE_STORAGE_POLICY_MOST_RECENT = 1
+	//Push type of Live Activity channels
+	CHANNEL_PUSH_TYPE_LIVE_ACTIVITY = "LiveActivity"
+)
+
+//Error response from the channel management API
+type ChannelError struct {
+	//HTTP status code
+	StatusCode int
+	//Reason Apple gave, e.g. "ChannelNotRegistered"
+	Reason string
+}
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("Channel request failed with status %v : %v", e.StatusCode, e.Reason)
+}
+
+//Client for creating, reading and deleting broadcast push channels
+type ChannelClient struct {
+	//config
+	config *ChannelClientConfig
+	//base url of the app's channel endpoints
+	baseURL string
+}
+
+//Create a channel management client with the supplied config
+//If invalid config an error will be returned
+func NewChannelClient(config *ChannelClientConfig) (*ChannelClient, error) {
+	errorStrs := ""
+
+	if config.HTTPClient == nil && config.Credentials == nil &&
+		(config.CertificateBytes == nil || config.KeyBytes == nil) {
+		errorStrs += "Invalid Key/Certificate bytes\n"
+	}
+	if config.BundleID == "" {
+		errorStrs += "Invalid BundleID. Must be supplied\n"
+	}
+	if config.RequestTimeout < 0 {
+		errorStrs += "Invalid RequestTimeout. Should be > 0\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.GatewayHost == "" {
+		config.GatewayHost = "api-manage-broadcast.push.apple.com"
+	}
+	if config.GatewayPort == "" {
+		config.GatewayPort = "2196"
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 10
+	}
+	if config.HTTPClient == nil {
+		client, err := configCredentials(config.Credentials, config.CertificateBytes, config.KeyBytes,
+			nil).HTTPClient(time.Duration(config.RequestTimeout) * time.Second)
+		if err != nil {
+			return nil, err
+		}
+		config.HTTPClient = client
+	}
+
+	return &ChannelClient{
+		config:  config,
+		baseURL: "https://" + config.GatewayHost + ":" + config.GatewayPort + "/1/apps/" + config.BundleID,
+	}, nil
+}
+
+//Create a channel
+func (c *ChannelClient) CreateChannel(messageStoragePolicy int) (*Channel, error) {
+	body, err := json.Marshal(channelBody{
+		MessageStoragePolicy: messageStoragePolicy,
+		PushType:             CHANNEL_PUSH_TYPE_LIVE_ACTIVITY,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, _, err := c.do("POST", "/channels", "", body)
+	if err != nil {
+		return nil, err
+	}
+
+	channelID := response.Header.Get("apns-channel-id")
+	if channelID == "" {
+		return nil, errors.New("Channel created without an apns-channel-id")
+	}
+	return &Channel{
+		ID:                   channelID,
+		MessageStoragePolicy: messageStoragePolicy,
+		PushType:             CHANNEL_PUSH_TYPE_LIVE_ACTIVITY,
+	}, nil
+}
+
+//Read a channel's settings
+func (c *ChannelClient) ReadChannel(channelID string) (*Channel, error) {
+	_, responseBody, err := c.do("GET", "/channels", channelID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body channelBody
+	if err := json.Unmarshal(responseBody, &body); err != nil {
+		return nil, err
+	}
+	return &Channel{
+		ID:                   channelID,
+		MessageStoragePolicy: body.MessageStoragePolicy,
+		PushType:             body.PushType,
+	}, nil
+}
+
+//Read every channel belonging to the app
+//Only channel ids are returned, use ReadChannel for their settings
+func (c *ChannelClient) ReadAllChannels() ([]*Channel, error) {
+	_, responseBody, err := c.do("GET", "/all-channels", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Channels []string `json:"channels"`
+	}
+	if err := json.Unmarshal(responseBody, &body); err != nil {
+		return nil, err
+	}
+	channels := make([]*Channel, len(body.Channels))
+	for i, channelID := range body.Channels {
+		channels[i] = &Channel{ID: channelID}
+	}
+	return channels, nil
+}
+
+//Delete a channel
+func (c *ChannelClient) DeleteChannel(channelID string) error {
+	_, _, err := c.do("DELETE", "/channels", channelID, nil)
+	return err
+}
+
+//Channel settings as sent to and returned from Apple
+type channelBody struct {
+	MessageStoragePolicy int    `json:"message-storage-policy"`
+	PushType             string `json:"push-type"`
+}
+
+//Make a request to the channel management API
+//Any non 2xx response is returned as a *ChannelError
+func (c *ChannelClient) do(method string, path string, channelID string, body []byte) (*http.Response, []byte, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, c.baseURL+path, bodyReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if channelID != "" {
+		request.Header.Set("apns-channel-id", channelID)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.config.HTTPClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var reason struct {
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(responseBody, &reason)
+		return nil, nil, &ChannelError{StatusCode: response.StatusCode, Reason: reason.Reason}
+	}
+	return response, responseBody, nil
+}
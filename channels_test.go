@@ -0,0 +1,119 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Fake channel management API keeping channels in memory
+func newChannelServer() *httptest.Server {
+	lock := new(sync.Mutex)
+	channels := make(map[string]channelBody)
+	counter := 0
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !strings.HasPrefix(r.URL.Path, "/1/apps/com.example.app/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		channelID := r.Header.Get("apns-channel-id")
+
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/1/apps/com.example.app") {
+		case "POST /channels":
+			var body channelBody
+			json.NewDecoder(r.Body).Decode(&body)
+			counter++
+			channelID = "channel-" + string(rune('0'+counter))
+			channels[channelID] = body
+			w.Header().Set("apns-channel-id", channelID)
+			w.WriteHeader(http.StatusCreated)
+		case "GET /channels":
+			body, ok := channels[channelID]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"reason":"ChannelNotRegistered"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(body)
+		case "GET /all-channels":
+			ids := []string{}
+			for id := range channels {
+				ids = append(ids, id)
+			}
+			json.NewEncoder(w).Encode(map[string][]string{"channels": ids})
+		case "DELETE /channels":
+			delete(channels, channelID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func testChannelClient(t *testing.T, server *httptest.Server) *ChannelClient {
+	host := strings.TrimPrefix(server.URL, "https://")
+	client, err := NewChannelClient(&ChannelClientConfig{
+		BundleID:    "com.example.app",
+		GatewayHost: host[:strings.LastIndex(host, ":")],
+		GatewayPort: host[strings.LastIndex(host, ":")+1:],
+		HTTPClient:  server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestChannelClientLifecycle(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	client := testChannelClient(t, server)
+
+	channel, err := client.CreateChannel(MESSAGE_STORAGE_POLICY_MOST_RECENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.ID != "channel-1" {
+		t.Errorf("Expected channel id from apns-channel-id header but got %v", channel.ID)
+	}
+
+	read, err := client.ReadChannel(channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.MessageStoragePolicy != MESSAGE_STORAGE_POLICY_MOST_RECENT || read.PushType != CHANNEL_PUSH_TYPE_LIVE_ACTIVITY {
+		t.Errorf("Expected channel settings to be read back but got %+v", read)
+	}
+
+	all, err := client.ReadAllChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].ID != channel.ID {
+		t.Errorf("Expected one channel %v but got %v", channel.ID, all)
+	}
+
+	if err := client.DeleteChannel(channel.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.ReadChannel(channel.ID)
+	var channelErr *ChannelError
+	if !errors.As(err, &channelErr) || channelErr.StatusCode != http.StatusNotFound || channelErr.Reason != "ChannelNotRegistered" {
+		t.Errorf("Expected ChannelNotRegistered for deleted channel but got %v", err)
+	}
+}
+
+func TestChannelClientShouldValidateConfig(t *testing.T) {
+	if _, err := NewChannelClient(&ChannelClientConfig{}); err == nil {
+		t.Error("Expected error for missing certificate and bundle id")
+	}
+}
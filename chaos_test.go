@@ -0,0 +1,238 @@
+package apns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * Socket that injects faults: an Apple error frame once a number of
+ * notifications have been written, a disconnect part way through a frame,
+ * and slow writes (Apple reading slowly)
+ */
+type chaosConn struct {
+	MockConnPool
+	//source of randomness, only used while holding the lock
+	rand *rand.Rand
+	//upper bound on how long each write takes
+	maxWriteDelay time.Duration
+	//number of notifications after which Apple returns an error, 0 for never
+	errorAfter int
+	errorCode  uint8
+	//write which is cut off part way through, closing the socket, 0 for never
+	disconnectOnWrite int
+	//complete notifications written
+	written []writtenNotification
+	writes  int
+	//Boolean saying Apple has sent an error or the socket was reset
+	broken     bool
+	errorFrame chan []byte
+}
+
+func newChaosConn(r *rand.Rand) *chaosConn {
+	conn := &chaosConn{
+		MockConnPool: newMockConnPool(),
+		rand:         rand.New(rand.NewSource(r.Int63())),
+		errorFrame:   make(chan []byte, 1),
+	}
+	switch r.Intn(3) {
+	case 0:
+		conn.errorAfter = 1 + r.Intn(20)
+		conn.errorCode = []uint8{8, 10}[r.Intn(2)]
+	case 1:
+		conn.disconnectOnWrite = 1 + r.Intn(5)
+	}
+	if r.Intn(2) == 0 {
+		conn.maxWriteDelay = time.Millisecond
+	}
+	return conn
+}
+
+func (conn *chaosConn) Read(b []byte) (int, error) {
+	select {
+	case frame := <-conn.errorFrame:
+		return copy(b, frame), nil
+	case <-conn.CloseChannel:
+		return 0, errors.New("Socket Closed")
+	}
+}
+
+func (conn *chaosConn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.broken {
+		return 0, errors.New("Connection reset by peer")
+	}
+	if conn.maxWriteDelay > 0 {
+		time.Sleep(time.Duration(conn.rand.Int63n(int64(conn.maxWriteDelay))))
+	}
+
+	conn.writes++
+	if conn.writes == conn.disconnectOnWrite {
+		b = b[:conn.rand.Intn(len(b))]
+		conn.WrittenBytes.Write(b)
+		conn.written = append(conn.written, parseCompleteNotifications(b)...)
+		conn.broken = true
+		conn.MockConnPool.Close()
+		return len(b), errors.New("Connection reset by peer")
+	}
+
+	conn.WrittenBytes.Write(b)
+	conn.written = append(conn.written, parseNotifications(b)...)
+	if conn.errorAfter > 0 && len(conn.written) >= conn.errorAfter {
+		frame := []byte{8, conn.errorCode, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(frame[2:], conn.written[conn.rand.Intn(len(conn.written))].ID)
+		conn.errorFrame <- frame
+		conn.broken = true
+	}
+	return len(b), nil
+}
+
+func (conn *chaosConn) notifications() []writtenNotification {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return append([]writtenNotification(nil), conn.written...)
+}
+
+//Decode the notifications in written bytes, ignoring a frame that was cut off
+func parseCompleteNotifications(b []byte) []writtenNotification {
+	complete := 0
+	for complete+NOTIFICATION_HEADER_SIZE <= len(b) {
+		frameEnd := complete + NOTIFICATION_HEADER_SIZE +
+			int(binary.BigEndian.Uint32(b[complete+1:complete+NOTIFICATION_HEADER_SIZE]))
+		if frameEnd > len(b) {
+			break
+		}
+		complete = frameEnd
+	}
+	return parseNotifications(b[:complete])
+}
+
+//Send payloads on a connection over a chaos socket, then check every payload
+//is accounted for by what was written and what the connection reported
+func runChaosRound(t *testing.T, r *rand.Rand) {
+	socket := newChaosConn(r)
+	lock := new(sync.Mutex)
+	var payloadErrors []*PayloadError
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            []int{-1, 1, 5}[r.Intn(3)],
+			MaxOutboundTCPFrameSize:   []int{TCP_FRAME_MAX, 512}[r.Intn(2)],
+			MaxPayloadSize:            2048,
+			OnPayloadError: func(err *PayloadError) {
+				lock.Lock()
+				payloadErrors = append(payloadErrors, err)
+				lock.Unlock()
+			},
+		})
+
+	payloads := testTokens(1 + r.Intn(40))
+	byJSON := make(map[string]*Payload)
+	for i, p := range payloads {
+		p.AlertText = fmt.Sprintf("%v", i)
+		byJSON[fmt.Sprintf(`{"aps":{"alert":"%v"}}`, i)] = p
+	}
+
+	var sent []*Payload
+	var connectionClose *ConnectionClose
+	for _, p := range payloads {
+		select {
+		case apn.SendChannel <- p:
+			sent = append(sent, p)
+		case connectionClose = <-apn.CloseChannel:
+		}
+		if connectionClose != nil {
+			break
+		}
+	}
+	if connectionClose == nil {
+		apn.Disconnect()
+		connectionClose = <-apn.CloseChannel
+	}
+
+	//every payload is reported at most once
+	reported := make(map[*Payload]string)
+	report := func(p *Payload, how string) {
+		if previously, ok := reported[p]; ok {
+			t.Errorf("Payload %v reported as %v and %v", p.AlertText, previously, how)
+		}
+		reported[p] = how
+	}
+	if connectionClose.ErrorPayload != nil {
+		report(connectionClose.ErrorPayload, "error payload")
+	}
+	for _, p := range connectionClose.UnsentPayloads {
+		report(p, "unsent")
+	}
+	lock.Lock()
+	for _, err := range payloadErrors {
+		report(err.Payload, "payload error")
+	}
+	lock.Unlock()
+
+	writtenIDs := make(map[*Payload]uint32)
+	for _, notification := range socket.notifications() {
+		writtenIDs[byJSON[notification.Payload]] = notification.ID
+	}
+
+	//payloads which were neither written nor reported were lost without notice,
+	//unless the close says the socket broke with them in flight
+	inDoubt := connectionClose.Error != nil && connectionClose.Error.ErrorCode == CONNECTION_CLOSED_UNKNOWN
+	for _, p := range sent {
+		_, written := writtenIDs[p]
+		if _, ok := reported[p]; !ok && !written && !inDoubt {
+			t.Errorf("Payload %v was lost without notice, close %+v", p.AlertText, connectionClose.Error)
+		}
+	}
+
+	//payloads written after the one Apple rejected must be returned unsent
+	if connectionClose.ErrorPayload != nil {
+		errorID := connectionClose.Error.MessageID
+		if writtenIDs[connectionClose.ErrorPayload] != errorID {
+			t.Errorf("Expected error payload to have been written with id %v", errorID)
+		}
+		for p, id := range writtenIDs {
+			if id > errorID && reported[p] != "unsent" {
+				t.Errorf("Payload %v written after the error payload wasn't returned unsent", p.AlertText)
+			}
+			if id < errorID && reported[p] == "unsent" {
+				t.Errorf("Payload %v written before the error payload was returned unsent", p.AlertText)
+			}
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	rounds := 200
+	if testing.Short() {
+		rounds = 20
+	}
+	seed := time.Now().UnixNano()
+	t.Logf("Chaos seed %v", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < rounds && !t.Failed(); i++ {
+		runChaosRound(t, r)
+	}
+
+	//every connection's go-routines should have exited
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Expected %v go-routines but there are %v\n%s",
+				goroutines, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
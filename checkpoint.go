@@ -0,0 +1,138 @@
+package apns
+
+import (
+	"time"
+)
+
+//Point in a connection's writes up to which every payload has been accepted
+//or rejected by Apple, so none of them need sending again (see APNSConfig.OnCheckpoint)
+//Checkpoints arrive in the order frames were written, so persisting the
+//latest is enough to know where to resume after a crash
+type Checkpoint struct {
+	//Id of the connection the frame was written on (see APNSConnection.ID)
+	ConnectionID string `json:"connection_id"`
+	//Number of the frame on the connection, counting from 1
+	Frame uint64 `json:"frame"`
+	//Message ids of the first and last payloads covered, in the order they were written
+	FirstMessageID uint32 `json:"first_message_id"`
+	LastMessageID  uint32 `json:"last_message_id"`
+	//Number of payloads covered
+	Payloads int `json:"payloads"`
+	//UUID and OutboxID of the last payload covered, e.g. to find where to
+	//resume in an upstream queue
+	LastUUID     string `json:"last_uuid,omitempty"`
+	LastOutboxID string `json:"last_outbox_id,omitempty"`
+	//When the frame was written to the socket
+	FlushedAt time.Time `json:"flushed_at"`
+	//Whether it only covers the start of the frame, because the connection
+	//closed with the rest of the frame unsent or in doubt
+	Partial bool `json:"partial,omitempty"`
+	//The last payload covered
+	LastPayload *Payload `json:"-"`
+}
+
+//Frame written to the socket, waiting for its payloads to be accepted or rejected
+//Guarded by inFlightBufferLock
+type checkpointFrame struct {
+	checkpoint *Checkpoint
+	//payloads in the order they were written
+	payloads []*idPayload
+	//number of payloads not yet accepted or rejected
+	outstanding int
+}
+
+//Checkpoint covering payloads, in the order they were written
+func newCheckpoint(connectionID string, frameNumber uint64, payloads []*idPayload,
+	flushedAt time.Time) *Checkpoint {
+	last := payloads[len(payloads)-1]
+	return &Checkpoint{
+		ConnectionID:   connectionID,
+		Frame:          frameNumber,
+		FirstMessageID: payloads[0].ID,
+		LastMessageID:  last.ID,
+		Payloads:       len(payloads),
+		LastUUID:       last.Payload.UUID,
+		LastOutboxID:   last.Payload.OutboxID,
+		FlushedAt:      flushedAt,
+		LastPayload:    last.Payload,
+	}
+}
+
+//Start waiting on the payloads of the frame just written
+//NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
+func (c *APNSConnection) addCheckpointFrame(flushedAt time.Time) {
+	c.framesFlushed++
+	f := &checkpointFrame{payloads: append([]*idPayload(nil), c.framedIDPayloads...)}
+	for _, idPayloadObj := range f.payloads {
+		idPayloadObj.frame = f
+		if !idPayloadObj.confirmed {
+			f.outstanding++
+		}
+	}
+	f.checkpoint = newCheckpoint(c.id, c.framesFlushed, f.payloads, flushedAt)
+	c.checkpointFrames = append(c.checkpointFrames, f)
+}
+
+//Record that a written payload has been accepted or rejected by Apple, and
+//pass on the checkpoints of the frames that completes
+func (c *APNSConnection) confirm(idPayloadObj *idPayload) {
+	if c.config.OnCheckpoint == nil {
+		return
+	}
+	c.inFlightBufferLock.Lock()
+	if idPayloadObj.confirmed {
+		c.inFlightBufferLock.Unlock()
+		return
+	}
+	idPayloadObj.confirmed = true
+	if idPayloadObj.frame != nil {
+		idPayloadObj.frame.outstanding--
+	}
+	ready := c.readyCheckpoints()
+	c.inFlightBufferLock.Unlock()
+	for _, checkpoint := range ready {
+		c.config.OnCheckpoint(checkpoint)
+	}
+}
+
+//Pass on the checkpoints left once the connection has closed: complete
+//frames, then the confirmed start of the first incomplete frame
+func (c *APNSConnection) closeCheckpoints() {
+	if c.config.OnCheckpoint == nil {
+		return
+	}
+	c.inFlightBufferLock.Lock()
+	ready := c.readyCheckpoints()
+	if len(c.checkpointFrames) > 0 {
+		f := c.checkpointFrames[0]
+		confirmed := 0
+		for confirmed < len(f.payloads) && f.payloads[confirmed].confirmed {
+			confirmed++
+		}
+		if confirmed > 0 {
+			checkpoint := newCheckpoint(c.id, f.checkpoint.Frame, f.payloads[:confirmed],
+				f.checkpoint.FlushedAt)
+			checkpoint.Partial = true
+			ready = append(ready, checkpoint)
+		}
+		//the rest will never be confirmed
+		c.checkpointFrames = nil
+	}
+	c.inFlightBufferLock.Unlock()
+	for _, checkpoint := range ready {
+		c.config.OnCheckpoint(checkpoint)
+	}
+}
+
+//Remove the frames at the front whose payloads have all been accepted or
+//rejected, returning their checkpoints
+//NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
+func (c *APNSConnection) readyCheckpoints() []*Checkpoint {
+	var ready []*Checkpoint
+	for len(c.checkpointFrames) > 0 && c.checkpointFrames[0].outstanding == 0 {
+		ready = append(ready, c.checkpointFrames[0].checkpoint)
+		c.checkpointFrames[0] = nil
+		c.checkpointFrames = c.checkpointFrames[1:]
+	}
+	return ready
+}
@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"testing"
+)
+
+func TestCheckpointsShouldFollowFramesInOrder(t *testing.T) {
+	checkpoints := make(chan *Checkpoint, 10)
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		OnCheckpoint: func(checkpoint *Checkpoint) {
+			checkpoints <- checkpoint
+		},
+	})
+	payloads := testTokens(3)
+	for i, p := range payloads {
+		p.UUID = string(rune('a' + i))
+		apn.SendChannel <- p
+	}
+	apn.Flush()
+	select {
+	case checkpoint := <-checkpoints:
+		t.Fatalf("Expected no checkpoint while Apple may still reject the frames but got %+v", checkpoint)
+	default:
+	}
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+	close(checkpoints)
+	var frames []uint64
+	for checkpoint := range checkpoints {
+		frames = append(frames, checkpoint.Frame)
+		i := len(frames) - 1
+		if checkpoint.FirstMessageID != uint32(i+1) || checkpoint.LastMessageID != uint32(i+1) ||
+			checkpoint.Payloads != 1 || checkpoint.LastUUID != payloads[i].UUID ||
+			checkpoint.LastPayload != payloads[i] || checkpoint.Partial ||
+			checkpoint.ConnectionID != apn.ID() || checkpoint.FlushedAt.IsZero() {
+			t.Errorf("Expected a checkpoint for payload %v but got %+v", i, checkpoint)
+		}
+	}
+	if len(frames) != 3 || frames[0] != 1 || frames[2] != 3 {
+		t.Errorf("Expected checkpoints for frames 1 to 3 but got %v", frames)
+	}
+}
+
+func TestCheckpointShouldCoverConfirmedStartOfFrameOnError(t *testing.T) {
+	checkpoints := make(chan *Checkpoint, 10)
+	//the second of four payloads written in one frame is rejected
+	socket := newMockConnAppleError(4, 2, 8)
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            60000,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		OnCheckpoint: func(checkpoint *Checkpoint) {
+			checkpoints <- checkpoint
+		},
+	})
+	payloads := testTokens(4)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	apn.Flush()
+
+	connectionClose := <-apn.CloseChannel
+	if len(connectionClose.UnsentPayloads) != 2 {
+		t.Fatalf("Expected the payloads after the error to be unsent but got %v", connectionClose.UnsentPayloads)
+	}
+	close(checkpoints)
+	var got []*Checkpoint
+	for checkpoint := range checkpoints {
+		got = append(got, checkpoint)
+	}
+	if len(got) != 1 || got[0].Frame != 1 || !got[0].Partial || got[0].Payloads != 2 ||
+		got[0].FirstMessageID != 1 || got[0].LastMessageID != 2 || got[0].LastPayload != payloads[1] {
+		t.Errorf("Expected a partial checkpoint up to the rejected payload but got %+v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package apns
+
+import (
+	"time"
+)
+
+//Source of the current time and of timers (see APNSConfig.Clock)
+//Lets tests drive framing timeouts, acceptance windows, idle timeouts,
+//pool scaling and reconnect backoff without real sleeps, e.g. with
+//apnstest.FakeClock
+type Clock interface {
+	Now() time.Time
+	//Timer sending the time on its channel once d has passed
+	NewTimer(d time.Duration) Timer
+	//Ticker sending the time on its channel every d
+	NewTicker(d time.Duration) Ticker
+	//Timer calling f once d has passed, f mustn't block
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+//Timer made by a Clock, as time.Timer
+type Timer interface {
+	//Channel the time is sent on when the timer fires, nil for AfterFunc timers
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+//Ticker made by a Clock, as time.Ticker
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+//Clock using the time package, used when APNSConfig.Clock isn't set
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) Chan() <-chan time.Time {
+	return t.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+//The clock, or SystemClock if it's nil
+func configClock(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
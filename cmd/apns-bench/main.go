@@ -0,0 +1,97 @@
+//Load generator for capacity planning
+//
+//Sends payloads through a supervised pool at a steady rate and prints
+//throughput, allocations and (against the mock gateway) latency:
+//
+//	apns-bench -rate 5000 -size 256 -pool 4 -duration 30s
+//	apns-bench -dsn "apns://sandbox?cert=cert.pem&key=key.pem" -token <device token>
+//
+//Without -dsn payloads go to an in-process mock gateway (see apnstest)
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+	"github.com/joekarl/go-libapns/loadtest"
+)
+
+func main() {
+	dsn := flag.String("dsn", "", "gateway to send to (see apns.ParseDSN), defaults to an in-process mock gateway")
+	token := flag.String("token", "", "device token to send every payload to, defaults to a made up token for each payload")
+	rate := flag.Int("rate", 0, "payloads per second, 0 for as fast as possible")
+	size := flag.Int("size", 100, "bytes of alert text in each payload")
+	poolSize := flag.Int("pool", 1, "number of connections")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send for")
+	flag.Parse()
+
+	if err := run(*dsn, *token, *rate, *size, *poolSize, *duration); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn string, token string, rate int, size int, poolSize int, duration time.Duration) error {
+	var connectionConfig *apns.APNSConfig
+	var server *apnstest.Server
+	if dsn == "" {
+		var err error
+		if server, err = apnstest.NewServer(nil); err != nil {
+			return err
+		}
+		defer server.Close()
+		connectionConfig = server.Config()
+	} else {
+		poolConfig, err := apns.ParseDSN(dsn)
+		if err != nil {
+			return err
+		}
+		connectionConfig = poolConfig.ConnectionConfig
+	}
+
+	//the supervisor replaces connections Apple closes (e.g. for a bad token)
+	//so a long run keeps going
+	supervisor, err := apns.NewSupervisor(&apns.SupervisorConfig{
+		ConnectionConfig: connectionConfig,
+		Size:             poolSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	var rejected uint64
+	closed := make(chan bool)
+	go func() {
+		for connectionClose := range supervisor.CloseChannel {
+			if connectionClose.ErrorPayload != nil {
+				atomic.AddUint64(&rejected, 1)
+			}
+		}
+		close(closed)
+	}()
+
+	report, err := loadtest.Run(&loadtest.Config{
+		Send:        supervisor.Send,
+		Server:      server,
+		Rate:        rate,
+		Duration:    int(duration / time.Millisecond),
+		PayloadSize: size,
+		Token:       token,
+	})
+	supervisor.Disconnect()
+	<-closed
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("connections: %v\n", poolSize)
+	fmt.Printf("payload:     %v bytes of alert text\n", size)
+	fmt.Println(report)
+	fmt.Printf("rejected:    %v\n", atomic.LoadUint64(&rejected))
+	return nil
+}
@@ -0,0 +1,145 @@
+//Frame inspector for debugging what was written to (or read from) the gateway
+//
+//Reads captured frame bytes, raw or hex, from a file or stdin and prints
+//each frame's items: token, JSON payload, id, expiration and priority.
+//Error responses from Apple are printed with their status:
+//
+//	apns-decode capture.bin
+//	echo "0200000049010020..." | apns-decode
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/frame"
+)
+
+func main() {
+	maxPayloadSize := flag.Int("max-payload", 2048, "payload size to flag payloads over")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: apns-decode [-max-payload n] [file]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var input []byte
+	var err error
+	if flag.NArg() > 0 {
+		input, err = os.ReadFile(flag.Arg(0))
+	} else {
+		input, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := decode(os.Stdout, unhex(input), *maxPayloadSize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//Input decoded from hex if it's only hex digits and whitespace, otherwise as is
+func unhex(input []byte) []byte {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, string(input))
+	if b, err := hex.DecodeString(digits); err == nil && len(b) > 0 {
+		return b
+	}
+	return input
+}
+
+//Print every frame in b
+func decode(w io.Writer, b []byte, maxPayloadSize int) error {
+	offset := 0
+	for count := 1; len(b) > 0; count++ {
+		if b[0] == frame.COMMAND_ERROR_RESPONSE {
+			status, id, err := frame.ParseErrorResponse(b)
+			if err != nil {
+				return fmt.Errorf("Error response at offset %v: %v", offset, err)
+			}
+			fmt.Fprintf(w, "error response %v (offset %v)\n", count, offset)
+			name, ok := apns.APPLE_PUSH_RESPONSES[status]
+			if !ok {
+				name = "unknown"
+			}
+			fmt.Fprintf(w, "  status:     %v (%v)\n", status, name)
+			fmt.Fprintf(w, "  id:         %v\n", id)
+			b = b[frame.ERROR_RESPONSE_SIZE:]
+			offset += frame.ERROR_RESPONSE_SIZE
+			continue
+		}
+
+		length, err := frame.FrameLength(b)
+		if err != nil {
+			return fmt.Errorf("Frame at offset %v: %v", offset, err)
+		}
+		items, err := frame.ParseFrame(b[:length])
+		if err != nil {
+			return fmt.Errorf("Frame at offset %v: %v", offset, err)
+		}
+		fmt.Fprintf(w, "notification %v (offset %v, %v bytes)\n", count, offset, length)
+		printItems(w, items, maxPayloadSize)
+		b = b[length:]
+		offset += length
+	}
+	return nil
+}
+
+//Print a notification frame's items
+func printItems(w io.Writer, items []frame.Item, maxPayloadSize int) {
+	for _, item := range items {
+		switch item.ID {
+		case frame.ITEM_DEVICE_TOKEN:
+			note := ""
+			if len(item.Data) != apns.APNS_TOKEN_SIZE {
+				note = fmt.Sprintf(" (%v bytes, should be %v)", len(item.Data), apns.APNS_TOKEN_SIZE)
+			}
+			fmt.Fprintf(w, "  token:      %x%v\n", item.Data, note)
+		case frame.ITEM_PAYLOAD:
+			note := fmt.Sprintf("%v bytes", len(item.Data))
+			if len(item.Data) > maxPayloadSize {
+				note += fmt.Sprintf(", over %v so Apple returns INVALID_PAYLOAD_SIZE", maxPayloadSize)
+			}
+			if !json.Valid(item.Data) {
+				note += ", not valid JSON"
+			}
+			fmt.Fprintf(w, "  payload:    (%v)\n", note)
+			var indented bytes.Buffer
+			if json.Indent(&indented, item.Data, "    ", "  ") == nil {
+				fmt.Fprintf(w, "    %s\n", indented.Bytes())
+			} else {
+				fmt.Fprintf(w, "    %q\n", item.Data)
+			}
+		case frame.ITEM_NOTIFICATION_ID, frame.ITEM_EXPIRATION_DATE, frame.ITEM_PRIORITY:
+			n, err := frame.ParseNotification([]frame.Item{item})
+			if err != nil {
+				fmt.Fprintf(w, "  item %v:     %x (%v)\n", item.ID, item.Data, err)
+			} else if item.ID == frame.ITEM_NOTIFICATION_ID {
+				fmt.Fprintf(w, "  id:         %v\n", n.ID)
+			} else if item.ID == frame.ITEM_EXPIRATION_DATE {
+				fmt.Fprintf(w, "  expiration: %v (%v)\n", n.ExpirationTime,
+					time.Unix(int64(n.ExpirationTime), 0).UTC().Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(w, "  priority:   %v\n", n.Priority)
+			}
+		default:
+			fmt.Fprintf(w, "  item %v:     %x (unknown item, Apple returns INVALID_FRAME_ITEM_ID)\n", item.ID, item.Data)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/joekarl/go-libapns/frame"
+)
+
+func TestDecodeShouldPrintFrames(t *testing.T) {
+	b := frame.AppendNotification(nil, &frame.Notification{
+		Token:          bytes.Repeat([]byte{0xab}, 32),
+		Payload:        []byte(`{"aps":{"alert":"hi"}}`),
+		ID:             7,
+		ExpirationTime: 1700000000,
+		Priority:       10,
+	})
+	b = frame.AppendErrorResponse(b, 8, 7)
+
+	var out bytes.Buffer
+	if err := decode(&out, unhex([]byte(hex.EncodeToString(b)+"\n")), 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"notification 1 (offset 0, 83 bytes)",
+		"token:      " + strings.Repeat("ab", 32),
+		"over 10 so Apple returns INVALID_PAYLOAD_SIZE",
+		`"alert": "hi"`,
+		"id:         7",
+		"expiration: 1700000000 (2023-11-14T22:13:20Z)",
+		"priority:   10",
+		"error response 2 (offset 83)",
+		"status:     8 (INVALID_TOKEN)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q but got\n%v", expected, out.String())
+		}
+	}
+}
+
+func TestDecodeShouldReportTruncatedFrames(t *testing.T) {
+	b := frame.AppendNotification(nil, &frame.Notification{Token: []byte{1}, Payload: []byte("{}")})
+	var out bytes.Buffer
+	if err := decode(&out, b[:len(b)-1], 2048); err == nil || !strings.Contains(err.Error(), "offset 0") {
+		t.Errorf("Expected an error for the frame at offset 0 but got %v", err)
+	}
+	if !bytes.Equal(unhex(b), b) {
+		t.Error("Expected raw bytes to be left alone")
+	}
+}
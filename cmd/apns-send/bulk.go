@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+//A row of a bulk send file
+type row struct {
+	//line of the file the row starts on
+	line int
+	//the row's fields by column name, including "token"
+	vars map[string]string
+}
+
+//Text templates the fields of each payload are rendered from, nil for fields
+//left out, with a row's fields as the data, e.g. "Hi {{.name}}"
+type payloadTemplate struct {
+	title    *template.Template
+	alert    *template.Template
+	sound    *template.Template
+	category *template.Template
+	//rendered to a number, or "" for no badge
+	badge    *template.Template
+	priority uint8
+}
+
+//Config for a bulk send
+type bulkConfig struct {
+	connectionConfig *apns.APNSConfig
+	poolSize         int
+	template         *payloadTemplate
+	//how long to wait after the last payload is written for Apple to reject it
+	linger time.Duration
+	//where failed rows are written, one JSON object per line
+	failures io.Writer
+	//where the progress bar is drawn, nil for none
+	progress io.Writer
+}
+
+//Outcome of a bulk send
+type bulkReport struct {
+	rows   int
+	failed int
+}
+
+//Line of the failure report
+type bulkFailure struct {
+	Line  int    `json:"line"`
+	Token string `json:"token"`
+	Error string `json:"error"`
+}
+
+func runBulk(args []string) error {
+	flags := flag.NewFlagSet("bulk", flag.ContinueOnError)
+	dsn := flags.String("dsn", "", "gateway and credentials to send with (see apns.ParseDSN) : required")
+	format := flags.String("format", "", "csv or ndjson, defaults to the file's extension")
+	failuresPath := flags.String("failures", "failures.ndjson", "file failed rows are written to")
+	poolSize := flags.Int("pool", 0, "number of connections, defaults to the DSN's pool")
+	title := flags.String("title", "", "alert title template")
+	alert := flags.String("alert", "", "alert body template")
+	sound := flags.String("sound", "", "sound template")
+	category := flags.String("category", "", "category template")
+	badge := flags.String("badge", "", "badge number template")
+	priority := flags.Int("priority", 10, "priority, 10 or 5")
+	linger := flags.Duration("linger", time.Second, "how long to wait for Apple to reject the last payloads")
+	quiet := flags.Bool("quiet", false, "don't draw the progress bar")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: apns-send bulk -dsn <dsn> [flags] <rows.csv|rows.ndjson>")
+		fmt.Fprintln(flags.Output(), "\nEach row has a token column, every column can be used in the templates as {{.column}}")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *dsn == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	poolConfig, err := apns.ParseDSN(*dsn)
+	if err != nil {
+		return err
+	}
+	if *poolSize > 0 {
+		poolConfig.Size = *poolSize
+	}
+	tmpl, err := newPayloadTemplate(*title, *alert, *sound, *category, *badge, uint8(*priority))
+	if err != nil {
+		return err
+	}
+	rows, err := readRowsFile(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	failures, err := os.Create(*failuresPath)
+	if err != nil {
+		return err
+	}
+	defer failures.Close()
+
+	config := &bulkConfig{
+		connectionConfig: poolConfig.ConnectionConfig,
+		poolSize:         poolConfig.Size,
+		template:         tmpl,
+		linger:           *linger,
+		failures:         failures,
+	}
+	if !*quiet {
+		config.progress = os.Stderr
+	}
+	report, err := bulkSend(config, rows)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sent %v of %v rows\n", report.rows-report.failed, report.rows)
+	if report.failed > 0 {
+		return fmt.Errorf("%v rows failed, see %v", report.failed, *failuresPath)
+	}
+	return nil
+}
+
+//Parse each non-empty field into a template, failing on fields a row doesn't have
+func newPayloadTemplate(title string, alert string, sound string, category string,
+	badge string, priority uint8) (*payloadTemplate, error) {
+	if err := apns.ValidatePriority(priority); err != nil {
+		return nil, err
+	}
+	t := &payloadTemplate{priority: priority}
+	for _, field := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"title", title, &t.title},
+		{"alert", alert, &t.alert},
+		{"sound", sound, &t.sound},
+		{"category", category, &t.category},
+		{"badge", badge, &t.badge},
+	} {
+		if field.text == "" {
+			continue
+		}
+		parsed, err := template.New(field.name).Option("missingkey=error").Parse(field.text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v template : %v", field.name, err)
+		}
+		*field.tmpl = parsed
+	}
+	if t.title == nil && t.alert == nil && t.sound == nil && t.category == nil && t.badge == nil {
+		return nil, errors.New("Invalid template. Should have at least one of title, alert, sound, category or badge")
+	}
+	return t, nil
+}
+
+//Render a row's payload
+func (t *payloadTemplate) render(r *row) (*apns.Payload, error) {
+	execute := func(tmpl *template.Template) (string, error) {
+		if tmpl == nil {
+			return "", nil
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, r.vars); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+
+	payload := &apns.Payload{Token: r.vars["token"], Priority: t.priority, ExtraData: r}
+	var err error
+	if payload.AlertBody.Title, err = execute(t.title); err != nil {
+		return nil, err
+	}
+	if payload.AlertBody.Body, err = execute(t.alert); err != nil {
+		return nil, err
+	}
+	if payload.Sound, err = execute(t.sound); err != nil {
+		return nil, err
+	}
+	if payload.Category, err = execute(t.category); err != nil {
+		return nil, err
+	}
+	badge, err := execute(t.badge)
+	if err != nil {
+		return nil, err
+	}
+	if badge != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(badge))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid badge %q. Should be a number", badge)
+		}
+		payload.Badge = apns.NewBadgeNumber(n)
+	}
+	return payload, nil
+}
+
+//Read the rows of a CSV or NDJSON file, format "" to go by its extension
+func readRowsFile(path string, format string) ([]*row, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			format = "csv"
+		case ".ndjson", ".jsonl":
+			format = "ndjson"
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch format {
+	case "csv":
+		return readCSVRows(f)
+	case "ndjson":
+		return readNDJSONRows(f)
+	}
+	return nil, fmt.Errorf("Invalid format %q. Should be csv or ndjson", format)
+}
+
+//Rows of a CSV file whose first line names the columns
+func readCSVRows(r io.Reader) ([]*row, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSV header : %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	if !contains(header, "token") {
+		return nil, errors.New("Invalid CSV. Should have a token column")
+	}
+
+	var rows []*row
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		r := &row{line: line, vars: make(map[string]string, len(header))}
+		for i, name := range header {
+			r.vars[name] = record[i]
+		}
+		rows = append(rows, r)
+	}
+}
+
+//Rows of a file with a JSON object per line, blank lines are skipped
+//Values which aren't strings are used as their JSON, e.g. 3 or true
+func readNDJSONRows(r io.Reader) ([]*row, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	var rows []*row
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return nil, fmt.Errorf("Error reading line %v : %v", line, err)
+		}
+		r := &row{line: line, vars: make(map[string]string, len(fields))}
+		for name, value := range fields {
+			var s string
+			if json.Unmarshal(value, &s) != nil {
+				s = string(value)
+			}
+			r.vars[name] = s
+		}
+		if _, ok := r.vars["token"]; !ok {
+			return nil, fmt.Errorf("Invalid line %v. Should have a token", line)
+		}
+		rows = append(rows, r)
+	}
+	return rows, scanner.Err()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//Send a payload for every row through a supervised pool, writing the rows
+//which fail to the failure report
+func bulkSend(config *bulkConfig, rows []*row) (*bulkReport, error) {
+	report := &bulkReport{rows: len(rows)}
+	var done, failed int64
+	failuresLock := new(sync.Mutex)
+	failures := json.NewEncoder(config.failures)
+	fail := func(r *row, err error) {
+		atomic.AddInt64(&failed, 1)
+		failuresLock.Lock()
+		failures.Encode(&bulkFailure{Line: r.line, Token: r.vars["token"], Error: err.Error()})
+		failuresLock.Unlock()
+	}
+	failPayload := func(payload *apns.Payload, err error) {
+		if r, ok := payload.ExtraData.(*row); ok {
+			fail(r, err)
+		}
+	}
+
+	connectionConfig := *config.connectionConfig
+	connectionConfig.OnPayloadError = func(err *apns.PayloadError) {
+		failPayload(err.Payload, err.Err)
+	}
+	supervisor, err := apns.NewSupervisor(&apns.SupervisorConfig{
+		ConnectionConfig: &connectionConfig,
+		Size:             config.poolSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	closed := make(chan bool)
+	go func() {
+		for connectionClose := range supervisor.CloseChannel {
+			if connectionClose.ErrorPayload != nil && connectionClose.Error != nil {
+				failPayload(connectionClose.ErrorPayload, connectionClose.Error)
+			}
+			for _, payload := range connectionClose.UnsentPayloads {
+				failPayload(payload, apns.ErrConnectionClosed)
+			}
+		}
+		close(closed)
+	}()
+
+	stopProgress := make(chan bool)
+	progressStopped := make(chan bool)
+	go func() {
+		defer close(progressStopped)
+		if config.progress == nil {
+			return
+		}
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprint(config.progress, progressLine(int(atomic.LoadInt64(&done)),
+					len(rows), int(atomic.LoadInt64(&failed))))
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	for _, r := range rows {
+		payload, err := config.template.render(r)
+		if err == nil {
+			err = supervisor.Send(payload)
+		}
+		if err != nil {
+			fail(r, err)
+		}
+		atomic.AddInt64(&done, 1)
+	}
+
+	//give Apple a chance to reject the last payloads before hanging up
+	supervisor.Pool().Flush()
+	time.Sleep(config.linger)
+	supervisor.Disconnect()
+	<-closed
+	close(stopProgress)
+	<-progressStopped
+
+	report.failed = int(atomic.LoadInt64(&failed))
+	if config.progress != nil {
+		fmt.Fprintln(config.progress, progressLine(len(rows), len(rows), report.failed))
+	}
+	return report, nil
+}
+
+//Progress bar, drawn over the previous one
+//
+//	[###############               ] 500/1000 rows, 3 failed
+func progressLine(done int, total int, failed int) string {
+	const width = 30
+	filled := width
+	if total > 0 {
+		filled = done * width / total
+	}
+	return fmt.Sprintf("\r[%v%v] %v/%v rows, %v failed", strings.Repeat("#", filled),
+		strings.Repeat(" ", width-filled), done, total, failed)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func TestReadRowsShouldParseCSVAndNDJSON(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "rows.csv")
+	os.WriteFile(csvPath, []byte("token,name\n01ab,Ann\n02cd,\"Bo, Jr\"\n"), 0644)
+	ndjsonPath := filepath.Join(dir, "rows.ndjson")
+	os.WriteFile(ndjsonPath, []byte(`{"token":"01ab","name":"Ann","count":3}`+"\n\n"+`{"token":"02cd","name":"Bo"}`+"\n"), 0644)
+
+	for _, path := range []string{csvPath, ndjsonPath} {
+		rows, err := readRowsFile(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0].vars["name"] != "Ann" || rows[1].vars["token"] != "02cd" {
+			t.Errorf("Expected 2 rows from %v but got %v", filepath.Base(path), rows)
+		}
+		if rows[1].line != 3 {
+			t.Errorf("Expected the second row of %v on line 3 but got %v", filepath.Base(path), rows[1].line)
+		}
+	}
+	if rows, _ := readRowsFile(ndjsonPath, ""); rows[0].vars["count"] != "3" {
+		t.Errorf("Expected numbers as their JSON but got %q", rows[0].vars["count"])
+	}
+
+	os.WriteFile(csvPath, []byte("name\nAnn\n"), 0644)
+	if _, err := readRowsFile(csvPath, ""); err == nil {
+		t.Error("Expected an error for a CSV without a token column")
+	}
+	if _, err := readRowsFile(csvPath, "xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestBulkSendShouldReportFailures(t *testing.T) {
+	server, err := apnstest.NewServer(&apnstest.ServerConfig{Record: true, ErrorTokens: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	good := strings.Repeat("ab", 32)
+	rows := []*row{
+		{line: 2, vars: map[string]string{"token": good, "name": "Ann", "count": "3"}},
+		{line: 3, vars: map[string]string{"token": "zz", "name": "Bo", "count": "1"}},
+		{line: 4, vars: map[string]string{"token": good, "count": "1"}},
+		{line: 5, vars: map[string]string{"token": good, "name": "Cy", "count": "x"}},
+		{line: 6, vars: map[string]string{"token": apnstest.ErrorToken(8, 0), "name": "Di", "count": "1"}},
+	}
+	tmpl, err := newPayloadTemplate("", "Hi {{.name}}", "", "", "{{.count}}", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures, progress bytes.Buffer
+	report, err := bulkSend(&bulkConfig{
+		connectionConfig: server.Config(),
+		poolSize:         1,
+		template:         tmpl,
+		linger:           100 * time.Millisecond,
+		failures:         &failures,
+		progress:         &progress,
+	}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.rows != 5 || report.failed != 4 {
+		t.Errorf("Expected 4 of 5 rows to fail but got %+v", report)
+	}
+	failedLines := map[int]string{}
+	for _, line := range strings.Split(strings.TrimSpace(failures.String()), "\n") {
+		var failure bulkFailure
+		if err := json.Unmarshal([]byte(line), &failure); err != nil {
+			t.Fatal(err)
+		}
+		failedLines[failure.Line] = failure.Error
+	}
+	for _, line := range []int{3, 4, 5, 6} {
+		if failedLines[line] == "" {
+			t.Errorf("Expected line %v in the failure report but got %v", line, failures.String())
+		}
+	}
+	if failedLines[6] != "INVALID_TOKEN" {
+		t.Errorf("Expected Apple's error for line 6 but got %q", failedLines[6])
+	}
+
+	notifications := server.Notifications()
+	if len(notifications) == 0 || !strings.Contains(string(notifications[0].Payload), `"Hi Ann"`) ||
+		!strings.Contains(string(notifications[0].Payload), `"badge":3`) {
+		t.Errorf("Expected the rendered payload to be sent but got %v", notifications)
+	}
+	if !strings.HasSuffix(progress.String(), "] 5/5 rows, 4 failed\n") {
+		t.Errorf("Expected a finished progress bar but got %q", progress.String())
+	}
+}
+
+func TestProgressLineShouldFillWithRows(t *testing.T) {
+	if line := progressLine(15, 30, 2); line != "\r["+strings.Repeat("#", 15)+strings.Repeat(" ", 15)+"] 15/30 rows, 2 failed" {
+		t.Errorf("Unexpected progress line %q", line)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+//Line printed for each feedback entry
+type feedbackLine struct {
+	Token     string `json:"token"`
+	Timestamp string `json:"timestamp"`
+}
+
+func runFeedback(args []string) error {
+	flags := flag.NewFlagSet("feedback", flag.ContinueOnError)
+	dsn := flags.String("dsn", "", "credentials to connect with (see apns.ParseDSN), sandbox hosts use the sandbox feedback service : required")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: apns-send feedback -dsn <dsn>")
+		fmt.Fprintln(flags.Output(), "\nPrints a JSON line per token Apple reports the app was removed for")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *dsn == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	poolConfig, err := apns.ParseDSN(*dsn)
+	if err != nil {
+		return err
+	}
+	stream, err := apns.StreamFeedbackService(apns.FeedbackConfigFromAPNSConfig(poolConfig.ConnectionConfig))
+	if err != nil {
+		return err
+	}
+	count := printFeedback(os.Stdout, stream.EntryChannel)
+	fmt.Fprintf(os.Stderr, "%v tokens\n", count)
+	return stream.Err()
+}
+
+//Print entries as JSON lines until the channel is closed
+//Returns the number printed
+func printFeedback(w io.Writer, entries <-chan apns.FeedbackEntry) int {
+	encoder := json.NewEncoder(w)
+	count := 0
+	for entry := range entries {
+		encoder.Encode(&feedbackLine{
+			Token:     entry.Token,
+			Timestamp: entry.Timestamp.UTC().Format(time.RFC3339),
+		})
+		count++
+	}
+	return count
+}
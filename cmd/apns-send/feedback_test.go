@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestPrintFeedbackShouldWriteJSONLines(t *testing.T) {
+	entries := make(chan apns.FeedbackEntry, 2)
+	entries <- apns.FeedbackEntry{Token: "01ab", Timestamp: time.Unix(1700000000, 0)}
+	entries <- apns.FeedbackEntry{Token: "02cd", Timestamp: time.Unix(1700000060, 0)}
+	close(entries)
+
+	var out bytes.Buffer
+	if count := printFeedback(&out, entries); count != 2 {
+		t.Errorf("Expected 2 entries but printed %v", count)
+	}
+	expected := `{"token":"01ab","timestamp":"2023-11-14T22:13:20Z"}` + "\n" +
+		`{"token":"02cd","timestamp":"2023-11-14T22:14:20Z"}` + "\n"
+	if out.String() != expected {
+		t.Errorf("Expected\n%v\nbut got\n%v", expected, out.String())
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func runInspectCert(args []string) error {
+	flags := flag.NewFlagSet("inspect-cert", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: apns-send inspect-cert <cert.pem>")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	certificateBytes, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	info, err := apns.ParseCertificateInfo(certificateBytes)
+	if err != nil {
+		return err
+	}
+	printCertificateInfo(os.Stdout, info, time.Now())
+	return nil
+}
+
+//Print a certificate's details, with its expiry relative to now
+func printCertificateInfo(w io.Writer, info *apns.CertificateInfo, now time.Time) {
+	var environments []string
+	if info.Sandbox {
+		environments = append(environments, "sandbox")
+	}
+	if info.Production {
+		environments = append(environments, "production")
+	}
+	environment := strings.Join(environments, ", ")
+	if info.Universal() {
+		environment += " (universal)"
+	} else if environment == "" {
+		environment = "none (not a push certificate?)"
+	}
+
+	days := int(info.NotAfter.Sub(now).Hours() / 24)
+	expiry := fmt.Sprintf("in %v days", days)
+	if now.After(info.NotAfter) {
+		expiry = fmt.Sprintf("EXPIRED %v days ago", -days)
+	} else if now.Before(info.NotBefore) {
+		expiry = "not valid until " + info.NotBefore.UTC().Format(time.RFC3339)
+	}
+
+	fmt.Fprintf(w, "subject:     %v\n", info.CommonName)
+	fmt.Fprintf(w, "bundle id:   %v\n", info.BundleID)
+	fmt.Fprintf(w, "topics:      %v\n", strings.Join(info.Topics, ", "))
+	fmt.Fprintf(w, "environment: %v\n", environment)
+	fmt.Fprintf(w, "expires:     %v (%v)\n", info.NotAfter.UTC().Format(time.RFC3339), expiry)
+}
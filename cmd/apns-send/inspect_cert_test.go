@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+func TestPrintCertificateInfoShouldShowEnvironmentAndExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	info := &apns.CertificateInfo{
+		CommonName: "Apple Push Services: com.example.app",
+		BundleID:   "com.example.app",
+		Topics:     []string{"com.example.app", "com.example.app.voip"},
+		Sandbox:    true,
+		Production: true,
+		NotBefore:  now.AddDate(-1, 0, 0),
+		NotAfter:   now.AddDate(0, 0, 30),
+	}
+	var out bytes.Buffer
+	printCertificateInfo(&out, info, now)
+	for _, expected := range []string{
+		"topics:      com.example.app, com.example.app.voip",
+		"environment: sandbox, production (universal)",
+		"expires:     2026-10-31T00:00:00Z (in 30 days)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q but got\n%v", expected, out.String())
+		}
+	}
+
+	info.Sandbox = false
+	out.Reset()
+	printCertificateInfo(&out, info, now.AddDate(0, 0, 32))
+	if !strings.Contains(out.String(), "environment: production\n") ||
+		!strings.Contains(out.String(), "EXPIRED 2 days ago") {
+		t.Errorf("Expected an expired production certificate but got\n%v", out.String())
+	}
+}
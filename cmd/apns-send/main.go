@@ -0,0 +1,61 @@
+//Command line tool for sending push notifications from scripts and by hand
+//
+//	apns-send bulk -dsn "apns://sandbox?cert=cert.pem&key=key.pem" -alert "Hi {{.name}}" rows.csv
+//	apns-send inspect-cert cert.pem
+//	apns-send feedback -dsn "apns://sandbox?cert=cert.pem&key=key.pem" > removed.ndjson
+//	apns-send mock -addr 0.0.0.0:2195 -hosts staging-apns.internal -error-tokens
+//	apns-send validate -f payload.json
+//
+//Run a command with -h for its flags
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+//A subcommand
+type command struct {
+	//one line description for the usage message
+	summary string
+	//run with the arguments after the command's name
+	run func(args []string) error
+}
+
+var commands = map[string]*command{
+	"bulk":         {"send a templated payload to every row of a CSV or NDJSON file", runBulk},
+	"feedback":     {"print the tokens the feedback service reports as JSON lines", runFeedback},
+	"inspect-cert": {"print a certificate's topics, environments and expiry", runInspectCert},
+	"mock":         {"run the mock gateway, e.g. for staging", runMock},
+	"validate":     {"check a payload file and show the bytes it would be sent as", runValidate},
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]].run(os.Args[2:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+//Print the commands to stderr
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apns-send <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14v %v\n", name, commands[name].summary)
+	}
+}
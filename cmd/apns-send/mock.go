@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func runMock(args []string) error {
+	flags := flag.NewFlagSet("mock", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:2195", "address to listen on")
+	hosts := flags.String("hosts", "", "comma separated host names or IPs clients connect with, besides localhost and 127.0.0.1")
+	errorTokens := flags.Bool("error-tokens", false, "respond to tokens made with apnstest.ErrorToken with the Apple error they ask for")
+	dir := flags.String("out", ".", "directory ca.pem, cert.pem and key.pem are written to")
+	verbose := flags.Bool("v", false, "print every notification read")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: apns-send mock [flags]")
+		fmt.Fprintln(flags.Output(), "\nRuns the mock gateway until interrupted")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	config := &apnstest.ServerConfig{Addr: *addr, ErrorTokens: *errorTokens}
+	if *hosts != "" {
+		config.Hosts = strings.Split(*hosts, ",")
+	}
+	var log io.Writer
+	if *verbose {
+		log = os.Stdout
+	}
+	server, err := startMock(config, *dir, log)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Addr())
+	fmt.Printf("mock gateway listening on %v\n", server.Addr())
+	fmt.Printf("connect with apns://<host>:%v?cert=%v&key=%v\n", port,
+		filepath.Join(*dir, "cert.pem"), filepath.Join(*dir, "key.pem"))
+	fmt.Printf("and APNSConfig.RootCAs holding %v\n", filepath.Join(*dir, "ca.pem"))
+	if *errorTokens {
+		fmt.Printf("tokens ending in 0008 get INVALID_TOKEN, see apnstest.ErrorToken\n")
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	<-interrupted
+	fmt.Printf("read %v notifications\n", server.Received())
+	return nil
+}
+
+//Start the mock gateway and write the CA and client credentials it accepts to dir
+//Notifications read are printed to log, unless it's nil
+func startMock(config *apnstest.ServerConfig, dir string, log io.Writer) (*apnstest.Server, error) {
+	server, err := apnstest.NewServer(config)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := server.Config()
+	for name, b := range map[string][]byte{
+		"ca.pem":   server.RootCAPEM(),
+		"cert.pem": clientConfig.CertificateBytes,
+		"key.pem":  clientConfig.KeyBytes,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			server.Close()
+			return nil, err
+		}
+	}
+	if log != nil {
+		server.SetNotificationHandler(func(n *apnstest.Notification) {
+			fmt.Fprintf(log, "%v id %v priority %v %s\n", n.Token, n.ID, n.Priority, n.Payload)
+		})
+	}
+	return server, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func TestMockShouldAcceptClientsUsingTheWrittenCredentials(t *testing.T) {
+	dir := t.TempDir()
+	server, err := startMock(&apnstest.ServerConfig{Addr: "127.0.0.1:0"}, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	read := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(read("ca.pem")) {
+		t.Fatal("Expected ca.pem to hold the CA")
+	}
+	host, port, _ := net.SplitHostPort(server.Addr())
+	conn, err := apns.NewAPNSConnection(&apns.APNSConfig{
+		GatewayHost:      host,
+		GatewayPort:      port,
+		CertificateBytes: read("cert.pem"),
+		KeyBytes:         read("key.pem"),
+		RootCAs:          rootCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	conn.SendChannel <- &apns.Payload{Token: strings.Repeat("ab", 32), AlertText: "hi"}
+	deadline := time.Now().Add(time.Second)
+	for server.Received() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if server.Received() != 1 {
+		t.Errorf("Expected the mock to read the notification but it read %v", server.Received())
+	}
+}
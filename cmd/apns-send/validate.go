@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/frame"
+)
+
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	path := flags.String("f", "", "payload file, an apns.Payload as JSON, e.g. {\"Token\": \"...\", \"AlertText\": \"hi\"} : required")
+	maxPayloadSize := flags.Int("max-payload", 2048, "max number of bytes allowed in the payload (see APNSConfig.MaxPayloadSize)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: apns-send validate -f payload.json")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	b, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	if !validatePayload(os.Stdout, b, *maxPayloadSize, time.Now()) {
+		return errors.New("Payload is invalid")
+	}
+	return nil
+}
+
+//Print a payload file's errors, warnings, size and the frame it would be sent in
+//Returns false if the payload can't be sent
+func validatePayload(w io.Writer, b []byte, maxPayloadSize int, now time.Time) bool {
+	payload := &apns.Payload{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		fmt.Fprintf(w, "error:   %v\n", err)
+		return false
+	}
+
+	var errs, warnings []string
+	token, err := hex.DecodeString(payload.Token)
+	if payload.Token == "" {
+		warnings = append(warnings, "no Token, so no frame is shown")
+	} else if err != nil {
+		errs = append(errs, fmt.Sprintf("%v : %v", apns.ErrBadTokenEncoding, err))
+	} else if len(token) != apns.APNS_TOKEN_SIZE {
+		errs = append(errs, fmt.Sprintf("%v. Was %v bytes but should have been %v bytes",
+			apns.ErrBadTokenLength, len(token), apns.APNS_TOKEN_SIZE))
+	}
+
+	payloadBytes, err := payload.Marshal(maxPayloadSize)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else if size, _ := payload.EstimateSize(); size > maxPayloadSize {
+		warnings = append(warnings, fmt.Sprintf("%v bytes before truncation, the alert text is cut to fit %v",
+			size, maxPayloadSize))
+	} else if maxPayloadSize-size < maxPayloadSize/10 {
+		warnings = append(warnings, fmt.Sprintf("only %v bytes under the max, longer alerts will be truncated",
+			maxPayloadSize-size))
+	}
+
+	//lint the aps dictionary as it would be sent, web and MDM pushes don't have one
+	var sent struct {
+		APS map[string]interface{} `json:"aps"`
+	}
+	hasAPS := payload.PushType != apns.PUSH_TYPE_WEBPUSH && payload.PushType != apns.PUSH_TYPE_MDM
+	if payloadBytes != nil && hasAPS && json.Unmarshal(payloadBytes, &sent) == nil {
+		_, hasAlert := sent.APS["alert"]
+		_, hasContentAvailable := sent.APS["content-available"]
+		if len(sent.APS) == 0 && payload.PushType != apns.PUSH_TYPE_FILEPROVIDER {
+			warnings = append(warnings, "empty aps dictionary, the device does nothing with it")
+		}
+		if hasContentAvailable && !hasAlert && payload.Priority == 10 {
+			warnings = append(warnings, "background (ContentAvailable without an alert) pushes should be Priority 5, Apple may throttle them at 10")
+		}
+	}
+	if payload.ExpirationTime != apns.NoExpiration && payload.ExpirationTime != apns.ExpireImmediately &&
+		int64(payload.ExpirationTime) < now.Unix() {
+		warnings = append(warnings, fmt.Sprintf("ExpirationTime %v has passed, Apple won't store it if the device is offline",
+			time.Unix(int64(payload.ExpirationTime), 0).UTC().Format(time.RFC3339)))
+	}
+
+	for _, e := range errs {
+		fmt.Fprintf(w, "error:   %v\n", e)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "warning: %v\n", warning)
+	}
+	if payloadBytes == nil {
+		return false
+	}
+	fmt.Fprintf(w, "size:    %v of %v bytes\n", len(payloadBytes), maxPayloadSize)
+	fmt.Fprintf(w, "payload: %s\n", payloadBytes)
+	if len(errs) == 0 && len(token) == apns.APNS_TOKEN_SIZE {
+		expirationTime, expireImmediately := payload.FrameExpiration(now)
+		notification := &frame.Notification{
+			Token:             token,
+			Payload:           payloadBytes,
+			ID:                1,
+			ExpirationTime:    expirationTime,
+			ExpireImmediately: expireImmediately,
+			Priority:          payload.Priority,
+		}
+		b := frame.AppendNotification(nil, notification)
+		fmt.Fprintf(w, "frame:   (as the first notification on a connection)\n%v\n%x\n", frame.Dump(b, nil), b)
+	}
+	return len(errs) == 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePayloadShouldReportSizeWarningsAndFrame(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	token := strings.Repeat("ab", 32)
+	var out bytes.Buffer
+	valid := validatePayload(&out, []byte(`{"Token": "`+token+`", "ContentAvailable": 1, "Priority": 10,
+		"ExpirationTime": 1700000000}`), 2048, now)
+	if !valid {
+		t.Errorf("Expected the payload to be valid but got\n%v", out.String())
+	}
+	for _, expected := range []string{
+		"warning: background (ContentAvailable without an alert) pushes should be Priority 5",
+		"warning: ExpirationTime 2023-11-14T22:13:20Z has passed",
+		`size:    31 of 2048 bytes`,
+		`payload: {"aps":{"content-available":1}}`,
+		"item 1  01 0020 " + token,
+		"item 5  05 0001 0a",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q but got\n%v", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	valid = validatePayload(&out, []byte(`{"Token": "abc", "AlertText": "`+strings.Repeat("x", 100)+`", "Sound": "a/b.caf"}`),
+		64, now)
+	if valid {
+		t.Errorf("Expected the payload to be invalid but got\n%v", out.String())
+	}
+	for _, expected := range []string{"error:   Token is not hex encoded", "error:   Invalid sound name"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q but got\n%v", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if validatePayload(&out, []byte(`{"Tokn": "ab"}`), 2048, now) || !strings.Contains(out.String(), "unknown field") {
+		t.Errorf("Expected misspelled fields to be an error but got\n%v", out.String())
+	}
+}
@@ -3,16 +3,23 @@
 package apns
 
 import (
-	"bytes"
 	"container/list"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"runtime/pprof"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/joekarl/go-libapns/frame"
 )
 
 //Config for creating an APNS Connection
@@ -23,10 +30,13 @@ type APNSConfig struct {
 	FramingTimeout int
 	//max number of bytes allowed in payload, defaults to 2048
 	MaxPayloadSize int
-	//bytes for cert.pem : required
+	//bytes for cert.pem : required unless Credentials is supplied
 	CertificateBytes []byte
-	//bytes for key.pem : required
+	//bytes for key.pem : required unless Credentials is supplied
 	KeyBytes []byte
+	//TLS setup shared with feedback and HTTP/2 clients, replaces CertificateBytes,
+	//KeyBytes and RootCAs when supplied, defaults to none
+	Credentials *Credentials
 	//apple gateway, defaults to "gateway.push.apple.com"
 	GatewayHost string
 	//apple gateway port, defaults to "2195"
@@ -38,18 +48,183 @@ type APNSConfig struct {
 	SocketTimeout int
 	//number of seconds to wait for Tls handshake to complete before bailing, defaults to no timeout
 	TlsTimeout int
+	//number of milliseconds the whole dial (DNS lookup, TCP connect and TLS handshake)
+	//may take, defaults to 0 (only SocketTimeout and TlsTimeout apply)
+	DialTimeout int
+	//number of milliseconds after a payload is written without Apple rejecting it
+	//before SendR reports it as accepted, defaults to 5000
+	AcceptanceWindow int
+	//remove payloads from the in flight buffer once AcceptanceWindow has passed
+	//since they were written, so it holds only the payloads Apple may still reject
+	//rather than the last InFlightPayloadBufferSize, defaults to false
+	//an error for a pruned payload is reported as UnsentPayloadBufferOverflow
+	PruneInFlightPayloads bool
+	//called once for each payload the connection concludes Apple accepted, as
+	//the binary protocol only reports errors: when it's pushed out of the
+	//in flight buffer, when Apple rejects a later payload, or when the
+	//connection is disconnected without an error
+	//called from the connection's go-routines so it must not block on the connection
+	//defaults to none
+	OnAccepted func(payload *Payload)
+	//called once every payload in a frame written to the socket has been
+	//accepted or rejected by Apple, in the order frames were written, so
+	//upstream systems can persist how far they've got (see Checkpoint)
+	//called from the connection's go-routines so it must not block on the connection
+	//defaults to none
+	OnCheckpoint func(checkpoint *Checkpoint)
+	//number of milliseconds during which a payload identical to one already written
+	//(same token, JSON and CollapseID) is dropped, defaults to 0 (disabled)
+	DuplicateSuppressionWindow int
+	//durable store payloads are written to before being sent, defaults to none
+	OutboxStore OutboxStore
+	//receives a record of what became of every payload the connection takes,
+	//e.g. for audit trails, defaults to none
+	AuditSink AuditSink
+	//topic recorded for each payload in AuditSink records, defaults to the
+	//bundle id of the connection's certificate
+	AuditTopic func(payload *Payload) string
+	//called with payloads that are rejected before being sent (bad token, too large, etc)
+	//called from the connection's send go-routine so it must not block on the connection
+	//defaults to logging the error at LOG_LEVEL_WARN
+	OnPayloadError func(err *PayloadError)
+	//handlers called when the connection closes with an error, keyed by error code
+	//(see APPLE_PUSH_RESPONSES, CONNECTION_CLOSED_UNKNOWN), defaults to none
+	ErrorHandlers map[uint8]AppleErrorHandler
+	//feed that tokens Apple returns INVALID_TOKEN for are reported to, defaults to none
+	InvalidTokenFeed *InvalidTokenFeed
+	//converts payloads to JSON, defaults to DefaultPayloadMarshaler
+	PayloadMarshaler PayloadMarshaler
+	//generate a UUID for payloads sent without one, defaults to false
+	GeneratePayloadUUIDs bool
+	//makes the UUIDs given to payloads without one, defaults to random (version 4) UUIDs
+	//for reproducible UUIDs in tests and replay tooling
+	GenerateUUID func() (string, error)
+	//source of the message ids payloads are framed with, defaults to counting
+	//from 1 on each connection
+	//see MessageIDRange for partitioning ids between senders
+	MessageIDs MessageIDGenerator
+	//functions wrapped around queueing each payload received on SendChannel, defaults to none
+	//the first wraps all the others, see SendMiddleware
+	SendMiddleware []SendMiddleware
+	//functions wrapped around delivering payload errors and connection closes, defaults to none
+	//the first wraps all the others, see ResultInterceptor
+	ResultInterceptors []ResultInterceptor
+	//called with each payload just before it's marshalled, e.g. to vary alert copy for an experiment
+	//changes are made to the payload sent, so copy shared CustomFields maps before changing them
+	//called from the connection's send go-routine, defaults to none
+	OnBeforeMarshal func(payload *Payload)
+	//order payloads waiting for the framing timeout are written in, defaults to QUEUE_ORDER_FIFO
+	//QUEUE_ORDER_PRIORITY writes priority 10 and default priority payloads first, QUEUE_ORDER_EXPIRATION the closest to expiring
+	QueueOrder QueueOrder
+	//write payloads in exactly the order they're taken from SendChannel, defaults to false
+	//QueueOrder must be QUEUE_ORDER_FIFO, and marshalling stays on the send go-routine
+	//even if it's ever done in parallel otherwise
+	//the order holds per connection, a pool spreads payloads over several
+	StrictOrdering bool
+	//number of milliseconds without a payload being sent after which the connection
+	//disconnects itself, defaults to 0 (disabled)
+	//Apple and intermediaries drop idle connections, see Supervisor for redialing on the next send
+	IdleTimeout int
+	//wraps the connection's socket (after the TLS handshake), defaults to none
+	//for injecting latency, partial writes or resets in tests
+	WrapConn func(net.Conn) net.Conn
+	//source of the time and timers for framing timeouts, acceptance windows,
+	//idle timeouts and expirations, defaults to SystemClock
+	//for driving the connection from tests without real sleeps
+	Clock Clock
+	//certificate authorities the gateway's certificate is verified against,
+	//defaults to the system's (set to a test gateway's, see apnstest)
+	RootCAs *x509.CertPool
+	//print a hex dump of the frame Apple returned an error for, or of the frames
+	//being written when a write fails, defaults to false
+	//device tokens are masked to their first 6 characters (or hashed, see TokenRedaction)
+	DumpFramesOnError bool
+	//re-parse frames with the frame package before writing them, closing the
+	//connection with a WriteError (see ErrCorruptFrame) if they don't match the
+	//payloads framed, so encoding bugs show up in development rather than as
+	//INVALID_PAYLOAD_SIZE from Apple, defaults to false
+	VerifyFrames bool
+	//how device tokens are shown in log lines and PayloadError strings,
+	//defaults to TOKEN_REDACTION_NONE (in full)
+	TokenRedaction TokenRedaction
+	//where log lines go, defaults to StdoutLogger
+	Logger Logger
+	//most verbose level logged, defaults to LOG_LEVEL_ERROR
+	//which logs nothing while payloads are being sent successfully
+	LogLevel LogLevel
 }
 
+//Handler for an error returned by Apple
+//payload is the payload that caused the error, or nil if it couldn't be found
+type AppleErrorHandler func(err *AppleError, payload *Payload)
+
+//Returned from SendWithContext and SendR when the connection closes before the payload is written
+var ErrConnectionClosed = errors.New("Connection closed before the payload was written")
+
+//Returned in a WriteError when frames fail their check before being written (see APNSConfig.VerifyFrames)
+var ErrCorruptFrame = errors.New("Frames failed their integrity check")
+
 //Object returned on a connection close or connection error
 type ConnectionClose struct {
-	//Any payload objects that weren't sent after a connection close
-	UnsentPayloads *list.List
+	//Any payload objects that weren't sent after a connection close, oldest first
+	UnsentPayloads []*Payload
 	//The error details returned from Apple
 	Error *AppleError
 	//The payload object that caused the error
 	ErrorPayload *Payload
+	//Message ID the error payload was sent with, 0 if there's no error payload
+	ErrorPayloadID uint32
+	//Number of payloads written on the connection before the error payload,
+	//-1 if there's no error payload
+	//Payloads written after it are at the front of UnsentPayloads
+	ErrorPayloadPosition int
+	//Message ID each of UnsentPayloads was sent with, in the same order
+	//0 for payloads that were still queued and never written
+	UnsentPayloadIDs []uint32
 	//True if error payload wasn't found indicating some unsent payloads were lost
 	UnsentPayloadBufferOverflow bool
+	//When the connection was opened
+	OpenedAt time.Time
+	//When the connection closed
+	ClosedAt time.Time
+	//Number of payloads written to the socket over the life of the connection
+	PayloadsSent uint64
+	//Number of bytes written to the socket over the life of the connection
+	BytesWritten uint64
+	//The raw error response read from Apple, nil if the socket closed without one
+	ErrorFrame []byte
+	//Id of the connection that closed (see APNSConnection.ID)
+	ConnectionID string
+	//Transport the connection sent payloads with
+	Transport Transport
+	//The connection and timing ErrorPayload was sent with, nil if there's no error payload
+	ErrorPayloadMetadata *SendMetadata
+	//True if the connection disconnected itself after IdleTimeout
+	Idle bool
+	//The failed write that broke the connection, nil if every write succeeded
+	WriteError *WriteError
+}
+
+//A write of frames to the socket which failed part way through
+//The stream is broken after it, Apple can't find the start of the next frame
+type WriteError struct {
+	//Number of bytes of the frames written before the write failed
+	Written int
+	//Number of bytes being written
+	Size int
+	//Error from the socket, io.ErrShortWrite if it wrote nothing without one
+	//Left out of JSON, see ErrorString
+	Err error `json:"-"`
+	//Err's message
+	ErrorString string
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Error writing to socket after %v of %v bytes : %v", e.Written, e.Size, e.ErrorString)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
 }
 
 //Details from Apple regarding a connection close
@@ -60,6 +235,24 @@ type AppleError struct {
 	ErrorCode uint8
 	//String name of error code
 	ErrorString string
+	//UUID of the payload that caused the error, if it had one
+	PayloadUUID string
+	//Set when ErrorCode isn't in APPLE_PUSH_RESPONSES, nil otherwise
+	Unknown *UnknownAppleError
+}
+
+//Error code Apple returned which isn't in APPLE_PUSH_RESPONSES, e.g. one added
+//after this package was written
+//Found with errors.As on an AppleError, so new codes can be logged and reported
+type UnknownAppleError struct {
+	//Error code returned by Apple
+	ErrorCode uint8
+	//The error response frame read from the socket
+	Frame []byte
+}
+
+func (e *UnknownAppleError) Error() string {
+	return fmt.Sprintf("UNKNOWN_ERROR_CODE_%v", e.ErrorCode)
 }
 
 //APNS Connection state
@@ -72,20 +265,108 @@ type APNSConnection struct {
 	socket net.Conn
 	//config
 	config *APNSConfig
+	//Where log lines go, config.Logger or StdoutLogger
+	logger Logger
+	//Id the connection's go-routines are labelled with in profiles
+	id string
 	//Buffer to hold payloads for replay
 	inFlightPayloadBuffer *list.List
 	//Stateful buffer to hold framed byte data
-	inFlightFrameByteBuffer *bytes.Buffer
-	//Stateful buffer to hold data while generating item bytes
-	inFlightItemByteBuffer *bytes.Buffer
+	//preallocated to maxFrameSize and reused so framing doesn't allocate
+	inFlightFrameBuffer []byte
+	//Max number of bytes to buffer before writing to the socket
+	maxFrameSize int
 	//Mutex to sync access to Frame byte buffer
 	inFlightBufferLock *sync.Mutex
-	//Stateful counter to identify payloads for replay
+	//Payloads in the frame buffer, stamped with when they're written
+	framedIDPayloads []*idPayload
+	//Stateful counter to identify payloads for replay, unless config.MessageIDs is set
 	payloadIdCounter uint32
+	//Number of payloads buffered, for the position of an error payload
+	payloadsBuffered int
 	// Mutex to sync during disconnect
 	disconnectLock *sync.Mutex
 	// Boolean saying we're disconnecting
 	disconnecting bool
+	//Filter for dropping duplicate payloads, nil if disabled
+	//Guarded by inFlightBufferLock
+	duplicateFilter *duplicateFilter
+	//Number of payloads dropped as duplicates
+	duplicatesSuppressed atomic.Uint64
+	//Payloads waiting for the framing timeout before being written
+	sendQueue *sendQueue
+	//Number of queued payloads replaced by a newer one with the same CollapseID
+	payloadsCollapsed atomic.Uint64
+	//Channel Disconnect uses to have the send go-routine write out the queue
+	drainChannel chan chan bool
+	//Channel Flush uses to have the send go-routine write out the queue and buffer
+	flushChannel chan chan bool
+	//Channel Cancel uses to have the send go-routine remove a queued payload
+	cancelChannel chan *cancelRequest
+	//Channel SendWithContext hands payloads to the send go-routine on
+	contextSendChannel chan *contextSendRequest
+	//Channels SendR callers are waiting on
+	results *resultWaiters
+	//The payload queuePayload last added to the send queue, so the send
+	//go-routine can tell when one was dropped
+	//only touched by the send go-routine
+	lastQueued *Payload
+	//Channel Pause and Resume use to tell the send go-routine to stop or start writing
+	pauseChannel chan bool
+	//Closed once the send go-routine stops taking payloads
+	sendStoppedChannel chan bool
+	//queuePayload wrapped in the configured SendMiddleware
+	send SendFunc
+	//deliverResult wrapped in the configured ResultInterceptors
+	deliver ResultFunc
+	//config.Clock, or SystemClock
+	clock Clock
+	//When the connection was opened
+	openedAt time.Time
+	//Number of payloads in the frame buffer
+	framedPayloads int
+	//Number of payloads written to the socket
+	payloadsSent atomic.Uint64
+	//Number of bytes written to the socket
+	bytesWritten atomic.Uint64
+	//Length of inFlightPayloadBuffer, so it can be read from other go-routines
+	inFlightCount atomic.Int64
+	//When the frame buffer was last written to the socket, in unix nanoseconds
+	lastFlush atomic.Int64
+	//Boolean saying we disconnected after IdleTimeout
+	//only touched by the send go-routine
+	idleClosed bool
+	//Set to 1 once a write to the socket has failed
+	writeFailed int32
+	//The write that failed, guarded by inFlightBufferLock
+	writeError *WriteError
+	//Topic recorded in audit records without an AuditTopic, the certificate's bundle id
+	auditTopic string
+	//Number of frames written, and those waiting for OnCheckpoint oldest first,
+	//guarded by inFlightBufferLock
+	framesFlushed    uint64
+	checkpointFrames []*checkpointFrame
+	//The raw error response read from Apple, set before the close listener
+	//passes the error on
+	errorFrame []byte
+}
+
+//Request for the send go-routine to cancel a queued payload
+type cancelRequest struct {
+	//UUID of the payload to cancel
+	uuid string
+	//Receives whether the payload was cancelled
+	cancelled chan bool
+}
+
+//Request for the send go-routine to take a payload from SendWithContext
+type contextSendRequest struct {
+	payload *Payload
+	//Receives the payload's PayloadError, or nil once it's been queued
+	taken chan error
+	//Receives why the payload left the queue (see sendQueue.watch),
+	//nil if it already has, set before taken receives
+	dequeued <-chan error
 }
 
 //Wrapper for associating an ID with a Payload object
@@ -94,6 +375,19 @@ type idPayload struct {
 	Payload *Payload
 	//The numerical id (from payloadIdCounter) for replay identification
 	ID uint32
+	//Number of payloads buffered on the connection before this one
+	Position int
+	//When the payload was queued
+	QueuedAt time.Time
+	//When the frame holding the payload was written to the socket
+	//set under inFlightBufferLock
+	FlushedAt time.Time
+	//The frame the payload was written in and whether Apple has accepted or
+	//rejected it, only kept for OnCheckpoint, guarded by inFlightBufferLock
+	frame     *checkpointFrame
+	confirmed bool
+	//Hash of the JSON the payload was framed with, only kept for AuditSink
+	payloadHash string
 }
 
 const (
@@ -101,7 +395,7 @@ const (
 	TCP_FRAME_MAX = 65535
 	//Number of bytes used in the Apple Notification Header
 	//command is 1 byte, frame length is 4 bytes
-	NOTIFICATION_HEADER_SIZE = 5
+	NOTIFICATION_HEADER_SIZE = frame.HEADER_SIZE
 	//Size of token
 	APNS_TOKEN_SIZE = 32
 	// client shutdown via disconnect error code
@@ -110,6 +404,12 @@ const (
 	CONNECTION_CLOSED_UNKNOWN = 251
 )
 
+//Stateful counter to identify connections in profiles
+var connectionIdCounter uint64
+
+//Number of connection go-routines running, so tests can check none leak
+var connectionGoroutines int64
+
 // This enumerates the response codes that Apple defines
 // for push notification attempts.
 var APPLE_PUSH_RESPONSES = map[uint8]string{
@@ -133,11 +433,35 @@ func (e *AppleError) Error() string {
 	return e.ErrorString
 }
 
+//The UnknownAppleError if Apple returned a code this package doesn't know
+func (e *AppleError) Unwrap() error {
+	if e.Unknown == nil {
+		return nil
+	}
+	return e.Unknown
+}
+
+//AppleError for an error response frame, see UnknownAppleError for codes missing
+//from APPLE_PUSH_RESPONSES
+func newAppleError(errorFrame []byte) *AppleError {
+	appleError := &AppleError{
+		ErrorCode: errorFrame[1],
+		MessageID: binary.BigEndian.Uint32(errorFrame[2:]),
+	}
+	errorString, ok := APPLE_PUSH_RESPONSES[appleError.ErrorCode]
+	if !ok {
+		appleError.Unknown = &UnknownAppleError{ErrorCode: appleError.ErrorCode, Frame: errorFrame}
+		errorString = appleError.Unknown.Error()
+	}
+	appleError.ErrorString = errorString
+	return appleError
+}
+
 // Apply config defaults to given Config
 func applyConfigDefaults(config *APNSConfig) error {
 	errorStrs := ""
 
-	if config.CertificateBytes == nil || config.KeyBytes == nil {
+	if config.Credentials == nil && (config.CertificateBytes == nil || config.KeyBytes == nil) {
 		errorStrs += "Invalid Key/Certificate bytes\n"
 	}
 	if config.InFlightPayloadBufferSize < 0 {
@@ -149,6 +473,27 @@ func applyConfigDefaults(config *APNSConfig) error {
 	if config.MaxPayloadSize < 0 {
 		errorStrs += "Invalid MaxPayloadSize. Should be greater than 0.\n"
 	}
+	if config.DuplicateSuppressionWindow < 0 {
+		errorStrs += "Invalid DuplicateSuppressionWindow. Should be >= 0\n"
+	}
+	if config.IdleTimeout < 0 {
+		errorStrs += "Invalid IdleTimeout. Should be >= 0\n"
+	}
+	if config.DialTimeout < 0 {
+		errorStrs += "Invalid DialTimeout. Should be >= 0\n"
+	}
+	if config.StrictOrdering && config.QueueOrder != QUEUE_ORDER_FIFO {
+		errorStrs += "Invalid QueueOrder. Should be QUEUE_ORDER_FIFO with StrictOrdering\n"
+	}
+	if config.AcceptanceWindow < 0 {
+		errorStrs += "Invalid AcceptanceWindow. Should be >= 0\n"
+	}
+	if !config.TokenRedaction.valid() {
+		errorStrs += "Invalid TokenRedaction. Should be TOKEN_REDACTION_NONE, TOKEN_REDACTION_PREFIX or TOKEN_REDACTION_HASH\n"
+	}
+	if config.LogLevel < LOG_LEVEL_OFF || config.LogLevel > LOG_LEVEL_DEBUG {
+		errorStrs += "Invalid LogLevel. Should be between LOG_LEVEL_OFF and LOG_LEVEL_DEBUG\n"
+	}
 
 	if errorStrs != "" {
 		return errors.New(errorStrs)
@@ -175,6 +520,9 @@ func applyConfigDefaults(config *APNSConfig) error {
 	if config.TlsTimeout == 0 {
 		config.TlsTimeout = 5
 	}
+	if config.AcceptanceWindow == 0 {
+		config.AcceptanceWindow = 5000
+	}
 	return nil
 }
 
@@ -182,23 +530,37 @@ func applyConfigDefaults(config *APNSConfig) error {
 //If invalid config an error will be returned
 //See APNSConfig object for defaults
 func NewAPNSConnection(config *APNSConfig) (*APNSConnection, error) {
+	return NewAPNSConnectionContext(context.Background(), config)
+}
+
+//Create a new apns connection, giving up on the dial if ctx is done before
+//the TCP connect and TLS handshake finish, so a hung DNS lookup or handshake
+//can't block startup indefinitely
+//Cancelling ctx once the connection is open has no effect on it
+func NewAPNSConnectionContext(ctx context.Context, config *APNSConfig) (*APNSConnection, error) {
 	err := applyConfigDefaults(config)
 
 	if err != nil {
 		return nil, err
 	}
 
-	tcpSocket, err := net.DialTimeout("tcp",
-		config.GatewayHost+":"+config.GatewayPort,
-		time.Duration(config.SocketTimeout)*time.Second)
+	if config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.DialTimeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(config.SocketTimeout) * time.Second}
+	tcpSocket, err := dialer.DialContext(ctx, "tcp", config.GatewayHost+":"+config.GatewayPort)
 	if err != nil {
 		//failed to connect to gateway
 		return nil, err
 	}
 
-	tlsSocket, err := createTLSClient(tcpSocket, config)
+	tlsSocket, err := createTLSClient(ctx, tcpSocket, config)
 
 	if err != nil {
+		tcpSocket.Close()
 		return nil, err
 	}
 
@@ -213,7 +575,7 @@ func SocketAPNSConnection(socket net.Conn, config *APNSConfig) (*APNSConnection,
 		return nil, err
 	}
 
-	tlsSocket, err := createTLSClient(socket, config)
+	tlsSocket, err := createTLSClient(context.Background(), socket, config)
 
 	if err != nil {
 		return nil, err
@@ -222,21 +584,16 @@ func SocketAPNSConnection(socket net.Conn, config *APNSConfig) (*APNSConnection,
 	return socketAPNSConnection(tlsSocket, config), nil
 }
 
-func createTLSClient(socket net.Conn, config *APNSConfig) (net.Conn, error) {
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+func createTLSClient(ctx context.Context, socket net.Conn, config *APNSConfig) (net.Conn, error) {
+	tlsConf, err := configCredentials(config.Credentials, config.CertificateBytes, config.KeyBytes,
+		config.RootCAs).TLSConfig(config.GatewayHost)
 	if err != nil {
-		//failed to validate key pair
 		return nil, err
 	}
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
-	}
-
 	tlsSocket := tls.Client(socket, tlsConf)
 	tlsSocket.SetDeadline(time.Now().Add(time.Duration(config.TlsTimeout) * time.Second))
-	err = tlsSocket.Handshake()
+	err = tlsSocket.HandshakeContext(ctx)
 	if err != nil {
 		//failed to handshake with tls information
 		return nil, err
@@ -255,29 +612,79 @@ func socketAPNSConnection(socket net.Conn, config *APNSConfig) *APNSConnection {
 	c := new(APNSConnection)
 	//TODO(karl): maybe should copy the config to prevent tampering?
 	c.config = config
+	c.logger = config.Logger
+	if c.logger == nil {
+		c.logger = StdoutLogger{}
+	}
+	if config.WrapConn != nil {
+		socket = config.WrapConn(socket)
+	}
 	c.inFlightPayloadBuffer = list.New()
+	if config.AuditSink != nil && config.AuditTopic == nil {
+		credentials := configCredentials(config.Credentials, config.CertificateBytes, config.KeyBytes, nil)
+		if info, err := ParseCertificateInfo(credentials.CertificateBytes); err == nil {
+			c.auditTopic = info.BundleID
+		}
+	}
 	c.socket = socket
 	c.SendChannel = make(chan *Payload)
 	c.CloseChannel = make(chan *ConnectionClose)
-	c.inFlightFrameByteBuffer = new(bytes.Buffer)
-	c.inFlightItemByteBuffer = new(bytes.Buffer)
+	c.maxFrameSize = config.MaxOutboundTCPFrameSize
+	if c.maxFrameSize <= 0 {
+		c.maxFrameSize = TCP_FRAME_MAX
+	}
+	c.inFlightFrameBuffer = make([]byte, 0, c.maxFrameSize)
+	c.clock = configClock(config.Clock)
+	c.openedAt = c.clock.Now()
 	c.inFlightBufferLock = new(sync.Mutex)
 	c.disconnectLock = new(sync.Mutex)
 	c.payloadIdCounter = 1
-	errCloseChannel := make(chan *AppleError)
+	c.sendQueue = newSendQueue(config.QueueOrder, c.clock)
+	c.drainChannel = make(chan chan bool)
+	c.flushChannel = make(chan chan bool)
+	c.cancelChannel = make(chan *cancelRequest)
+	c.contextSendChannel = make(chan *contextSendRequest)
+	c.results = newResultWaiters(c.clock)
+	c.pauseChannel = make(chan bool)
+	c.sendStoppedChannel = make(chan bool)
+	c.send = ChainSendMiddleware(c.queuePayload, config.SendMiddleware...)
+	c.deliver = ChainResultInterceptors(c.deliverResult, config.ResultInterceptors...)
+	if config.DuplicateSuppressionWindow > 0 {
+		c.duplicateFilter = newDuplicateFilter(
+			time.Duration(config.DuplicateSuppressionWindow) * time.Millisecond)
+	}
+	c.id = strconv.FormatUint(atomic.AddUint64(&connectionIdCounter, 1), 10)
+	//buffered so the close go-routine can always exit, even once the send
+	//go-routine has stopped listening
+	errCloseChannel := make(chan *AppleError, 1)
+	c.logf(LOG_LEVEL_INFO, "Connection to %v opened", config.GatewayHost)
 
-	go c.closeListener(errCloseChannel)
-	go c.sendListener(errCloseChannel)
+	go c.labelled("reader", func() { c.closeListener(errCloseChannel) })
+	go c.labelled("writer", func() { c.sendListener(errCloseChannel) })
 
 	return c
 }
 
+//Id of the connection, unique within the process
+//Used in ConnectionClose, SendMetadata and profile labels
+func (c *APNSConnection) ID() string {
+	return c.id
+}
+
 //Disconnect from the Apns Gateway
 //Flushes any currently unsent messages before disconnecting from the socket
+//The go-routine reading from the socket exits once the socket is closed
 func (c *APNSConnection) Disconnect() {
 	c.disconnectLock.Lock()
 	c.disconnecting = true
 	c.disconnectLock.Unlock()
+	//have the send go-routine buffer anything queued, unless it's already stopped
+	drained := make(chan bool)
+	select {
+	case c.drainChannel <- drained:
+		<-drained
+	case <-c.sendStoppedChannel:
+	}
 	//flush on disconnect
 	c.inFlightBufferLock.Lock()
 	c.flushBufferToSocket()
@@ -285,18 +692,176 @@ func (c *APNSConnection) Disconnect() {
 	c.noFlushDisconnect()
 }
 
+//Send a payload, honoring ctx until the payload is written to the socket
+//Blocks until the payload has been framed to be written, e.g. after the
+//framing timeout. If ctx is done first the payload is removed from the
+//queue and ctx.Err() is returned
+//Returns the payload's *PayloadError if it's rejected, ErrPayloadCollapsed or
+//ErrPayloadCancelled if it leaves the queue that way, and ErrConnectionClosed
+//if the connection closes before the payload is written
+//A UUID is generated for payloads without one, so they can be cancelled
+func (c *APNSConnection) SendWithContext(ctx context.Context, payload *Payload) error {
+	if payload.UUID == "" {
+		payload.UUID, _ = c.generateUUID()
+	}
+	request := &contextSendRequest{payload: payload, taken: make(chan error, 1)}
+	select {
+	case c.contextSendChannel <- request:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.sendStoppedChannel:
+		return ErrConnectionClosed
+	}
+	if err := <-request.taken; err != nil || request.dequeued == nil {
+		//rejected, or written (or dropped) straight away
+		return err
+	}
+
+	select {
+	case err := <-request.dequeued:
+		return err
+	case <-ctx.Done():
+		if c.Cancel(payload.UUID) {
+			return ctx.Err()
+		}
+		//too late, it left the queue in the meantime
+		return <-request.dequeued
+	}
+}
+
+//Send a payload, returning a channel which receives its result exactly once:
+//nil once AcceptanceWindow has passed since it was written without Apple
+//rejecting it (or once it's framed if it's dropped as a duplicate, or straight
+//away if it's dropped by SendMiddleware), otherwise why it failed. That's its *PayloadError if it's
+//rejected before being written, ErrPayloadCollapsed or ErrPayloadCancelled,
+//the *AppleError Apple returned for it, ErrConnectionClosed if the connection
+//closed before it was written or Apple discarded it after rejecting an earlier
+//payload, or the connection's *AppleError if the socket broke while it was in doubt
+//The channel is buffered, so it's fine to never read it
+//Blocks until the connection takes the payload, as sending on SendChannel does
+//Don't send the same *Payload again until its result has been received
+func (c *APNSConnection) SendR(payload *Payload) <-chan error {
+	result := c.results.add(payload)
+	select {
+	case c.SendChannel <- payload:
+	case <-c.sendStoppedChannel:
+		c.results.settle(payload, ErrConnectionClosed)
+	}
+	return result
+}
+
+//Write the payloads waiting for the framing timeout to the socket now,
+//e.g. at the end of a batch job, instead of waiting for the timer
+//Returns once they've been written. Does nothing while paused or once
+//the connection has closed
+func (c *APNSConnection) Flush() {
+	flushed := make(chan bool)
+	select {
+	case c.flushChannel <- flushed:
+		<-flushed
+	case <-c.sendStoppedChannel:
+	}
+}
+
+//Remove a payload which is still waiting for the framing timeout
+//The payload is identified by its UUID (see APNSConfig.GeneratePayloadUUIDs)
+//Returns false if there's no such payload, it's already been written to
+//the socket, or the connection has closed
+func (c *APNSConnection) Cancel(uuid string) bool {
+	if uuid == "" {
+		return false
+	}
+	//ask the send go-routine so payloads it has taken are always queued first
+	request := &cancelRequest{uuid: uuid, cancelled: make(chan bool, 1)}
+	select {
+	case c.cancelChannel <- request:
+		return <-request.cancelled
+	case <-c.sendStoppedChannel:
+		return false
+	}
+}
+
+//Stop writing payloads to Apple, e.g. during an Apple outage or while
+//rotating credentials
+//Payloads sent while paused are still taken (and appended to the OutboxStore)
+//but wait in the queue until Resume is called. If the connection closes
+//while paused, queued payloads are returned as UnsentPayloads
+func (c *APNSConnection) Pause() {
+	c.setPaused(true)
+}
+
+//Start writing payloads again, beginning with any queued while paused
+func (c *APNSConnection) Resume() {
+	c.setPaused(false)
+}
+
+//Tell the send go-routine to stop or start writing, unless it's already stopped
+func (c *APNSConnection) setPaused(paused bool) {
+	select {
+	case c.pauseChannel <- paused:
+	case <-c.sendStoppedChannel:
+	}
+}
+
+//Number of payloads waiting to be written
+func (c *APNSConnection) QueueDepth() int {
+	return c.sendQueue.len()
+}
+
+//How long the longest waiting payload has been queued, 0 if none are queued
+func (c *APNSConnection) OldestQueuedAge() time.Duration {
+	return c.sendQueue.oldestAge(c.clock.Now())
+}
+
+//Iterate over metadata for the payloads queued right now
+func (c *APNSConnection) QueueSnapshot() *QueueIterator {
+	return &QueueIterator{infos: c.sendQueue.snapshot(), current: -1}
+}
+
+//Run f with pprof labels naming the connection and the go-routine's role,
+//so CPU and goroutine profiles of busy services can be attributed to connections
+func (c *APNSConnection) labelled(role string, f func()) {
+	atomic.AddInt64(&connectionGoroutines, 1)
+	defer atomic.AddInt64(&connectionGoroutines, -1)
+	pprof.Do(context.Background(), pprof.Labels("apns_connection", c.id, "role", role),
+		func(context.Context) { f() })
+}
+
 //internal close socket
+//The read deadline unblocks the close go-routine's Read even if closing
+//doesn't (e.g. a WrapConn that doesn't pass Close through to a blocked Read)
 func (c *APNSConnection) noFlushDisconnect() {
+	c.socket.SetReadDeadline(time.Now())
 	c.socket.Close()
 }
 
 //go-routine to listen for socket closes or apple response information
+//Reads until a well formed error response arrives, waiting out short reads and
+//skipping bytes which can't start one, so garbage isn't mistaken for a message id
+//Only the first error response counts, apple stops processing after it
 func (c *APNSConnection) closeListener(errCloseChannel chan *AppleError) {
-	buffer := make([]byte, 6, 6)
-	_, err := c.socket.Read(buffer)
-	if err != nil {
+	buffer := make([]byte, 64)
+	var received []byte
+	var errorFrame []byte
+	var err error
+	for errorFrame == nil && err == nil {
+		var n int
+		n, err = c.socket.Read(buffer)
+		if n > 0 {
+			received = append(received, buffer[:n]...)
+		}
+		var skipped int
+		errorFrame, skipped = nextErrorResponse(received)
+		if skipped > 0 {
+			c.logf(LOG_LEVEL_WARN, "Skipped %v bytes which aren't an error response : %x", skipped, received[:skipped])
+			received = received[skipped:]
+		}
+	}
+	if errorFrame == nil {
 		c.disconnectLock.Lock()
-		if c.disconnecting {
+		//if a write failed the socket broke under us and payloads in flight
+		//are in doubt, even if we were disconnecting anyway
+		if c.disconnecting && atomic.LoadInt32(&c.writeFailed) == 0 {
 			errCloseChannel <- &AppleError{
 				ErrorCode:   CONNECTION_CLOSED_DISCONNECT, // closed due to disconnect
 				ErrorString: err.Error(),
@@ -311,13 +876,35 @@ func (c *APNSConnection) closeListener(errCloseChannel chan *AppleError) {
 		}
 		c.disconnectLock.Unlock()
 	} else {
-		messageId := binary.BigEndian.Uint32(buffer[2:])
-		errCloseChannel <- &AppleError{
-			ErrorString: APPLE_PUSH_RESPONSES[uint8(buffer[1])],
-			ErrorCode:   uint8(buffer[1]),
-			MessageID:   messageId,
+		c.errorFrame = errorFrame
+		errCloseChannel <- newAppleError(errorFrame)
+	}
+}
+
+//First complete error response in bytes read from apple, nil if there isn't one yet,
+//and the number of leading bytes which can't be part of one
+//A frame must have the error response command and a status other than the
+//internal CONNECTION_CLOSED_* codes, unknown statuses are passed on (see UnknownAppleError)
+func nextErrorResponse(b []byte) ([]byte, int) {
+	for i := 0; i < len(b); i++ {
+		if b[i] != frame.COMMAND_ERROR_RESPONSE {
+			continue
+		}
+		if i+1 == len(b) {
+			//wait for the status
+			return nil, i
 		}
+		status := b[i+1]
+		if status == CONNECTION_CLOSED_DISCONNECT || status == CONNECTION_CLOSED_UNKNOWN {
+			continue
+		}
+		if len(b)-i < frame.ERROR_RESPONSE_SIZE {
+			//wait for the message id
+			return nil, i
+		}
+		return append([]byte(nil), b[i:i+frame.ERROR_RESPONSE_SIZE]...), i
 	}
+	return nil, len(b)
 }
 
 //go-routine to listen for Payloads which should be sent
@@ -327,7 +914,76 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 	longTimeoutDuration := 5 * time.Minute
 	shortTimeoutDuration := time.Duration(c.config.FramingTimeout) * time.Millisecond
 	zeroTimeoutDuration := 0 * time.Millisecond
-	timeoutTimer := time.NewTimer(longTimeoutDuration)
+	timeoutTimer := c.clock.NewTimer(longTimeoutDuration)
+	//whether Pause has been called without Resume
+	paused := false
+	//fires after IdleTimeout without a payload, never if it's disabled
+	idleTimeoutDuration := time.Duration(c.config.IdleTimeout) * time.Millisecond
+	var idleTimer Timer
+	var idleChannel <-chan time.Time
+	if idleTimeoutDuration > zeroTimeoutDuration {
+		idleTimer = c.clock.NewTimer(idleTimeoutDuration)
+		idleChannel = idleTimer.Chan()
+	}
+	//fires five times per AcceptanceWindow, never if pruning is disabled
+	var pruneTicker Ticker
+	var pruneChannel <-chan time.Time
+	if c.config.PruneInFlightPayloads && c.config.AcceptanceWindow > 0 {
+		pruneTicker = c.clock.NewTicker(time.Duration(c.config.AcceptanceWindow) * time.Millisecond / 5)
+		pruneChannel = pruneTicker.Chan()
+	}
+
+	//queue a payload taken from SendChannel or SendWithContext, and write it
+	//now or schedule the framing timeout
+	//Returns the payload's PayloadError if it was rejected
+	takePayload := func(sendPayload *Payload) *PayloadError {
+		if idleTimer != nil {
+			idleTimer.Reset(idleTimeoutDuration)
+		}
+		if c.config.GeneratePayloadUUIDs && sendPayload.UUID == "" {
+			sendPayload.UUID, _ = c.generateUUID()
+		}
+		queueWasEmpty := c.sendQueue.len() == 0
+		c.lastQueued = nil
+		if err := c.send(sendPayload); err != nil {
+			var payloadErr *PayloadError
+			if !errors.As(err, &payloadErr) {
+				payloadErr = &PayloadError{Payload: sendPayload, Err: err}
+			}
+			c.results.settle(sendPayload, payloadErr)
+			c.payloadError(payloadErr)
+			return payloadErr
+		}
+		if c.lastQueued != sendPayload {
+			//dropped by middleware
+			c.results.settle(sendPayload, nil)
+			c.audit(sendPayload, "", AUDIT_OUTCOME_DROPPED, nil)
+		}
+		if c.sendQueue.len() == 0 {
+			//payload was dropped
+			return nil
+		}
+		if paused {
+			//wait for Resume
+			return nil
+		}
+
+		if shortTimeoutDuration > zeroTimeoutDuration {
+			//schedule short timeout when the queue starts filling,
+			//so payloads wait at most one timeout
+			if queueWasEmpty {
+				timeoutTimer.Reset(shortTimeoutDuration)
+			}
+		} else {
+			//buffer and flush to socket
+			c.drainSendQueue()
+			c.inFlightBufferLock.Lock()
+			c.flushBufferToSocket()
+			c.inFlightBufferLock.Unlock()
+			timeoutTimer.Reset(longTimeoutDuration)
+		}
+		return nil
+	}
 
 	for {
 		if appleError != nil {
@@ -337,54 +993,109 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 		case sendPayload := <-c.SendChannel:
 			if sendPayload == nil {
 				//channel was closed
+				close(c.sendStoppedChannel)
+				//let SendWithContext and SendR callers know their payloads won't be written
+				for p := c.sendQueue.popUnsent(); p != nil; p = c.sendQueue.popUnsent() {
+					c.results.settle(p, ErrConnectionClosed)
+					c.audit(p, "", AUDIT_OUTCOME_UNDELIVERED, ErrConnectionClosed)
+				}
 				return
 			}
-			idPayloadObj := &idPayload{
-				Payload: sendPayload,
-				ID:      c.payloadIdCounter,
+			takePayload(sendPayload)
+			break
+		case request := <-c.contextSendChannel:
+			if err := takePayload(request.payload); err != nil {
+				request.taken <- err
+			} else {
+				request.dequeued = c.sendQueue.watch(request.payload.UUID)
+				request.taken <- nil
 			}
-
-			// increment payload id counter but don't allow
-			// 0 as valid id as it is the null value
-			// only a problem if we overflow a uint32
-			c.payloadIdCounter++
-
-			if c.payloadIdCounter == 0 {
-				c.payloadIdCounter = 1
+			break
+		case <-timeoutTimer.Chan():
+			//buffer and flush to socket
+			if !paused {
+				c.drainSendQueue()
+				c.inFlightBufferLock.Lock()
+				c.flushBufferToSocket()
+				c.inFlightBufferLock.Unlock()
 			}
-
-			err := c.bufferPayload(idPayloadObj)
-			if err != nil {
-				fmt.Print(err)
-				break
+			timeoutTimer.Reset(longTimeoutDuration)
+			break
+		case flushed := <-c.flushChannel:
+			if !paused {
+				c.drainSendQueue()
+				c.inFlightBufferLock.Lock()
+				c.flushBufferToSocket()
+				c.inFlightBufferLock.Unlock()
+				timeoutTimer.Reset(longTimeoutDuration)
 			}
-
-			if shortTimeoutDuration > zeroTimeoutDuration {
-				//schedule short timeout
-				timeoutTimer.Reset(shortTimeoutDuration)
-			} else {
-				//flush buffer to socket
+			close(flushed)
+			break
+		case drained := <-c.drainChannel:
+			//paused payloads are left to be returned as unsent
+			if !paused {
+				c.drainSendQueue()
+			}
+			close(drained)
+			break
+		case paused = <-c.pauseChannel:
+			if !paused && c.sendQueue.len() > 0 {
+				//write out everything queued while paused
+				c.drainSendQueue()
 				c.inFlightBufferLock.Lock()
 				c.flushBufferToSocket()
 				c.inFlightBufferLock.Unlock()
 				timeoutTimer.Reset(longTimeoutDuration)
 			}
 			break
-		case <-timeoutTimer.C:
-			//flush buffer to socket
+		case <-idleChannel:
+			if c.sendQueue.len() > 0 {
+				//paused with payloads waiting, not idle
+				idleTimer.Reset(idleTimeoutDuration)
+				break
+			}
+			//disconnect as Disconnect would, the close arrives on errCloseChannel
+			c.disconnectLock.Lock()
+			c.disconnecting = true
+			c.disconnectLock.Unlock()
+			c.idleClosed = true
 			c.inFlightBufferLock.Lock()
 			c.flushBufferToSocket()
 			c.inFlightBufferLock.Unlock()
-			timeoutTimer.Reset(longTimeoutDuration)
+			c.noFlushDisconnect()
+			break
+		case <-pruneChannel:
+			c.pruneInFlightBuffer(c.clock.Now())
+			break
+		case request := <-c.cancelChannel:
+			cancelled := c.sendQueue.cancel(request.uuid)
+			if cancelled != nil {
+				c.settle(cancelled, ErrPayloadCancelled)
+				c.audit(cancelled, "", AUDIT_OUTCOME_DROPPED, ErrPayloadCancelled)
+			}
+			request.cancelled <- cancelled != nil
 			break
 		case appleError = <-errCloseChannel:
 			break
 		}
 	}
+	respondedAt := c.clock.Now()
+	timeoutTimer.Stop()
+	if idleTimer != nil {
+		idleTimer.Stop()
+	}
+	if pruneTicker != nil {
+		pruneTicker.Stop()
+	}
+	close(c.sendStoppedChannel)
 
 	// gather unsent payload objs
-	unsentPayloads := list.New()
+	unsentPayloads := []*Payload{}
+	unsentPayloadIDs := []uint32{}
+	unsentPayloadHashes := []string{}
 	var errorPayload *Payload
+	var errorPayloadMetadata *SendMetadata
+	errorPayloadPosition := -1
 	// only calculate unsent payloads if messageId is not empty
 	if appleError.ErrorCode != 0 &&
 			appleError.ErrorCode != CONNECTION_CLOSED_DISCONNECT &&
@@ -394,9 +1105,86 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 			if idPayloadObj.ID == appleError.MessageID {
 				//found error payload, keep track of it and remove from send buffer
 				errorPayload = idPayloadObj.Payload
+				errorPayloadPosition = idPayloadObj.Position
+				errorPayloadMetadata = c.sendMetadata(idPayloadObj.QueuedAt)
+				c.inFlightBufferLock.Lock()
+				errorPayloadMetadata.FlushedAt = idPayloadObj.FlushedAt
+				c.inFlightBufferLock.Unlock()
+				errorPayloadMetadata.RespondedAt = respondedAt
+				appleError.PayloadUUID = errorPayload.UUID
+				if appleError.ErrorCode == 10 {
+					//SHUTDOWN identifies the last payload apple accepted
+					c.accept(idPayloadObj)
+				} else {
+					c.settle(errorPayload, appleError)
+					c.audit(errorPayload, idPayloadObj.payloadHash, AUDIT_OUTCOME_REJECTED, appleError)
+					if c.config.DumpFramesOnError {
+						c.dumpPayloadFrame(idPayloadObj, appleError)
+					}
+				}
+				//anything before the error payload made it to apple
+				for e = e.Next(); e != nil; e = e.Next() {
+					c.accept(e.Value.(*idPayload))
+				}
+				//oldest first, so frames complete in order
+				for e = c.inFlightPayloadBuffer.Back(); e != nil; e = e.Prev() {
+					c.confirm(e.Value.(*idPayload))
+					if e.Value.(*idPayload) == idPayloadObj {
+						break
+					}
+				}
 				break
 			}
-			unsentPayloads.PushFront(idPayloadObj.Payload)
+			unsentPayloads = append(unsentPayloads, idPayloadObj.Payload)
+			unsentPayloadIDs = append(unsentPayloadIDs, idPayloadObj.ID)
+			unsentPayloadHashes = append(unsentPayloadHashes, idPayloadObj.payloadHash)
+		}
+	}
+	//the in flight buffer is newest first
+	for i, j := 0, len(unsentPayloads)-1; i < j; i, j = i+1, j-1 {
+		unsentPayloads[i], unsentPayloads[j] = unsentPayloads[j], unsentPayloads[i]
+		unsentPayloadIDs[i], unsentPayloadIDs[j] = unsentPayloadIDs[j], unsentPayloadIDs[i]
+		unsentPayloadHashes[i], unsentPayloadHashes[j] = unsentPayloadHashes[j], unsentPayloadHashes[i]
+	}
+	//payloads in flight were lost if the error payload wasn't found
+	unsentPayloadBufferOverflow := len(unsentPayloads) > 0 && errorPayload == nil
+
+	c.inFlightBufferLock.Lock()
+	writeError := c.writeError
+	c.inFlightBufferLock.Unlock()
+
+	//queued payloads were never written
+	for p := c.sendQueue.popUnsent(); p != nil; p = c.sendQueue.popUnsent() {
+		unsentPayloads = append(unsentPayloads, p)
+		unsentPayloadIDs = append(unsentPayloadIDs, 0)
+		unsentPayloadHashes = append(unsentPayloadHashes, "")
+	}
+
+	//everything in flight made it to apple if we closed the connection
+	if appleError.ErrorCode == CONNECTION_CLOSED_DISCONNECT {
+		for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
+			c.accept(e.Value.(*idPayload))
+		}
+		for e := c.inFlightPayloadBuffer.Back(); e != nil; e = e.Prev() {
+			c.confirm(e.Value.(*idPayload))
+		}
+	}
+	c.closeCheckpoints()
+
+	//SendR results for payloads which weren't accepted, anything in flight
+	//still unsettled is in doubt because the socket broke
+	for i, p := range unsentPayloads {
+		c.results.settle(p, ErrConnectionClosed)
+		c.audit(p, unsentPayloadHashes[i], AUDIT_OUTCOME_UNDELIVERED, ErrConnectionClosed)
+	}
+	//the in flight buffer wasn't matched against an error from apple
+	inDoubt := appleError.ErrorCode != CONNECTION_CLOSED_DISCONNECT &&
+		(appleError.ErrorCode == 0 || appleError.MessageID == 0)
+	for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
+		idPayloadObj := e.Value.(*idPayload)
+		c.results.settle(idPayloadObj.Payload, appleError)
+		if inDoubt {
+			c.audit(idPayloadObj.Payload, idPayloadObj.payloadHash, AUDIT_OUTCOME_UNDELIVERED, appleError)
 		}
 	}
 
@@ -404,110 +1192,528 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 	if appleError.ErrorCode == CONNECTION_CLOSED_DISCONNECT {
 		appleError = nil
 		errorPayload = nil
+		errorPayloadMetadata = nil
+		errorPayloadPosition = -1
 	}
 
-	//connection close channel write and close
-	go func() {
-		c.CloseChannel <- &ConnectionClose{
+	var errorPayloadID uint32
+	if errorPayload != nil {
+		errorPayloadID = appleError.MessageID
+	}
+
+	c.deliver(&Result{
+		Close: &ConnectionClose{
 			Error:                       appleError,
 			UnsentPayloads:              unsentPayloads,
 			ErrorPayload:                errorPayload,
-			UnsentPayloadBufferOverflow: (unsentPayloads.Len() > 0 && errorPayload == nil),
+			ErrorPayloadID:              errorPayloadID,
+			ErrorPayloadPosition:        errorPayloadPosition,
+			UnsentPayloadIDs:            unsentPayloadIDs,
+			UnsentPayloadBufferOverflow: unsentPayloadBufferOverflow,
+			OpenedAt:                    c.openedAt,
+			ClosedAt:                    c.clock.Now(),
+			PayloadsSent:                c.payloadsSent.Load(),
+			BytesWritten:                c.bytesWritten.Load(),
+			ErrorFrame:                  c.errorFrame,
+			Idle:                        c.idleClosed,
+			ConnectionID:                c.id,
+			Transport:                   TRANSPORT_BINARY,
+			ErrorPayloadMetadata:        errorPayloadMetadata,
+			WriteError:                  writeError,
+		},
+	})
+}
+
+//Deliver a result to the callbacks and CloseChannel, the end of the
+//ResultInterceptors chain
+func (c *APNSConnection) deliverResult(result *Result) {
+	if result.PayloadError != nil {
+		if c.config.OnPayloadError != nil {
+			c.config.OnPayloadError(result.PayloadError)
+		} else {
+			c.logf(LOG_LEVEL_WARN, "%v", result.PayloadError)
 		}
+	}
+	if result.Close == nil {
+		return
+	}
+
+	connectionClose := result.Close
+	if connectionClose.Error != nil {
+		c.logf(LOG_LEVEL_INFO, "Connection to %v closed : %v", c.config.GatewayHost, connectionClose.Error)
+	} else {
+		c.logf(LOG_LEVEL_INFO, "Connection to %v closed", c.config.GatewayHost)
+	}
+	if appleError := connectionClose.Error; appleError != nil {
+		errorPayload := connectionClose.ErrorPayload
+		if appleError.ErrorCode == 8 && errorPayload != nil && c.config.InvalidTokenFeed != nil {
+			c.config.InvalidTokenFeed.Report(errorPayload.Token,
+				INVALID_TOKEN_SOURCE_APPLE_ERROR, c.clock.Now())
+		}
+		if handler := c.config.ErrorHandlers[appleError.ErrorCode]; handler != nil {
+			handler(appleError, errorPayload)
+		}
+	}
+
+	//connection close channel write and close
+	go func() {
+		c.CloseChannel <- connectionClose
 
 		close(c.CloseChannel)
 	}()
 }
 
+//Add a payload to the send queue, the end of the SendMiddleware chain
+//The payload is appended to the outbox first
+func (c *APNSConnection) queuePayload(sendPayload *Payload) error {
+	if c.config.OutboxStore != nil && sendPayload.OutboxID == "" {
+		outboxID, err := c.config.OutboxStore.Append(sendPayload)
+		if err != nil {
+			return &PayloadError{
+				Payload: sendPayload,
+				Err:     fmt.Errorf("Error appending payload to outbox : %v", err),
+			}
+		}
+		sendPayload.OutboxID = outboxID
+	}
+	c.lastQueued = sendPayload
+	if collapsed := c.sendQueue.push(sendPayload); collapsed != nil {
+		c.payloadsCollapsed.Add(1)
+		c.settle(collapsed, ErrPayloadCollapsed)
+		c.audit(collapsed, "", AUDIT_OUTCOME_DROPPED, ErrPayloadCollapsed)
+	}
+	return nil
+}
+
+//Id for the next payload buffered, from config.MessageIDs or payloadIdCounter
+func (c *APNSConnection) nextMessageID() uint32 {
+	if c.config.MessageIDs != nil {
+		id := c.config.MessageIDs.NextMessageID()
+		for id == 0 {
+			//0 is the null id
+			id = c.config.MessageIDs.NextMessageID()
+		}
+		return id
+	}
+	id := c.payloadIdCounter
+	// increment payload id counter but don't allow
+	// 0 as valid id as it is the null value
+	// only a problem if we overflow a uint32
+	c.payloadIdCounter++
+
+	if c.payloadIdCounter == 0 {
+		c.payloadIdCounter = 1
+	}
+	return id
+}
+
+//UUID for a payload sent without one, from config.GenerateUUID or random
+func (c *APNSConnection) generateUUID() (string, error) {
+	if c.config.GenerateUUID != nil {
+		return c.config.GenerateUUID()
+	}
+	return newUUID()
+}
+
+//Buffer every queued payload, oldest first
+//Payloads which can't be buffered are reported and dropped
+func (c *APNSConnection) drainSendQueue() {
+	for {
+		sendPayload, dequeued, queuedAt := c.sendQueue.popWatched()
+		if sendPayload == nil {
+			break
+		}
+		idPayloadObj := &idPayload{
+			Payload:  sendPayload,
+			ID:       c.nextMessageID(),
+			QueuedAt: queuedAt,
+		}
+
+		buffered, err := c.bufferPayload(idPayloadObj)
+		if err != nil {
+			err.Metadata = c.sendMetadata(queuedAt)
+			c.settle(sendPayload, err)
+			c.payloadError(err)
+		} else if !buffered {
+			//dropped as a duplicate, the payload it duplicates stands in for it
+			c.duplicatesSuppressed.Add(1)
+			c.settle(sendPayload, nil)
+			c.audit(sendPayload, idPayloadObj.payloadHash, AUDIT_OUTCOME_DROPPED, nil)
+		}
+		if dequeued != nil {
+			if err != nil {
+				dequeued <- err
+			} else {
+				dequeued <- nil
+			}
+		}
+	}
+}
+
+//Marshal a payload with the configured PayloadMarshaler
+func (c *APNSConnection) marshalPayload(p *Payload) ([]byte, error) {
+	if c.config.PayloadMarshaler != nil {
+		return c.config.PayloadMarshaler.Marshal(p, c.config.MaxPayloadSize)
+	}
+	return DefaultPayloadMarshaler{Clock: c.clock}.Marshal(p, c.config.MaxPayloadSize)
+}
+
+//Log a line if level is at or below the configured LogLevel
+//Check the level before calling on the send path, as boxing the args allocates
+func (c *APNSConnection) logf(level LogLevel, format string, args ...interface{}) {
+	if level > c.config.LogLevel {
+		return
+	}
+	c.logger.Logf(level, format, args...)
+}
+
+//Print a hex dump of the frame a payload Apple returned an error for was sent in
+//The frame is encoded again, so it's as sent unless OnBeforeMarshal changed the payload
+func (c *APNSConnection) dumpPayloadFrame(idPayloadObj *idPayload, appleError *AppleError) {
+	token, _ := hex.DecodeString(idPayloadObj.Payload.Token)
+	payloadBytes, err := c.marshalPayload(idPayloadObj.Payload)
+	if err != nil {
+		c.logf(LOG_LEVEL_ERROR, "Error framing payload %v for dump : %v", idPayloadObj.ID, err)
+		return
+	}
+	notification := newFrameNotification(idPayloadObj, token, payloadBytes, c.clock.Now())
+	c.logf(LOG_LEVEL_ERROR, "Frame apple returned %v for\n%v", appleError.ErrorString,
+		frame.Dump(frame.AppendNotification(nil, &notification), c.dumpRedaction()))
+}
+
+//Redacts tokens in frame dumps, which always mask tokens even if
+//TokenRedaction shows them elsewhere
+func (c *APNSConnection) dumpRedaction() func(token string) string {
+	if c.config.TokenRedaction == TOKEN_REDACTION_NONE {
+		return TOKEN_REDACTION_PREFIX.Redact
+	}
+	return c.config.TokenRedaction.Redact
+}
+
+//Metadata for a payload taken by the connection, queuedAt zero if it wasn't queued
+func (c *APNSConnection) sendMetadata(queuedAt time.Time) *SendMetadata {
+	return &SendMetadata{
+		Transport:    TRANSPORT_BINARY,
+		ConnectionID: c.id,
+		QueuedAt:     queuedAt,
+		RespondedAt:  c.clock.Now(),
+	}
+}
+
+//Report a payload that couldn't be sent to OnPayloadError
+func (c *APNSConnection) payloadError(err *PayloadError) {
+	err.tokenRedaction = c.config.TokenRedaction
+	if err.Metadata == nil {
+		err.Metadata = c.sendMetadata(time.Time{})
+	}
+	c.audit(err.Payload, "", AUDIT_OUTCOME_REJECTED, err)
+	c.deliver(&Result{PayloadError: err})
+}
+
+//Number of payloads in the in-flight window, written but kept in case
+//Apple rejects one of them (see APNSConfig.InFlightPayloadBufferSize)
+func (c *APNSConnection) InFlightCount() int {
+	return int(c.inFlightCount.Load())
+}
+
+//When payloads were last successfully written to the socket
+//Zero if nothing has been written yet
+func (c *APNSConnection) LastFlushTime() time.Time {
+	lastFlush := c.lastFlush.Load()
+	if lastFlush == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastFlush)
+}
+
+//Number of payloads dropped because they duplicated a recently sent payload
+//See APNSConfig.DuplicateSuppressionWindow
+func (c *APNSConnection) DuplicatesSuppressed() uint64 {
+	return c.duplicatesSuppressed.Load()
+}
+
+//Number of queued payloads dropped because a newer payload with the same
+//token and CollapseID was sent before they were written
+func (c *APNSConnection) PayloadsCollapsed() uint64 {
+	return c.payloadsCollapsed.Load()
+}
+
+//Record a payload's fate in the outbox and send its SendR result, nil reason for sent
+func (c *APNSConnection) settle(p *Payload, reason error) {
+	c.results.settle(p, reason)
+	c.markOutbox(p, reason)
+}
+
+//Settle a payload Apple is taken to have accepted, and report it to OnAccepted
+func (c *APNSConnection) accept(idPayloadObj *idPayload) {
+	c.settle(idPayloadObj.Payload, nil)
+	c.audit(idPayloadObj.Payload, idPayloadObj.payloadHash, AUDIT_OUTCOME_ACCEPTED, nil)
+	if c.config.OnAccepted != nil {
+		c.config.OnAccepted(idPayloadObj.Payload)
+	}
+}
+
+//Remove payloads written before AcceptanceWindow ago from the in flight buffer,
+//Apple has had its chance to reject them
+//Payloads waiting to be written are kept, the buffer is newest first so pruning stops at the first recent one
+func (c *APNSConnection) pruneInFlightBuffer(now time.Time) {
+	cutoff := now.Add(-time.Duration(c.config.AcceptanceWindow) * time.Millisecond)
+	pruned := []*idPayload{}
+	c.inFlightBufferLock.Lock()
+	for e := c.inFlightPayloadBuffer.Back(); e != nil; e = c.inFlightPayloadBuffer.Back() {
+		idPayloadObj := e.Value.(*idPayload)
+		if idPayloadObj.FlushedAt.IsZero() || idPayloadObj.FlushedAt.After(cutoff) {
+			break
+		}
+		c.inFlightPayloadBuffer.Remove(e)
+		pruned = append(pruned, idPayloadObj)
+	}
+	c.inFlightBufferLock.Unlock()
+	c.inFlightCount.Store(int64(c.inFlightPayloadBuffer.Len()))
+	for _, idPayloadObj := range pruned {
+		c.accept(idPayloadObj)
+		c.confirm(idPayloadObj)
+	}
+}
+
+//Check the frame buffer parses back into the payloads framed since the last
+//flush, in order (see APNSConfig.VerifyFrames)
+func (c *APNSConnection) verifyFrameBuffer() error {
+	ids, err := frame.Verify(c.inFlightFrameBuffer)
+	if err != nil {
+		return fmt.Errorf("%w : %v", ErrCorruptFrame, err)
+	}
+	if len(ids) != len(c.framedIDPayloads) {
+		return fmt.Errorf("%w : %v frames for %v payloads", ErrCorruptFrame, len(ids), len(c.framedIDPayloads))
+	}
+	for i, id := range ids {
+		if id != c.framedIDPayloads[i].ID {
+			return fmt.Errorf("%w : frame %v has id %v but should have %v",
+				ErrCorruptFrame, i, id, c.framedIDPayloads[i].ID)
+		}
+	}
+	return nil
+}
+
+//Send a payload's outcome to the AuditSink, if there is one
+//payloadHash is the hash of the JSON it was framed with, "" if it wasn't framed
+func (c *APNSConnection) audit(p *Payload, payloadHash string, outcome AuditOutcome, reason error) {
+	if c.config.AuditSink == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:         c.clock.Now(),
+		ConnectionID: c.id,
+		TokenHash:    auditTokenHash(p.Token),
+		Topic:        c.auditTopic,
+		PayloadHash:  payloadHash,
+		UUID:         p.UUID,
+		Outcome:      outcome,
+	}
+	if c.config.AuditTopic != nil {
+		record.Topic = c.config.AuditTopic(p)
+	}
+	if reason != nil {
+		record.Error = reason.Error()
+	}
+	if err := c.config.AuditSink.Record(record); err != nil {
+		c.logf(LOG_LEVEL_ERROR, "Error recording audit record for %v : %v",
+			c.config.TokenRedaction.Redact(p.Token), err)
+	}
+}
+
+//Record a payload's fate in the outbox, nil reason for sent
+//Payloads that aren't in the outbox are ignored
+func (c *APNSConnection) markOutbox(p *Payload, reason error) {
+	if c.config.OutboxStore == nil || p.OutboxID == "" {
+		return
+	}
+	var err error
+	if reason == nil {
+		err = c.config.OutboxStore.MarkSent(p.OutboxID)
+	} else {
+		err = c.config.OutboxStore.MarkFailed(p.OutboxID, reason)
+	}
+	if err != nil {
+		c.logf(LOG_LEVEL_ERROR, "Error updating outbox record %v : %v", p.OutboxID, err)
+	}
+}
+
 //Write buffer payload to tcp frame buffer and flush if tcp frame buffer full
+//Returns false without buffering it if it duplicates a payload written within
+//the duplicate suppression window, or one waiting to be written
 //THREADSAFE (with regard to interaction with the frameBuffer using frameBufferLock)
-func (c *APNSConnection) bufferPayload(idPayloadObj *idPayload) error {
+func (c *APNSConnection) bufferPayload(idPayloadObj *idPayload) (bool, *PayloadError) {
 	token, err := hex.DecodeString(idPayloadObj.Payload.Token)
 	if err != nil {
-		return fmt.Errorf("Error decoding token for payload %+v : %v\n", idPayloadObj.Payload, err)
+		return false, &PayloadError{
+			Payload: idPayloadObj.Payload,
+			Err:     fmt.Errorf("%w : %v", ErrBadTokenEncoding, err),
+		}
 	}
 
 	if len(token) != APNS_TOKEN_SIZE {
-		return fmt.Errorf("Invalid token length. Was %v bytes but should have been %v bytes\n", len(token), APNS_TOKEN_SIZE)
+		return false, &PayloadError{
+			Payload: idPayloadObj.Payload,
+			Err: fmt.Errorf("%w. Was %v bytes but should have been %v bytes",
+				ErrBadTokenLength, len(token), APNS_TOKEN_SIZE),
+		}
 	}
 
-	payloadBytes, err := idPayloadObj.Payload.Marshal(c.config.MaxPayloadSize)
+	if c.config.OnBeforeMarshal != nil {
+		c.config.OnBeforeMarshal(idPayloadObj.Payload)
+	}
+	//checked here as well as by Payload.marshal, since the priority is
+	//written into the frame whichever PayloadMarshaler is configured
+	if err := ValidatePriority(idPayloadObj.Payload.Priority); err != nil {
+		return false, &PayloadError{
+			Payload: idPayloadObj.Payload,
+			Err:     err,
+		}
+	}
+	payloadBytes, err := c.marshalPayload(idPayloadObj.Payload)
 	if err != nil {
-		return fmt.Errorf("Error marshalling payload %+v : %v\n", idPayloadObj.Payload, err)
+		return false, &PayloadError{
+			Payload: idPayloadObj.Payload,
+			Err:     err,
+		}
+	}
+	if c.config.AuditSink != nil {
+		idPayloadObj.payloadHash = auditHash(payloadBytes)
+	}
+	if c.duplicateFilter != nil {
+		key := duplicateKey(idPayloadObj.Payload, payloadBytes)
+		c.inFlightBufferLock.Lock()
+		duplicate := c.duplicateFilter.isDuplicate(key, c.clock.Now())
+		c.inFlightBufferLock.Unlock()
+		if duplicate {
+			return false, nil
+		}
 	}
 
+	idPayloadObj.Position = c.payloadsBuffered
+	c.payloadsBuffered++
 	c.inFlightPayloadBuffer.PushFront(idPayloadObj)
 	//check to see if we've overrun our buffer
 	//if so, remove one from the buffer
 	if c.inFlightPayloadBuffer.Len() > c.config.InFlightPayloadBufferSize {
-		c.inFlightPayloadBuffer.Remove(c.inFlightPayloadBuffer.Back())
+		evicted := c.inFlightPayloadBuffer.Remove(c.inFlightPayloadBuffer.Back()).(*idPayload)
+		//apple has had plenty of time to reject it
+		c.accept(evicted)
+		c.confirm(evicted)
 	}
+	c.inFlightCount.Store(int64(c.inFlightPayloadBuffer.Len()))
 
 	//acquire lock to tcp buffer to do length checking, buffer writing,
 	//and potentially flush buffer
 	c.inFlightBufferLock.Lock()
 	defer c.inFlightBufferLock.Unlock()
 
-	//write token
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(1))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(APNS_TOKEN_SIZE))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, token)
-
-	//write payload
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(len(payloadBytes)))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, payloadBytes)
-
-	//write id
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(3))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.ID)
-
-	//write expire date if set
-	if idPayloadObj.Payload.ExpirationTime != 0 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.ExpirationTime)
-	}
+	notification := newFrameNotification(idPayloadObj, token, payloadBytes, c.clock.Now())
 
-	//write priority if set correctly
-	if idPayloadObj.Payload.Priority == 10 || idPayloadObj.Payload.Priority == 5 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(5))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.Priority)
-	}
-
-	//check to see if we should flush inFlightFrameByteBuffer
-	if c.inFlightFrameByteBuffer.Len()+c.inFlightItemByteBuffer.Len()+NOTIFICATION_HEADER_SIZE > TCP_FRAME_MAX {
+	//check to see if we should flush the frame buffer first
+	//flushing before appending keeps the bytes on the wire in the order
+	//payloads are buffered, even when a frame boundary falls between them
+	notificationSize := frame.NotificationSize(len(token), len(payloadBytes),
+		notification.ExpirationTime != 0 || notification.ExpireImmediately, notification.Priority != 0)
+	if len(c.inFlightFrameBuffer) > 0 &&
+		len(c.inFlightFrameBuffer)+notificationSize > c.maxFrameSize {
 		c.flushBufferToSocket()
 	}
 
-	//write header info and item info
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint32(c.inFlightItemByteBuffer.Len()))
-	c.inFlightItemByteBuffer.WriteTo(c.inFlightFrameByteBuffer)
+	c.inFlightFrameBuffer = frame.AppendNotification(c.inFlightFrameBuffer, &notification)
+	c.framedIDPayloads = append(c.framedIDPayloads, idPayloadObj)
+	c.framedPayloads++
 
-	c.inFlightItemByteBuffer.Reset()
+	return true, nil
+}
 
-	return nil
+//Notification frame for a payload, with its token and marshalled JSON
+//now is when it's being framed
+func newFrameNotification(idPayloadObj *idPayload, token []byte, payloadBytes []byte,
+	now time.Time) frame.Notification {
+	//relative to now so the TimeToLive starts once the payload is written
+	expirationTime, expireImmediately := idPayloadObj.Payload.FrameExpiration(now)
+	//the priority was checked by ValidatePriority when the payload was buffered
+	return frame.Notification{
+		Token:             token,
+		Payload:           payloadBytes,
+		ID:                idPayloadObj.ID,
+		ExpirationTime:    expirationTime,
+		ExpireImmediately: expireImmediately,
+		Priority:          idPayloadObj.Payload.Priority,
+	}
 }
 
 //NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
 //Write tcp frame buffer to socket and reset when done
 //Close on error
 func (c *APNSConnection) flushBufferToSocket() {
-	//if buffer not created, or zero length, do nothing
-	if c.inFlightFrameByteBuffer == nil || c.inFlightFrameByteBuffer.Len() == 0 {
+	//if buffer zero length, do nothing
+	if len(c.inFlightFrameBuffer) == 0 {
 		return
 	}
 
-	bufBytes := c.inFlightFrameByteBuffer.Bytes()
-
-	//write to socket
-	_, writeErr := c.socket.Write(bufBytes)
+	//write to socket, some wrappers write less than asked without an error
+	//so keep going until the whole frame buffer is written
+	written := 0
+	var writeErr error
+	if c.config.VerifyFrames {
+		//nothing is written if the frames are corrupt
+		writeErr = c.verifyFrameBuffer()
+	}
+	for written < len(c.inFlightFrameBuffer) && writeErr == nil {
+		n, err := c.socket.Write(c.inFlightFrameBuffer[written:])
+		if n > 0 {
+			written += n
+		}
+		if err == nil && n <= 0 {
+			err = io.ErrShortWrite
+		}
+		writeErr = err
+	}
+	c.bytesWritten.Add(uint64(written))
 	if writeErr != nil {
-		fmt.Printf("Error while writing to socket \n%v\n", writeErr)
+		c.writeError = &WriteError{
+			Written:     written,
+			Size:        len(c.inFlightFrameBuffer),
+			Err:         writeErr,
+			ErrorString: writeErr.Error(),
+		}
+		c.logf(LOG_LEVEL_ERROR, "%v", c.writeError)
+		if c.config.DumpFramesOnError {
+			c.logf(LOG_LEVEL_ERROR, "Frames being written\n%v", frame.Dump(c.inFlightFrameBuffer, c.dumpRedaction()))
+		}
+		atomic.StoreInt32(&c.writeFailed, 1)
+		if c.duplicateFilter != nil {
+			c.duplicateFilter.unwritten()
+		}
 		defer c.noFlushDisconnect()
+	} else {
+		now := c.clock.Now()
+		acceptanceWindow := time.Duration(c.config.AcceptanceWindow) * time.Millisecond
+		for _, idPayloadObj := range c.framedIDPayloads {
+			idPayloadObj.FlushedAt = now
+			//Apple can't reject it before it's written
+			c.results.settleAfter(idPayloadObj.Payload, acceptanceWindow)
+		}
+		if c.duplicateFilter != nil {
+			c.duplicateFilter.written(now)
+		}
+		if c.config.OnCheckpoint != nil {
+			c.addCheckpointFrame(now)
+		}
+		c.payloadsSent.Add(uint64(c.framedPayloads))
+		c.lastFlush.Store(now.UnixNano())
+		if c.config.LogLevel >= LOG_LEVEL_DEBUG {
+			c.logf(LOG_LEVEL_DEBUG, "Wrote %v payloads in %v bytes", c.framedPayloads, written)
+		}
+	}
+	//keep the underlying array for the next frame
+	c.inFlightFrameBuffer = c.inFlightFrameBuffer[:0]
+	for i := range c.framedIDPayloads {
+		c.framedIDPayloads[i] = nil
 	}
-	c.inFlightFrameByteBuffer.Reset()
+	c.framedIDPayloads = c.framedIDPayloads[:0]
+	c.framedPayloads = 0
 }
@@ -2,10 +2,28 @@ package apns
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"net"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -341,20 +359,19 @@ func TestConnectionShouldCloseAndReturnUnsentOnAppleResponse(t *testing.T) {
 					t.FailNow()
 				}
 
-				for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
-					fmt.Printf("Unsent payload %v\n", e.Value.(*Payload))
+				for _, unsentPayload := range connectionClose.UnsentPayloads {
+					fmt.Printf("Unsent payload %v\n", unsentPayload)
 				}
 
-				if connectionClose.UnsentPayloads == nil ||
-					connectionClose.UnsentPayloads.Len() != 2 {
-					fmt.Printf("Should have returned 2 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+				if len(connectionClose.UnsentPayloads) != 2 {
+					fmt.Printf("Should have returned 2 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, len(connectionClose.UnsentPayloads))
 					syncChan <- true
 					t.FailNow()
 				}
 
-				if connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != token3 &&
-					connectionClose.UnsentPayloads.Back().Value.(*Payload).Token != token4 {
-					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+				if connectionClose.UnsentPayloads[0].Token != token3 &&
+					connectionClose.UnsentPayloads[len(connectionClose.UnsentPayloads)-1].Token != token4 {
+					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, len(connectionClose.UnsentPayloads))
 					syncChan <- true
 					t.FailNow()
 				}
@@ -490,19 +507,18 @@ func TestConnectionShouldCloseAndReturnUnsentUpToBufferSizeOnAppleResponse(t *te
 					t.FailNow()
 				}
 
-				for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
-					fmt.Printf("Unsent payload %v\n", e.Value.(*Payload))
+				for _, unsentPayload := range connectionClose.UnsentPayloads {
+					fmt.Printf("Unsent payload %v\n", unsentPayload)
 				}
 
-				if connectionClose.UnsentPayloads == nil ||
-					connectionClose.UnsentPayloads.Len() != 1 {
-					fmt.Printf("Should have returned 1 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+				if len(connectionClose.UnsentPayloads) != 1 {
+					fmt.Printf("Should have returned 1 unsent payload objects but received %v len %v\n", connectionClose.UnsentPayloads, len(connectionClose.UnsentPayloads))
 					syncChan <- true
 					t.FailNow()
 				}
 
-				if connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != token4 {
-					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, connectionClose.UnsentPayloads.Len())
+				if connectionClose.UnsentPayloads[0].Token != token4 {
+					fmt.Printf("Expected to receive specific unsent payloads but received %v len %v\n", connectionClose.UnsentPayloads, len(connectionClose.UnsentPayloads))
 					syncChan <- true
 					t.FailNow()
 				}
@@ -726,3 +742,1249 @@ func TestShouldNotWritePayloadIfUnableToMarshall(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+/**
+ * Socket that records the size of each write and blocks reads until closed
+ */
+type MockConnWriteSizes struct {
+	*MockConnPool
+	WriteSizes *[]int
+}
+
+func (conn MockConnWriteSizes) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	*conn.WriteSizes = append(*conn.WriteSizes, len(b))
+	conn.lock.Unlock()
+	return conn.MockConnPool.Write(b)
+}
+
+func TestConnectionShouldNotWriteMoreThanMaxFrameSize(t *testing.T) {
+	pool := newMockConnPool()
+	socket := MockConnWriteSizes{
+		MockConnPool: &pool,
+		WriteSizes:   new([]int),
+	}
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   200,
+			MaxPayloadSize:            2048,
+		})
+
+	for _, p := range testTokens(10) {
+		p.AlertText = "Testing"
+		p.Priority = 10
+		apn.SendChannel <- p
+	}
+
+	//wait for the framing timeout to flush the last frame
+	deadline := time.Now().Add(time.Second)
+	for {
+		pool.lock.Lock()
+		written := len(parseNotifications(pool.WrittenBytes.Bytes()))
+		pool.lock.Unlock()
+		if written == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for payloads to be written, %v of 10 written", written)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if len(*socket.WriteSizes) < 2 {
+		t.Errorf("Expected payloads to be split across frames but got writes %v", *socket.WriteSizes)
+	}
+	for _, size := range *socket.WriteSizes {
+		if size > 200 {
+			t.Errorf("Expected writes of at most 200 bytes but got writes %v", *socket.WriteSizes)
+			break
+		}
+	}
+}
+
+func TestConnectionShouldWriteOneBytePriorityItem(t *testing.T) {
+	c := &APNSConnection{
+		config: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			MaxPayloadSize:            2048,
+		},
+		inFlightPayloadBuffer: list.New(),
+		inFlightBufferLock:    new(sync.Mutex),
+		inFlightFrameBuffer:   make([]byte, 0, TCP_FRAME_MAX),
+		maxFrameSize:          TCP_FRAME_MAX,
+		clock:                 SystemClock,
+	}
+
+	payload := testTokens(1)[0]
+	payload.Priority = 5
+	if _, err := c.bufferPayload(&idPayload{Payload: payload, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := c.inFlightFrameBuffer
+	if int(binary.BigEndian.Uint32(frame[1:5])) != len(frame)-5 {
+		t.Fatalf("Expected frame length %v but header says %v", len(frame)-5, binary.BigEndian.Uint32(frame[1:5]))
+	}
+	//priority is the last item
+	item := frame[len(frame)-4:]
+	if item[0] != 5 || binary.BigEndian.Uint16(item[1:3]) != 1 || item[3] != 5 {
+		t.Errorf("Expected 1 byte priority item but got %v", item)
+	}
+}
+
+/**
+ * Socket that throws away writes without allocating
+ */
+type MockConnDiscard struct {
+	MockConnErrorOnWrite
+}
+
+func (conn MockConnDiscard) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func TestFlushBufferToSocketShouldNotAllocate(t *testing.T) {
+	c := &APNSConnection{
+		socket: MockConnDiscard{},
+		config: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			MaxPayloadSize:            2048,
+		},
+		inFlightPayloadBuffer: list.New(),
+		inFlightBufferLock:    new(sync.Mutex),
+		inFlightFrameBuffer:   make([]byte, 0, TCP_FRAME_MAX),
+		maxFrameSize:          TCP_FRAME_MAX,
+		clock:                 SystemClock,
+		results:               newResultWaiters(SystemClock),
+	}
+	if _, err := c.bufferPayload(&idPayload{Payload: testTokens(1)[0], ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte(nil), c.inFlightFrameBuffer...)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		c.inFlightFrameBuffer = append(c.inFlightFrameBuffer, frame...)
+		c.flushBufferToSocket()
+	})
+	if allocs != 0 {
+		t.Errorf("Expected flushing to reuse the frame buffer but got %v allocations per flush", allocs)
+	}
+}
+
+func TestShouldReportBadTokensAndKeepSending(t *testing.T) {
+	socket := newMockConnPool()
+	payloadErrors := make(chan *PayloadError, 2)
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OnPayloadError: func(err *PayloadError) {
+				payloadErrors <- err
+			},
+		})
+
+	badEncoding := &Payload{Token: "not hex"}
+	badLength := &Payload{Token: "4ec500"}
+	apn.SendChannel <- badEncoding
+	apn.SendChannel <- badLength
+
+	err := <-payloadErrors
+	if err.Payload != badEncoding || !errors.Is(err, ErrBadTokenEncoding) {
+		t.Errorf("Expected ErrBadTokenEncoding for %v but got %v", badEncoding, err)
+	}
+	err = <-payloadErrors
+	if err.Payload != badLength || !errors.Is(err, ErrBadTokenLength) {
+		t.Errorf("Expected ErrBadTokenLength for %v but got %v", badLength, err)
+	}
+	if err.Metadata == nil || err.Metadata.ConnectionID != apn.ID() || err.Metadata.QueuedAt.IsZero() ||
+		!err.Metadata.FlushedAt.IsZero() {
+		t.Errorf("Expected metadata for a queued but unwritten payload but got %+v", err.Metadata)
+	}
+
+	apn.SendChannel <- testTokens(1)[0]
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the good payload to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	apn.Disconnect()
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.Error != nil {
+		t.Errorf("Expected connection to stay open after bad tokens but got %v", connectionClose.Error)
+	}
+	if n := len(parseNotifications(socket.WrittenBytes.Bytes())); n != 1 {
+		t.Errorf("Expected the good payload to be written but %v were written", n)
+	}
+}
+
+func TestConnectionShouldCallErrorHandlerForCode(t *testing.T) {
+	var handledError *AppleError
+	var handledPayload *Payload
+	otherCalled := false
+
+	apn := socketAPNSConnection(newMockConnAppleError(2, 2, 8),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			ErrorHandlers: map[uint8]AppleErrorHandler{
+				8: func(err *AppleError, payload *Payload) {
+					handledError = err
+					handledPayload = payload
+				},
+				7: func(err *AppleError, payload *Payload) {
+					otherCalled = true
+				},
+			},
+		})
+
+	payloads := testTokens(2)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+
+	connectionClose := <-apn.CloseChannel
+
+	if handledError == nil || handledError != connectionClose.Error {
+		t.Fatalf("Expected INVALID_TOKEN handler to be called with %v but got %v", connectionClose.Error, handledError)
+	}
+	if handledPayload != payloads[1] {
+		t.Errorf("Expected handler to be called with the error payload but got %v", handledPayload)
+	}
+	if otherCalled {
+		t.Error("Expected only the handler for the returned error code to be called")
+	}
+}
+
+func TestConnectionShouldCallOnBeforeMarshal(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OnBeforeMarshal: func(payload *Payload) {
+				if payload.ExtraData == "b" {
+					payload.AlertText = "Variant B"
+					payload.CustomFields = map[string]interface{}{"variant": "b"}
+				}
+			},
+		})
+
+	payloads := testTokens(2)
+	payloads[0].AlertText = "Control"
+	payloads[1].AlertText = "Control"
+	payloads[1].ExtraData = "b"
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		socket.lock.Lock()
+		written := len(parseNotifications(socket.WrittenBytes.Bytes()))
+		socket.lock.Unlock()
+		if written == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for payloads to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if written[0].Payload != `{"aps":{"alert":"Control"}}` ||
+		written[1].Payload != `{"aps":{"alert":"Variant B"},"variant":"b"}` {
+		t.Errorf("Expected hook to change the second payload only but got %v", written)
+	}
+}
+
+func TestConnectionCloseShouldReportDiagnostics(t *testing.T) {
+	socket := newMockConnAppleError(3, 2, 8)
+	before := time.Now()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	for _, p := range testTokens(3) {
+		apn.SendChannel <- p
+	}
+	connectionClose := <-apn.CloseChannel
+
+	if connectionClose.OpenedAt.Before(before) || connectionClose.ClosedAt.Before(connectionClose.OpenedAt) {
+		t.Errorf("Expected open and close times in order but got %v and %v",
+			connectionClose.OpenedAt, connectionClose.ClosedAt)
+	}
+	if connectionClose.PayloadsSent != 3 {
+		t.Errorf("Expected 3 payloads sent but got %v", connectionClose.PayloadsSent)
+	}
+	if connectionClose.BytesWritten != uint64(socket.Written()) {
+		t.Errorf("Expected %v bytes written but got %v", socket.Written(), connectionClose.BytesWritten)
+	}
+	if !bytes.Equal(connectionClose.ErrorFrame, []byte{8, 8, 0, 0, 0, 2}) {
+		t.Errorf("Expected the raw error frame but got %v", connectionClose.ErrorFrame)
+	}
+	if connectionClose.ErrorPayloadID != 2 || connectionClose.ErrorPayloadPosition != 1 {
+		t.Errorf("Expected the second payload written to be the error payload but got id %v position %v",
+			connectionClose.ErrorPayloadID, connectionClose.ErrorPayloadPosition)
+	}
+	if !reflect.DeepEqual(connectionClose.UnsentPayloadIDs, []uint32{3}) {
+		t.Errorf("Expected the third payload to be unsent but got ids %v", connectionClose.UnsentPayloadIDs)
+	}
+}
+
+func TestConnectionCloseShouldReportErrorPayloadMetadata(t *testing.T) {
+	socket := newMockConnAppleError(3, 2, 8)
+	before := time.Now()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	for _, p := range testTokens(3) {
+		apn.SendChannel <- p
+	}
+	connectionClose := <-apn.CloseChannel
+
+	if connectionClose.ConnectionID != apn.ID() || connectionClose.Transport != TRANSPORT_BINARY {
+		t.Errorf("Expected the connection's id and transport but got %q and %q",
+			connectionClose.ConnectionID, connectionClose.Transport)
+	}
+	metadata := connectionClose.ErrorPayloadMetadata
+	if metadata == nil {
+		t.Fatal("Expected metadata for the error payload")
+	}
+	if metadata.ConnectionID != apn.ID() || metadata.Transport != TRANSPORT_BINARY {
+		t.Errorf("Expected the connection's id and transport but got %+v", metadata)
+	}
+	if metadata.QueuedAt.Before(before) || metadata.FlushedAt.Before(metadata.QueuedAt) ||
+		metadata.RespondedAt.Before(metadata.FlushedAt) {
+		t.Errorf("Expected queue, flush and response times in order but got %+v", metadata)
+	}
+	if metadata.QueueTime() < 0 || metadata.ResponseTime() < 0 {
+		t.Errorf("Expected positive durations but got %v and %v", metadata.QueueTime(), metadata.ResponseTime())
+	}
+}
+
+func TestConnectionCloseShouldRoundTripThroughJSON(t *testing.T) {
+	payload := &Payload{
+		Token:      testTokens(1)[0].Token,
+		AlertText:  "hi",
+		Badge:      NewBadgeNumber(0),
+		CollapseID: "score",
+		UUID:       "uuid-a",
+	}
+	connectionClose := &ConnectionClose{
+		UnsentPayloads: []*Payload{payload, {Token: payload.Token}},
+		Error: &AppleError{
+			MessageID:   2,
+			ErrorCode:   8,
+			ErrorString: APPLE_PUSH_RESPONSES[8],
+			PayloadUUID: "uuid-a",
+		},
+		ErrorPayload:         payload,
+		ErrorPayloadID:       2,
+		ErrorPayloadPosition: 1,
+		UnsentPayloadIDs:     []uint32{3, 0},
+		OpenedAt:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		ClosedAt:             time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC),
+		PayloadsSent:         2,
+		BytesWritten:         200,
+		ErrorFrame:           []byte{8, 8, 0, 0, 0, 2},
+		WriteError:           &WriteError{Written: 10, Size: 200, ErrorString: "Connection reset by peer"},
+	}
+
+	data, err := json.Marshal(connectionClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &ConnectionClose{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, connectionClose) {
+		t.Errorf("Expected %+v after round trip but got %+v", connectionClose, decoded)
+	}
+}
+
+func TestConnectionShouldReportInFlightCountAndLastFlush(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 2,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+	defer apn.Disconnect()
+
+	if apn.InFlightCount() != 0 || !apn.LastFlushTime().IsZero() {
+		t.Error("Expected nothing in flight or flushed yet")
+	}
+
+	before := time.Now()
+	for _, p := range testTokens(3) {
+		apn.SendChannel <- p
+	}
+	//wait for the last payload to be written
+	apn.Cancel("none")
+
+	if apn.InFlightCount() != 2 {
+		t.Errorf("Expected in flight count to be capped at the buffer size but got %v", apn.InFlightCount())
+	}
+	if lastFlush := apn.LastFlushTime(); lastFlush.Before(before) || lastFlush.After(time.Now()) {
+		t.Errorf("Expected last flush to be just now but got %v", lastFlush)
+	}
+}
+
+func TestConnectionShouldDisconnectWhenIdle(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			IdleTimeout:               20,
+		})
+
+	apn.SendChannel <- testTokens(1)[0]
+
+	select {
+	case connectionClose := <-apn.CloseChannel:
+		if !connectionClose.Idle || connectionClose.Error != nil || len(connectionClose.UnsentPayloads) != 0 {
+			t.Errorf("Expected a clean idle close but got %+v", connectionClose)
+		}
+		if connectionClose.ClosedAt.Sub(apn.LastFlushTime()) < 20*time.Millisecond {
+			t.Errorf("Expected connection to stay open for IdleTimeout after the last payload")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the idle connection to close")
+	}
+	if socket.Written() == 0 {
+		t.Error("Expected payload to be written before the idle close")
+	}
+}
+
+//Socket wrapper which writes half of the first frame then fails
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (conn shortWriteConn) Write(b []byte) (int, error) {
+	n, _ := conn.Conn.Write(b[:len(b)/2])
+	return n, io.ErrShortWrite
+}
+
+func TestConnectionShouldCloseOnWrappedConnFault(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			WrapConn: func(conn net.Conn) net.Conn {
+				return shortWriteConn{conn}
+			},
+		})
+
+	apn.SendChannel <- testTokens(1)[0]
+	connectionClose := <-apn.CloseChannel
+
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
+		t.Errorf("Expected CONNECTION_CLOSED_UNKNOWN after the short write but got %v", connectionClose.Error)
+	}
+	if connectionClose.BytesWritten == 0 || connectionClose.BytesWritten != uint64(socket.Written()) ||
+		connectionClose.PayloadsSent != 0 {
+		t.Errorf("Expected only the partial frame to be counted but got %v bytes and %v payloads",
+			connectionClose.BytesWritten, connectionClose.PayloadsSent)
+	}
+}
+
+func TestConnectionShouldDumpRedactedFramesOnError(t *testing.T) {
+	logger := newTestLogger()
+	config := func() *APNSConfig {
+		return &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			DumpFramesOnError:         true,
+			Logger:                    logger,
+		}
+	}
+	payload := testTokens(1)[0]
+	payload.AlertText = "hi"
+
+	apn := socketAPNSConnection(newMockConnAppleError(1, 1, 8), config())
+	apn.SendChannel <- payload
+	<-apn.CloseChannel
+	output := logger.output()
+	for _, expected := range []string{
+		"Frame apple returned INVALID_TOKEN for",
+		"item 1  01 0020 4ec500**********",
+		"item 2  02 0016 " + hex.EncodeToString([]byte(`{"aps":{"alert":"hi"}}`)),
+		"item 3  03 0004 00000001",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected dump to contain %q but got\n%v", expected, output)
+		}
+	}
+	if strings.Contains(output, payload.Token) {
+		t.Error("Expected token to be masked")
+	}
+
+	logger = newTestLogger()
+	writeConfig := config()
+	writeConfig.Logger = logger
+	writeConfig.WrapConn = func(conn net.Conn) net.Conn {
+		return shortWriteConn{conn}
+	}
+	apn = socketAPNSConnection(newMockConnPool(), writeConfig)
+	apn.SendChannel <- payload
+	<-apn.CloseChannel
+	output = logger.output()
+	if !strings.Contains(output, "Frames being written\nnotification (") ||
+		!strings.Contains(output, "4ec500**********") || strings.Contains(output, payload.Token) {
+		t.Errorf("Expected a redacted dump of the frames being written but got\n%v", output)
+	}
+}
+
+//Self signed client cert and key, pem encoded
+func testKeyPair(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+//Listener that accepts connections but never answers the TLS handshake
+//Returns its host and port, and the accepted connections
+func hungGateway(t *testing.T) (string, string, chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port, accepted
+}
+
+func TestDialTimeoutShouldBoundTheHandshake(t *testing.T) {
+	host, port, accepted := hungGateway(t)
+	cert, key := testKeyPair(t)
+	config := &APNSConfig{
+		CertificateBytes: cert,
+		KeyBytes:         key,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		TlsTimeout:       10,
+		DialTimeout:      50,
+	}
+
+	start := time.Now()
+	conn, err := NewAPNSConnection(config)
+	if conn != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the dial to time out but got %v, %v", conn, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected DialTimeout to apply before TlsTimeout but took %v", elapsed)
+	}
+
+	//the half open socket should be closed
+	server := <-accepted
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, server); err != nil {
+		t.Errorf("Expected the client to close the socket but got %v", err)
+	}
+}
+
+func TestDialShouldHonorContextCancellation(t *testing.T) {
+	host, port, _ := hungGateway(t)
+	cert, key := testKeyPair(t)
+	config := &APNSConfig{
+		CertificateBytes: cert,
+		KeyBytes:         key,
+		GatewayHost:      host,
+		GatewayPort:      port,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	conn, err := NewAPNSConnectionContext(ctx, config)
+	if conn != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the dial to be cancelled but got %v, %v", conn, err)
+	}
+
+	conn, err = NewAPNSConnectionContext(ctx, config)
+	if conn != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a dial with a done context to fail but got %v, %v", conn, err)
+	}
+}
+
+func TestDialTimeoutShouldBeValidated(t *testing.T) {
+	config := &APNSConfig{CertificateBytes: []byte{1}, KeyBytes: []byte{1}, DialTimeout: -1}
+	if err := applyConfigDefaults(config); err == nil || !strings.Contains(err.Error(), "DialTimeout") {
+		t.Errorf("Expected a DialTimeout error but got %v", err)
+	}
+}
+
+func TestConnectionGoroutinesShouldBeLabelled(t *testing.T) {
+	socket := newMockConnPool()
+	conn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	defer conn.Disconnect()
+
+	for _, role := range []string{"reader", "writer"} {
+		labels := `"apns_connection":"` + conn.id + `", "role":"` + role + `"`
+		//the go-routines may not have started yet
+		deadline := time.Now().Add(time.Second)
+		for {
+			var profile bytes.Buffer
+			pprof.Lookup("goroutine").WriteTo(&profile, 1)
+			if strings.Contains(profile.String(), labels) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected a goroutine labelled %v but got\n%v", labels, profile.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+/**
+ * Socket whose blocked Read is only released by a read deadline, like a
+ * wrapper which doesn't pass Close through
+ */
+type deadlineOnlyConn struct {
+	MockConnPool
+}
+
+func (conn deadlineOnlyConn) Close() error {
+	return nil
+}
+func (conn deadlineOnlyConn) SetReadDeadline(t time.Time) error {
+	return conn.MockConnPool.Close()
+}
+
+func TestDisconnectShouldStopConnectionGoroutines(t *testing.T) {
+	before := atomic.LoadInt64(&connectionGoroutines)
+
+	for _, p := range testTokens(3) {
+		conn := socketAPNSConnection(deadlineOnlyConn{newMockConnPool()}, &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+		conn.SendChannel <- p
+		conn.Disconnect()
+		select {
+		case <-conn.CloseChannel:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the reader to notice the disconnect")
+		}
+	}
+
+	//the readers and writers of every connection should exit
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&connectionGoroutines) > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection goroutines to exit but %v are running, %v were before",
+				atomic.LoadInt64(&connectionGoroutines), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushShouldWriteWithoutWaitingForFramingTimeout(t *testing.T) {
+	socket := newMockConnPool()
+	conn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            60000,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	defer conn.Disconnect()
+
+	for _, p := range testTokens(2) {
+		conn.SendChannel <- p
+	}
+	if socket.Written() != 0 {
+		t.Fatalf("Expected payloads to wait for the framing timeout")
+	}
+	conn.Flush()
+	if written := parseNotifications(socket.WrittenBytes.Bytes()); len(written) != 2 || conn.QueueDepth() != 0 {
+		t.Errorf("Expected Flush to write both payloads but got %v", written)
+	}
+
+	//nothing to write while paused
+	conn.Pause()
+	conn.SendChannel <- testTokens(1)[0]
+	conn.Flush()
+	if conn.QueueDepth() != 1 {
+		t.Errorf("Expected Flush not to write while paused")
+	}
+	conn.Resume()
+}
+
+func TestSendWithContextShouldRemoveQueuedPayloadWhenDone(t *testing.T) {
+	socket := newMockConnPool()
+	conn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            60000,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		OnPayloadError:            func(err *PayloadError) {},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	payload := testTokens(1)[0]
+	if err := conn.SendWithContext(ctx, payload); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded but got %v", err)
+	}
+	if payload.UUID == "" || conn.QueueDepth() != 0 {
+		t.Errorf("Expected the payload to be given a UUID and removed from the queue")
+	}
+	conn.Flush()
+	if socket.Written() != 0 {
+		t.Errorf("Expected nothing to be written but wrote %v bytes", socket.Written())
+	}
+
+	//rejected when it's framed
+	sent := make(chan error)
+	go func() {
+		sent <- conn.SendWithContext(context.Background(), &Payload{Token: "zz", AlertText: "hi"})
+	}()
+	for conn.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Flush()
+	if err := <-sent; !errors.Is(err, ErrBadTokenEncoding) {
+		t.Errorf("Expected the payload error but got %v", err)
+	}
+
+	//written by Flush before the context is done
+	go func() {
+		sent <- conn.SendWithContext(context.Background(), testTokens(1)[0])
+	}()
+	for conn.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Flush()
+	if err := <-sent; err != nil || socket.Written() == 0 {
+		t.Errorf("Expected the payload to be written but got %v", err)
+	}
+
+	//connection closes with the payload still queued
+	go func() {
+		sent <- conn.SendWithContext(context.Background(), testTokens(1)[0])
+	}()
+	for conn.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	socket.Close()
+	if err := <-sent; err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed but got %v", err)
+	}
+	<-conn.CloseChannel
+	if err := conn.SendWithContext(context.Background(), testTokens(1)[0]); err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed after the close but got %v", err)
+	}
+}
+
+func TestSendRShouldReceiveExactlyOneResult(t *testing.T) {
+	socket := MockConnErrorOnToken{
+		WrittenBytes: new(bytes.Buffer),
+		CloseChannel: make(chan uint32),
+	}
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          60000,
+	})
+	result := apn.SendR(testTokens(1)[0])
+	var appleError *AppleError
+	if err := <-result; !errors.As(err, &appleError) || appleError.ErrorCode != 8 {
+		t.Errorf("Expected Apple's INVALID_TOKEN but got %v", err)
+	}
+	<-apn.CloseChannel
+
+	socket2 := newMockConnPool()
+	conn := socketAPNSConnection(socket2, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          50,
+		OnPayloadError:            func(err *PayloadError) {},
+	})
+	start := time.Now()
+	accepted := conn.SendR(testTokens(1)[0])
+	rejected := conn.SendR(&Payload{Token: "zz", AlertText: "hi"})
+	if err := <-rejected; !errors.Is(err, ErrBadTokenEncoding) {
+		t.Errorf("Expected the payload error but got %v", err)
+	}
+	if err := <-accepted; err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected nil after the acceptance window but got %v after %v", err, time.Since(start))
+	}
+
+	//the caller abandons the channel, the connection mustn't block on it
+	conn.SendR(testTokens(1)[0])
+	conn.Pause()
+	queued := conn.SendR(testTokens(1)[0])
+	conn.Disconnect()
+	if err := <-queued; err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed for the queued payload but got %v", err)
+	}
+	<-conn.CloseChannel
+	if err := <-conn.SendR(testTokens(1)[0]); err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed after the close but got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for _, result := range []<-chan error{result, accepted, rejected, queued} {
+		select {
+		case err := <-result:
+			t.Errorf("Expected a single result but got another, %v", err)
+		default:
+		}
+	}
+	if n := conn.results.count.Load(); n != 0 {
+		t.Errorf("Expected no payloads left waiting but got %v", n)
+	}
+}
+
+//Mock socket whose writes block until released
+type MockConnBlockedWrite struct {
+	MockConnPool
+	Release chan bool
+}
+
+func (conn MockConnBlockedWrite) Write(b []byte) (n int, err error) {
+	<-conn.Release
+	return conn.MockConnPool.Write(b)
+}
+
+func TestSendRShouldStartTheAcceptanceWindowOnceWritten(t *testing.T) {
+	socket := MockConnBlockedWrite{
+		MockConnPool: newMockConnPool(),
+		Release:      make(chan bool),
+	}
+	conn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          50,
+	})
+	defer conn.Disconnect()
+
+	result := conn.SendR(testTokens(1)[0])
+	select {
+	case err := <-result:
+		close(socket.Release)
+		t.Fatalf("Expected no result while the write is blocked but got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	written := time.Now()
+	close(socket.Release)
+	if err := <-result; err != nil || time.Since(written) < 50*time.Millisecond {
+		t.Errorf("Expected nil an acceptance window after the write but got %v after %v", err, time.Since(written))
+	}
+}
+
+func TestOnAcceptedShouldReportPayloadsLeavingTheBuffer(t *testing.T) {
+	socket := newMockConnPool()
+	accepted := make(chan *Payload, 10)
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 2,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		OnAccepted: func(payload *Payload) {
+			accepted <- payload
+		},
+	})
+
+	payloads := testTokens(4)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	//the first two are pushed out of the buffer by the last two
+	for _, p := range payloads[:2] {
+		if got := <-accepted; got != p {
+			t.Errorf("Expected %v to be accepted but got %v", p.AlertText, got.AlertText)
+		}
+	}
+	if len(accepted) != 0 {
+		t.Errorf("Expected payloads still in the buffer to wait but got %v accepted", len(accepted))
+	}
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+	close(accepted)
+	count := 0
+	for range accepted {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected the rest to be accepted on disconnect but got %v", count)
+	}
+}
+
+func TestPruneInFlightPayloadsShouldAcceptPayloadsOutsideTheWindow(t *testing.T) {
+	socket := newMockConnPool()
+	accepted := make(chan *Payload, 10)
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          50,
+		PruneInFlightPayloads:     true,
+		OnAccepted: func(payload *Payload) {
+			accepted <- payload
+		},
+	})
+	defer apn.Disconnect()
+
+	payloads := testTokens(3)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	for _, p := range payloads {
+		select {
+		case got := <-accepted:
+			if got != p {
+				t.Errorf("Expected %v to be pruned but got %v", p.AlertText, got.AlertText)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected payloads to be pruned after the acceptance window")
+		}
+	}
+	if count := apn.InFlightCount(); count != 0 {
+		t.Errorf("Expected an empty in flight buffer but got %v payloads", count)
+	}
+}
+
+func TestOnAcceptedShouldSkipRejectedPayloads(t *testing.T) {
+	socket := newMockConnAppleError(3, 2, 8)
+	var accepted []*Payload
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		OnAccepted: func(payload *Payload) {
+			accepted = append(accepted, payload)
+		},
+	})
+
+	payloads := testTokens(3)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	<-apn.CloseChannel
+
+	//only the payload before the rejected one made it
+	if len(accepted) != 1 || accepted[0] != payloads[0] {
+		t.Errorf("Expected only the first payload to be accepted but got %v", accepted)
+	}
+}
+
+/**
+ * Socket whose reads return scripted chunks, then block until closed
+ */
+type MockConnReads struct {
+	*MockConnPool
+	reads chan []byte
+}
+
+func newMockConnReads(reads ...[]byte) MockConnReads {
+	socket := newMockConnPool()
+	conn := MockConnReads{MockConnPool: &socket, reads: make(chan []byte, len(reads))}
+	for _, b := range reads {
+		conn.reads <- b
+	}
+	close(conn.reads)
+	return conn
+}
+
+func (conn MockConnReads) Read(b []byte) (n int, err error) {
+	if chunk, ok := <-conn.reads; ok {
+		return copy(b, chunk), nil
+	}
+	return conn.MockConnPool.Read(b)
+}
+
+func TestCloseListenerShouldResyncOnMalformedErrorResponses(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		reads     [][]byte
+		errorCode uint8
+		messageID uint32
+	}{
+		{"short reads", [][]byte{{8, 8, 0}, {0}, {0, 2}}, 8, 2},
+		{"garbage first", [][]byte{{1, 2, 3, 8, 250, 8, 8, 0, 0, 0, 3}}, 8, 3},
+		{"several frames", [][]byte{{8, 7, 0, 0, 0, 2, 8, 10, 0, 0, 0, 5}}, 7, 2},
+		{"garbage only", [][]byte{{1, 2, 3}, {8}}, CONNECTION_CLOSED_UNKNOWN, 0},
+	} {
+		socket := newMockConnReads(test.reads...)
+		apn := socketAPNSConnection(socket, &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+		if test.errorCode == CONNECTION_CLOSED_UNKNOWN {
+			//the socket breaks before a whole frame arrives
+			time.AfterFunc(50*time.Millisecond, func() { socket.Close() })
+		}
+
+		connectionClose := <-apn.CloseChannel
+		if connectionClose.Error == nil || connectionClose.Error.ErrorCode != test.errorCode ||
+			connectionClose.Error.MessageID != test.messageID {
+			t.Errorf("%v: expected error %v for message %v but got %+v", test.name,
+				test.errorCode, test.messageID, connectionClose.Error)
+		}
+	}
+}
+
+func TestUnknownErrorCodesShouldBeForwardedWithTheirFrame(t *testing.T) {
+	socket := newMockConnAppleError(2, 1, 42)
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		AcceptanceWindow:          5000,
+	})
+	payloads := testTokens(2)
+	result := apn.SendR(payloads[0])
+	apn.SendChannel <- payloads[1]
+
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.ErrorPayload != payloads[0] || connectionClose.Error.ErrorString != "UNKNOWN_ERROR_CODE_42" {
+		t.Errorf("Expected the first payload to fail with an unknown code but got %+v", connectionClose.Error)
+	}
+	var unknown *UnknownAppleError
+	if err := <-result; !errors.As(err, &unknown) || unknown.ErrorCode != 42 ||
+		!bytes.Equal(unknown.Frame, []byte{8, 42, 0, 0, 0, 1}) {
+		t.Errorf("Expected an UnknownAppleError with the raw frame but got %#v", err)
+	}
+
+	var known *UnknownAppleError
+	if errors.As(&AppleError{ErrorCode: 8, ErrorString: "INVALID_TOKEN"}, &known) {
+		t.Error("Expected known codes not to unwrap to an UnknownAppleError")
+	}
+}
+
+/**
+ * Socket which writes at most a few bytes per call, breaking after a limit
+ */
+type MockConnShortWrites struct {
+	*MockConnPool
+	//most bytes written per call
+	chunk int
+	//total bytes written before writes fail, 0 for never
+	limit int
+}
+
+func (conn MockConnShortWrites) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.limit > 0 && conn.WrittenBytes.Len() >= conn.limit {
+		return 0, errors.New("Connection reset by peer")
+	}
+	if len(b) > conn.chunk {
+		b = b[:conn.chunk]
+	}
+	return conn.WrittenBytes.Write(b)
+}
+
+func TestFlushShouldFinishPartialWrites(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(MockConnShortWrites{MockConnPool: &socket, chunk: 7}, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	payloads := testTokens(3)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	apn.Disconnect()
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.Error != nil || connectionClose.WriteError != nil {
+		t.Errorf("Expected a clean close but got %+v", connectionClose)
+	}
+	if written := parseNotifications(socket.WrittenBytes.Bytes()); len(written) != 3 {
+		t.Errorf("Expected 3 whole notifications written but got %v", written)
+	}
+
+	socket = newMockConnPool()
+	apn = socketAPNSConnection(MockConnShortWrites{MockConnPool: &socket, chunk: 7, limit: 20}, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	apn.SendChannel <- testTokens(1)[0]
+	connectionClose = <-apn.CloseChannel
+	writeError := connectionClose.WriteError
+	if writeError == nil || writeError.Written != 21 || writeError.Size <= writeError.Written ||
+		writeError.Err == nil {
+		t.Errorf("Expected the bytes written before the failure to be reported but got %+v", writeError)
+	}
+}
+
+func TestVerifyFramesShouldCloseBeforeWritingCorruptFrames(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		VerifyFrames:              true,
+	})
+	apn.SendChannel <- testTokens(1)[0]
+	if socket.Written() == 0 {
+		t.Fatal("Expected a well formed frame to be written")
+	}
+	written := socket.Written()
+
+	//a frame the connection didn't account for
+	apn.inFlightBufferLock.Lock()
+	apn.inFlightFrameBuffer = append(apn.inFlightFrameBuffer, socket.WrittenBytes.Bytes()...)
+	apn.flushBufferToSocket()
+	apn.inFlightBufferLock.Unlock()
+
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.WriteError == nil || !errors.Is(connectionClose.WriteError.Err, ErrCorruptFrame) ||
+		connectionClose.WriteError.Written != 0 {
+		t.Errorf("Expected ErrCorruptFrame before anything was written but got %+v", connectionClose.WriteError)
+	}
+	if socket.Written() != written {
+		t.Errorf("Expected the corrupt frame not to be written but %v bytes were", socket.Written()-written)
+	}
+}
+
+//Every notification is its own frame with fixed item ids, and message ids are
+//uint32s, so nothing wraps when a TCP frame holds more than 255 notifications
+func TestFramesShouldKeepIDsPastByteBoundaries(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            60000,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		VerifyFrames:              true,
+	})
+	defer apn.Disconnect()
+
+	for _, p := range testTokens(300) {
+		p.AlertText = ""
+		p.Badge = NewBadgeNumber(1)
+		apn.SendChannel <- p
+	}
+	apn.Flush()
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 300 {
+		t.Fatalf("Expected 300 notifications but got %v", len(written))
+	}
+	for i, n := range written {
+		if n.ID != uint32(i+1) {
+			t.Fatalf("Expected notification %v to have id %v but got %v", i, i+1, n.ID)
+		}
+	}
+}
+
+func TestMessageIDsShouldSkipZeroWhenWrapping(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	})
+	defer apn.Disconnect()
+	//before the first send, which hands the counter to the send go-routine
+	apn.payloadIdCounter = math.MaxUint32
+
+	for _, p := range testTokens(2) {
+		apn.SendChannel <- p
+	}
+	apn.Flush()
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 2 || written[0].ID != math.MaxUint32 || written[1].ID != 1 {
+		t.Errorf("Expected ids %v then 1 but got %v", uint32(math.MaxUint32), written)
+	}
+}
@@ -0,0 +1,103 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"time"
+)
+
+//TLS setup shared by gateway connections, feedback connections and HTTP/2
+//clients (e.g. ChannelClient), so the certificate, CA pool and ciphers are
+//defined once and every client agrees on them
+//Set as the Credentials of APNSConfig, APNSFeedbackServiceConfig or
+//ChannelClientConfig, or use ConnectionConfig, FeedbackConfig and
+//ChannelClientConfig to start a config from it
+type Credentials struct {
+	//bytes for cert.pem : required
+	CertificateBytes []byte
+	//bytes for key.pem : required
+	KeyBytes []byte
+	//certificate authorities servers' certificates are verified against,
+	//defaults to the system's
+	RootCAs *x509.CertPool
+	//cipher suites offered for TLS 1.2, defaults to Go's
+	CipherSuites []uint16
+	//lowest TLS version offered (e.g. tls.VersionTLS12), defaults to Go's
+	MinVersion uint16
+}
+
+//Credentials for a certificate and key, checking they're a valid pair
+func NewCredentials(certificateBytes []byte, keyBytes []byte) (*Credentials, error) {
+	if _, err := tls.X509KeyPair(certificateBytes, keyBytes); err != nil {
+		return nil, err
+	}
+	return &Credentials{CertificateBytes: certificateBytes, KeyBytes: keyBytes}, nil
+}
+
+//TLS config for connecting to serverName ("" to leave it to the caller,
+//as http.Transport does)
+func (c *Credentials) TLSConfig(serverName string) (*tls.Config, error) {
+	x509Cert, err := tls.X509KeyPair(c.CertificateBytes, c.KeyBytes)
+	if err != nil {
+		//failed to validate key pair
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{x509Cert},
+		ServerName:   serverName,
+		RootCAs:      c.RootCAs,
+		CipherSuites: c.CipherSuites,
+		MinVersion:   c.MinVersion,
+	}, nil
+}
+
+//HTTP/2 client authenticating with the credentials, timeout 0 for none
+func (c *Credentials) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	tlsConf, err := c.TLSConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsConf,
+			ForceAttemptHTTP2: true,
+		},
+	}, nil
+}
+
+//Push connection config using the credentials, other fields default as usual
+func (c *Credentials) ConnectionConfig() *APNSConfig {
+	return &APNSConfig{Credentials: c}
+}
+
+//Feedback service config using the credentials, other fields default as usual
+func (c *Credentials) FeedbackConfig() *APNSFeedbackServiceConfig {
+	return &APNSFeedbackServiceConfig{Credentials: c}
+}
+
+//Channel management config using the credentials for an app's bundle id
+func (c *Credentials) ChannelClientConfig(bundleID string) *ChannelClientConfig {
+	return &ChannelClientConfig{Credentials: c, BundleID: bundleID}
+}
+
+//Copy of the credentials with a new certificate and key, nil if c is nil
+func (c *Credentials) withKeyPair(certificateBytes []byte, keyBytes []byte) *Credentials {
+	if c == nil {
+		return nil
+	}
+	rotated := *c
+	rotated.CertificateBytes = certificateBytes
+	rotated.KeyBytes = keyBytes
+	return &rotated
+}
+
+//The config's Credentials, or credentials made from its own certificate, key and CAs
+func configCredentials(credentials *Credentials, certificateBytes []byte, keyBytes []byte,
+	rootCAs *x509.CertPool) *Credentials {
+	if credentials != nil {
+		return credentials
+	}
+	return &Credentials{CertificateBytes: certificateBytes, KeyBytes: keyBytes, RootCAs: rootCAs}
+}
@@ -0,0 +1,68 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsShouldBeSharedByEveryClient(t *testing.T) {
+	server := newChannelServer()
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "https://")
+	host, port := address[:strings.LastIndex(address, ":")], address[strings.LastIndex(address, ":")+1:]
+
+	cert, key := testKeyPair(t)
+	credentials, err := NewCredentials(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials.RootCAs = x509.NewCertPool()
+	credentials.RootCAs.AddCert(server.Certificate())
+	credentials.MinVersion = tls.VersionTLS12
+
+	connectionConfig := credentials.ConnectionConfig()
+	connectionConfig.GatewayHost = host
+	connectionConfig.GatewayPort = port
+	conn, err := NewAPNSConnection(connectionConfig)
+	if err != nil {
+		t.Fatalf("Expected the gateway connection to verify the server with the shared CAs but got %v", err)
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+
+	feedbackConfig := FeedbackConfigFromAPNSConfig(connectionConfig)
+	feedbackConfig.GatewayHost = host
+	feedbackConfig.GatewayPort = port
+	socket, err := dialFeedbackService(feedbackConfig)
+	if err != nil {
+		t.Fatalf("Expected the feedback connection to use the same credentials but got %v", err)
+	}
+	socket.Close()
+
+	channelConfig := credentials.ChannelClientConfig("com.example.app")
+	channelConfig.GatewayHost = host
+	channelConfig.GatewayPort = port
+	client, err := NewChannelClient(channelConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateChannel(MESSAGE_STORAGE_POLICY_MOST_RECENT); err != nil {
+		t.Errorf("Expected the HTTP/2 client to use the same credentials but got %v", err)
+	}
+
+	//without the CAs the server can't be verified
+	untrusted := credentials.withKeyPair(cert, key)
+	untrusted.RootCAs = nil
+	untrustedConfig := untrusted.ConnectionConfig()
+	untrustedConfig.GatewayHost = host
+	untrustedConfig.GatewayPort = port
+	if _, err := NewAPNSConnection(untrustedConfig); err == nil {
+		t.Error("Expected the handshake to fail without the server's CA")
+	}
+
+	if _, err := NewCredentials(cert, []byte("not a key")); err == nil {
+		t.Error("Expected an error for a key that doesn't match")
+	}
+}
@@ -0,0 +1,72 @@
+package apns
+
+import (
+	"crypto/sha1"
+	"time"
+)
+
+//Tracks recently written payloads so duplicates can be dropped
+//NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
+type duplicateFilter struct {
+	//how long a payload blocks its duplicates for
+	window time.Duration
+	//when each written payload key was written
+	seen map[string]time.Time
+	//keys of payloads framed but not yet written
+	framed map[string]bool
+	//when expired keys were last cleared out
+	lastPrune time.Time
+}
+
+func newDuplicateFilter(window time.Duration) *duplicateFilter {
+	return &duplicateFilter{
+		window: window,
+		seen:   make(map[string]time.Time),
+		framed: make(map[string]bool),
+	}
+}
+
+//Key identifying duplicates of a payload, from its token, the JSON it's
+//framed with and its CollapseID
+//A newer update with the same CollapseID but different content isn't a duplicate
+func duplicateKey(p *Payload, payloadBytes []byte) string {
+	sum := sha1.Sum(payloadBytes)
+	return p.Token + "|" + string(sum[:]) + "|" + p.CollapseID
+}
+
+//Returns true if the key was written within the window or is waiting to be written
+//otherwise records the key as waiting to be written
+func (f *duplicateFilter) isDuplicate(key string, now time.Time) bool {
+	if now.Sub(f.lastPrune) > f.window {
+		for k, seen := range f.seen {
+			if now.Sub(seen) > f.window {
+				delete(f.seen, k)
+			}
+		}
+		f.lastPrune = now
+	}
+
+	if f.framed[key] {
+		return true
+	}
+	if seen, ok := f.seen[key]; ok && now.Sub(seen) <= f.window {
+		return true
+	}
+	f.framed[key] = true
+	return false
+}
+
+//Record the keys waiting to be written as written now
+func (f *duplicateFilter) written(now time.Time) {
+	for key := range f.framed {
+		f.seen[key] = now
+		delete(f.framed, key)
+	}
+}
+
+//Forget the keys waiting to be written, as they never will be
+func (f *duplicateFilter) unwritten() {
+	for key := range f.framed {
+		delete(f.framed, key)
+	}
+}
@@ -0,0 +1,90 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicateFilterWindow(t *testing.T) {
+	f := newDuplicateFilter(time.Second)
+	now := time.Now()
+
+	if f.isDuplicate("a", now) {
+		t.Error("First payload should not be a duplicate")
+	}
+	if !f.isDuplicate("a", now) {
+		t.Error("Repeat while waiting to be written should be a duplicate")
+	}
+	f.written(now)
+	if !f.isDuplicate("a", now.Add(500*time.Millisecond)) {
+		t.Error("Repeat within window should be a duplicate")
+	}
+	if f.isDuplicate("b", now.Add(500*time.Millisecond)) {
+		t.Error("Different key should not be a duplicate")
+	}
+	f.written(now.Add(500 * time.Millisecond))
+	if f.isDuplicate("a", now.Add(2*time.Second)) {
+		t.Error("Repeat after window should not be a duplicate")
+	}
+	if len(f.seen) != 0 {
+		t.Errorf("Expected expired keys to be pruned but %v remain", len(f.seen))
+	}
+
+	//a payload that was never written doesn't block its resend
+	f.unwritten()
+	if f.isDuplicate("a", now.Add(2*time.Second)) {
+		t.Error("Repeat of an unwritten payload should not be a duplicate")
+	}
+}
+
+func TestDuplicateKeyUsesContents(t *testing.T) {
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+	key := func(p *Payload) string {
+		payloadBytes, _ := p.Marshal(2048)
+		return duplicateKey(p, payloadBytes)
+	}
+
+	if key(&Payload{Token: token, AlertText: "1-0", CollapseID: "score"}) ==
+		key(&Payload{Token: token, AlertText: "2-0", CollapseID: "score"}) {
+		t.Error("A newer update with the same CollapseID should have a different key")
+	}
+	if key(&Payload{Token: token, AlertText: "1-0", CollapseID: "score"}) !=
+		key(&Payload{Token: token, AlertText: "1-0", CollapseID: "score"}) {
+		t.Error("Identical payloads should have the same key")
+	}
+	if key(&Payload{Token: token, AlertText: "1-0", CollapseID: "score"}) ==
+		key(&Payload{Token: token, AlertText: "1-0"}) {
+		t.Error("Payloads with different CollapseIDs should have different keys")
+	}
+}
+
+func TestConnectionShouldSuppressDuplicates(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize:  10000,
+			FramingTimeout:             -1,
+			MaxOutboundTCPFrameSize:    TCP_FRAME_MAX,
+			MaxPayloadSize:             2048,
+			DuplicateSuppressionWindow: 60000,
+		})
+
+	token := "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f"
+
+	apn.SendChannel <- &Payload{Token: token, AlertText: "Testing"}
+	apn.SendChannel <- &Payload{Token: token, AlertText: "Testing"}
+	apn.SendChannel <- &Payload{Token: token, AlertText: "Testing again"}
+	//a newer update for a CollapseID isn't a duplicate
+	apn.SendChannel <- &Payload{Token: token, AlertText: "Score 1-0", CollapseID: "score"}
+	apn.SendChannel <- &Payload{Token: token, AlertText: "Score 2-0", CollapseID: "score"}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if n := len(parseNotifications(socket.WrittenBytes.Bytes())); n != 4 {
+		t.Errorf("Expected 4 payloads written but got %v", n)
+	}
+	if apn.DuplicatesSuppressed() != 1 {
+		t.Errorf("Expected 1 duplicate suppressed but got %v", apn.DuplicatesSuppressed())
+	}
+}
@@ -0,0 +1,92 @@
+package apns
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+//Hosts which can be given by name in a DSN
+var DSN_GATEWAY_HOSTS = map[string]string{
+	"production": "gateway.push.apple.com",
+	"sandbox":    "gateway.sandbox.push.apple.com",
+}
+
+//Parse a pool config from a DSN, e.g. for ops tooling and environment driven deployments
+//
+//	apns://sandbox?cert=/path/cert.pem&key=/path/key.pem&pool=4
+//
+//The host is "production", "sandbox" or a gateway host, with an optional port.
+//cert and key are paths to cert.pem and key.pem : required
+//pool is the number of connections (APNSPoolConfig.Size)
+//framing_timeout, idle_timeout and dial_timeout are APNSConfig.FramingTimeout,
+//IdleTimeout and DialTimeout in milliseconds
+//lazy is APNSPoolConfig.Lazy, true or false
+//Anything not given is left for NewAPNSPool and NewAPNSConnection to default
+func ParseDSN(dsn string) (*APNSPoolConfig, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	connectionConfig := &APNSConfig{}
+	config := &APNSPoolConfig{ConnectionConfig: connectionConfig}
+	errorStrs := ""
+
+	if u.Scheme != "apns" {
+		errorStrs += "Invalid DSN scheme. Should be apns\n"
+	}
+	if host, ok := DSN_GATEWAY_HOSTS[u.Hostname()]; ok {
+		connectionConfig.GatewayHost = host
+	} else {
+		connectionConfig.GatewayHost = u.Hostname()
+	}
+	connectionConfig.GatewayPort = u.Port()
+
+	//parse an int parameter, recording an error if it isn't one
+	intParam := func(name string, value string) int {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			errorStrs += "Invalid " + name + ". Should be an integer >= 0\n"
+		}
+		return n
+	}
+
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "cert":
+			if connectionConfig.CertificateBytes, err = os.ReadFile(value); err != nil {
+				errorStrs += "Invalid cert. " + err.Error() + "\n"
+			}
+		case "key":
+			if connectionConfig.KeyBytes, err = os.ReadFile(value); err != nil {
+				errorStrs += "Invalid key. " + err.Error() + "\n"
+			}
+		case "pool":
+			config.Size = intParam(name, value)
+		case "framing_timeout":
+			connectionConfig.FramingTimeout = intParam(name, value)
+		case "idle_timeout":
+			connectionConfig.IdleTimeout = intParam(name, value)
+		case "dial_timeout":
+			connectionConfig.DialTimeout = intParam(name, value)
+		case "lazy":
+			if config.Lazy, err = strconv.ParseBool(value); err != nil {
+				errorStrs += "Invalid lazy. Should be true or false\n"
+			}
+		default:
+			errorStrs += "Invalid DSN parameter " + name + "\n"
+		}
+	}
+
+	if connectionConfig.CertificateBytes == nil || connectionConfig.KeyBytes == nil {
+		errorStrs += "Invalid DSN. Should have cert and key parameters\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+	return config, nil
+}
@@ -0,0 +1,53 @@
+package apns
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDSN(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, []byte("cert"), 0600)
+	os.WriteFile(keyPath, []byte("key"), 0600)
+
+	config, err := ParseDSN("apns://sandbox?cert=" + certPath + "&key=" + keyPath + "&pool=4&idle_timeout=60000&dial_timeout=3000&lazy=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectionConfig := config.ConnectionConfig
+	if connectionConfig.GatewayHost != "gateway.sandbox.push.apple.com" || connectionConfig.GatewayPort != "" {
+		t.Errorf("Expected sandbox gateway but got %v:%v", connectionConfig.GatewayHost, connectionConfig.GatewayPort)
+	}
+	if string(connectionConfig.CertificateBytes) != "cert" || string(connectionConfig.KeyBytes) != "key" {
+		t.Error("Expected cert and key to be read from their files")
+	}
+	if config.Size != 4 || !config.Lazy || connectionConfig.IdleTimeout != 60000 || connectionConfig.DialTimeout != 3000 {
+		t.Errorf("Expected pool, lazy, idle_timeout and dial_timeout to be set but got %+v", config)
+	}
+
+	config, err = ParseDSN("apns://localhost:2196?cert=" + certPath + "&key=" + keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ConnectionConfig.GatewayHost != "localhost" || config.ConnectionConfig.GatewayPort != "2196" {
+		t.Errorf("Expected localhost:2196 but got %v:%v",
+			config.ConnectionConfig.GatewayHost, config.ConnectionConfig.GatewayPort)
+	}
+}
+
+func TestParseDSNShouldReportEveryError(t *testing.T) {
+	_, err := ParseDSN("http://sandbox?pool=lots&colour=red")
+	if err == nil {
+		t.Fatal("Expected invalid DSN to fail")
+	}
+	for _, expected := range []string{"scheme", "pool", "colour", "cert and key"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to mention %v but got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package apns
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	//Payload.ExpirationTime which leaves the expiration out of the frame,
+	//Apple stores the payload for an offline device as long as it chooses
+	//(or until TimeToLive runs out if that's set)
+	NoExpiration uint32 = 0
+	//Payload.ExpirationTime which sends an expiration of 0, Apple delivers
+	//the payload if the device is online and otherwise discards it without storing it
+	ExpireImmediately uint32 = math.MaxUint32
+)
+
+//Expiration time the payload is framed with when written at now, and whether
+//it's sent as an expiration of 0 (ExpireImmediately)
+//TimeToLive is counted from now when ExpirationTime is NoExpiration
+func (p *Payload) FrameExpiration(now time.Time) (uint32, bool) {
+	switch {
+	case p.ExpirationTime == ExpireImmediately:
+		return 0, true
+	case p.ExpirationTime != NoExpiration:
+		return p.ExpirationTime, false
+	case p.TimeToLive > 0:
+		return uint32(now.Add(p.TimeToLive).Unix()), false
+	}
+	return 0, false
+}
+
+//Expiration time used to order the send queue, payloads expiring immediately
+//first and 0 for payloads which can wait (no expiration, or a TimeToLive
+//which doesn't start until they're written)
+func (p *Payload) queueExpiration() uint32 {
+	if p.ExpirationTime == ExpireImmediately {
+		return 1
+	}
+	return p.ExpirationTime
+}
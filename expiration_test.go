@@ -0,0 +1,86 @@
+package apns
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/frame"
+)
+
+func TestFrameExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		payload           Payload
+		expirationTime    uint32
+		expireImmediately bool
+	}{
+		{Payload{}, 0, false},
+		{Payload{ExpirationTime: ExpireImmediately}, 0, true},
+		{Payload{ExpirationTime: 1700003600}, 1700003600, false},
+		{Payload{TimeToLive: time.Hour}, 1700003600, false},
+		{Payload{ExpirationTime: 1700000060, TimeToLive: time.Hour}, 1700000060, false},
+	}
+	for _, test := range tests {
+		expirationTime, expireImmediately := test.payload.FrameExpiration(now)
+		if expirationTime != test.expirationTime || expireImmediately != test.expireImmediately {
+			t.Errorf("Expected %v, %v for %+v but got %v, %v", test.expirationTime, test.expireImmediately,
+				test.payload, expirationTime, expireImmediately)
+		}
+	}
+}
+
+func TestConnectionShouldWriteExpirationsWhenFramed(t *testing.T) {
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	payloads := testTokens(3)
+	payloads[0].ExpirationTime = ExpireImmediately
+	payloads[1].TimeToLive = time.Hour
+	before := time.Now()
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	var notifications []*frame.Notification
+	r := bytes.NewReader(socket.WrittenBytes.Bytes())
+	for r.Len() > 0 {
+		b, err := frame.ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := frame.ParseFrame(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := frame.ParseNotification(items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifications = append(notifications, n)
+	}
+	if len(notifications) != 3 {
+		t.Fatalf("Expected 3 notifications but got %v", len(notifications))
+	}
+	if !notifications[0].ExpireImmediately || notifications[0].ExpirationTime != 0 {
+		t.Errorf("Expected an expiration of 0 but got %+v", notifications[0])
+	}
+	expires := int64(notifications[1].ExpirationTime)
+	if expires < before.Add(time.Hour).Unix() || expires > time.Now().Add(time.Hour).Unix() {
+		t.Errorf("Expected the TimeToLive to start when framed but got %v", expires)
+	}
+	if payloads[1].ExpirationTime != NoExpiration {
+		t.Errorf("Expected the payload to be left alone but got ExpirationTime %v", payloads[1].ExpirationTime)
+	}
+	if notifications[2].ExpireImmediately || notifications[2].ExpirationTime != 0 {
+		t.Errorf("Expected no expiration but got %+v", notifications[2])
+	}
+}
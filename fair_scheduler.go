@@ -0,0 +1,243 @@
+package apns
+
+import (
+	"errors"
+	"sync"
+)
+
+//Returned from FairScheduler.Send once the scheduler has been closed
+var ErrSchedulerClosed = errors.New("Scheduler has been closed")
+
+//Config for sharing a pool between topics with weighted fairness
+type FairSchedulerConfig struct {
+	//sends a payload, e.g. APNSPool.Send or Supervisor.Send : required
+	Send SendFunc
+	//returns the topic a payload is scheduled under, e.g. the tenant it's for : required
+	Topic func(payload *Payload) string
+	//weights of specific topics, overriding DefaultWeight, should be > 0
+	//a topic with weight 3 gets three sends for every one of a topic with weight 1
+	//while both have payloads waiting
+	Weights map[string]int
+	//weight of topics not in Weights, defaults to 1
+	DefaultWeight int
+	//max number of payloads queued per topic before Send blocks, defaults to 1000
+	QueueSize int
+	//number of go-routines sending, e.g. the pool's size, defaults to 1
+	//A token's payloads are never sent by two go-routines at once, so they
+	//still reach Send in the order they were queued
+	Senders int
+	//called with payloads the Send function failed for, defaults to none
+	//called from the sending go-routines
+	OnSendError func(payload *Payload, err error)
+}
+
+//Queues payloads per topic and sends them with weighted fairness, so a
+//huge campaign from one tenant can't starve transactional pushes from
+//others sharing the pool
+//Topics with payloads waiting take turns in proportion to their weights
+//(smooth weighted round robin). Idle topics don't build up credit, so a
+//topic that was quiet can't burst ahead of the others when it wakes up
+//THREADSAFE
+type FairScheduler struct {
+	//config
+	config *FairSchedulerConfig
+	//Mutex to sync access to everything below
+	lock *sync.Mutex
+	//signalled whenever a payload is queued or taken, or the scheduler closes
+	changed *sync.Cond
+	//topics with payloads waiting, in the order they became active
+	active []*fairTopic
+	//active topics by name
+	topics map[string]*fairTopic
+	//whether Close has been called
+	closed bool
+	//tokens with a payload being sent, skipped until it returns
+	sending map[string]bool
+	//done once every sender has exited
+	senders *sync.WaitGroup
+}
+
+//Payloads waiting for a topic
+type fairTopic struct {
+	name    string
+	weight  int
+	queue   []*Payload
+	current int
+}
+
+//Create a scheduler with the supplied config and start its senders
+//If invalid config an error will be returned
+func NewFairScheduler(config *FairSchedulerConfig) (*FairScheduler, error) {
+	errorStrs := ""
+
+	if config.Send == nil {
+		errorStrs += "Invalid Send. Must be supplied\n"
+	}
+	if config.Topic == nil {
+		errorStrs += "Invalid Topic. Must be supplied\n"
+	}
+	for topic, weight := range config.Weights {
+		if weight <= 0 {
+			errorStrs += "Invalid Weights for " + topic + ". Should be > 0\n"
+		}
+	}
+	if config.DefaultWeight < 0 {
+		errorStrs += "Invalid DefaultWeight. Should be > 0\n"
+	}
+	if config.QueueSize < 0 {
+		errorStrs += "Invalid QueueSize. Should be > 0\n"
+	}
+	if config.Senders < 0 {
+		errorStrs += "Invalid Senders. Should be > 0\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.DefaultWeight == 0 {
+		config.DefaultWeight = 1
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 1000
+	}
+	if config.Senders == 0 {
+		config.Senders = 1
+	}
+
+	s := &FairScheduler{
+		config:  config,
+		lock:    new(sync.Mutex),
+		topics:  make(map[string]*fairTopic),
+		sending: make(map[string]bool),
+		senders: new(sync.WaitGroup),
+	}
+	s.changed = sync.NewCond(s.lock)
+	for i := 0; i < config.Senders; i++ {
+		s.senders.Add(1)
+		go s.sendListener()
+	}
+	return s, nil
+}
+
+//Queue a payload to be sent in its topic's turn
+//Blocks while the topic already has QueueSize payloads waiting
+//Returns ErrSchedulerClosed once Close has been called
+func (s *FairScheduler) Send(payload *Payload) error {
+	name := s.config.Topic(payload)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.closed {
+			return ErrSchedulerClosed
+		}
+		topic := s.topics[name]
+		if topic == nil {
+			topic = &fairTopic{name: name, weight: s.weight(name)}
+			s.topics[name] = topic
+			s.active = append(s.active, topic)
+		}
+		if len(topic.queue) < s.config.QueueSize {
+			topic.queue = append(topic.queue, payload)
+			s.changed.Broadcast()
+			return nil
+		}
+		s.changed.Wait()
+	}
+}
+
+//Number of payloads waiting, by topic
+func (s *FairScheduler) QueueDepths() map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	depths := make(map[string]int, len(s.topics))
+	for name, topic := range s.topics {
+		depths[name] = len(topic.queue)
+	}
+	return depths
+}
+
+//Stop taking payloads and return once everything queued has been sent
+func (s *FairScheduler) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.changed.Broadcast()
+	s.lock.Unlock()
+	s.senders.Wait()
+}
+
+//go-routine sending payloads in turn until the scheduler is closed and empty
+func (s *FairScheduler) sendListener() {
+	defer s.senders.Done()
+	for {
+		s.lock.Lock()
+		payload := s.next()
+		for payload == nil {
+			if len(s.active) == 0 && s.closed {
+				s.lock.Unlock()
+				return
+			}
+			s.changed.Wait()
+			payload = s.next()
+		}
+		s.sending[payload.Token] = true
+		s.changed.Broadcast()
+		s.lock.Unlock()
+
+		if err := s.config.Send(payload); err != nil && s.config.OnSendError != nil {
+			s.config.OnSendError(payload, err)
+		}
+
+		s.lock.Lock()
+		delete(s.sending, payload.Token)
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}
+}
+
+//Take the next payload by smooth weighted round robin over the active topics
+//Every active topic gains its weight, the one with the most is picked and
+//pays back the total, so picks interleave in proportion to the weights
+//Topics whose next payload's token is being sent sit the round out
+//Returns nil if there's no topic to pick
+//NOT THREADSAFE (need to acquire lock before calling)
+func (s *FairScheduler) next() *Payload {
+	total := 0
+	var picked *fairTopic
+	for _, topic := range s.active {
+		if s.sending[topic.queue[0].Token] {
+			continue
+		}
+		topic.current += topic.weight
+		total += topic.weight
+		if picked == nil || topic.current > picked.current {
+			picked = topic
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+	picked.current -= total
+	payload := picked.queue[0]
+	picked.queue[0] = nil
+	picked.queue = picked.queue[1:]
+	if len(picked.queue) == 0 {
+		//forget the topic's credit so it can't bank turns while idle
+		delete(s.topics, picked.name)
+		for i, topic := range s.active {
+			if topic == picked {
+				s.active = append(s.active[:i], s.active[i+1:]...)
+				break
+			}
+		}
+	}
+	return payload
+}
+
+//Weight of a topic
+func (s *FairScheduler) weight(topic string) int {
+	if weight, ok := s.config.Weights[topic]; ok {
+		return weight
+	}
+	return s.config.DefaultWeight
+}
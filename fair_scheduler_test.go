@@ -0,0 +1,149 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFairSchedulerShouldInterleaveTopicsByWeight(t *testing.T) {
+	started := make(chan bool)
+	gate := make(chan bool)
+	lock := new(sync.Mutex)
+	var sent []string
+	scheduler, err := NewFairScheduler(&FairSchedulerConfig{
+		Send: func(p *Payload) error {
+			if p.ExtraData == "warmup" {
+				started <- true
+				<-gate
+				return nil
+			}
+			lock.Lock()
+			sent = append(sent, p.ExtraData.(string))
+			lock.Unlock()
+			return nil
+		},
+		Topic: func(p *Payload) string {
+			if p.ExtraData == "transactional" {
+				return "transactional"
+			}
+			return "campaign"
+		},
+		Weights: map[string]int{"transactional": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//hold the sender so everything else queues up behind the campaign
+	scheduler.Send(&Payload{ExtraData: "warmup"})
+	<-started
+	for i := 0; i < 6; i++ {
+		scheduler.Send(&Payload{ExtraData: "campaign"})
+	}
+	for i := 0; i < 3; i++ {
+		scheduler.Send(&Payload{ExtraData: "transactional"})
+	}
+	if depths := scheduler.QueueDepths(); depths["campaign"] != 6 || depths["transactional"] != 3 {
+		t.Errorf("Expected 6 campaign and 3 transactional payloads queued but got %v", depths)
+	}
+	close(gate)
+	scheduler.Close()
+
+	order := strings.Join(sent, ",")
+	expected := "transactional,campaign,transactional,transactional,campaign,campaign,campaign,campaign,campaign"
+	if order != expected {
+		t.Errorf("Expected transactional payloads to get two turns for each campaign turn but got %v", order)
+	}
+	if err := scheduler.Send(&Payload{}); !errors.Is(err, ErrSchedulerClosed) {
+		t.Errorf("Expected ErrSchedulerClosed after Close but got %v", err)
+	}
+}
+
+func TestFairSchedulerShouldBlockFullTopicsOnly(t *testing.T) {
+	gate := make(chan bool)
+	sendErr := errors.New("Pool has been disconnected")
+	failed := make(chan *Payload, 10)
+	scheduler, err := NewFairScheduler(&FairSchedulerConfig{
+		Send: func(p *Payload) error {
+			<-gate
+			return sendErr
+		},
+		Topic:     func(p *Payload) string { return p.ExtraData.(string) },
+		QueueSize: 1,
+		OnSendError: func(p *Payload, err error) {
+			failed <- p
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the first is taken by the sender, the second fills the queue
+	scheduler.Send(&Payload{ExtraData: "campaign"})
+	scheduler.Send(&Payload{ExtraData: "campaign"})
+	blocked := make(chan bool)
+	go func() {
+		scheduler.Send(&Payload{ExtraData: "campaign"})
+		close(blocked)
+	}()
+	//other topics still get in
+	scheduler.Send(&Payload{ExtraData: "transactional"})
+	select {
+	case <-blocked:
+		t.Error("Expected Send to block while its topic's queue is full")
+	default:
+	}
+
+	close(gate)
+	<-blocked
+	scheduler.Close()
+	if len(failed) != 4 {
+		t.Errorf("Expected every payload to be reported to OnSendError but got %v", len(failed))
+	}
+
+	if _, err := NewFairScheduler(&FairSchedulerConfig{Weights: map[string]int{"a": 0}}); err == nil {
+		t.Error("Expected an error without Send or Topic and with a weight of 0")
+	}
+}
+
+func TestFairSchedulerShouldSendEachTokenOnOneSenderAtATime(t *testing.T) {
+	gate := make(chan bool)
+	sent := make(chan string, 10)
+	scheduler, err := NewFairScheduler(&FairSchedulerConfig{
+		Send: func(p *Payload) error {
+			sent <- p.ExtraData.(string)
+			if p.ExtraData == "a1" {
+				<-gate
+			}
+			return nil
+		},
+		Topic:   func(p *Payload) string { return p.Token },
+		Senders: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler.Send(&Payload{Token: "a", ExtraData: "a1"})
+	if first := <-sent; first != "a1" {
+		t.Fatalf("Expected a1 to be sent first but got %v", first)
+	}
+	//a2 waits for a1 while the idle senders get on with other tokens
+	scheduler.Send(&Payload{Token: "a", ExtraData: "a2"})
+	for _, token := range []string{"b", "c", "d"} {
+		scheduler.Send(&Payload{Token: token, ExtraData: token + "1"})
+	}
+	for i := 0; i < 3; i++ {
+		if other := <-sent; other == "a2" {
+			t.Fatal("Expected a2 to wait until a1 had been sent")
+		}
+	}
+
+	close(gate)
+	scheduler.Close()
+	if last := <-sent; last != "a2" {
+		t.Errorf("Expected a2 to be sent once a1 had been but got %v", last)
+	}
+}
@@ -0,0 +1,201 @@
+package apns
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Store of device tokens which the feedback poller invalidates
+type TokenStore interface {
+	//Called for each token Apple reports as no longer valid
+	//timestamp is when Apple determined the app was no longer on the device,
+	//so a token registered after that time is valid again
+	InvalidateToken(token string, timestamp time.Time) error
+}
+
+//Config for polling the APNS Feedback Service
+type FeedbackPollerConfig struct {
+	//config used to connect to the feedback service
+	//required unless ConnectionConfig is supplied
+	FeedbackConfig *APNSFeedbackServiceConfig
+	//push connection config to take the certificate, key and timeouts from
+	//when FeedbackConfig isn't supplied, the feedback host matches the gateway
+	//host (sandbox or production)
+	ConnectionConfig *APNSConfig
+	//number of seconds between polls, defaults to 86400 (daily)
+	Interval int
+	//number of seconds to wait before retrying a failed poll, defaults to 60
+	//doubles on each consecutive failure up to Interval
+	RetryInterval int
+	//store to invalidate tokens in, defaults to none
+	TokenStore TokenStore
+	//feed to report tokens to, defaults to none
+	InvalidTokenFeed *InvalidTokenFeed
+	//called with each feedback response, defaults to none
+	OnFeedback func(response *FeedbackResponse)
+	//called with connection, read and TokenStore errors, defaults to none
+	OnError func(err error)
+	//function used to read from the feedback service, defaults to ConnectToFeedbackService
+	Connect func(config *APNSFeedbackServiceConfig) (*list.List, error)
+	//source of the poll and retry timers, defaults to SystemClock
+	Clock Clock
+}
+
+//Periodically polls the APNS Feedback Service
+type FeedbackPoller struct {
+	//config
+	config *FeedbackPollerConfig
+	//Closed to stop polling
+	stopChannel chan bool
+	//Closed once the poll go-routine has exited
+	doneChannel chan bool
+	//Makes Stop safe to call more than once
+	stopOnce *sync.Once
+}
+
+//Create a feedback poller with the supplied config and start polling
+//The first poll happens immediately
+func NewFeedbackPoller(config *FeedbackPollerConfig) (*FeedbackPoller, error) {
+	errorStrs := ""
+
+	if config.FeedbackConfig == nil && config.ConnectionConfig == nil {
+		errorStrs += "Invalid FeedbackConfig. FeedbackConfig or ConnectionConfig must be supplied\n"
+	}
+	if config.Interval < 0 {
+		errorStrs += "Invalid Interval. Should be > 0\n"
+	}
+	if config.RetryInterval < 0 {
+		errorStrs += "Invalid RetryInterval. Should be > 0\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.FeedbackConfig == nil {
+		config.FeedbackConfig = FeedbackConfigFromAPNSConfig(config.ConnectionConfig)
+	}
+	if config.Interval == 0 {
+		config.Interval = 86400
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 60
+	}
+	if config.Connect == nil {
+		config.Connect = ConnectToFeedbackService
+	}
+	config.Clock = configClock(config.Clock)
+
+	p := &FeedbackPoller{
+		config:      config,
+		stopChannel: make(chan bool),
+		doneChannel: make(chan bool),
+		stopOnce:    new(sync.Once),
+	}
+
+	go p.pollListener()
+
+	return p, nil
+}
+
+//Create a feedback service config using the certificate, key and timeouts
+//of a push connection config
+//Sandbox gateways are mapped to the sandbox feedback service
+func FeedbackConfigFromAPNSConfig(config *APNSConfig) *APNSFeedbackServiceConfig {
+	feedbackHost := ""
+	if strings.Contains(config.GatewayHost, "sandbox") {
+		feedbackHost = "feedback.sandbox.push.apple.com"
+	}
+	return &APNSFeedbackServiceConfig{
+		CertificateBytes: config.CertificateBytes,
+		KeyBytes:         config.KeyBytes,
+		Credentials:      config.Credentials,
+		GatewayHost:      feedbackHost,
+		SocketTimeout:    config.SocketTimeout,
+		TlsTimeout:       config.TlsTimeout,
+	}
+}
+
+//Stop polling
+//Waits for a poll in progress to finish
+func (p *FeedbackPoller) Stop() {
+	p.stopOnce.Do(func() { close(p.stopChannel) })
+	<-p.doneChannel
+}
+
+//go-routine to poll the feedback service until stopped
+func (p *FeedbackPoller) pollListener() {
+	defer close(p.doneChannel)
+
+	failures := 0
+	for {
+		if err := p.poll(); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		timer := p.config.Clock.NewTimer(p.nextPollDelay(failures))
+		select {
+		case <-timer.Chan():
+		case <-p.stopChannel:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//Connect to the feedback service once and hand the responses on
+//Responses read before an error are still handed on
+func (p *FeedbackPoller) poll() error {
+	responses, err := p.config.Connect(p.config.FeedbackConfig)
+	if responses != nil {
+		for e := responses.Front(); e != nil; e = e.Next() {
+			response := e.Value.(*FeedbackResponse)
+			timestamp := time.Unix(int64(response.Timestamp), 0)
+			if p.config.OnFeedback != nil {
+				p.config.OnFeedback(response)
+			}
+			if p.config.InvalidTokenFeed != nil {
+				p.config.InvalidTokenFeed.reportWait(response.Token,
+					INVALID_TOKEN_SOURCE_FEEDBACK, timestamp)
+			}
+			if p.config.TokenStore != nil {
+				storeErr := p.config.TokenStore.InvalidateToken(response.Token, timestamp)
+				if storeErr != nil {
+					p.reportError(storeErr)
+				}
+			}
+		}
+	}
+	if err != nil {
+		p.reportError(err)
+	}
+	return err
+}
+
+//Time to wait before the next poll given the number of consecutive failed polls
+func (p *FeedbackPoller) nextPollDelay(failures int) time.Duration {
+	interval := time.Duration(p.config.Interval) * time.Second
+	if failures == 0 {
+		return interval
+	}
+	delay := time.Duration(p.config.RetryInterval) * time.Second
+	for i := 1; i < failures && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		return interval
+	}
+	return delay
+}
+
+//Report an error to OnError
+func (p *FeedbackPoller) reportError(err error) {
+	if p.config.OnError != nil {
+		p.config.OnError(err)
+	}
+}
@@ -0,0 +1,92 @@
+package apns
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockTokenStore struct {
+	lock        *sync.Mutex
+	Invalidated map[string]time.Time
+}
+
+func (s MockTokenStore) InvalidateToken(token string, timestamp time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Invalidated[token] = timestamp
+	return nil
+}
+
+func TestFeedbackPollerShouldInvalidateTokens(t *testing.T) {
+	store := MockTokenStore{
+		lock:        new(sync.Mutex),
+		Invalidated: make(map[string]time.Time),
+	}
+	polls := make(chan bool, 10)
+	errs := make(chan error, 10)
+
+	poller, err := NewFeedbackPoller(&FeedbackPollerConfig{
+		FeedbackConfig: &APNSFeedbackServiceConfig{},
+		TokenStore:     store,
+		OnError:        func(err error) { errs <- err },
+		Connect: func(config *APNSFeedbackServiceConfig) (*list.List, error) {
+			responses := list.New()
+			responses.PushBack(&FeedbackResponse{Token: "aa", Timestamp: 100})
+			responses.PushBack(&FeedbackResponse{Token: "bb", Timestamp: 200})
+			polls <- true
+			//responses read before an error should still be handed on
+			return responses, errors.New("Connection reset")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-polls
+	poller.Stop()
+
+	if err := <-errs; err.Error() != "Connection reset" {
+		t.Errorf("Expected poll error to be reported but got %v", err)
+	}
+	if len(polls) != 0 {
+		t.Errorf("Expected a single poll before stopping but got %v more", len(polls))
+	}
+	if store.Invalidated["aa"] != time.Unix(100, 0) || store.Invalidated["bb"] != time.Unix(200, 0) {
+		t.Errorf("Expected tokens to be invalidated with their timestamps but got %v", store.Invalidated)
+	}
+}
+
+func TestFeedbackPollerShouldBackOffAfterFailures(t *testing.T) {
+	p := &FeedbackPoller{config: &FeedbackPollerConfig{Interval: 600, RetryInterval: 60}}
+
+	expected := []time.Duration{600, 60, 120, 240, 480, 600, 600}
+	for failures, seconds := range expected {
+		if delay := p.nextPollDelay(failures); delay != seconds*time.Second {
+			t.Errorf("Expected %v delay after %v failures but got %v", seconds*time.Second, failures, delay)
+		}
+	}
+}
+
+func TestFeedbackConfigShouldReuseConnectionConfig(t *testing.T) {
+	config := FeedbackConfigFromAPNSConfig(&APNSConfig{
+		CertificateBytes: []byte("cert"),
+		KeyBytes:         []byte("key"),
+		GatewayHost:      "gateway.sandbox.push.apple.com",
+		TlsTimeout:       3,
+	})
+
+	if string(config.CertificateBytes) != "cert" || string(config.KeyBytes) != "key" || config.TlsTimeout != 3 {
+		t.Errorf("Expected certificate, key and timeouts to be copied but got %+v", config)
+	}
+	if config.GatewayHost != "feedback.sandbox.push.apple.com" {
+		t.Errorf("Expected sandbox feedback host but got %v", config.GatewayHost)
+	}
+
+	config = FeedbackConfigFromAPNSConfig(&APNSConfig{GatewayHost: "gateway.push.apple.com"})
+	if config.GatewayHost != "" {
+		t.Errorf("Expected production feedback host to be defaulted but got %v", config.GatewayHost)
+	}
+}
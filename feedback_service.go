@@ -11,15 +11,19 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 //Config for creating an APNS Feedback Service Connection
 type APNSFeedbackServiceConfig struct {
-	//bytes for cert.pem : required
+	//bytes for cert.pem : required unless Credentials is supplied
 	CertificateBytes []byte
-	//bytes for key.pem : required
+	//bytes for key.pem : required unless Credentials is supplied
 	KeyBytes []byte
+	//TLS setup shared with push connections and HTTP/2 clients, replaces
+	//CertificateBytes and KeyBytes when supplied, defaults to none
+	Credentials *Credentials
 	//apple gateway, defaults to "feedback.push.apple.com"
 	GatewayHost string
 	//apple gateway port, defaults to "2196"
@@ -45,14 +49,64 @@ const (
 	FEEDBACK_RESPONSE_HEADER_FRAME_SIZE = 6
 )
 
+//Feedback service tuple with the timestamp converted to a time
+type FeedbackEntry struct {
+	//Device push token
+	Token string
+	//When APNs determined that the app no longer exists on the device
+	Timestamp time.Time
+}
+
+//Stream of entries read from the feedback service
+type FeedbackStream struct {
+	//Channel entries are received on
+	//Closed once Apple closes the connection, a read error occurs or the stream is closed
+	EntryChannel <-chan FeedbackEntry
+	//socket being read from
+	socket net.Conn
+	//error that ended the stream
+	err error
+	//Closed to stop the read go-routine
+	closeChannel chan bool
+	//Makes Close safe to call more than once
+	closeOnce *sync.Once
+}
+
 //Create a new apns feedback service connection with supplied config
 //If invalid config an error will be returned
 //Also if unable to create a connection an error will be returned
 //Will return a list of *FeedbackResponse or error
 func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, error) {
+	tlsSocket, err := dialFeedbackService(config)
+	if err != nil {
+		return nil, err
+	}
+
+	//let socket close itself when we're finished
+	defer tlsSocket.Close()
+
+	return readFromFeedbackService(tlsSocket)
+}
+
+//Create a new apns feedback service connection with supplied config
+//and stream its entries as they're read
+//If invalid config or unable to create a connection an error will be returned
+//Range over EntryChannel then check Err to see if the stream ended early
+func StreamFeedbackService(config *APNSFeedbackServiceConfig) (*FeedbackStream, error) {
+	tlsSocket, err := dialFeedbackService(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamFromFeedbackService(tlsSocket,
+		time.Duration(config.SocketTimeout)*time.Second), nil
+}
+
+//Apply defaults then connect and handshake with the feedback service
+func dialFeedbackService(config *APNSFeedbackServiceConfig) (net.Conn, error) {
 	errorStrs := ""
 
-	if config.CertificateBytes == nil || config.KeyBytes == nil {
+	if config.Credentials == nil && (config.CertificateBytes == nil || config.KeyBytes == nil) {
 		errorStrs += "Invalid Key/Certificate bytes\n"
 	}
 
@@ -73,17 +127,12 @@ func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, er
 		config.TlsTimeout = 5
 	}
 
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+	tlsConf, err := configCredentials(config.Credentials, config.CertificateBytes, config.KeyBytes,
+		nil).TLSConfig(config.GatewayHost)
 	if err != nil {
-		//failed to validate key pair
 		return nil, err
 	}
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
-	}
-
 	tcpSocket, err := net.DialTimeout("tcp",
 		config.GatewayHost+":"+config.GatewayPort,
 		time.Duration(config.SocketTimeout)*time.Second)
@@ -97,15 +146,12 @@ func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, er
 	err = tlsSocket.Handshake()
 	if err != nil {
 		//failed to handshake with tls information
+		tcpSocket.Close()
 		return nil, err
 	}
 
 	//hooray! we're connected
-
-	//let socket close itself when we're finished
-	defer tlsSocket.Close()
-
-	return readFromFeedbackService(tlsSocket)
+	return tlsSocket, nil
 }
 
 //Read from the socket until there is no more to be read or an error occurs
@@ -113,56 +159,117 @@ func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, er
 //On error some responses may be returned so one should check that the list
 //returned doesn't have anything in it
 func readFromFeedbackService(socket net.Conn) (*list.List, error) {
+	responses := list.New()
+
+	err := readFeedbackResponses(socket, 0, func(response *FeedbackResponse) bool {
+		responses.PushBack(response)
+		return true
+	})
+
+	return responses, err
+}
+
+//Start a go-routine streaming entries from the socket
+//timeout is how long to wait for each entry, 0 for no timeout
+func streamFromFeedbackService(socket net.Conn, timeout time.Duration) *FeedbackStream {
+	entryChannel := make(chan FeedbackEntry)
+	stream := &FeedbackStream{
+		EntryChannel: entryChannel,
+		socket:       socket,
+		closeChannel: make(chan bool),
+		closeOnce:    new(sync.Once),
+	}
+
+	go stream.readListener(entryChannel, timeout)
+
+	return stream
+}
+
+//go-routine to read entries until Apple closes the connection
+func (s *FeedbackStream) readListener(entryChannel chan FeedbackEntry, timeout time.Duration) {
+	err := readFeedbackResponses(s.socket, timeout, func(response *FeedbackResponse) bool {
+		select {
+		case entryChannel <- FeedbackEntry{
+			Token:     response.Token,
+			Timestamp: time.Unix(int64(response.Timestamp), 0),
+		}:
+			return true
+		case <-s.closeChannel:
+			return false
+		}
+	})
+
+	select {
+	case <-s.closeChannel:
+		//reads fail once the socket is closed out from under them
+	default:
+		s.err = err
+	}
+	s.socket.Close()
+	close(entryChannel)
+}
+
+//Error that ended the stream, or nil if Apple closed the connection or the
+//stream was closed
+//Only valid once EntryChannel has been closed
+func (s *FeedbackStream) Err() error {
+	return s.err
+}
+
+//Stop reading and close the connection
+//EntryChannel will be closed
+func (s *FeedbackStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeChannel)
+		s.socket.Close()
+	})
+}
+
+//Read responses from the socket and pass them to handler until there is no
+//more to be read, an error occurs or handler returns false
+//timeout is how long to wait for each response, 0 for no timeout
+func readFeedbackResponses(socket net.Conn, timeout time.Duration,
+	handler func(response *FeedbackResponse) bool) error {
 
 	headerBuffer := make([]byte, FEEDBACK_RESPONSE_HEADER_FRAME_SIZE)
-	responses := list.New()
 
 	for {
-		bytesRead, err := socket.Read(headerBuffer)
+		if timeout > 0 {
+			socket.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		_, err := io.ReadFull(socket, headerBuffer)
 		if err != nil {
 			if err == io.EOF {
 				//we're good, just reached the end of the socket
-				return responses, nil
-			} else {
-				//this is a legit error, return it
-				return responses, err
+				return nil
+			} else if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("Should have read %v header bytes but the connection closed",
+					FEEDBACK_RESPONSE_HEADER_FRAME_SIZE)
 			}
-		}
-
-		if bytesRead != FEEDBACK_RESPONSE_HEADER_FRAME_SIZE {
-			//? should always be this size...
-			return responses,
-				errors.New(fmt.Sprintf("Should have read %v header bytes but read %v bytes",
-					FEEDBACK_RESPONSE_HEADER_FRAME_SIZE, bytesRead))
+			//this is a legit error, return it
+			return err
 		}
 
 		tokenSize := int(binary.BigEndian.Uint16(headerBuffer[4:6]))
 
 		tokenBuffer := make([]byte, tokenSize)
 
-		bytesRead, err = socket.Read(tokenBuffer)
+		_, err = io.ReadFull(socket, tokenBuffer)
 		if err != nil {
-			if err == io.EOF {
-				//we're good, just reached the end of the socket
-				return responses, nil
-			} else {
-				//this is a legit error, return it
-				return responses, err
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("Should have read %v token bytes but the connection closed",
+					tokenSize)
 			}
-		}
-
-		if bytesRead != tokenSize {
-			//? should always be this size...
-			return responses,
-				errors.New(fmt.Sprintf("Should have read %v token bytes but read %v bytes",
-					tokenSize, bytesRead))
+			//this is a legit error, return it
+			return err
 		}
 
 		response := new(FeedbackResponse)
 		response.Timestamp = binary.BigEndian.Uint32(headerBuffer[0:4])
 		response.Token = hex.EncodeToString(tokenBuffer)
-		responses.PushBack(response)
+		if !handler(response) {
+			return nil
+		}
 	}
-
-	return responses, nil
 }
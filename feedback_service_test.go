@@ -306,3 +306,110 @@ func TestFeedbackServiceReadShouldReturnTokensAndError(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestFeedbackStreamShouldRangeOverEntries(t *testing.T) {
+	var writeHeaderState = true
+	var feedbackResponse = &FeedbackResponse{}
+	socket := MockConnTokens{
+		CurrentResponse:  &feedbackResponse,
+		WriteHeaderState: &writeHeaderState,
+		ResponseChannel:  make(chan *FeedbackResponse),
+		CloseChannel:     make(chan bool),
+	}
+
+	tokens := []string{
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		"4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8e",
+	}
+
+	go func() {
+		for i, token := range tokens {
+			socket.ResponseChannel <- &FeedbackResponse{
+				Timestamp: uint32(837431 + i),
+				Token:     token,
+			}
+		}
+		socket.CloseChannel <- true
+	}()
+
+	stream := streamFromFeedbackService(socket, time.Second)
+
+	var entries []FeedbackEntry
+	for entry := range stream.EntryChannel {
+		entries = append(entries, entry)
+	}
+
+	if stream.Err() != nil {
+		t.Errorf("Shouldn't have received an error but got %v", stream.Err())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Should've received 2 entries but got %v", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Token != tokens[i] || !entry.Timestamp.Equal(time.Unix(int64(837431+i), 0)) {
+			t.Errorf("Should've received token %v at %v but got %+v", tokens[i], 837431+i, entry)
+		}
+	}
+}
+
+func TestFeedbackStreamShouldReportReadError(t *testing.T) {
+	var writeHeaderState = true
+	var feedbackResponse = &FeedbackResponse{}
+	socket := MockConnTokensAndErr{
+		CurrentResponse:  &feedbackResponse,
+		WriteHeaderState: &writeHeaderState,
+		ResponseChannel:  make(chan *FeedbackResponse),
+		CloseChannel:     make(chan bool),
+	}
+
+	go func() {
+		socket.ResponseChannel <- &FeedbackResponse{
+			Timestamp: uint32(837431),
+			Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		}
+		socket.CloseChannel <- true
+	}()
+
+	stream := streamFromFeedbackService(socket, 0)
+
+	count := 0
+	for range stream.EntryChannel {
+		count++
+	}
+
+	if count != 1 {
+		t.Errorf("Should've received 1 entry before the error but got %v", count)
+	}
+	if stream.Err() == nil {
+		t.Error("Should have received an error")
+	}
+}
+
+func TestFeedbackStreamShouldStopOnClose(t *testing.T) {
+	var writeHeaderState = true
+	var feedbackResponse = &FeedbackResponse{}
+	socket := MockConnTokens{
+		CurrentResponse:  &feedbackResponse,
+		WriteHeaderState: &writeHeaderState,
+		ResponseChannel:  make(chan *FeedbackResponse, 2),
+		CloseChannel:     make(chan bool),
+	}
+
+	for i := 0; i < 2; i++ {
+		socket.ResponseChannel <- &FeedbackResponse{
+			Timestamp: uint32(837431),
+			Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		}
+	}
+
+	stream := streamFromFeedbackService(socket, 0)
+	<-stream.EntryChannel
+	stream.Close()
+
+	//second entry may or may not make it before the close is noticed
+	for range stream.EntryChannel {
+	}
+	if stream.Err() != nil {
+		t.Errorf("Shouldn't have received an error after closing but got %v", stream.Err())
+	}
+}
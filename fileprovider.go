@@ -0,0 +1,54 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	//Suffix of the topic File Provider pushes are sent to, after the app's bundle id
+	FILE_PROVIDER_TOPIC_SUFFIX = ".pushkit.fileprovider"
+	//ContainerIdentifier for changes to the items in the working set
+	FILE_PROVIDER_WORKING_SET = "NSFileProviderWorkingSetContainerItemIdentifier"
+	//ContainerIdentifier for changes to the root container's items
+	FILE_PROVIDER_ROOT_CONTAINER = "NSFileProviderRootContainerItemIdentifier"
+)
+
+//Returned when a File Provider push has no ContainerIdentifier
+var ErrFileProviderMissingField = errors.New("File Provider push is missing a required field")
+
+//Returned when a File Provider push has aps fields, or ContainerIdentifier
+//is set on a payload which isn't a File Provider push
+var ErrFileProviderField = errors.New("Field not allowed on a File Provider push")
+
+//Topic File Provider pushes for an app are sent to, e.g.
+//com.example.app.pushkit.fileprovider
+//Pushes are sent on a connection using the certificate for this topic
+func FileProviderTopic(bundleID string) string {
+	return bundleID + FILE_PROVIDER_TOPIC_SUFFIX
+}
+
+//Check a File Provider push names a container, and has nothing else
+func (p *Payload) validateFileProvider() error {
+	if p.PushType != PUSH_TYPE_FILEPROVIDER {
+		if p.ContainerIdentifier != "" {
+			return fmt.Errorf("%w : ContainerIdentifier", ErrFileProviderField)
+		}
+		return nil
+	}
+	if p.ContainerIdentifier == "" {
+		return fmt.Errorf("%w : ContainerIdentifier", ErrFileProviderMissingField)
+	}
+	//the extension is only told which container changed, there's nothing to show
+	if len(p.apsMap(SystemClock)) != 0 {
+		return fmt.Errorf("%w : aps fields aren't sent with File Provider pushes", ErrFileProviderField)
+	}
+	return nil
+}
+
+//Add the container identifier beside the aps dictionary
+func (p *Payload) addFileProviderFields(fullPayload map[string]interface{}) {
+	if p.PushType == PUSH_TYPE_FILEPROVIDER {
+		fullPayload["container-identifier"] = p.ContainerIdentifier
+	}
+}
@@ -0,0 +1,44 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFileProviderShouldMarshalContainerIdentifier(t *testing.T) {
+	p := Payload{PushType: PUSH_TYPE_FILEPROVIDER, ContainerIdentifier: FILE_PROVIDER_WORKING_SET}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"aps":{},"container-identifier":"NSFileProviderWorkingSetContainerItemIdentifier"}`
+	if string(json) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(json))
+	}
+	if size, _ := p.EstimateSize(); size != len(expected) {
+		t.Errorf("Expected an estimate of %v but got %v", len(expected), size)
+	}
+	if topic := FileProviderTopic("com.example.app"); topic != "com.example.app.pushkit.fileprovider" {
+		t.Errorf("Unexpected topic %v", topic)
+	}
+}
+
+func TestFileProviderShouldValidateFields(t *testing.T) {
+	p := Payload{PushType: PUSH_TYPE_FILEPROVIDER}
+	if _, err := p.Marshal(256); !errors.Is(err, ErrFileProviderMissingField) {
+		t.Errorf("Expected ErrFileProviderMissingField but got %v", err)
+	}
+
+	p.ContainerIdentifier = FILE_PROVIDER_ROOT_CONTAINER
+	p.AlertText = "Synced"
+	if _, err := p.Marshal(256); !errors.Is(err, ErrFileProviderField) {
+		t.Errorf("Expected ErrFileProviderField for an alert but got %v", err)
+	}
+
+	p.AlertText = ""
+	p.PushType = PUSH_TYPE_DEFAULT
+	if _, err := p.Marshal(256); !errors.Is(err, ErrFileProviderField) {
+		t.Errorf("Expected ErrFileProviderField for ContainerIdentifier on a regular push but got %v", err)
+	}
+}
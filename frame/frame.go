@@ -0,0 +1,322 @@
+//Package encoding and decoding the binary provider protocol's frames:
+//notifications (command 2) made of items, and error responses (command 8)
+//
+//Used by the connection to write notifications, and by the mock gateway,
+//debugging tools and fuzzing to read them
+package frame
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Command of a notification frame
+	COMMAND_NOTIFICATION = 2
+	//Command of an error response frame
+	COMMAND_ERROR_RESPONSE = 8
+	//Size of a notification frame's command and frame length
+	HEADER_SIZE = 5
+	//Size of an item's id and data length
+	ITEM_HEADER_SIZE = 3
+	//Size of an error response frame: command, status and notification id
+	ERROR_RESPONSE_SIZE = 6
+
+	//Item ids
+	ITEM_DEVICE_TOKEN    = 1
+	ITEM_PAYLOAD         = 2
+	ITEM_NOTIFICATION_ID = 3
+	ITEM_EXPIRATION_DATE = 4
+	ITEM_PRIORITY        = 5
+)
+
+var (
+	//The bytes end before the frame does
+	ErrShortFrame = errors.New("Frame is incomplete")
+	//An item's data runs past the end of its frame
+	ErrItemOverrun = errors.New("Item overruns frame")
+	//An item has the wrong size for its id
+	ErrBadItemSize = errors.New("Item has the wrong size")
+	//An item id isn't part of a notification, or appears twice in one frame
+	ErrBadItemID = errors.New("Item id is unknown or repeated")
+	//A frame doesn't have a device token, payload or notification id
+	ErrMissingItem = errors.New("Frame is missing an item")
+)
+
+//Frame command other than the one expected
+type UnsupportedCommandError struct {
+	Command uint8
+}
+
+func (e *UnsupportedCommandError) Error() string {
+	return "Unsupported command " + strconv.Itoa(int(e.Command))
+}
+
+//Item of a notification frame
+type Item struct {
+	ID uint8
+	//Data, sharing memory with the frame it was parsed from
+	Data []byte
+}
+
+//Notification built from a frame's items
+type Notification struct {
+	//Device token, binary
+	Token   []byte
+	Payload []byte
+	ID      uint32
+	//Expiration time and priority, 0 to leave the item out
+	ExpirationTime uint32
+	Priority       uint8
+	//Write an expiration time of 0 when ExpirationTime is 0, so Apple
+	//doesn't store the notification if the device is offline
+	ExpireImmediately bool
+}
+
+//Number of bytes a notification frame takes, header included
+func NotificationSize(tokenSize int, payloadSize int, hasExpiration bool, hasPriority bool) int {
+	size := HEADER_SIZE + ITEM_HEADER_SIZE + tokenSize + ITEM_HEADER_SIZE + payloadSize +
+		ITEM_HEADER_SIZE + 4
+	if hasExpiration {
+		size += ITEM_HEADER_SIZE + 4
+	}
+	if hasPriority {
+		size += ITEM_HEADER_SIZE + 1
+	}
+	return size
+}
+
+//Append a notification frame to buf
+//Appending byte by byte doesn't allocate when there's capacity (unlike binary.Write)
+func AppendNotification(buf []byte, n *Notification) []byte {
+	//write header, with the frame length filled in once the items are written
+	headerStart := len(buf)
+	buf = append(buf, COMMAND_NOTIFICATION, 0, 0, 0, 0)
+
+	buf = AppendItem(buf, ITEM_DEVICE_TOKEN, n.Token)
+	buf = AppendItem(buf, ITEM_PAYLOAD, n.Payload)
+	buf = appendItemHeader(buf, ITEM_NOTIFICATION_ID, 4)
+	buf = appendUint32(buf, n.ID)
+	if n.ExpirationTime != 0 || n.ExpireImmediately {
+		buf = appendItemHeader(buf, ITEM_EXPIRATION_DATE, 4)
+		buf = appendUint32(buf, n.ExpirationTime)
+	}
+	if n.Priority != 0 {
+		buf = appendItemHeader(buf, ITEM_PRIORITY, 1)
+		buf = append(buf, n.Priority)
+	}
+
+	binary.BigEndian.PutUint32(buf[headerStart+1:], uint32(len(buf)-headerStart-HEADER_SIZE))
+	return buf
+}
+
+//Append an item to a notification frame's items
+func AppendItem(buf []byte, id uint8, data []byte) []byte {
+	buf = appendItemHeader(buf, id, len(data))
+	return append(buf, data...)
+}
+
+//Append an item id and length
+func appendItemHeader(buf []byte, id uint8, length int) []byte {
+	return append(buf, id, byte(length>>8), byte(length))
+}
+
+//Append a big endian uint32
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//Number of bytes the notification frame at the start of b takes, header included
+//ErrShortFrame if b doesn't hold all of it
+func FrameLength(b []byte) (int, error) {
+	if len(b) < HEADER_SIZE {
+		return 0, ErrShortFrame
+	}
+	if b[0] != COMMAND_NOTIFICATION {
+		return 0, &UnsupportedCommandError{Command: b[0]}
+	}
+	length := HEADER_SIZE + int(binary.BigEndian.Uint32(b[1:HEADER_SIZE]))
+	if length < HEADER_SIZE || length > len(b) {
+		return 0, ErrShortFrame
+	}
+	return length, nil
+}
+
+//Parse the items of a notification frame, b must be exactly one frame
+func ParseFrame(b []byte) ([]Item, error) {
+	length, err := FrameLength(b)
+	if err != nil {
+		return nil, err
+	}
+	if length != len(b) {
+		return nil, errors.New("Frame is followed by " + strconv.Itoa(len(b)-length) + " bytes")
+	}
+
+	var items []Item
+	data := b[HEADER_SIZE:]
+	for len(data) > 0 {
+		if len(data) < ITEM_HEADER_SIZE {
+			return nil, ErrItemOverrun
+		}
+		itemLength := int(binary.BigEndian.Uint16(data[1:ITEM_HEADER_SIZE]))
+		if len(data) < ITEM_HEADER_SIZE+itemLength {
+			return nil, ErrItemOverrun
+		}
+		items = append(items, Item{ID: data[0], Data: data[ITEM_HEADER_SIZE : ITEM_HEADER_SIZE+itemLength]})
+		data = data[ITEM_HEADER_SIZE+itemLength:]
+	}
+	return items, nil
+}
+
+//Build a notification from a frame's items, unknown items are ignored
+func ParseNotification(items []Item) (*Notification, error) {
+	n := &Notification{}
+	for _, item := range items {
+		switch item.ID {
+		case ITEM_DEVICE_TOKEN:
+			n.Token = item.Data
+		case ITEM_PAYLOAD:
+			n.Payload = item.Data
+		case ITEM_NOTIFICATION_ID, ITEM_EXPIRATION_DATE:
+			if len(item.Data) != 4 {
+				return nil, ErrBadItemSize
+			}
+			if item.ID == ITEM_NOTIFICATION_ID {
+				n.ID = binary.BigEndian.Uint32(item.Data)
+			} else {
+				n.ExpirationTime = binary.BigEndian.Uint32(item.Data)
+				n.ExpireImmediately = n.ExpirationTime == 0
+			}
+		case ITEM_PRIORITY:
+			if len(item.Data) != 1 {
+				return nil, ErrBadItemSize
+			}
+			n.Priority = item.Data[0]
+		}
+	}
+	return n, nil
+}
+
+//Check b is a run of complete, well formed notification frames, e.g. before
+//writing them, and return their notification ids in order
+//Stricter than ParseFrame and ParseNotification: unknown or repeated items and
+//frames without a device token, payload or notification id are errors too
+func Verify(b []byte) ([]uint32, error) {
+	var ids []uint32
+	for offset := 0; offset < len(b); {
+		length, err := FrameLength(b[offset:])
+		if err == nil {
+			var id uint32
+			id, err = verifyFrame(b[offset : offset+length])
+			ids = append(ids, id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Frame %v at offset %v : %w", len(ids), offset, err)
+		}
+		offset += length
+	}
+	return ids, nil
+}
+
+//Check a single notification frame, returning its notification id
+func verifyFrame(b []byte) (uint32, error) {
+	items, err := ParseFrame(b)
+	if err != nil {
+		return 0, err
+	}
+	seen := map[uint8]bool{}
+	for _, item := range items {
+		if item.ID < ITEM_DEVICE_TOKEN || item.ID > ITEM_PRIORITY || seen[item.ID] {
+			return 0, ErrBadItemID
+		}
+		seen[item.ID] = true
+	}
+	if !seen[ITEM_DEVICE_TOKEN] || !seen[ITEM_PAYLOAD] || !seen[ITEM_NOTIFICATION_ID] {
+		return 0, ErrMissingItem
+	}
+	n, err := ParseNotification(items)
+	if err != nil {
+		return 0, err
+	}
+	return n.ID, nil
+}
+
+//Read one notification frame from r
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != COMMAND_NOTIFICATION {
+		return nil, &UnsupportedCommandError{Command: header[0]}
+	}
+	b := make([]byte, HEADER_SIZE+int(binary.BigEndian.Uint32(header[1:])))
+	copy(b, header)
+	if _, err := io.ReadFull(r, b[HEADER_SIZE:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//Append an error response frame to buf
+func AppendErrorResponse(buf []byte, status uint8, id uint32) []byte {
+	buf = append(buf, COMMAND_ERROR_RESPONSE, status)
+	return appendUint32(buf, id)
+}
+
+//Parse an error response frame into its status code and notification id
+func ParseErrorResponse(b []byte) (uint8, uint32, error) {
+	if len(b) < ERROR_RESPONSE_SIZE {
+		return 0, 0, ErrShortFrame
+	}
+	if b[0] != COMMAND_ERROR_RESPONSE {
+		return 0, 0, &UnsupportedCommandError{Command: b[0]}
+	}
+	return b[1], binary.BigEndian.Uint32(b[2:ERROR_RESPONSE_SIZE]), nil
+}
+
+//Hex dump of the notification and error response frames in b, one line per
+//header and item, with device tokens passed through redactToken (nil to show
+//them in full). Bytes which don't parse as a frame are dumped as is
+//
+//	notification (83 bytes)
+//	  header  02 0000004e
+//	  item 1  01 0020 a1b2c3...
+//	  item 2  02 0016 7b22617073223a7b22616c657274223a226869227d7d
+func Dump(b []byte, redactToken func(token string) string) string {
+	var lines []string
+	for len(b) > 0 {
+		if b[0] == COMMAND_ERROR_RESPONSE && len(b) >= ERROR_RESPONSE_SIZE {
+			lines = append(lines, "error response", fmt.Sprintf("  %x", b[:ERROR_RESPONSE_SIZE]))
+			b = b[ERROR_RESPONSE_SIZE:]
+			continue
+		}
+		length, err := FrameLength(b)
+		if err != nil {
+			break
+		}
+		items, err := ParseFrame(b[:length])
+		if err != nil {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("notification (%v bytes)", length),
+			fmt.Sprintf("  header  %02x %x", b[0], b[1:HEADER_SIZE]))
+		for _, item := range items {
+			data := hex.EncodeToString(item.Data)
+			if item.ID == ITEM_DEVICE_TOKEN && redactToken != nil {
+				data = redactToken(data)
+			}
+			lines = append(lines, fmt.Sprintf("  item %v  %02x %04x %v", item.ID, item.ID, len(item.Data), data))
+		}
+		b = b[length:]
+	}
+	if len(b) > 0 {
+		lines = append(lines, fmt.Sprintf("unparsed (%v bytes)", len(b)), fmt.Sprintf("  %x", b))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,188 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testNotification() *Notification {
+	return &Notification{
+		Token:          bytes.Repeat([]byte{0xab}, 32),
+		Payload:        []byte(`{"aps":{"alert":"hi"}}`),
+		ID:             7,
+		ExpirationTime: 1700000000,
+		Priority:       10,
+	}
+}
+
+func TestNotificationShouldRoundTrip(t *testing.T) {
+	n := testNotification()
+	b := AppendNotification([]byte{1, 2, 3}, n)[3:]
+	if len(b) != NotificationSize(len(n.Token), len(n.Payload), true, true) {
+		t.Fatalf("Expected frame of NotificationSize but got %v bytes", len(b))
+	}
+
+	items, err := ParseFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 || items[0].ID != ITEM_DEVICE_TOKEN || items[4].ID != ITEM_PRIORITY {
+		t.Fatalf("Expected 5 items in order but got %+v", items)
+	}
+	parsed, err := ParseNotification(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, n) {
+		t.Errorf("Expected %+v but got %+v", n, parsed)
+	}
+
+	read, err := ReadFrame(bytes.NewReader(append(b, b...)))
+	if err != nil || !bytes.Equal(read, b) {
+		t.Errorf("Expected to read one frame but got %v, %v", read, err)
+	}
+}
+
+func TestNotificationShouldLeaveOutUnsetItems(t *testing.T) {
+	n := testNotification()
+	n.ExpirationTime = 0
+	n.Priority = 0
+	b := AppendNotification(nil, n)
+	if len(b) != NotificationSize(len(n.Token), len(n.Payload), false, false) {
+		t.Errorf("Expected frame of NotificationSize but got %v bytes", len(b))
+	}
+	items, err := ParseFrame(b)
+	if err != nil || len(items) != 3 {
+		t.Errorf("Expected 3 items but got %v, %v", len(items), err)
+	}
+
+	n.ExpireImmediately = true
+	b = AppendNotification(nil, n)
+	if len(b) != NotificationSize(len(n.Token), len(n.Payload), true, false) {
+		t.Errorf("Expected frame of NotificationSize but got %v bytes", len(b))
+	}
+	items, err = ParseFrame(b)
+	if err != nil || len(items) != 4 || items[3].ID != ITEM_EXPIRATION_DATE {
+		t.Fatalf("Expected an expiration item but got %+v, %v", items, err)
+	}
+	if parsed, _ := ParseNotification(items); !parsed.ExpireImmediately || parsed.ExpirationTime != 0 {
+		t.Errorf("Expected a 0 expiration to parse as ExpireImmediately but got %+v", parsed)
+	}
+}
+
+func TestParseFrameShouldRejectMalformedFrames(t *testing.T) {
+	b := AppendNotification(nil, testNotification())
+
+	if _, err := ParseFrame(b[:len(b)-1]); err != ErrShortFrame {
+		t.Errorf("Expected ErrShortFrame but got %v", err)
+	}
+	if _, err := ParseFrame(append(b, 0)); err == nil {
+		t.Error("Expected trailing bytes to be an error")
+	}
+	var commandErr *UnsupportedCommandError
+	if _, err := ParseFrame(append([]byte{8}, b[1:]...)); !errors.As(err, &commandErr) || commandErr.Command != 8 {
+		t.Errorf("Expected unsupported command 8 but got %v", err)
+	}
+
+	//last item claims one more byte than the frame has
+	overrun := append([]byte(nil), b...)
+	overrun[len(overrun)-2]++
+	if _, err := ParseFrame(overrun); err != ErrItemOverrun {
+		t.Errorf("Expected ErrItemOverrun but got %v", err)
+	}
+
+	if _, err := ParseNotification([]Item{{ID: ITEM_NOTIFICATION_ID, Data: []byte{1}}}); err != ErrBadItemSize {
+		t.Errorf("Expected ErrBadItemSize but got %v", err)
+	}
+}
+
+func TestVerifyShouldCheckEveryFrame(t *testing.T) {
+	second := testNotification()
+	second.ID = 8
+	b := AppendNotification(AppendNotification(nil, testNotification()), second)
+	if ids, err := Verify(b); err != nil || !reflect.DeepEqual(ids, []uint32{7, 8}) {
+		t.Errorf("Expected ids 7 and 8 but got %v, %v", ids, err)
+	}
+
+	if _, err := Verify(b[:len(b)-1]); !errors.Is(err, ErrShortFrame) || !strings.Contains(err.Error(), "Frame 1 at offset") {
+		t.Errorf("Expected the second frame to be short but got %v", err)
+	}
+	unknown := append([]byte(nil), b...)
+	unknown[HEADER_SIZE] = 9
+	if _, err := Verify(unknown); !errors.Is(err, ErrBadItemID) {
+		t.Errorf("Expected ErrBadItemID but got %v", err)
+	}
+	payloadOnly := []byte{COMMAND_NOTIFICATION, 0, 0, 0, 5, ITEM_PAYLOAD, 0, 2, '{', '}'}
+	if _, err := Verify(payloadOnly); !errors.Is(err, ErrMissingItem) {
+		t.Errorf("Expected ErrMissingItem but got %v", err)
+	}
+}
+
+func TestErrorResponseShouldRoundTrip(t *testing.T) {
+	b := AppendErrorResponse(nil, 8, 1234)
+	if !bytes.Equal(b, []byte{8, 8, 0, 0, 4, 210}) {
+		t.Errorf("Unexpected error response %v", b)
+	}
+	status, id, err := ParseErrorResponse(b)
+	if status != 8 || id != 1234 || err != nil {
+		t.Errorf("Expected status 8 id 1234 but got %v %v %v", status, id, err)
+	}
+	if _, _, err := ParseErrorResponse(b[:5]); err != ErrShortFrame {
+		t.Errorf("Expected ErrShortFrame but got %v", err)
+	}
+}
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add(AppendNotification(nil, testNotification()))
+	f.Add([]byte{2, 0, 0, 0, 3, 1, 0, 5})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		items, err := ParseFrame(b)
+		if err != nil {
+			return
+		}
+		n, err := ParseNotification(items)
+		if err != nil {
+			return
+		}
+		//anything parsed re-encodes to a frame that parses the same
+		reparsed, err := ParseFrame(AppendNotification(nil, n))
+		if err != nil {
+			t.Fatalf("Re-encoded frame didn't parse: %v", err)
+		}
+		again, _ := ParseNotification(reparsed)
+		if !bytes.Equal(again.Token, n.Token) || !bytes.Equal(again.Payload, n.Payload) ||
+			again.ID != n.ID || again.ExpirationTime != n.ExpirationTime || again.Priority != n.Priority ||
+			again.ExpireImmediately != n.ExpireImmediately {
+			t.Fatalf("Expected %+v but got %+v", n, again)
+		}
+	})
+}
+
+func TestDumpShouldRedactTokens(t *testing.T) {
+	b := AppendNotification(nil, testNotification())
+	b = AppendErrorResponse(b, 8, 7)
+	b = append(b, 2, 0)
+
+	dump := Dump(b, func(token string) string {
+		return token[:6] + "..."
+	})
+	expected := strings.Join([]string{
+		"notification (83 bytes)",
+		"  header  02 0000004e",
+		"  item 1  01 0020 ababab...",
+		"  item 2  02 0016 7b22617073223a7b22616c657274223a226869227d7d",
+		"  item 3  03 0004 00000007",
+		"  item 4  04 0004 6553f100",
+		"  item 5  05 0001 0a",
+		"error response",
+		"  080800000007",
+		"unparsed (2 bytes)",
+		"  0200",
+	}, "\n")
+	if dump != expected {
+		t.Errorf("Expected\n%v\nbut got\n%v", expected, dump)
+	}
+}
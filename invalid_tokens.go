@@ -0,0 +1,124 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Where an invalid token was reported from
+//There's no source for HTTP/2 410 Unregistered responses, as connections
+//only speak the binary protocol (see TRANSPORT_BINARY)
+type InvalidTokenSource int
+
+const (
+	//Apple closed a connection with INVALID_TOKEN (error code 8)
+	INVALID_TOKEN_SOURCE_APPLE_ERROR InvalidTokenSource = iota
+	//The feedback service listed the token
+	INVALID_TOKEN_SOURCE_FEEDBACK
+)
+
+func (s InvalidTokenSource) String() string {
+	switch s {
+	case INVALID_TOKEN_SOURCE_APPLE_ERROR:
+		return "APPLE_ERROR"
+	case INVALID_TOKEN_SOURCE_FEEDBACK:
+		return "FEEDBACK"
+	}
+	return "UNKNOWN"
+}
+
+//A device token Apple reported as no longer valid
+type InvalidToken struct {
+	//Device push token
+	Token string
+	//Where the token was reported from
+	Source InvalidTokenSource
+	//When the token became invalid
+	//For feedback this is when Apple determined the app was removed,
+	//for errors it's when the error was received
+	Timestamp time.Time
+}
+
+//Single stream of invalid tokens from connections and feedback pollers
+//Set it as APNSConfig.InvalidTokenFeed and FeedbackPollerConfig.InvalidTokenFeed
+//Connections never block on the feed, tokens they report while it's full are
+//dropped, so InvalidTokens should be consumed promptly. Feedback pollers wait
+//for room instead, as Apple only returns each feedback token once
+type InvalidTokenFeed struct {
+	//Channel invalid tokens are sent on
+	channel chan InvalidToken
+	//Closed when the feed is closed
+	closeChannel chan bool
+	//Makes Close safe to call more than once
+	closeOnce *sync.Once
+	//Number of tokens dropped because the feed was full or closed
+	dropped atomic.Uint64
+}
+
+//Default number of tokens an invalid token feed buffers
+const DEFAULT_INVALID_TOKEN_FEED_BUFFER_SIZE = 1000
+
+//Create an invalid token feed
+//bufferSize is the number of tokens that can be reported before one is received,
+//defaults to DEFAULT_INVALID_TOKEN_FEED_BUFFER_SIZE
+//Connections drop tokens rather than wait, so the feed is never unbuffered
+func NewInvalidTokenFeed(bufferSize int) *InvalidTokenFeed {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_INVALID_TOKEN_FEED_BUFFER_SIZE
+	}
+	return &InvalidTokenFeed{
+		channel:      make(chan InvalidToken, bufferSize),
+		closeChannel: make(chan bool),
+		closeOnce:    new(sync.Once),
+	}
+}
+
+//Channel invalid tokens are received on
+//Not closed when the feed is closed since reporters may still be running
+func (f *InvalidTokenFeed) InvalidTokens() <-chan InvalidToken {
+	return f.channel
+}
+
+//Report an invalid token
+//Never blocks, the token is dropped if the feed is full or closed
+func (f *InvalidTokenFeed) Report(token string, source InvalidTokenSource, timestamp time.Time) {
+	select {
+	case <-f.closeChannel:
+		f.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case f.channel <- InvalidToken{Token: token, Source: source, Timestamp: timestamp}:
+	default:
+		f.dropped.Add(1)
+	}
+}
+
+//Report an invalid token, waiting until there's room in the feed
+//The token is dropped if the feed is closed
+func (f *InvalidTokenFeed) reportWait(token string, source InvalidTokenSource, timestamp time.Time) {
+	select {
+	case <-f.closeChannel:
+		f.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case f.channel <- InvalidToken{Token: token, Source: source, Timestamp: timestamp}:
+	case <-f.closeChannel:
+		f.dropped.Add(1)
+	}
+}
+
+//Number of tokens dropped because the feed was full or closed
+func (f *InvalidTokenFeed) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+//Close the feed
+//Any waiting or later reports are dropped
+func (f *InvalidTokenFeed) Close() {
+	f.closeOnce.Do(func() { close(f.closeChannel) })
+}
@@ -0,0 +1,94 @@
+package apns
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestInvalidTokenFeedShouldMergeSources(t *testing.T) {
+	feed := NewInvalidTokenFeed(10)
+	defer feed.Close()
+
+	apn := socketAPNSConnection(newMockConnAppleError(1, 1, 8),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			InvalidTokenFeed:          feed,
+		})
+	payload := testTokens(1)[0]
+	apn.SendChannel <- payload
+	<-apn.CloseChannel
+
+	poller, err := NewFeedbackPoller(&FeedbackPollerConfig{
+		FeedbackConfig:   &APNSFeedbackServiceConfig{},
+		InvalidTokenFeed: feed,
+		Connect: func(config *APNSFeedbackServiceConfig) (*list.List, error) {
+			responses := list.New()
+			responses.PushBack(&FeedbackResponse{Token: "aa", Timestamp: 100})
+			return responses, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := <-feed.InvalidTokens()
+	second := <-feed.InvalidTokens()
+	poller.Stop()
+
+	if first.Token != payload.Token || first.Source != INVALID_TOKEN_SOURCE_APPLE_ERROR {
+		t.Errorf("Expected apple error for %v but got %+v", payload.Token, first)
+	}
+	if second.Token != "aa" || second.Source != INVALID_TOKEN_SOURCE_FEEDBACK ||
+		!second.Timestamp.Equal(time.Unix(100, 0)) {
+		t.Errorf("Expected feedback for aa at 100 but got %+v", second)
+	}
+}
+
+func TestInvalidTokenFeedShouldDropReportsAfterClose(t *testing.T) {
+	feed := NewInvalidTokenFeed(0)
+	feed.Close()
+
+	//would block forever if the report wasn't dropped
+	feed.Report("aa", INVALID_TOKEN_SOURCE_FEEDBACK, time.Now())
+	feed.reportWait("bb", INVALID_TOKEN_SOURCE_FEEDBACK, time.Now())
+
+	if len(feed.InvalidTokens()) != 0 || feed.Dropped() != 2 {
+		t.Errorf("Expected reports after close to be dropped but %v were", feed.Dropped())
+	}
+}
+
+func TestInvalidTokenFeedShouldDefaultToABuffer(t *testing.T) {
+	feed := NewInvalidTokenFeed(0)
+	defer feed.Close()
+
+	//nothing is receiving yet, an unbuffered feed would drop both
+	feed.Report("aa", INVALID_TOKEN_SOURCE_APPLE_ERROR, time.Now())
+	feed.Report("bb", INVALID_TOKEN_SOURCE_APPLE_ERROR, time.Now())
+
+	if cap(feed.InvalidTokens()) != DEFAULT_INVALID_TOKEN_FEED_BUFFER_SIZE {
+		t.Errorf("Expected a buffer of %v but got %v", DEFAULT_INVALID_TOKEN_FEED_BUFFER_SIZE, cap(feed.InvalidTokens()))
+	}
+	if len(feed.InvalidTokens()) != 2 || feed.Dropped() != 0 {
+		t.Errorf("Expected both tokens to be kept but %v were dropped", feed.Dropped())
+	}
+}
+
+func TestInvalidTokenFeedShouldNotBlockWhenFull(t *testing.T) {
+	feed := NewInvalidTokenFeed(1)
+	defer feed.Close()
+
+	//would block forever if the second report waited for room
+	feed.Report("aa", INVALID_TOKEN_SOURCE_APPLE_ERROR, time.Now())
+	feed.Report("bb", INVALID_TOKEN_SOURCE_APPLE_ERROR, time.Now())
+
+	if token := <-feed.InvalidTokens(); token.Token != "aa" {
+		t.Errorf("Expected the first token to be kept but got %+v", token)
+	}
+	if feed.Dropped() != 1 {
+		t.Errorf("Expected 1 token dropped but got %v", feed.Dropped())
+	}
+}
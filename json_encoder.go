@@ -0,0 +1,19 @@
+package apns
+
+import (
+	"encoding/json"
+)
+
+//Encodes payload dictionaries to JSON
+//Payloads are built from maps, strings, ints, APSAlertBody and custom field
+//values, so any encoder compatible with encoding/json can be used
+type JSONEncoder interface {
+	Marshal(v interface{}) ([]byte, error)
+}
+
+//Encoder using encoding/json, used when no other encoder is configured
+type StdJSONEncoder struct{}
+
+func (StdJSONEncoder) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
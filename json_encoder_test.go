@@ -0,0 +1,39 @@
+package apns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//Encoder which counts calls and indents its output
+type MockCountingEncoder struct {
+	calls *int
+}
+
+func (e MockCountingEncoder) Marshal(v interface{}) ([]byte, error) {
+	*e.calls++
+	return json.MarshalIndent(v, "", " ")
+}
+
+func TestDefaultMarshalerShouldUseEncoder(t *testing.T) {
+	calls := 0
+	marshaler := DefaultPayloadMarshaler{Encoder: MockCountingEncoder{calls: &calls}}
+
+	payloadBytes, err := marshaler.Marshal(&Payload{AlertText: "Testing"}, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n \"aps\": {\n  \"alert\": \"Testing\"\n }\n}"
+	if string(payloadBytes) != expected || calls != 1 {
+		t.Errorf("Expected encoder to be called once giving %v but got %v after %v calls", expected, string(payloadBytes), calls)
+	}
+
+	//truncation re-encodes with the same encoder
+	payloadBytes, err = marshaler.Marshal(&Payload{AlertText: "Testing a long alert"}, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloadBytes) > 40 || calls != 3 {
+		t.Errorf("Expected truncated payload from the encoder but got %v after %v calls", string(payloadBytes), calls)
+	}
+}
@@ -0,0 +1,64 @@
+package jsoniterencoder
+
+import (
+	"strings"
+	"testing"
+
+	apns "github.com/joekarl/go-libapns"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func testPayloads() []*apns.Payload {
+	badge := apns.NewBadgeNumber(0)
+	return []*apns.Payload{
+		{AlertText: "Hello <world> & friends", Sound: "default"},
+		{AlertText: "Badge cleared", Badge: badge, ContentAvailable: 1},
+		{
+			AlertBody: apns.APSAlertBody{
+				Body:    "Body text",
+				Title:   "Title",
+				LocArgs: []string{"a", "b"},
+			},
+			Category:     "reply",
+			CustomFields: map[string]interface{}{"z": 1, "a": []int{1, 2}, "m": map[string]string{"k": "v"}},
+		},
+		//long enough to be truncated
+		{AlertText: strings.Repeat("x", 300)},
+	}
+}
+
+func TestEncoderShouldMatchEncodingJSON(t *testing.T) {
+	marshaler := NewPayloadMarshaler()
+	for _, p := range testPayloads() {
+		expected, expectedErr := p.Marshal(256)
+		actual, err := marshaler.Marshal(p, 256)
+		if err != nil || expectedErr != nil {
+			t.Fatalf("Expected payload to marshal but got %v and %v", expectedErr, err)
+		}
+		if string(actual) != string(expected) {
+			t.Errorf("Expected %s but got %s", expected, actual)
+		}
+	}
+}
+
+func BenchmarkStdEncoder(b *testing.B) {
+	benchmarkMarshaler(b, apns.DefaultPayloadMarshaler{})
+}
+
+func BenchmarkJsoniterEncoder(b *testing.B) {
+	benchmarkMarshaler(b, NewPayloadMarshaler())
+}
+
+func BenchmarkJsoniterDefaultEncoder(b *testing.B) {
+	benchmarkMarshaler(b, apns.DefaultPayloadMarshaler{Encoder: NewWithAPI(jsoniter.ConfigDefault)})
+}
+
+func benchmarkMarshaler(b *testing.B, marshaler apns.PayloadMarshaler) {
+	payloads := testPayloads()[:3]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, p := range payloads {
+			marshaler.Marshal(p, 2048)
+		}
+	}
+}
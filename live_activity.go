@@ -0,0 +1,124 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Kind of push a payload is
+//Apple takes the push type as a request header on HTTP/2, it isn't part
+//of the binary interface, but it decides which aps fields are allowed
+type PushType string
+
+const (
+	//Regular alert, background or voip push
+	PUSH_TYPE_DEFAULT PushType = ""
+	//Push which shows an alert, plays a sound or badges the app icon
+	PUSH_TYPE_ALERT PushType = "alert"
+	//Silent push which wakes the app to fetch content
+	PUSH_TYPE_BACKGROUND PushType = "background"
+	//Incoming call push, needs a VoIP Services certificate
+	PUSH_TYPE_VOIP PushType = "voip"
+	//Declarative Web Push shown by the browser, see Payload.WebPush
+	PUSH_TYPE_WEBPUSH PushType = "webpush"
+	//Tells a File Provider extension a container changed, see Payload.ContainerIdentifier
+	PUSH_TYPE_FILEPROVIDER PushType = "fileprovider"
+	//Wakes an MDM enrolled device to check in, see Payload.PushMagic
+	PUSH_TYPE_MDM PushType = "mdm"
+	//Start, update or end a Live Activity
+	PUSH_TYPE_LIVE_ACTIVITY PushType = "liveactivity"
+)
+
+//What a Live Activity push does to the activity
+type LiveActivityEvent string
+
+const (
+	//Start a new activity, requires AttributesType, Attributes and ContentState
+	LIVE_ACTIVITY_EVENT_START LiveActivityEvent = "start"
+	//Update a running activity, requires ContentState
+	LIVE_ACTIVITY_EVENT_UPDATE LiveActivityEvent = "update"
+	//End an activity, ContentState is optional final content
+	LIVE_ACTIVITY_EVENT_END LiveActivityEvent = "end"
+)
+
+//Returned when a Live Activity push is missing a field its event requires
+var ErrLiveActivityMissingField = errors.New("Live Activity push is missing a required field")
+
+//Returned when a Live Activity field is set on a payload which isn't a
+//Live Activity push
+var ErrLiveActivityField = errors.New("Live Activity field set on a payload which isn't a Live Activity push")
+
+//Check Live Activity fields are only set on Live Activity pushes and
+//that Live Activity pushes have the fields their event needs
+func (p *Payload) validateLiveActivity() error {
+	if p.PushType != PUSH_TYPE_LIVE_ACTIVITY {
+		switch {
+		case p.Event != "":
+			return fmt.Errorf("%w : Event", ErrLiveActivityField)
+		case p.ContentState != nil:
+			return fmt.Errorf("%w : ContentState", ErrLiveActivityField)
+		case p.AttributesType != "" || p.Attributes != nil:
+			return fmt.Errorf("%w : Attributes", ErrLiveActivityField)
+		case !p.StaleDate.IsZero():
+			return fmt.Errorf("%w : StaleDate", ErrLiveActivityField)
+		case !p.DismissalDate.IsZero():
+			return fmt.Errorf("%w : DismissalDate", ErrLiveActivityField)
+		}
+		return nil
+	}
+
+	switch p.Event {
+	case LIVE_ACTIVITY_EVENT_START:
+		if p.AttributesType == "" || p.Attributes == nil {
+			return fmt.Errorf("%w : start events need AttributesType and Attributes", ErrLiveActivityMissingField)
+		}
+		if p.ContentState == nil {
+			return fmt.Errorf("%w : start events need ContentState", ErrLiveActivityMissingField)
+		}
+	case LIVE_ACTIVITY_EVENT_UPDATE:
+		if p.ContentState == nil {
+			return fmt.Errorf("%w : update events need ContentState", ErrLiveActivityMissingField)
+		}
+	case LIVE_ACTIVITY_EVENT_END:
+	case "":
+		return fmt.Errorf("%w : Event", ErrLiveActivityMissingField)
+	default:
+		return fmt.Errorf("Unknown Live Activity event %q", p.Event)
+	}
+	if p.Event != LIVE_ACTIVITY_EVENT_START && (p.AttributesType != "" || p.Attributes != nil) {
+		return fmt.Errorf("%w : Attributes are only sent with start events", ErrLiveActivityField)
+	}
+	if p.Event != LIVE_ACTIVITY_EVENT_END && !p.DismissalDate.IsZero() {
+		return fmt.Errorf("%w : DismissalDate is only sent with end events", ErrLiveActivityField)
+	}
+	return nil
+}
+
+//Add Live Activity fields to the aps dictionary
+//Dates are sent as UNIX time in seconds, timestamp defaults to clock's now
+func (p *Payload) addLiveActivityFields(aps map[string]interface{}, clock Clock) {
+	if p.PushType != PUSH_TYPE_LIVE_ACTIVITY {
+		return
+	}
+	timestamp := p.Timestamp
+	if timestamp.IsZero() {
+		timestamp = clock.Now()
+	}
+	aps["timestamp"] = timestamp.Unix()
+	aps["event"] = p.Event
+	if p.ContentState != nil {
+		aps["content-state"] = p.ContentState
+	}
+	if p.AttributesType != "" {
+		aps["attributes-type"] = p.AttributesType
+	}
+	if p.Attributes != nil {
+		aps["attributes"] = p.Attributes
+	}
+	if !p.StaleDate.IsZero() {
+		aps["stale-date"] = p.StaleDate.Unix()
+	}
+	if !p.DismissalDate.IsZero() {
+		aps["dismissal-date"] = p.DismissalDate.Unix()
+	}
+}
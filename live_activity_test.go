@@ -0,0 +1,127 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLiveActivityDatesShouldMarshalToEpoch(t *testing.T) {
+	p := Payload{
+		PushType:      PUSH_TYPE_LIVE_ACTIVITY,
+		Event:         LIVE_ACTIVITY_EVENT_END,
+		Timestamp:     time.Unix(1699990000, 0),
+		StaleDate:     time.Unix(1700000000, 0),
+		DismissalDate: time.Unix(1700003600, 500),
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"aps":{"dismissal-date":1700003600,"event":"end","stale-date":1700000000,"timestamp":1699990000}}`
+	if string(json) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(json))
+	}
+}
+
+func TestLiveActivityTimestampShouldDefaultToTheMarshalerClock(t *testing.T) {
+	now := time.Unix(1699990000, 0)
+	p := Payload{
+		PushType: PUSH_TYPE_LIVE_ACTIVITY,
+		Event:    LIVE_ACTIVITY_EVENT_END,
+	}
+
+	json, err := DefaultPayloadMarshaler{Clock: fixedClock{now: &now}}.Marshal(&p, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"aps":{"event":"end","timestamp":1699990000}}`
+	if string(json) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(json))
+	}
+}
+
+func TestLiveActivityDatesShouldOnlyBeOnLiveActivities(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing",
+		StaleDate: time.Unix(1700000000, 0),
+	}
+
+	if _, err := p.Marshal(256); !errors.Is(err, ErrLiveActivityField) {
+		t.Errorf("Expected ErrLiveActivityField for StaleDate but got %v", err)
+	}
+
+	p.StaleDate = time.Time{}
+	p.DismissalDate = time.Unix(1700000000, 0)
+	if _, err := p.Marshal(256); !errors.Is(err, ErrLiveActivityField) {
+		t.Errorf("Expected ErrLiveActivityField for DismissalDate but got %v", err)
+	}
+}
+
+type testDeliveryState struct {
+	Status  string `json:"status"`
+	Minutes int    `json:"minutes"`
+}
+
+func TestLiveActivityContentStateShouldMarshal(t *testing.T) {
+	p := Payload{
+		PushType:       PUSH_TYPE_LIVE_ACTIVITY,
+		Event:          LIVE_ACTIVITY_EVENT_START,
+		Timestamp:      time.Unix(1700000000, 0),
+		AttributesType: "DeliveryAttributes",
+		Attributes:     map[string]string{"order": "42"},
+		ContentState:   testDeliveryState{Status: "cooking", Minutes: 20},
+		AlertText:      "Your order is being prepared",
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"aps":{"alert":"Your order is being prepared","attributes":{"order":"42"},"attributes-type":"DeliveryAttributes",` +
+		`"content-state":{"status":"cooking","minutes":20},"event":"start","timestamp":1700000000}}`
+	if string(json) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(json))
+	}
+
+	size, _ := p.EstimateSize()
+	if size != len(expected) {
+		t.Errorf("Expected content-state to count towards the size %v but got %v", len(expected), size)
+	}
+}
+
+func TestLiveActivityEventsShouldRequireFields(t *testing.T) {
+	state := testDeliveryState{Status: "cooking"}
+	missing := []Payload{
+		{PushType: PUSH_TYPE_LIVE_ACTIVITY, ContentState: state},
+		{PushType: PUSH_TYPE_LIVE_ACTIVITY, Event: LIVE_ACTIVITY_EVENT_UPDATE},
+		{PushType: PUSH_TYPE_LIVE_ACTIVITY, Event: LIVE_ACTIVITY_EVENT_START, ContentState: state},
+	}
+	for _, p := range missing {
+		if _, err := p.Marshal(256); !errors.Is(err, ErrLiveActivityMissingField) {
+			t.Errorf("Expected ErrLiveActivityMissingField for %+v but got %v", p, err)
+		}
+	}
+
+	misplaced := []Payload{
+		{Event: LIVE_ACTIVITY_EVENT_UPDATE},
+		{ContentState: state},
+		{PushType: PUSH_TYPE_LIVE_ACTIVITY, Event: LIVE_ACTIVITY_EVENT_UPDATE, ContentState: state,
+			DismissalDate: time.Unix(1700000000, 0)},
+		{PushType: PUSH_TYPE_LIVE_ACTIVITY, Event: LIVE_ACTIVITY_EVENT_END, AttributesType: "DeliveryAttributes"},
+	}
+	for _, p := range misplaced {
+		if _, err := p.Marshal(256); !errors.Is(err, ErrLiveActivityField) {
+			t.Errorf("Expected ErrLiveActivityField for %+v but got %v", p, err)
+		}
+	}
+
+	p := Payload{PushType: PUSH_TYPE_LIVE_ACTIVITY, Event: "pause"}
+	if _, err := p.Marshal(256); err == nil {
+		t.Error("Expected error for unknown event")
+	}
+}
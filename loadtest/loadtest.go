@@ -0,0 +1,207 @@
+//Package for soak and load testing connections and pools, driving payloads
+//at a steady rate and reporting throughput, allocations and latency
+package loadtest
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+//Config for a load test run
+type Config struct {
+	//sends a payload, e.g. a pool's Send or a function sending on a
+	//connection's SendChannel : required
+	Send func(payload *apns.Payload) error
+	//mock gateway the payloads end up at, for enqueue to flush latency,
+	//defaults to none (latency isn't reported)
+	Server *apnstest.Server
+	//number of payloads to send per second, defaults to 0 (as fast as Send returns)
+	Rate int
+	//number of milliseconds to send for, defaults to 10000
+	Duration int
+	//number of bytes of alert text in each payload, defaults to 100
+	PayloadSize int
+	//device token every payload is sent to, e.g. a real device for Apple's sandbox,
+	//defaults to a made up token for each payload (needed for latency)
+	Token string
+	//number of milliseconds to wait for the server to read every payload
+	//once sending stops, defaults to 5000
+	DrainTimeout int
+}
+
+//Results of a load test run
+type Report struct {
+	//Number of payloads Send accepted, and that it returned an error for
+	Sent       uint64
+	SendErrors uint64
+	//Number of sent payloads the server read (Server only)
+	Received uint64
+	//How long payloads were sent for
+	Elapsed time.Duration
+	//Payloads sent per second
+	Throughput float64
+	//Heap allocations and bytes allocated per payload sent, across the whole
+	//process (including the server if it's in process)
+	AllocsPerPayload float64
+	BytesPerPayload  float64
+	//Time from Send being called to the server reading the payload (Server only)
+	P50Latency time.Duration
+	P99Latency time.Duration
+	MaxLatency time.Duration
+}
+
+//Summary suitable for printing
+func (r *Report) String() string {
+	lines := []string{
+		fmt.Sprintf("sent:        %v in %v (%v errors)", r.Sent, r.Elapsed.Round(time.Millisecond), r.SendErrors),
+		fmt.Sprintf("throughput:  %.0f payloads/s", r.Throughput),
+		fmt.Sprintf("allocations: %.1f allocs/payload, %.0f bytes/payload", r.AllocsPerPayload, r.BytesPerPayload),
+	}
+	if r.P99Latency > 0 {
+		lines = append(lines,
+			fmt.Sprintf("received:    %v", r.Received),
+			fmt.Sprintf("latency:     p50 %v, p99 %v, max %v", r.P50Latency, r.P99Latency, r.MaxLatency))
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Token payload number seq is sent to, so the server can match it up
+func token(seq uint64) string {
+	return fmt.Sprintf("%064x", seq)
+}
+
+//Send payloads for the configured duration and report on them
+func Run(config *Config) (*Report, error) {
+	errorStrs := ""
+
+	if config.Send == nil {
+		errorStrs += "Invalid Send. Must be supplied\n"
+	}
+	if config.Rate < 0 {
+		errorStrs += "Invalid Rate. Should be >= 0\n"
+	}
+	if config.Duration < 0 {
+		errorStrs += "Invalid Duration. Should be > 0\n"
+	}
+	if config.PayloadSize < 0 {
+		errorStrs += "Invalid PayloadSize. Should be >= 0\n"
+	}
+	if config.DrainTimeout < 0 {
+		errorStrs += "Invalid DrainTimeout. Should be >= 0\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Duration == 0 {
+		config.Duration = 10000
+	}
+	if config.PayloadSize == 0 {
+		config.PayloadSize = 100
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 5000
+	}
+
+	report := &Report{}
+	alertText := strings.Repeat("x", config.PayloadSize)
+
+	//when each payload was sent, indexed by sequence number
+	lock := new(sync.Mutex)
+	var sentAt []time.Time
+	var latencies []time.Duration
+	var received uint64
+	if config.Server != nil {
+		config.Server.SetNotificationHandler(func(n *apnstest.Notification) {
+			seq, err := strconv.ParseUint(n.Token, 16, 64)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			if seq < uint64(len(sentAt)) {
+				latencies = append(latencies, n.ReceivedAt.Sub(sentAt[seq]))
+				atomic.AddUint64(&received, 1)
+			}
+			lock.Unlock()
+		})
+		defer config.Server.SetNotificationHandler(nil)
+	}
+
+	var interval time.Duration
+	if config.Rate > 0 {
+		interval = time.Second / time.Duration(config.Rate)
+	}
+	duration := time.Duration(config.Duration) * time.Millisecond
+
+	var memStart, memEnd runtime.MemStats
+	runtime.ReadMemStats(&memStart)
+	start := time.Now()
+	var seq uint64
+	for {
+		now := time.Now()
+		if now.Sub(start) >= duration {
+			break
+		}
+		if interval > 0 {
+			//pace from the start so slow sends are caught up on
+			if next := start.Add(time.Duration(seq) * interval); next.After(now) {
+				time.Sleep(next.Sub(now))
+			}
+		}
+
+		payload := &apns.Payload{Token: config.Token, AlertText: alertText}
+		if payload.Token == "" {
+			payload.Token = token(seq)
+		}
+		lock.Lock()
+		sentAt = append(sentAt, time.Now())
+		lock.Unlock()
+		if err := config.Send(payload); err != nil {
+			report.SendErrors++
+		} else {
+			report.Sent++
+		}
+		seq++
+	}
+	report.Elapsed = time.Since(start)
+	runtime.ReadMemStats(&memEnd)
+
+	if report.Sent > 0 {
+		report.Throughput = float64(report.Sent) / report.Elapsed.Seconds()
+		report.AllocsPerPayload = float64(memEnd.Mallocs-memStart.Mallocs) / float64(report.Sent)
+		report.BytesPerPayload = float64(memEnd.TotalAlloc-memStart.TotalAlloc) / float64(report.Sent)
+	}
+
+	if config.Server == nil {
+		return report, nil
+	}
+
+	deadline := time.Now().Add(time.Duration(config.DrainTimeout) * time.Millisecond)
+	for atomic.LoadUint64(&received) < report.Sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	report.Received = received
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		report.P50Latency = latencies[len(latencies)*50/100]
+		report.P99Latency = latencies[len(latencies)*99/100]
+		report.MaxLatency = latencies[len(latencies)-1]
+	}
+	return report, nil
+}
@@ -0,0 +1,54 @@
+package loadtest
+
+import (
+	"testing"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func TestRunShouldReportThroughputAndLatency(t *testing.T) {
+	server, err := apnstest.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	pool, err := apns.NewAPNSPool(&apns.APNSPoolConfig{
+		ConnectionConfig: server.Config(),
+		Size:             2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	report, err := Run(&Config{
+		Send:     pool.Send,
+		Server:   server,
+		Rate:     2000,
+		Duration: 200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Sent < 100 || report.Sent > 500 || report.SendErrors != 0 {
+		t.Errorf("Expected about 400 payloads to be sent at 2000/s for 200ms but got %v", report)
+	}
+	if report.Received != report.Sent {
+		t.Errorf("Expected the server to read every payload but got %v", report)
+	}
+	if report.P99Latency <= 0 || report.P99Latency < report.P50Latency || report.MaxLatency < report.P99Latency {
+		t.Errorf("Expected ordered latencies but got %v", report)
+	}
+	if report.AllocsPerPayload <= 0 {
+		t.Errorf("Expected allocations to be reported but got %v", report)
+	}
+}
+
+func TestRunShouldValidateConfig(t *testing.T) {
+	if _, err := Run(&Config{Rate: -1}); err == nil {
+		t.Error("Expected missing Send and negative Rate to be rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package apns
+
+import (
+	"fmt"
+)
+
+//Severity of a log line
+//A connection logs lines at its APNSConfig.LogLevel and below
+type LogLevel int
+
+const (
+	//Nothing is logged
+	LOG_LEVEL_OFF LogLevel = -1
+	//Failures which close a connection or lose track of a payload (the default)
+	//Nothing is logged at this level while payloads are being sent successfully
+	LOG_LEVEL_ERROR LogLevel = 0
+	//Payloads rejected before being sent, when there's no OnPayloadError
+	LOG_LEVEL_WARN LogLevel = 1
+	//Connections opening and closing
+	LOG_LEVEL_INFO LogLevel = 2
+	//Every frame written, too noisy for production
+	LOG_LEVEL_DEBUG LogLevel = 3
+)
+
+var logLevelNames = map[LogLevel]string{
+	LOG_LEVEL_OFF:   "OFF",
+	LOG_LEVEL_ERROR: "ERROR",
+	LOG_LEVEL_WARN:  "WARN",
+	LOG_LEVEL_INFO:  "INFO",
+	LOG_LEVEL_DEBUG: "DEBUG",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+//Destination for the library's log lines, e.g. an adapter for the app's logger
+//Only called for lines at or below the configured LogLevel
+//Called from the connection's go-routines, so must be safe for concurrent use
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+//Logger printing each line to stdout, the default
+type StdoutLogger struct{}
+
+func (StdoutLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
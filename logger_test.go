@@ -0,0 +1,88 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Logger keeping every line logged
+type testLogger struct {
+	lock  *sync.Mutex
+	lines []string
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{lock: new(sync.Mutex)}
+}
+
+func (l *testLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) output() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+//Send a good payload and one with a bad token, then disconnect
+func logSends(level LogLevel) string {
+	logger := newTestLogger()
+	apn := socketAPNSConnection(newMockConnPool(),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			GatewayHost:               "gateway.push.apple.com",
+			Logger:                    logger,
+			LogLevel:                  level,
+		})
+	apn.SendChannel <- testTokens(1)[0]
+	apn.SendChannel <- &Payload{Token: "4ec5"}
+	apn.Disconnect()
+	<-apn.CloseChannel
+	return logger.output()
+}
+
+func TestConnectionShouldLogNothingByDefaultWhileSending(t *testing.T) {
+	if output := logSends(LOG_LEVEL_ERROR); output != "" {
+		t.Errorf("Expected nothing to be logged but got\n%v", output)
+	}
+	if output := logSends(LOG_LEVEL_OFF); output != "" {
+		t.Errorf("Expected nothing to be logged but got\n%v", output)
+	}
+}
+
+func TestConnectionShouldLogAtConfiguredLevel(t *testing.T) {
+	output := logSends(LOG_LEVEL_WARN)
+	if !strings.HasPrefix(output, "WARN Error sending payload for token 4ec5") || strings.Contains(output, "INFO") {
+		t.Errorf("Expected only the payload error to be logged but got\n%v", output)
+	}
+
+	output = logSends(LOG_LEVEL_DEBUG)
+	for _, expected := range []string{
+		"INFO Connection to gateway.push.apple.com opened",
+		"DEBUG Wrote 1 payloads in",
+		"WARN Error sending payload for token 4ec5",
+		"INFO Connection to gateway.push.apple.com closed",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log to contain %q but got\n%v", expected, output)
+		}
+	}
+}
+
+func TestConfigShouldRejectUnknownLogLevel(t *testing.T) {
+	config := &APNSConfig{CertificateBytes: []byte{1}, KeyBytes: []byte{1}, LogLevel: LOG_LEVEL_DEBUG + 1}
+	if err := applyConfigDefaults(config); err == nil || !strings.Contains(err.Error(), "Invalid LogLevel") {
+		t.Errorf("Expected invalid LogLevel error but got %v", err)
+	}
+	if LogLevel(7).String() != "LogLevel(7)" || LOG_LEVEL_WARN.String() != "WARN" {
+		t.Error("Unexpected LogLevel names")
+	}
+}
@@ -0,0 +1,181 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Returned when an MDM push has no PushMagic
+var ErrMDMMissingField = errors.New("MDM push is missing a required field")
+
+//Returned when an MDM push has fields other than PushMagic, or PushMagic
+//is set on a payload which isn't an MDM push
+var ErrMDMField = errors.New("Field not allowed on an MDM push")
+
+//Returned by MDMEnrollments.Push for devices which aren't enrolled, or
+//whose token the feedback service has invalidated
+var ErrMDMDeviceNotEnrolled = errors.New("MDM device not enrolled")
+
+//Push credentials of an enrolled device, from its TokenUpdate check-in
+type MDMDevice struct {
+	//Device (or user channel) the credentials are for, e.g. the device's UDID
+	UDID string
+	//Device token, hex encoded
+	Token string
+	//Value the device checks MDM pushes for
+	PushMagic string
+	//Topic of the MDM push certificate the device enrolled with
+	Topic string
+	//When the credentials were last updated
+	UpdatedAt time.Time
+}
+
+//Store of enrolled devices' push credentials
+//It's also a TokenStore, so a FeedbackPoller can invalidate the tokens of
+//devices that were wiped or unenrolled without checking out
+type MDMDeviceStore interface {
+	TokenStore
+	//Save a device's credentials, replacing any it had before
+	PutMDMDevice(device *MDMDevice) error
+	//A device's credentials, nil if it isn't enrolled
+	MDMDevice(udid string) (*MDMDevice, error)
+	//Remove a device's credentials
+	DeleteMDMDevice(udid string) error
+}
+
+//Keeps an MDMDeviceStore in step with check-ins and builds the wake up
+//pushes for enrolled devices
+type MDMEnrollments struct {
+	//source of UpdatedAt times, defaults to SystemClock, set before the
+	//enrollments are used
+	Clock Clock
+	store MDMDeviceStore
+}
+
+//Create enrollments kept in store
+func NewMDMEnrollments(store MDMDeviceStore) *MDMEnrollments {
+	return &MDMEnrollments{store: store}
+}
+
+//Record a TokenUpdate check-in
+//A re-enrolled device checks in with a new token or PushMagic, which
+//replace (rotate) the old ones
+//Returns whether the device's credentials changed
+func (e *MDMEnrollments) TokenUpdate(udid string, token string, pushMagic string, topic string) (bool, error) {
+	if udid == "" || token == "" || pushMagic == "" {
+		return false, errors.New("Invalid TokenUpdate. Should have a UDID, token and PushMagic")
+	}
+	device, err := e.store.MDMDevice(udid)
+	if err != nil {
+		return false, err
+	}
+	if device != nil && device.Token == token && device.PushMagic == pushMagic && device.Topic == topic {
+		return false, nil
+	}
+	return true, e.store.PutMDMDevice(&MDMDevice{
+		UDID:      udid,
+		Token:     token,
+		PushMagic: pushMagic,
+		Topic:     topic,
+		UpdatedAt: configClock(e.Clock).Now(),
+	})
+}
+
+//Record a CheckOut, the device's credentials are forgotten
+func (e *MDMEnrollments) CheckOut(udid string) error {
+	return e.store.DeleteMDMDevice(udid)
+}
+
+//Wake up push telling a device to contact the MDM server
+func (e *MDMEnrollments) Push(udid string) (*Payload, error) {
+	device, err := e.store.MDMDevice(udid)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, fmt.Errorf("%w : %v", ErrMDMDeviceNotEnrolled, udid)
+	}
+	return NewMDMPush(device.Token, device.PushMagic), nil
+}
+
+//Wake up push for an MDM enrolled device
+//Send it on a connection using the MDM push certificate
+func NewMDMPush(token string, pushMagic string) *Payload {
+	return &Payload{
+		Token:     token,
+		PushMagic: pushMagic,
+		PushType:  PUSH_TYPE_MDM,
+		Priority:  PRIORITY_IMMEDIATE,
+	}
+}
+
+//Check an MDM push has its PushMagic, and nothing else
+func (p *Payload) validateMDM() error {
+	if p.PushType != PUSH_TYPE_MDM {
+		if p.PushMagic != "" {
+			return fmt.Errorf("%w : PushMagic", ErrMDMField)
+		}
+		return nil
+	}
+	if p.PushMagic == "" {
+		return fmt.Errorf("%w : PushMagic", ErrMDMMissingField)
+	}
+	//the device ignores everything but the mdm key
+	if len(p.apsMap(SystemClock)) != 0 || p.CustomFields != nil {
+		return fmt.Errorf("%w : only PushMagic is sent with MDM pushes", ErrMDMField)
+	}
+	return nil
+}
+
+//MDMDeviceStore held in memory, mostly useful for testing
+type MemoryMDMDeviceStore struct {
+	lock    *sync.Mutex
+	devices map[string]*MDMDevice
+}
+
+//Create a new empty in memory MDM device store
+func NewMemoryMDMDeviceStore() *MemoryMDMDeviceStore {
+	return &MemoryMDMDeviceStore{
+		lock:    new(sync.Mutex),
+		devices: make(map[string]*MDMDevice),
+	}
+}
+
+func (s *MemoryMDMDeviceStore) PutMDMDevice(device *MDMDevice) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d := *device
+	s.devices[device.UDID] = &d
+	return nil
+}
+
+func (s *MemoryMDMDeviceStore) MDMDevice(udid string) (*MDMDevice, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if device := s.devices[udid]; device != nil {
+		d := *device
+		return &d, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryMDMDeviceStore) DeleteMDMDevice(udid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.devices, udid)
+	return nil
+}
+
+//Forget devices with the token, unless they checked in again after timestamp
+func (s *MemoryMDMDeviceStore) InvalidateToken(token string, timestamp time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for udid, device := range s.devices {
+		if device.Token == token && device.UpdatedAt.Before(timestamp) {
+			delete(s.devices, udid)
+		}
+	}
+	return nil
+}
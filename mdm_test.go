@@ -0,0 +1,84 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMDMPushShouldMarshalPushMagic(t *testing.T) {
+	p := NewMDMPush(testTokens(1)[0].Token, "5A4B-magic")
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(json) != `{"mdm":"5A4B-magic"}` {
+		t.Errorf("Expected only the mdm key but got %v", string(json))
+	}
+
+	p.AlertText = "Hi"
+	if _, err := p.Marshal(256); !errors.Is(err, ErrMDMField) {
+		t.Errorf("Expected ErrMDMField for an alert but got %v", err)
+	}
+	p.AlertText = ""
+	p.PushMagic = ""
+	if _, err := p.Marshal(256); !errors.Is(err, ErrMDMMissingField) {
+		t.Errorf("Expected ErrMDMMissingField but got %v", err)
+	}
+	if _, err := (&Payload{AlertText: "Hi", PushMagic: "magic"}).Marshal(256); !errors.Is(err, ErrMDMField) {
+		t.Errorf("Expected ErrMDMField for PushMagic on a regular push but got %v", err)
+	}
+}
+
+//Clock whose Now is whatever now points to
+type fixedClock struct {
+	systemClock
+	now *time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return *c.now
+}
+
+func TestMDMEnrollmentsShouldRotateCredentials(t *testing.T) {
+	store := NewMemoryMDMDeviceStore()
+	enrollments := NewMDMEnrollments(store)
+	now := time.Unix(1700000000, 0)
+	enrollments.Clock = fixedClock{now: &now}
+
+	if changed, err := enrollments.TokenUpdate("udid-1", "aa01", "magic-1", "com.apple.mgmt.External.1"); !changed || err != nil {
+		t.Fatalf("Expected the first check-in to be saved but got %v, %v", changed, err)
+	}
+	if changed, _ := enrollments.TokenUpdate("udid-1", "aa01", "magic-1", "com.apple.mgmt.External.1"); changed {
+		t.Error("Expected a repeated check-in to leave the credentials alone")
+	}
+
+	//re-enrolled with new credentials
+	now = now.Add(time.Hour)
+	if changed, _ := enrollments.TokenUpdate("udid-1", "bb02", "magic-2", "com.apple.mgmt.External.1"); !changed {
+		t.Error("Expected new credentials to replace the old ones")
+	}
+	p, err := enrollments.Push("udid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Token != "bb02" || p.PushMagic != "magic-2" || p.PushType != PUSH_TYPE_MDM {
+		t.Errorf("Expected a push with the new credentials but got %+v", p)
+	}
+
+	//feedback from before the re-enrollment doesn't remove the device
+	store.InvalidateToken("bb02", now.Add(-time.Minute))
+	if _, err := enrollments.Push("udid-1"); err != nil {
+		t.Errorf("Expected the device to stay enrolled but got %v", err)
+	}
+	store.InvalidateToken("bb02", now.Add(time.Minute))
+	if _, err := enrollments.Push("udid-1"); !errors.Is(err, ErrMDMDeviceNotEnrolled) {
+		t.Errorf("Expected ErrMDMDeviceNotEnrolled after the token was invalidated but got %v", err)
+	}
+
+	enrollments.TokenUpdate("udid-2", "cc03", "magic-3", "")
+	enrollments.CheckOut("udid-2")
+	if _, err := enrollments.Push("udid-2"); !errors.Is(err, ErrMDMDeviceNotEnrolled) {
+		t.Errorf("Expected ErrMDMDeviceNotEnrolled after checking out but got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+//Source of the message ids payloads are framed with (see APNSConfig.MessageIDs)
+//Apple returns the id with an error, so ids must be unique among a
+//connection's in flight payloads. 0 is the null id and is skipped
+//Called from the connection's send go-routine, so a generator shared by
+//several connections must be THREADSAFE
+type MessageIDGenerator interface {
+	NextMessageID() uint32
+}
+
+//Function used as a MessageIDGenerator
+type MessageIDGeneratorFunc func() uint32
+
+func (f MessageIDGeneratorFunc) NextMessageID() uint32 {
+	return f()
+}
+
+//MessageIDGenerator counting from First to Last and wrapping back to First,
+//e.g. for senders in several processes to use their own part of the id space
+//THREADSAFE (so one range can be shared by a pool's connections)
+type MessageIDRange struct {
+	First uint32
+	Last  uint32
+	//Mutex to sync access to next
+	lock *sync.Mutex
+	next uint32
+}
+
+//Create a range of ids from first to last inclusive
+func NewMessageIDRange(first uint32, last uint32) (*MessageIDRange, error) {
+	if first == 0 {
+		return nil, errors.New("Invalid first message id. Should be greater than 0")
+	}
+	if last < first {
+		return nil, fmt.Errorf("Invalid last message id %v. Should be at least the first (%v)", last, first)
+	}
+	return &MessageIDRange{
+		First: first,
+		Last:  last,
+		lock:  new(sync.Mutex),
+		next:  first,
+	}, nil
+}
+
+//Range for one of partitions senders splitting the ids 1 to math.MaxUint32
+//equally between them, partition counting from 0
+func NewMessageIDPartition(partition int, partitions int) (*MessageIDRange, error) {
+	if partitions <= 0 || uint64(partitions) > math.MaxUint32 {
+		return nil, fmt.Errorf("Invalid partitions %v. Should be between 1 and %v", partitions, uint32(math.MaxUint32))
+	}
+	if partition < 0 || partition >= partitions {
+		return nil, fmt.Errorf("Invalid partition %v. Should be between 0 and %v", partition, partitions-1)
+	}
+	size := uint64(math.MaxUint32) / uint64(partitions)
+	first := uint64(partition)*size + 1
+	last := first + size - 1
+	if partition == partitions-1 {
+		//the last partition takes what's left over from dividing
+		last = math.MaxUint32
+	}
+	return NewMessageIDRange(uint32(first), uint32(last))
+}
+
+func (r *MessageIDRange) NextMessageID() uint32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := r.next
+	if r.next == r.Last {
+		r.next = r.First
+	} else {
+		r.next++
+	}
+	return id
+}
@@ -0,0 +1,80 @@
+package apns
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestMessageIDRangeShouldWrapToFirst(t *testing.T) {
+	r, err := NewMessageIDRange(5, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint32
+	for i := 0; i < 4; i++ {
+		ids = append(ids, r.NextMessageID())
+	}
+	if fmt.Sprint(ids) != "[5 6 7 5]" {
+		t.Errorf("Expected ids to wrap back to 5 but got %v", ids)
+	}
+
+	if _, err := NewMessageIDRange(0, 7); err == nil {
+		t.Error("Expected an error for a range including 0")
+	}
+	if _, err := NewMessageIDRange(7, 5); err == nil {
+		t.Error("Expected an error for a range ending before it starts")
+	}
+}
+
+func TestMessageIDPartitionsShouldCoverTheIDSpace(t *testing.T) {
+	var next uint32 = 1
+	for i := 0; i < 3; i++ {
+		r, err := NewMessageIDPartition(i, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.First != next || r.Last < r.First {
+			t.Errorf("Expected partition %v to start at %v but got %v-%v", i, next, r.First, r.Last)
+		}
+		next = r.Last + 1
+	}
+	if next != 0 {
+		t.Errorf("Expected the last partition to end at %v but got %v", uint32(math.MaxUint32), next-1)
+	}
+	if _, err := NewMessageIDPartition(3, 3); err == nil {
+		t.Error("Expected an error for a partition out of range")
+	}
+}
+
+func TestConnectionShouldUseInjectedIDsAndUUIDs(t *testing.T) {
+	ids, _ := NewMessageIDRange(1000, 1001)
+	uuids := 0
+	socket := newMockConnPool()
+	apn := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		GeneratePayloadUUIDs:      true,
+		GenerateUUID: func() (string, error) {
+			uuids++
+			return fmt.Sprintf("uuid-%v", uuids), nil
+		},
+		MessageIDs: ids,
+	})
+	defer apn.Disconnect()
+
+	payloads := testTokens(3)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	apn.Flush()
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 3 || written[0].ID != 1000 || written[1].ID != 1001 || written[2].ID != 1000 {
+		t.Errorf("Expected ids from the range but got %v", written)
+	}
+	if payloads[0].UUID != "uuid-1" || payloads[2].UUID != "uuid-3" {
+		t.Errorf("Expected generated UUIDs but got %v and %v", payloads[0].UUID, payloads[2].UUID)
+	}
+}
@@ -0,0 +1,57 @@
+package apns
+
+//Function wrapped around sending a payload, for validation, enrichment,
+//auditing or gating without changing the library
+//
+//Middleware can change the payload before calling next, return an error to
+//reject it, or return nil without calling next to drop it silently.
+//On a connection (APNSConfig.SendMiddleware) middleware runs on the send
+//go-routine, so it must not block on the connection, and errors are
+//reported to OnPayloadError
+type SendMiddleware func(next SendFunc) SendFunc
+
+//Wrap a SendFunc in middleware
+//The first middleware is called first and wraps all the others, e.g.
+//
+//	send := ChainSendMiddleware(pool.Send, audit, validate)
+//
+//calls audit, then validate, then pool.Send
+func ChainSendMiddleware(send SendFunc, middleware ...SendMiddleware) SendFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		send = middleware[i](send)
+	}
+	return send
+}
+
+//Something a connection reports back
+//Exactly one field is set
+type Result struct {
+	//A payload rejected before being sent, delivered to OnPayloadError
+	PayloadError *PayloadError
+	//The connection closing, delivered to ErrorHandlers, the InvalidTokenFeed
+	//and CloseChannel
+	Close *ConnectionClose
+}
+
+//Delivers a result to the connection's callbacks and CloseChannel
+type ResultFunc func(result *Result)
+
+//Function wrapped around delivering results, for logging, metric tagging or
+//transforming errors before they reach callbacks and channels
+//
+//Interceptors can change the result before calling next (e.g. replace
+//PayloadError.Err with an application error type) or not call next to
+//swallow a payload error. Connection closes should always be passed on,
+//CloseChannel is never written to otherwise.
+//Interceptors run on the connection's send go-routine, so they must not
+//block on the connection
+type ResultInterceptor func(next ResultFunc) ResultFunc
+
+//Wrap a ResultFunc in interceptors
+//The first interceptor is called first and wraps all the others
+func ChainResultInterceptors(deliver ResultFunc, interceptors ...ResultInterceptor) ResultFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		deliver = interceptors[i](deliver)
+	}
+	return deliver
+}
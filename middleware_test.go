@@ -0,0 +1,165 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainSendMiddlewareShouldCallInOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) SendMiddleware {
+		return func(next SendFunc) SendFunc {
+			return func(payload *Payload) error {
+				calls = append(calls, name)
+				return next(payload)
+			}
+		}
+	}
+	send := ChainSendMiddleware(func(payload *Payload) error {
+		calls = append(calls, "send")
+		return nil
+	}, record("first"), record("second"))
+
+	if err := send(&Payload{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ",") != "first,second,send" {
+		t.Errorf("Expected middleware to be called in order but got %v", calls)
+	}
+}
+
+func TestConnectionShouldRunSendMiddleware(t *testing.T) {
+	socket := newMockConnPool()
+	payloadErrors := make(chan *PayloadError, 1)
+	errGated := errors.New("Feature disabled")
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OnPayloadError: func(err *PayloadError) {
+				payloadErrors <- err
+			},
+			SendMiddleware: []SendMiddleware{
+				//gate
+				func(next SendFunc) SendFunc {
+					return func(payload *Payload) error {
+						if payload.Category == "gated" {
+							return errGated
+						}
+						return next(payload)
+					}
+				},
+				//enrich
+				func(next SendFunc) SendFunc {
+					return func(payload *Payload) error {
+						payload.CustomFields = map[string]interface{}{"v": 2}
+						return next(payload)
+					}
+				},
+			},
+		})
+
+	payloads := testTokens(2)
+	payloads[0].Category = "gated"
+	apn.SendChannel <- payloads[0]
+	apn.SendChannel <- payloads[1]
+
+	err := <-payloadErrors
+	if err.Payload != payloads[0] || !errors.Is(err, errGated) {
+		t.Errorf("Expected gated payload to be reported with the middleware error but got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the payload to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 1 || written[0].Payload != `{"aps":{},"v":2}` {
+		t.Errorf("Expected only the enriched payload to be written but got %v", written)
+	}
+}
+
+type taggedError struct {
+	tag string
+	err error
+}
+
+func (e *taggedError) Error() string {
+	return e.tag + " : " + e.err.Error()
+}
+
+func (e *taggedError) Unwrap() error {
+	return e.err
+}
+
+func TestConnectionShouldRunResultInterceptors(t *testing.T) {
+	var calls []string
+	var handled *AppleError
+	payloadErrors := make(chan *PayloadError, 1)
+
+	apn := socketAPNSConnection(newMockConnAppleError(2, 2, 8),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OnPayloadError: func(err *PayloadError) {
+				payloadErrors <- err
+			},
+			ErrorHandlers: map[uint8]AppleErrorHandler{
+				8: func(err *AppleError, payload *Payload) {
+					calls = append(calls, "handler")
+					handled = err
+				},
+			},
+			ResultInterceptors: []ResultInterceptor{
+				//log
+				func(next ResultFunc) ResultFunc {
+					return func(result *Result) {
+						calls = append(calls, "log")
+						next(result)
+					}
+				},
+				//transform
+				func(next ResultFunc) ResultFunc {
+					return func(result *Result) {
+						calls = append(calls, "transform")
+						if result.PayloadError != nil {
+							result.PayloadError.Err = &taggedError{tag: "tenant-1", err: result.PayloadError.Err}
+						}
+						next(result)
+					}
+				},
+			},
+		})
+
+	apn.SendChannel <- &Payload{Token: "4ec500"}
+	err := <-payloadErrors
+	var tagged *taggedError
+	if !errors.As(err, &tagged) || tagged.tag != "tenant-1" || !errors.Is(err, ErrBadTokenLength) {
+		t.Errorf("Expected payload error to be transformed but got %v", err)
+	}
+
+	for _, p := range testTokens(2) {
+		apn.SendChannel <- p
+	}
+	connectionClose := <-apn.CloseChannel
+
+	if strings.Join(calls, ",") != "log,transform,log,transform,handler" {
+		t.Errorf("Expected interceptors to run in order before the handler but got %v", calls)
+	}
+	if handled == nil || handled != connectionClose.Error {
+		t.Errorf("Expected close to reach the error handler and CloseChannel but got %v", handled)
+	}
+}
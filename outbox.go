@@ -0,0 +1,284 @@
+package apns
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+//Durable storage for payloads on their way to apple
+//
+//When set on APNSConfig a connection appends every payload to the store before
+//sending it, then marks it sent once apple has had the chance to reject it
+//(it's dropped out of the in-flight buffer or the connection closed after it)
+//or failed if apple rejected it. Payloads returned as unsent on a connection
+//close are left pending, so PendingIterator gives everything that still needs
+//to be sent after a crash or restart.
+//
+//Implementations must be safe for use from multiple connections at once
+type OutboxStore interface {
+	//Persist a payload which is about to be sent, returning its record id
+	Append(payload *Payload) (string, error)
+	//Mark a record as delivered to apple
+	MarkSent(id string) error
+	//Mark a record as rejected by apple so it isn't sent again
+	MarkFailed(id string, reason error) error
+	//Iterate over records not yet marked sent or failed, oldest first
+	PendingIterator() (OutboxIterator, error)
+}
+
+//Iterator over pending outbox records
+type OutboxIterator interface {
+	//Advance to the next record, returns false when done or on error
+	Next() bool
+	//The current record's payload, with OutboxID set to the record id
+	Payload() *Payload
+	//Error that stopped iteration, if any
+	Err() error
+	//Release any resources held by the iterator
+	Close() error
+}
+
+//Resend every pending payload in an outbox
+//Payloads keep their OutboxID so they aren't appended to the store again
+//Returns the number of payloads sent
+func ReplayOutbox(store OutboxStore, send SendFunc) (int, error) {
+	iter, err := store.PendingIterator()
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	sent := 0
+	for iter.Next() {
+		if err := send(iter.Payload()); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, iter.Err()
+}
+
+//Function which sends a payload, like APNSPool.Send
+type SendFunc func(payload *Payload) error
+
+//OutboxStore held in memory, mostly useful for testing
+//Records are lost when the process exits
+type MemoryOutboxStore struct {
+	lock    *sync.Mutex
+	counter int
+	//pending records in the order they were appended
+	pending *list.List
+	//pending records by id
+	records map[string]*list.Element
+	//ids of records marked failed, and why
+	failed map[string]error
+}
+
+//Create a new empty in memory outbox
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{
+		lock:    new(sync.Mutex),
+		pending: list.New(),
+		records: make(map[string]*list.Element),
+		failed:  make(map[string]error),
+	}
+}
+
+func (s *MemoryOutboxStore) Append(payload *Payload) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counter++
+	id := strconv.Itoa(s.counter)
+	s.records[id] = s.pending.PushBack(&outboxRecord{id: id, payload: payload})
+	return id, nil
+}
+
+func (s *MemoryOutboxStore) MarkSent(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(id)
+}
+
+func (s *MemoryOutboxStore) MarkFailed(id string, reason error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.remove(id); err != nil {
+		return err
+	}
+	s.failed[id] = reason
+	return nil
+}
+
+//Number of records waiting to be sent
+func (s *MemoryOutboxStore) PendingLen() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending.Len()
+}
+
+//Reasons records were marked failed, by record id
+func (s *MemoryOutboxStore) Failed() map[string]error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	failed := make(map[string]error, len(s.failed))
+	for id, reason := range s.failed {
+		failed[id] = reason
+	}
+	return failed
+}
+
+//Iterates over a snapshot of the pending records
+func (s *MemoryOutboxStore) PendingIterator() (OutboxIterator, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make([]*outboxRecord, 0, s.pending.Len())
+	for e := s.pending.Front(); e != nil; e = e.Next() {
+		records = append(records, e.Value.(*outboxRecord))
+	}
+	return &memoryOutboxIterator{records: records, index: -1}, nil
+}
+
+//NOT THREADSAFE (need to acquire lock before calling)
+func (s *MemoryOutboxStore) remove(id string) error {
+	e, ok := s.records[id]
+	if !ok {
+		return errors.New("Unknown outbox record " + id)
+	}
+	s.pending.Remove(e)
+	delete(s.records, id)
+	return nil
+}
+
+type outboxRecord struct {
+	id      string
+	payload *Payload
+}
+
+type memoryOutboxIterator struct {
+	records []*outboxRecord
+	index   int
+}
+
+func (i *memoryOutboxIterator) Next() bool {
+	i.index++
+	return i.index < len(i.records)
+}
+
+func (i *memoryOutboxIterator) Payload() *Payload {
+	record := i.records[i.index]
+	record.payload.OutboxID = record.id
+	return record.payload
+}
+
+func (i *memoryOutboxIterator) Err() error {
+	return nil
+}
+
+func (i *memoryOutboxIterator) Close() error {
+	return nil
+}
+
+//Serialized form of a payload for durable outbox stores
+type storedPayload struct {
+	Payload *Payload
+	//Whether the badge was set, for records written before BadgeNumber
+	//marshalled unset badges as null
+	BadgeSet bool
+}
+
+//How durable outbox stores compress the payloads they write
+//Payloads of a campaign are highly repetitive, so compressing keeps the
+//store small for large sends at the cost of some CPU per Append
+type OutboxCompression uint8
+
+const (
+	//Payloads are stored as plain JSON
+	OUTBOX_COMPRESSION_NONE OutboxCompression = 0
+	//Payloads are stored as gzipped JSON
+	OUTBOX_COMPRESSION_GZIP OutboxCompression = 1
+)
+
+//First bytes of a gzip stream, which JSON can't start with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+//gzip writers, reused as each allocates several hundred KB
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+//Serialize a payload for a durable outbox store
+//For use by OutboxStore implementations which need to write payloads out
+//ExtraData and CustomFields must be json serializable, and come back
+//as generic json values (map[string]interface{}, float64, etc)
+func MarshalOutboxPayload(p *Payload) ([]byte, error) {
+	return json.Marshal(storedPayload{
+		Payload:  p,
+		BadgeSet: p.Badge.IsSet(),
+	})
+}
+
+//Serialize a payload as MarshalOutboxPayload does, then compress it
+//UnmarshalOutboxPayload reads any compression, so a store can switch
+//compression with records of the old kind still pending
+func MarshalOutboxPayloadCompressed(p *Payload, compression OutboxCompression) ([]byte, error) {
+	data, err := MarshalOutboxPayload(p)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case OUTBOX_COMPRESSION_NONE:
+		return data, nil
+	case OUTBOX_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Invalid outbox compression %v. Should be OUTBOX_COMPRESSION_NONE or OUTBOX_COMPRESSION_GZIP", compression)
+}
+
+//Deserialize a payload written by MarshalOutboxPayload or
+//MarshalOutboxPayloadCompressed
+func UnmarshalOutboxPayload(data []byte) (*Payload, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("Error decompressing outbox record : %v", err)
+		}
+	}
+	stored := storedPayload{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	if stored.Payload == nil {
+		return nil, errors.New("Outbox record has no payload")
+	}
+	if !stored.BadgeSet {
+		stored.Payload.Badge.UnSet()
+	}
+	return stored.Payload, nil
+}
@@ -0,0 +1,172 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMemoryOutboxStoreTracksPending(t *testing.T) {
+	store := NewMemoryOutboxStore()
+
+	ids := make([]string, 3)
+	for i := range ids {
+		ids[i], _ = store.Append(&Payload{AlertText: string(rune('a' + i))})
+	}
+
+	if err := store.MarkSent(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkFailed(ids[1], errors.New("Rejected")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkSent("missing"); err == nil {
+		t.Error("Expected error marking unknown record")
+	}
+
+	if store.PendingLen() != 1 {
+		t.Errorf("Expected 1 pending record but got %v", store.PendingLen())
+	}
+	if store.Failed()[ids[1]] == nil {
+		t.Error("Expected failed record to be recorded")
+	}
+
+	var replayed []*Payload
+	sent, err := ReplayOutbox(store, func(p *Payload) error {
+		replayed = append(replayed, p)
+		return nil
+	})
+	if err != nil || sent != 1 {
+		t.Fatalf("Expected 1 payload replayed but got %v, %v", sent, err)
+	}
+	if replayed[0].AlertText != "c" || replayed[0].OutboxID != ids[2] {
+		t.Errorf("Expected pending payload c with its outbox id but got %+v", replayed[0])
+	}
+}
+
+func TestConnectionShouldRecordPayloadFatesInOutbox(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	socket := newMockConnAppleError(3, 2, 8)
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OutboxStore:               store,
+		})
+
+	payloads := testTokens(3)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	connectionClose := <-apn.CloseChannel
+
+	if connectionClose.ErrorPayload != payloads[1] {
+		t.Fatalf("Expected second payload to fail but got %v", connectionClose.ErrorPayload)
+	}
+	if _, ok := store.Failed()[payloads[1].OutboxID]; !ok {
+		t.Error("Expected error payload to be marked failed")
+	}
+
+	iter, _ := store.PendingIterator()
+	defer iter.Close()
+	if !iter.Next() || iter.Payload() != payloads[2] || iter.Next() {
+		t.Error("Expected only the unsent payload to be left pending")
+	}
+}
+
+func TestConnectionShouldMarkOutboxSentOnDisconnect(t *testing.T) {
+	store := NewMemoryOutboxStore()
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OutboxStore:               store,
+		})
+
+	for _, p := range testTokens(3) {
+		apn.SendChannel <- p
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if store.PendingLen() != 0 {
+		t.Errorf("Expected all payloads marked sent but %v are pending", store.PendingLen())
+	}
+}
+
+func TestOutboxPayloadEncodingRoundTrips(t *testing.T) {
+	p := &Payload{
+		Token:        "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		AlertText:    "Testing",
+		Badge:        NewBadgeNumber(0),
+		CustomFields: map[string]interface{}{"str": "string"},
+		Priority:     10,
+	}
+
+	data, err := MarshalOutboxPayload(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalOutboxPayload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Token != p.Token || decoded.AlertText != p.AlertText ||
+		decoded.Priority != p.Priority || decoded.CustomFields["str"] != "string" {
+		t.Errorf("Expected %+v but got %+v", p, decoded)
+	}
+	if !decoded.Badge.IsSet() || decoded.Badge.Number() != 0 {
+		t.Error("Expected badge cleared to 0 to stay set")
+	}
+
+	data, _ = MarshalOutboxPayload(&Payload{Token: p.Token})
+	decoded, _ = UnmarshalOutboxPayload(data)
+	if decoded.Badge.IsSet() {
+		t.Error("Expected unset badge to stay unset")
+	}
+}
+
+func TestOutboxPayloadCompressionRoundTrips(t *testing.T) {
+	p := &Payload{
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		AlertText: strings.Repeat("Big sale this weekend! ", 20),
+		Badge:     NewBadgeNumber(3),
+	}
+	plain, err := MarshalOutboxPayload(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := MarshalOutboxPayloadCompressed(p, OUTBOX_COMPRESSION_GZIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(plain)/2 {
+		t.Errorf("Expected a repetitive payload to compress to under half of %v bytes but got %v",
+			len(plain), len(compressed))
+	}
+
+	for _, data := range [][]byte{plain, compressed} {
+		decoded, err := UnmarshalOutboxPayload(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.AlertText != p.AlertText || decoded.Badge.Number() != 3 {
+			t.Errorf("Expected %+v but got %+v", p, decoded)
+		}
+	}
+
+	if _, err := MarshalOutboxPayloadCompressed(p, 9); err == nil {
+		t.Error("Expected an error for an unknown compression")
+	}
+	if _, err := UnmarshalOutboxPayload(compressed[:len(compressed)-4]); err == nil {
+		t.Error("Expected an error for a truncated record")
+	}
+}
@@ -1,22 +1,75 @@
 package apns
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 )
 
 //Object describing a push notification payload
 type Payload struct {
 	// Basic alert structure
+	// Sound is SoundDefault, a sound file name, or SoundNone to omit it
 	AlertText        string
 	Badge            BadgeNumber
 	Sound            string
 	ContentAvailable int
 	Category         string
 
+	// Identifier of the window or content to bring forward when the
+	// notification is opened (UIScene apps). >= iOS 13
+	TargetContentID string
+
+	// Criteria the app's Focus filter uses to decide whether the
+	// notification is shown while a Focus is on. >= iOS 16
+	FilterCriteria string
+
+	// Declarative Web Push notification, only allowed (and required) when
+	// PushType is PUSH_TYPE_WEBPUSH, sent in place of the aps dictionary
+	// Badge is sent as the site's app badge
+	WebPush *WebPushNotification
+	// Whether the site's service worker can change the web push before it's shown
+	WebPushMutable bool
+
+	// Container of a File Provider extension whose items changed, e.g.
+	// FILE_PROVIDER_WORKING_SET, only allowed (and required) when PushType is
+	// PUSH_TYPE_FILEPROVIDER, sent as container-identifier beside an empty aps
+	ContainerIdentifier string
+
+	// PushMagic from an MDM enrolled device's TokenUpdate check-in, only allowed
+	// (and required) when PushType is PUSH_TYPE_MDM, sent as the only key
+	// See MDMEnrollments
+	PushMagic string
+
+	// Values for the placeholders in a Safari website's urlFormatString,
+	// sent as url-args when not nil (Safari requires it, even if empty)
+	// See the safaripush package
+	URLArgs []string
+
+	// Kind of push, set to PUSH_TYPE_LIVE_ACTIVITY for Live Activity updates
+	// The presets (NewAlertPush, NewSilentPush, ...) set it for their kind of push
+	PushType PushType
+
+	// Live Activity fields, only allowed when PushType is PUSH_TYPE_LIVE_ACTIVITY
+	// Whether the push starts, updates or ends the activity : required
+	Event LiveActivityEvent
+	// Value marshaled as the activity's content-state, e.g. a struct matching
+	// the app's ContentState type. Counts towards the max payload size
+	ContentState interface{}
+	// Name and value of the app's ActivityAttributes, start events only
+	AttributesType string
+	Attributes     interface{}
+	// When the content was generated, defaults to when the payload is marshaled
+	// (by the marshaler's Clock, or APNSConfig.Clock for connections without a PayloadMarshaler)
+	Timestamp time.Time
+	// When the system marks the activity's content as out of date
+	StaleDate time.Time
+	// When the system removes an ended activity from the lock screen
+	DismissalDate time.Time
+
 	// If this is an enhanced message, use
 	// an APSAlertBody instead of .Alert
+	// AlertText is used as the body if AlertBody.Body isn't set
 	AlertBody APSAlertBody
 
 	// Any custom fields to be added to the apns payload
@@ -24,17 +77,40 @@ type Payload struct {
 	CustomFields map[string]interface{}
 
 	// Payload server fields
-	// UNIX time in seconds when the payload is invalid
+	// UNIX time in seconds when the payload is invalid, Apple stores it and
+	// retries delivery to an offline device until then
+	// NoExpiration (0) leaves it out, ExpireImmediately delivers only if the
+	// device is online now
 	ExpirationTime uint32
-	// Must be either 5 or 10, if not one of these two values will default to 5
+	// How long the payload is valid for once it's written to Apple, used for
+	// ExpirationTime when that's NoExpiration so time spent queued doesn't count
+	TimeToLive time.Duration
+	// PRIORITY_IMMEDIATE (10), PRIORITY_CONSERVE_POWER (5) or PRIORITY_DEFAULT (0)
+	// to leave it out, anything else fails to send with ErrInvalidPriority
 	Priority uint8
 
 	// Device push token, should contain no spaces
 	Token string
 
+	// Identifier for payloads which replace each other on the device
+	// Not sent to apple over the binary interface, but used to
+	// detect duplicate payloads, and only the newest of any queued
+	// payloads with the same token and CollapseID is sent
+	CollapseID string
+
 	// Any extra data to be associated with this payload,
 	// Will not be sent to apple but will be held onto for error cases
 	ExtraData interface{}
+
+	// Unique id for tracking the payload through errors and callbacks
+	// Generated when the connection takes the payload if
+	// APNSConfig.GeneratePayloadUUIDs is set and it's empty
+	UUID string
+
+	// Id of the payload's record in the connection's OutboxStore
+	// Set when the payload is appended to the store, payloads
+	// which already have one aren't appended again
+	OutboxID string
 }
 
 type APSAlertBody struct {
@@ -51,22 +127,13 @@ type APSAlertBody struct {
 	Title        string   `json:"title,omitempty"`
 	TitleLocKey  string   `json:"title-loc-key,omitempty"`
 	TitleLocArgs []string `json:"title-loc-args,omitempty"`
-}
 
-type alertBodyAps struct {
-	Alert            APSAlertBody
-	Badge            BadgeNumber
-	Sound            string
-	Category         string
-	ContentAvailable int
-}
+	// Notification group summary text fields. >= iOS 12
+	SummaryArg      string `json:"summary-arg,omitempty"`
+	SummaryArgCount int    `json:"summary-arg-count,omitempty"`
 
-type simpleAps struct {
-	Alert            string
-	Badge            BadgeNumber
-	Sound            string
-	Category         string
-	ContentAvailable int
+	// Label of the Safari website push's action button, defaults to "Show"
+	Action string `json:"action,omitempty"`
 }
 
 // Convert a Payload into a json object and then converted to a byte array
@@ -74,98 +141,81 @@ type simpleAps struct {
 // an attempt will be made to truncate the AlertText
 // If this cannot be done, then an error will be returned
 func (p *Payload) Marshal(maxPayloadSize int) ([]byte, error) {
-	if p.isSimple() {
-		return p.marshalSimplePayload(maxPayloadSize)
-	} else {
-		return p.marshalAlertBodyPayload(maxPayloadSize)
-	}
-}
-
-//Whether or not to use simple aps format or not
-func (p *Payload) isSimple() bool {
-	return p.AlertBody.Body == ""
+	return p.marshal(StdJSONEncoder{}, SystemClock, maxPayloadSize)
 }
 
-//Helper method to generate a json compatible map with aps key + custom fields
-//will return error if custom field named aps supplied
-func constructFullPayload(aps interface{}, customFields map[string]interface{}) (map[string]interface{}, error) {
-	var fullPayload = make(map[string]interface{})
-	fullPayload["aps"] = aps
-	for key, value := range customFields {
-		if key == "aps" {
-			return nil, errors.New("Cannot have a custom field named aps")
-		}
-		fullPayload[key] = value
+// Number of bytes the payload marshals to before any truncation
+// Errors if the payload can't be marshalled (e.g. a custom field named aps)
+func (p *Payload) EstimateSize() (int, error) {
+	if p.PushType == PUSH_TYPE_WEBPUSH {
+		jsonStr, err := StdJSONEncoder{}.Marshal(p.webPushMap())
+		return len(jsonStr), err
 	}
-	return fullPayload, nil
-}
-
-//Handle simple payload case with just text alert
-//Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalSimplePayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
-
-	//use simple payload
-	aps := simpleAps{
-		Alert:            p.AlertText,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
+	if p.PushType == PUSH_TYPE_MDM {
+		jsonStr, err := StdJSONEncoder{}.Marshal(map[string]interface{}{"mdm": p.PushMagic})
+		return len(jsonStr), err
 	}
-
-	fullPayload, err := constructFullPayload(aps, p.CustomFields)
+	fullPayload, err := constructFullPayload(p.apsMap(SystemClock), p.CustomFields)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	p.addFileProviderFields(fullPayload)
 
-	jsonStr, err = json.Marshal(fullPayload)
+	jsonStr, err := StdJSONEncoder{}.Marshal(fullPayload)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return len(jsonStr), nil
+}
 
-	payloadLen := len(jsonStr)
-
-	if payloadLen > maxPayloadSize {
-		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertText) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
-		}
-		aps.Alert = aps.Alert[:len(aps.Alert)-clipSize] + "..."
-		fullPayload["aps"] = aps
-		if err != nil {
-			return nil, err
-		}
-
-		jsonStr, err = json.Marshal(fullPayload)
-		if err != nil {
-			return nil, err
-		}
+// Number of bytes left before the payload reaches maxPayloadSize
+// Negative if the payload is over and its alert text would be truncated
+// (or it would fail to send if there isn't enough alert text to truncate)
+func (p *Payload) RemainingBytes(maxPayloadSize int) (int, error) {
+	size, err := p.EstimateSize()
+	if err != nil {
+		return 0, err
 	}
-
-	return jsonStr, nil
+	return maxPayloadSize - size, nil
 }
 
-//Handle complet payload case with alert object
+//Marshal with the given encoder, clock gives Live Activity timestamps that aren't set
 //Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalAlertBodyPayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
-
-	// Use APSAlertBody payload
-	aps := alertBodyAps{
-		Alert:            p.AlertBody,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
+func (p *Payload) marshal(encoder JSONEncoder, clock Clock, maxPayloadSize int) ([]byte, error) {
+	if err := ValidateSoundName(p.Sound); err != nil {
+		return nil, err
+	}
+	if err := ValidatePriority(p.Priority); err != nil {
+		return nil, err
+	}
+	if err := p.validateLiveActivity(); err != nil {
+		return nil, err
+	}
+	if err := p.validateWebPush(); err != nil {
+		return nil, err
+	}
+	if err := p.validateFileProvider(); err != nil {
+		return nil, err
+	}
+	if err := p.validateMDM(); err != nil {
+		return nil, err
+	}
+	if p.PushType == PUSH_TYPE_MDM {
+		return encoder.Marshal(map[string]interface{}{"mdm": p.PushMagic})
+	}
+	if p.PushType == PUSH_TYPE_WEBPUSH {
+		return p.marshalWebPush(encoder, maxPayloadSize)
 	}
 
+	aps := p.apsMap(clock)
+
 	fullPayload, err := constructFullPayload(aps, p.CustomFields)
 	if err != nil {
 		return nil, err
 	}
+	p.addFileProviderFields(fullPayload)
 
-	jsonStr, err = json.Marshal(fullPayload)
+	jsonStr, err := encoder.Marshal(fullPayload)
 	if err != nil {
 		return nil, err
 	}
@@ -174,16 +224,21 @@ func (p *Payload) marshalAlertBodyPayload(maxPayloadSize int) ([]byte, error) {
 
 	if payloadLen > maxPayloadSize {
 		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertBody.Body) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall %v or less bytes", maxPayloadSize))
-		}
-		aps.Alert.Body = aps.Alert.Body[:len(aps.Alert.Body)-clipSize] + "..."
-		fullPayload["aps"] = aps
-		if err != nil {
-			return nil, err
+		if p.isSimple() {
+			if clipSize > len(p.AlertText) {
+				return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
+			}
+			aps["alert"] = p.AlertText[:len(p.AlertText)-clipSize] + "..."
+		} else {
+			alert := p.alertBody()
+			if clipSize > len(alert.Body) {
+				return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall %v or less bytes", maxPayloadSize))
+			}
+			alert.Body = alert.Body[:len(alert.Body)-clipSize] + "..."
+			aps["alert"] = alert
 		}
 
-		jsonStr, err = json.Marshal(fullPayload)
+		jsonStr, err = encoder.Marshal(fullPayload)
 		if err != nil {
 			return nil, err
 		}
@@ -192,44 +247,76 @@ func (p *Payload) marshalAlertBodyPayload(maxPayloadSize int) ([]byte, error) {
 	return jsonStr, nil
 }
 
-func (s simpleAps) MarshalJSON() ([]byte, error) {
-	toMarshal := make(map[string]interface{})
+//Whether or not to use simple aps format or not
+//Simple format is used unless any AlertBody field is set
+func (p *Payload) isSimple() bool {
+	a := p.AlertBody
+	return a.Body == "" && a.ActionLocKey == "" && a.LocKey == "" &&
+		len(a.LocArgs) == 0 && a.LaunchImage == "" && a.Title == "" &&
+		a.TitleLocKey == "" && len(a.TitleLocArgs) == 0 &&
+		a.SummaryArg == "" && a.SummaryArgCount == 0 && a.Action == ""
+}
 
-	if s.Alert != "" {
-		toMarshal["alert"] = s.Alert
+//Alert dictionary to send
+//AlertText is used as the body if AlertBody doesn't have one, so fields
+//like LaunchImage can be added to a plain text alert
+func (p *Payload) alertBody() APSAlertBody {
+	alert := p.AlertBody
+	if alert.Body == "" {
+		alert.Body = p.AlertText
 	}
-	if s.Badge.IsSet() {
-		toMarshal["badge"] = s.Badge
+	return alert
+}
+
+//Build the aps dictionary
+//Plain maps and strings are used so any JSON encoder gives the same output
+//clock gives Live Activity timestamps that aren't set
+func (p *Payload) apsMap(clock Clock) map[string]interface{} {
+	aps := make(map[string]interface{})
+
+	if p.isSimple() {
+		if p.AlertText != "" {
+			aps["alert"] = p.AlertText
+		}
+	} else {
+		aps["alert"] = p.alertBody()
 	}
-	if s.Sound != "" {
-		toMarshal["sound"] = s.Sound
+	if p.Badge.IsSet() {
+		aps["badge"] = p.Badge.Number()
 	}
-	if s.Category != "" {
-		toMarshal["category"] = s.Category
+	if p.Sound != "" {
+		aps["sound"] = p.Sound
 	}
-	if s.ContentAvailable != 0 {
-		toMarshal["content-available"] = s.ContentAvailable
+	if p.Category != "" {
+		aps["category"] = p.Category
 	}
-
-	return json.Marshal(toMarshal)
-}
-
-func (a alertBodyAps) MarshalJSON() ([]byte, error) {
-	toMarshal := make(map[string]interface{})
-	toMarshal["alert"] = a.Alert
-
-	if a.Badge.IsSet() {
-		toMarshal["badge"] = a.Badge
+	if p.ContentAvailable != 0 {
+		aps["content-available"] = p.ContentAvailable
 	}
-	if a.Sound != "" {
-		toMarshal["sound"] = a.Sound
+	if p.TargetContentID != "" {
+		aps["target-content-id"] = p.TargetContentID
 	}
-	if a.Category != "" {
-		toMarshal["category"] = a.Category
+	if p.FilterCriteria != "" {
+		aps["filter-criteria"] = p.FilterCriteria
 	}
-	if a.ContentAvailable != 0 {
-		toMarshal["content-available"] = a.ContentAvailable
+	if p.URLArgs != nil {
+		aps["url-args"] = p.URLArgs
 	}
+	p.addLiveActivityFields(aps, clock)
+
+	return aps
+}
 
-	return json.Marshal(toMarshal)
+//Helper method to generate a json compatible map with aps key + custom fields
+//will return error if custom field named aps supplied
+func constructFullPayload(aps map[string]interface{}, customFields map[string]interface{}) (map[string]interface{}, error) {
+	var fullPayload = make(map[string]interface{})
+	fullPayload["aps"] = aps
+	for key, value := range customFields {
+		if key == "aps" {
+			return nil, errors.New("Cannot have a custom field named aps")
+		}
+		fullPayload[key] = value
+	}
+	return fullPayload, nil
 }
@@ -0,0 +1,33 @@
+package apns
+
+import (
+	"errors"
+)
+
+//Returned when a payload's token isn't valid hex
+var ErrBadTokenEncoding = errors.New("Token is not hex encoded")
+
+//Returned when a payload's token doesn't decode to APNS_TOKEN_SIZE bytes
+var ErrBadTokenLength = errors.New("Invalid token length")
+
+//Error for a payload which was rejected before being sent to Apple
+//The connection stays open and carries on with the next payload
+type PayloadError struct {
+	//The payload that couldn't be sent
+	Payload *Payload
+	//Why the payload couldn't be sent
+	//Use errors.Is to check for ErrBadTokenEncoding or ErrBadTokenLength
+	Err error
+	//The connection and timing the payload was rejected with
+	Metadata *SendMetadata
+	//how the token is shown in Error(), from the connection's config
+	tokenRedaction TokenRedaction
+}
+
+func (e *PayloadError) Error() string {
+	return "Error sending payload for token " + e.tokenRedaction.Redact(e.Payload.Token) + " : " + e.Err.Error()
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,26 @@
+package apns
+
+//Converts payloads to the JSON bytes sent to Apple
+//Implementations must return an error rather than more than maxPayloadSize bytes
+type PayloadMarshaler interface {
+	Marshal(p *Payload, maxPayloadSize int) ([]byte, error)
+}
+
+//Marshaler used when APNSConfig.PayloadMarshaler isn't set
+//Marshals like Payload.Marshal, truncating alert text to fit
+//Custom marshalers can wrap it to add fields or fall back to it
+type DefaultPayloadMarshaler struct {
+	//encoder used for the JSON encoding step, defaults to StdJSONEncoder
+	Encoder JSONEncoder
+	//source of Live Activity timestamps that aren't set, defaults to SystemClock
+	//connections marshalling without a PayloadMarshaler use APNSConfig.Clock
+	Clock Clock
+}
+
+func (m DefaultPayloadMarshaler) Marshal(p *Payload, maxPayloadSize int) ([]byte, error) {
+	encoder := m.Encoder
+	if encoder == nil {
+		encoder = StdJSONEncoder{}
+	}
+	return p.marshal(encoder, configClock(m.Clock), maxPayloadSize)
+}
@@ -0,0 +1,103 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/frame"
+)
+
+//Marshaler which adds a field to the aps dictionary
+type MockMutableContentMarshaler struct{}
+
+func (MockMutableContentMarshaler) Marshal(p *Payload, maxPayloadSize int) ([]byte, error) {
+	payloadBytes, err := DefaultPayloadMarshaler{}.Marshal(p, maxPayloadSize-len(`,"mutable-content":1`))
+	if err != nil {
+		return nil, err
+	}
+	//insert after `{"aps":{`
+	return append([]byte(`{"aps":{"mutable-content":1,`), payloadBytes[8:]...), nil
+}
+
+//Marshaler which writes the same JSON whatever the payload
+type MockStaticMarshaler struct{}
+
+func (MockStaticMarshaler) Marshal(p *Payload, maxPayloadSize int) ([]byte, error) {
+	return []byte(`{"aps":{"alert":"Static"}}`), nil
+}
+
+func TestConnectionShouldValidatePriorityWithConfiguredMarshaler(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			AcceptanceWindow:          1,
+			PayloadMarshaler:          MockStaticMarshaler{},
+			OnPayloadError:            func(err *PayloadError) {},
+		})
+
+	payloads := testTokens(2)
+	payloads[0].Priority = 7
+	payloads[1].Priority = PRIORITY_CONSERVE_POWER
+	invalid := apn.SendR(payloads[0])
+	valid := apn.SendR(payloads[1])
+	if err := <-invalid; !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("Expected ErrInvalidPriority but got %v", err)
+	}
+	if err := <-valid; err != nil {
+		t.Errorf("Expected the valid payload to be accepted but got %v", err)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := socket.WrittenBytes.Bytes()
+	items, err := frame.ParseFrame(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification, err := frame.ParseNotification(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parseNotifications(written)) != 1 || notification.Priority != PRIORITY_CONSERVE_POWER {
+		t.Errorf("Expected only the priority 5 payload to be written but got %+v", notification)
+	}
+}
+
+func TestConnectionShouldUseConfiguredMarshaler(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			PayloadMarshaler:          MockMutableContentMarshaler{},
+		})
+
+	payload := testTokens(1)[0]
+	payload.AlertText = "Testing"
+	apn.SendChannel <- payload
+
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the payload to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	notifications := parseNotifications(socket.WrittenBytes.Bytes())
+	expected := `{"aps":{"mutable-content":1,"alert":"Testing"}}`
+	if len(notifications) != 1 || notifications[0].Payload != expected {
+		t.Errorf("Expected payload %v but got %v", expected, notifications)
+	}
+}
@@ -0,0 +1,131 @@
+package apns
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+//Fields identifying a payload rather than describing what's sent, which
+//merges leave empty and diffs skip
+var payloadIdentityFields = map[string]bool{"UUID": true, "OutboxID": true}
+
+//A field two payloads have different values for
+type PayloadDifference struct {
+	//Field name, e.g. "Sound", "AlertBody.Title" or "CustomFields[user_id]"
+	Field string
+	//The field's value in each payload, nil for a custom field a payload doesn't have
+	A interface{}
+	B interface{}
+}
+
+func (d PayloadDifference) String() string {
+	return fmt.Sprintf("%v: %v != %v", d.Field, d.A, d.B)
+}
+
+//New payload with base's fields, replaced by the fields override has set
+//(non-zero values), e.g. to apply per-user values to a shared template
+//AlertBody is merged field by field and CustomFields key by key
+//Values are copied shallowly, and UUID and OutboxID are left empty since
+//the result is a new payload
+func MergePayloads(base *Payload, override *Payload) *Payload {
+	merged := &Payload{}
+	for _, p := range []*Payload{base, override} {
+		if p == nil {
+			continue
+		}
+		mergeFields(reflect.ValueOf(merged).Elem(), reflect.ValueOf(p).Elem())
+		if p.CustomFields != nil && merged.CustomFields == nil {
+			merged.CustomFields = make(map[string]interface{}, len(p.CustomFields))
+		}
+		for key, value := range p.CustomFields {
+			merged.CustomFields[key] = value
+		}
+	}
+	return merged
+}
+
+//Copy the non-zero fields of src to dst, recursing into the alert body
+func mergeFields(dst reflect.Value, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		name := src.Type().Field(i).Name
+		field := src.Field(i)
+		switch {
+		case payloadIdentityFields[name] || name == "CustomFields" || field.IsZero():
+		case name == "AlertBody":
+			mergeFields(dst.Field(i), field)
+		default:
+			dst.Field(i).Set(field)
+		}
+	}
+}
+
+//Fields which differ between two payloads, in field order with custom
+//fields by key, empty if they'd be sent the same
+//nil payloads compare as empty payloads
+func DiffPayloads(a *Payload, b *Payload) []PayloadDifference {
+	if a == nil {
+		a = &Payload{}
+	}
+	if b == nil {
+		b = &Payload{}
+	}
+	differences := diffFields("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem())
+
+	keys := make(map[string]bool)
+	for key := range a.CustomFields {
+		keys[key] = true
+	}
+	for key := range b.CustomFields {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		aValue, aOK := a.CustomFields[key]
+		bValue, bOK := b.CustomFields[key]
+		if aOK != bOK || !reflect.DeepEqual(aValue, bValue) {
+			differences = append(differences, PayloadDifference{
+				Field: "CustomFields[" + key + "]",
+				A:     aValue,
+				B:     bValue,
+			})
+		}
+	}
+	return differences
+}
+
+//Differences between the fields of two structs, recursing into the alert body
+func diffFields(prefix string, a reflect.Value, b reflect.Value) []PayloadDifference {
+	var differences []PayloadDifference
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		aField, bField := a.Field(i), b.Field(i)
+		switch {
+		case payloadIdentityFields[name] || name == "CustomFields":
+		case name == "AlertBody":
+			differences = append(differences, diffFields(name+".", aField, bField)...)
+		default:
+			if !fieldsEqual(aField.Interface(), bField.Interface()) {
+				differences = append(differences, PayloadDifference{
+					Field: prefix + name,
+					A:     aField.Interface(),
+					B:     bField.Interface(),
+				})
+			}
+		}
+	}
+	return differences
+}
+
+//Times are equal if they're the same instant, whatever their location
+func fieldsEqual(a interface{}, b interface{}) bool {
+	if aTime, ok := a.(time.Time); ok {
+		return aTime.Equal(b.(time.Time))
+	}
+	return reflect.DeepEqual(a, b)
+}
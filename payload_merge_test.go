@@ -0,0 +1,71 @@
+package apns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergePayloadsShouldApplyOverrides(t *testing.T) {
+	base := &Payload{
+		AlertBody:    APSAlertBody{Title: "Sale", Body: "Everything half off"},
+		Sound:        SoundDefault,
+		Badge:        NewBadgeNumber(3),
+		Priority:     PRIORITY_IMMEDIATE,
+		CustomFields: map[string]interface{}{"campaign": "spring", "user_id": 0},
+		UUID:         "base-uuid",
+	}
+	override := &Payload{
+		Token:        "aa01",
+		AlertBody:    APSAlertBody{Body: "Hi Ann, everything is half off"},
+		Badge:        NewBadgeNumber(0),
+		CustomFields: map[string]interface{}{"user_id": 7},
+	}
+
+	merged := MergePayloads(base, override)
+	expected := &Payload{
+		Token:        "aa01",
+		AlertBody:    APSAlertBody{Title: "Sale", Body: "Hi Ann, everything is half off"},
+		Sound:        SoundDefault,
+		Badge:        NewBadgeNumber(0),
+		Priority:     PRIORITY_IMMEDIATE,
+		CustomFields: map[string]interface{}{"campaign": "spring", "user_id": 7},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, merged)
+	}
+	if base.CustomFields["user_id"] != 0 || base.AlertBody.Body != "Everything half off" {
+		t.Errorf("Expected the base to be left alone but got %+v", base)
+	}
+	if !reflect.DeepEqual(MergePayloads(nil, base).AlertBody, base.AlertBody) {
+		t.Error("Expected a nil base to merge as an empty payload")
+	}
+}
+
+func TestDiffPayloadsShouldListChangedFields(t *testing.T) {
+	a := &Payload{
+		AlertBody:    APSAlertBody{Title: "Sale", Body: "Hi Ann"},
+		CollapseID:   "sale",
+		CustomFields: map[string]interface{}{"user_id": 7, "campaign": "spring"},
+		UUID:         "a",
+	}
+	b := MergePayloads(a, &Payload{
+		AlertBody:    APSAlertBody{Body: "Hi Bo"},
+		CustomFields: map[string]interface{}{"user_id": 8},
+	})
+
+	differences := DiffPayloads(a, b)
+	expected := []PayloadDifference{
+		{Field: "AlertBody.Body", A: "Hi Ann", B: "Hi Bo"},
+		{Field: "CustomFields[user_id]", A: 7, B: 8},
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Errorf("Expected %v but got %v", expected, differences)
+	}
+	if differences := DiffPayloads(a, MergePayloads(a, nil)); len(differences) != 0 {
+		t.Errorf("Expected a copy to have no differences but got %v", differences)
+	}
+	if differences := DiffPayloads(&Payload{CustomFields: map[string]interface{}{"x": 1}}, nil); len(differences) != 1 ||
+		differences[0].B != nil {
+		t.Errorf("Expected a missing custom field to diff against nil but got %v", differences)
+	}
+}
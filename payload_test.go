@@ -56,6 +56,34 @@ func TestBadge0ShouldOmitBadge(t *testing.T) {
 	}
 }
 
+func TestBadgeSetTo0ShouldClearBadge(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing this payload",
+		Badge:     NewBadgeNumber(0),
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":\"Testing this payload\",\"badge\":0}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+
+	p.Badge.UnSet()
+	json, err = p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson = "{\"aps\":{\"alert\":\"Testing this payload\"}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
 func TestSimpleMarshalWithCustomFields(t *testing.T) {
 	customFields := map[string]interface{}{
 		"num": 55,
@@ -534,3 +562,126 @@ func BenchmarkAlertBodyMarshalTruncate1024WithCustomFields(b *testing.B) {
 		p.Marshal(1024)
 	}
 }
+
+func TestEstimateSizeShouldMatchMarshal(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		Badge:        NewBadgeNumber(2),
+		CustomFields: map[string]interface{}{"id": 12},
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := p.EstimateSize()
+	if err != nil || size != len(json) {
+		t.Error(fmt.Sprintf("Expected size %v but got %v (%v)", len(json), size, err))
+	}
+
+	remaining, err := p.RemainingBytes(256)
+	if err != nil || remaining != 256-len(json) {
+		t.Error(fmt.Sprintf("Expected %v bytes remaining but got %v (%v)", 256-len(json), remaining, err))
+	}
+
+	remaining, _ = p.RemainingBytes(10)
+	if remaining != 10-len(json) {
+		t.Error(fmt.Sprintf("Expected %v bytes remaining when over but got %v", 10-len(json), remaining))
+	}
+}
+
+func TestEstimateSizeShouldErrorOnApsCustomField(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"aps": 12},
+	}
+
+	if _, err := p.EstimateSize(); err == nil {
+		t.Error("Expected error for custom field named aps")
+	}
+}
+
+func TestLaunchImageShouldUseAlertDictionary(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing this payload",
+		AlertBody: APSAlertBody{
+			LaunchImage: "launch.png",
+		},
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":{\"body\":\"Testing this payload\",\"launch-image\":\"launch.png\"}}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+
+	//AlertText is truncated when it's the body
+	json, err = p.Marshal(len(expectedJson) - 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson = "{\"aps\":{\"alert\":{\"body\":\"Testing this...\",\"launch-image\":\"launch.png\"}}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestAlertBodyMarshalSummaryArg(t *testing.T) {
+	p := Payload{
+		AlertText: "New message",
+		AlertBody: APSAlertBody{
+			SummaryArg:      "Karl",
+			SummaryArgCount: 2,
+		},
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":{\"body\":\"New message\",\"summary-arg\":\"Karl\",\"summary-arg-count\":2}}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestSimpleMarshalTargetContentID(t *testing.T) {
+	p := Payload{
+		AlertText:       "New message",
+		TargetContentID: "thread-42",
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":\"New message\",\"target-content-id\":\"thread-42\"}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestSimpleMarshalFilterCriteria(t *testing.T) {
+	p := Payload{
+		AlertText:      "Standup in 5",
+		FilterCriteria: "work",
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":\"Standup in 5\",\"filter-criteria\":\"work\"}}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
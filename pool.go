@@ -0,0 +1,842 @@
+package apns
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Config for creating a pool of APNS connections
+type APNSPoolConfig struct {
+	//config used for every connection in the pool : required
+	ConnectionConfig *APNSConfig
+	//number of connections to open, defaults to 1
+	Size int
+	//strategy for choosing the connection each payload is sent on, defaults to round robin
+	Router PoolRouter
+	//function used to open pool connections, defaults to NewAPNSConnection
+	Dial func(config *APNSConfig) (*APNSConnection, error)
+	//guarantee payloads for the same token are flushed in the order they were sent
+	//Unsent payloads from a closed connection are resent by the pool ahead of any
+	//later payloads for the same token instead of being returned on CloseChannel
+	//Router defaults to a consistent hash router when this is set, and can't be a
+	//RoundRobinRouter. ConnectionConfig.QueueOrder must be QUEUE_ORDER_FIFO
+	//Connections joining the pool (Add, scaling, Supervisor reconnects) only take
+	//over tokens once the others have written what's queued, and connections
+	//leaving it (Remove, Replace) write or hand back their queue first. Sends wait
+	//while this happens, and connections added while paused take no payloads until Resume
+	PreserveTokenOrder bool
+	//don't open connections until the first Send (or Connect), defaults to false
+	//dial errors are returned from that Send instead of NewAPNSPool
+	Lazy bool
+	//max number of connections to grow to when the pool is busy, defaults to 0 (Size is fixed)
+	//The pool grows one connection at a time while QueueDepth or OldestQueuedAge
+	//are over the thresholds below, and shrinks back towards Size when idle
+	MaxSize int
+	//queue depth at which a connection is added, defaults to 1000
+	ScaleUpQueueDepth int
+	//number of milliseconds the oldest queued payload may wait before a connection is added,
+	//defaults to 0 (only ScaleUpQueueDepth is used)
+	ScaleUpQueueAge int
+	//number of milliseconds the pool must have nothing queued before a connection
+	//added for being busy is removed, defaults to 30000
+	ScaleDownIdleTime int
+	//number of milliseconds between checks of the queue, defaults to 100
+	ScaleInterval int
+}
+
+//Pool of APNS connections that payloads are spread across
+type APNSPool struct {
+	//Channel that connection closes from pool members are received on
+	//Closed once the pool has been disconnected and all members have closed
+	CloseChannel chan *ConnectionClose
+	//config
+	config *APNSPoolConfig
+	//current pool members by id
+	members map[string]*poolMember
+	//Stateful counter to name pool members
+	memberIdCounter int
+	//Mutex to sync access to members and the router
+	lock *sync.Mutex
+	//Tracks member close watchers so CloseChannel can be closed
+	watchers *sync.WaitGroup
+	//Boolean saying we're disconnecting
+	disconnecting bool
+	//Boolean saying Pause has been called without Resume
+	paused bool
+	//Boolean saying Connect has opened the pool's connections
+	connected bool
+	//Mutex to stop concurrent Connects opening too many connections
+	connectLock *sync.Mutex
+	//Mutex to stop concurrent RotateCredentials
+	rotateLock *sync.Mutex
+	//Closed on Disconnect to stop scaling
+	stopChannel chan bool
+	//Payloads waiting to be resent, oldest first (PreserveTokenOrder only)
+	retryPayloads *list.List
+	//Number of payloads waiting to be resent for each token
+	retryTokens map[string]int
+	//Signalled when there are payloads to resend or members to resend them on
+	retryCond *sync.Cond
+	//Held for reading while a payload is routed and handed to a member, and for
+	//writing while members join or leave the router (PreserveTokenOrder only)
+	routeLock *sync.RWMutex
+	//Ids of members added while paused, not routed to until Resume (PreserveTokenOrder only)
+	unrouted map[string]bool
+	//Source of the scaling ticker, ConnectionConfig.Clock when the pool was created
+	//Kept so scaling needn't lock to read ConnectionConfig, which RotateCredentials replaces
+	clock Clock
+}
+
+//Connection belonging to a pool
+type poolMember struct {
+	//Id the router knows this member by
+	id string
+	//The member's connection
+	conn *APNSConnection
+	//Closed once the connection's close has been received
+	closed chan bool
+}
+
+//Returned from Send when the pool has no connections to send on
+var ErrPoolEmpty = errors.New("No connections in pool")
+
+//Returned from Send or Add when the pool has been disconnected
+var ErrPoolDisconnected = errors.New("Pool has been disconnected")
+
+//Returned from Replace when there's no member with the id given
+var ErrUnknownMember = errors.New("No such connection in pool")
+
+//Progress of RotateCredentials, reported after each connection is swapped
+type RotationProgress struct {
+	//Number of connections swapped so far
+	Done int
+	//Number of connections being swapped
+	Total int
+	//True once a new connection failed to open and connections already
+	//swapped are being swapped back to the old credentials
+	RollingBack bool
+}
+
+//Create a new pool of apns connections with supplied config
+//If invalid config or if any connection fails to open (unless Lazy) an error will be returned
+func NewAPNSPool(config *APNSPoolConfig) (*APNSPool, error) {
+	errorStrs := ""
+
+	if config.ConnectionConfig == nil {
+		errorStrs += "Invalid ConnectionConfig. Must be supplied\n"
+	}
+	if config.Size < 0 {
+		errorStrs += "Invalid Size. Should be > 0\n"
+	}
+	if config.MaxSize < 0 || (config.MaxSize > 0 && config.MaxSize < config.Size) {
+		errorStrs += "Invalid MaxSize. Should be 0 or >= Size\n"
+	}
+	if config.ScaleUpQueueDepth < 0 {
+		errorStrs += "Invalid ScaleUpQueueDepth. Should be > 0\n"
+	}
+	if config.ScaleUpQueueAge < 0 {
+		errorStrs += "Invalid ScaleUpQueueAge. Should be >= 0\n"
+	}
+	if config.ScaleDownIdleTime < 0 {
+		errorStrs += "Invalid ScaleDownIdleTime. Should be > 0\n"
+	}
+	if config.ScaleInterval < 0 {
+		errorStrs += "Invalid ScaleInterval. Should be > 0\n"
+	}
+	if config.PreserveTokenOrder {
+		//either would send payloads for a token out of order
+		if _, ok := config.Router.(*RoundRobinRouter); ok {
+			errorStrs += "Invalid Router. Should route by token with PreserveTokenOrder\n"
+		}
+		if config.ConnectionConfig != nil && config.ConnectionConfig.QueueOrder != QUEUE_ORDER_FIFO {
+			errorStrs += "Invalid ConnectionConfig.QueueOrder. Should be QUEUE_ORDER_FIFO with PreserveTokenOrder\n"
+		}
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Size == 0 {
+		config.Size = 1
+	}
+	if config.ScaleUpQueueDepth == 0 {
+		config.ScaleUpQueueDepth = 1000
+	}
+	if config.ScaleDownIdleTime == 0 {
+		config.ScaleDownIdleTime = 30000
+	}
+	if config.ScaleInterval == 0 {
+		config.ScaleInterval = 100
+	}
+	if config.Router == nil {
+		if config.PreserveTokenOrder {
+			config.Router = NewConsistentHashRouter(0)
+		} else {
+			config.Router = NewRoundRobinRouter()
+		}
+	}
+	if config.Dial == nil {
+		config.Dial = NewAPNSConnection
+	}
+
+	p := &APNSPool{
+		CloseChannel: make(chan *ConnectionClose),
+		config:       config,
+		members:      make(map[string]*poolMember),
+		lock:         new(sync.Mutex),
+		watchers:     new(sync.WaitGroup),
+		connectLock:  new(sync.Mutex),
+		rotateLock:   new(sync.Mutex),
+		stopChannel:  make(chan bool),
+		clock:        configClock(config.ConnectionConfig.Clock),
+	}
+
+	if config.PreserveTokenOrder {
+		p.retryPayloads = list.New()
+		p.retryTokens = make(map[string]int)
+		p.retryCond = sync.NewCond(p.lock)
+		p.routeLock = new(sync.RWMutex)
+		p.unrouted = make(map[string]bool)
+		p.watchers.Add(1)
+		go p.retryListener()
+	}
+	if config.MaxSize > config.Size {
+		go p.scaleListener()
+	}
+
+	if config.Lazy {
+		return p, nil
+	}
+	if err := p.Connect(); err != nil {
+		p.Disconnect()
+		//nobody will be listening for the closes
+		go func() {
+			for range p.CloseChannel {
+			}
+		}()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+//Open the pool's connections, for Lazy pools which should dial up front
+//Does nothing once the pool has connected, connections which close
+//afterwards aren't replaced (see Add and Supervisor for that)
+//If a connection fails to open the error is returned and the next
+//Connect or Send carries on where this one left off
+func (p *APNSPool) Connect() error {
+	if p.isConnected() {
+		return nil
+	}
+
+	p.connectLock.Lock()
+	defer p.connectLock.Unlock()
+	//another Connect may have finished while we waited
+	if p.isConnected() {
+		return nil
+	}
+	for p.Len() < p.config.Size {
+		if _, err := p.Add(); err != nil {
+			return err
+		}
+	}
+	p.lock.Lock()
+	p.connected = true
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *APNSPool) isConnected() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connected
+}
+
+//Open a new connection and add it to the pool
+//Returns the id the new member is routed by
+func (p *APNSPool) Add() (string, error) {
+	p.lock.Lock()
+	config := p.config.ConnectionConfig
+	p.lock.Unlock()
+	return p.add(config)
+}
+
+//Open a new connection with config and add it to the pool
+func (p *APNSPool) add(config *APNSConfig) (string, error) {
+	conn, err := p.config.Dial(config)
+	if err != nil {
+		return "", err
+	}
+
+	if p.routeLock != nil {
+		//tokens moving to the new member mustn't overtake payloads queued for them elsewhere
+		p.routeLock.Lock()
+		defer p.routeLock.Unlock()
+		p.Flush()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.disconnecting {
+		conn.Disconnect()
+		return "", ErrPoolDisconnected
+	}
+
+	p.memberIdCounter++
+	member := &poolMember{
+		id:     "apns-" + strconv.Itoa(p.memberIdCounter),
+		conn:   conn,
+		closed: make(chan bool),
+	}
+	if p.paused {
+		conn.Pause()
+	}
+	p.members[member.id] = member
+	if p.unrouted != nil && p.paused {
+		//the flush did nothing while paused, so route to it once resumed
+		p.unrouted[member.id] = true
+	} else {
+		p.config.Router.AddMember(member.id)
+	}
+	if p.retryCond != nil {
+		p.retryCond.Broadcast()
+	}
+
+	p.watchers.Add(1)
+	go p.watchMember(member)
+
+	return member.id, nil
+}
+
+//Disconnect a member and remove it from the pool
+//Its connection close will still be delivered on CloseChannel
+//With PreserveTokenOrder the member stays routed until its close has been
+//handled, so its unsent payloads are resent ahead of newer ones for the same tokens
+func (p *APNSPool) Remove(id string) bool {
+	if p.routeLock != nil {
+		return p.removeInOrder(id)
+	}
+
+	p.lock.Lock()
+	member, ok := p.members[id]
+	if ok {
+		p.removeMember(member)
+	}
+	p.lock.Unlock()
+
+	if ok {
+		member.conn.Disconnect()
+	}
+	return ok
+}
+
+//Disconnect a member and wait for watchMember to remove it (PreserveTokenOrder only)
+//No payloads are routed meanwhile, so none can reach another member ahead of
+//the ones this member writes while disconnecting or hands back for resending
+func (p *APNSPool) removeInOrder(id string) bool {
+	p.routeLock.Lock()
+	defer p.routeLock.Unlock()
+
+	p.lock.Lock()
+	member, ok := p.members[id]
+	p.lock.Unlock()
+
+	if ok {
+		member.conn.Disconnect()
+		<-member.closed
+	}
+	return ok
+}
+
+//Replace a member with a new connection, without a gap in sending
+//The new connection is dialed (which completes its TLS handshake) and takes
+//traffic before the old one is removed and disconnected, flushing the
+//payloads already queued on it. If the dial fails the old member is left in place
+//With PreserveTokenOrder the old member writes its queue before the new one takes
+//its tokens, or hands it back to be resent first if the pool is paused
+//Returns the new member's id
+func (p *APNSPool) Replace(id string) (string, error) {
+	p.lock.Lock()
+	config := p.config.ConnectionConfig
+	p.lock.Unlock()
+	return p.replace(id, config)
+}
+
+//Replace a member with a new connection opened with config
+func (p *APNSPool) replace(id string, config *APNSConfig) (string, error) {
+	p.lock.Lock()
+	_, ok := p.members[id]
+	p.lock.Unlock()
+	if !ok {
+		return "", ErrUnknownMember
+	}
+
+	newId, err := p.add(config)
+	if err != nil {
+		return "", err
+	}
+	//the old member may have closed by itself in the meantime
+	p.Remove(id)
+	return newId, nil
+}
+
+//Switch the pool to a new certificate and key without downtime
+//Connections are swapped one at a time with Replace, so the rest keep
+//sending, and onProgress (which may be nil) is called after each swap.
+//Once the first new connection has opened, connections added later (by Add,
+//or a Supervisor reconnecting) use the new credentials too.
+//If a new connection fails to open, the connections already swapped are
+//swapped back to the old credentials and the error is returned
+func (p *APNSPool) RotateCredentials(certificateBytes []byte, keyBytes []byte,
+	onProgress func(progress *RotationProgress)) error {
+	p.rotateLock.Lock()
+	defer p.rotateLock.Unlock()
+
+	p.lock.Lock()
+	oldConfig := p.config.ConnectionConfig
+	p.lock.Unlock()
+	newConfig := *oldConfig
+	newConfig.CertificateBytes = certificateBytes
+	newConfig.KeyBytes = keyBytes
+	newConfig.Credentials = oldConfig.Credentials.withKeyPair(certificateBytes, keyBytes)
+
+	ids := p.Members()
+	progress := &RotationProgress{Total: len(ids)}
+	var rotated []string
+	for _, id := range ids {
+		newId, err := p.replace(id, &newConfig)
+		if err == ErrUnknownMember {
+			//closed by itself, its replacement will use the new credentials
+			progress.Total--
+			continue
+		}
+		if err != nil {
+			if rollbackErr := p.rollbackRotation(rotated, oldConfig, progress, onProgress); rollbackErr != nil {
+				return fmt.Errorf("Error rotating credentials : %v, then rolling back : %v", err, rollbackErr)
+			}
+			return fmt.Errorf("Error rotating credentials, rolled back : %v", err)
+		}
+		if len(rotated) == 0 {
+			p.lock.Lock()
+			p.config.ConnectionConfig = &newConfig
+			p.lock.Unlock()
+		}
+		rotated = append(rotated, newId)
+		progress.Done++
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+	return nil
+}
+
+//Swap connections opened by a failed RotateCredentials back to the old config
+func (p *APNSPool) rollbackRotation(rotated []string, oldConfig *APNSConfig,
+	progress *RotationProgress, onProgress func(progress *RotationProgress)) error {
+	p.lock.Lock()
+	p.config.ConnectionConfig = oldConfig
+	p.lock.Unlock()
+
+	progress.RollingBack = true
+	for _, id := range rotated {
+		_, err := p.replace(id, oldConfig)
+		if err != nil && err != ErrUnknownMember {
+			return err
+		}
+		progress.Done--
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+	return nil
+}
+
+//Ids of the connections currently in the pool, sorted
+func (p *APNSPool) Members() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ids := make([]string, 0, len(p.members))
+	for id := range p.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//Number of connections currently in the pool
+func (p *APNSPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.members)
+}
+
+//Send a payload on the connection chosen by the pool's router
+//Blocks until a connection accepts the payload
+//If the chosen connection closes first the payload is routed again
+//With PreserveTokenOrder, payloads for a token which still has payloads
+//waiting to be resent are queued behind them and Send returns immediately
+//Returns ErrInvalidPriority straight away for payloads with an invalid priority
+func (p *APNSPool) Send(payload *Payload) error {
+	return p.send(payload, false)
+}
+
+//Route a payload to a member and wait for it to be accepted
+//Retries bypass the token ordering check since they are what's being waited on
+func (p *APNSPool) send(payload *Payload, retry bool) error {
+	if !retry {
+		if err := ValidatePriority(payload.Priority); err != nil {
+			return err
+		}
+		if err := p.Connect(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if p.routeLock != nil {
+			p.routeLock.RLock()
+		}
+		sent, err := p.sendToRoute(payload, retry)
+		if p.routeLock != nil {
+			p.routeLock.RUnlock()
+		}
+		if sent || err != nil {
+			return err
+		}
+		//member went away before taking the payload, try another
+	}
+}
+
+//Hand a payload to the member the router chooses, or queue it to be resent
+//Returns false if the member closed before taking it
+func (p *APNSPool) sendToRoute(payload *Payload, retry bool) (bool, error) {
+	p.lock.Lock()
+	if p.disconnecting {
+		p.lock.Unlock()
+		return false, ErrPoolDisconnected
+	}
+	if !retry && p.retryTokens[payload.Token] > 0 {
+		p.queueRetry(payload, false)
+		p.lock.Unlock()
+		return true, nil
+	}
+	member := p.members[p.config.Router.Route(payload)]
+	p.lock.Unlock()
+
+	if member == nil {
+		return false, ErrPoolEmpty
+	}
+
+	select {
+	case member.conn.SendChannel <- payload:
+		return true, nil
+	case <-member.closed:
+		return false, nil
+	}
+}
+
+//Remove a payload still waiting to be written on any pool connection
+//See APNSConnection.Cancel
+func (p *APNSPool) Cancel(uuid string) bool {
+	for _, member := range p.snapshotMembers() {
+		if member.conn.Cancel(uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+//Write the payloads waiting on every pool connection now, see APNSConnection.Flush
+func (p *APNSPool) Flush() {
+	for _, member := range p.snapshotMembers() {
+		member.conn.Flush()
+	}
+}
+
+//Stop every connection writing to Apple, see APNSConnection.Pause
+//Connections added while the pool is paused start paused
+func (p *APNSPool) Pause() {
+	p.setPaused(true)
+}
+
+//Start every connection writing again, see APNSConnection.Resume
+func (p *APNSPool) Resume() {
+	p.setPaused(false)
+}
+
+func (p *APNSPool) setPaused(paused bool) {
+	if p.routeLock != nil {
+		//members can't be added while the pause state is changing
+		p.routeLock.Lock()
+		defer p.routeLock.Unlock()
+	}
+
+	p.lock.Lock()
+	p.paused = paused
+	p.lock.Unlock()
+	for _, member := range p.snapshotMembers() {
+		if paused {
+			member.conn.Pause()
+		} else {
+			member.conn.Resume()
+		}
+	}
+
+	if p.unrouted != nil && !paused {
+		//write what was queued while paused before routing to members added meanwhile
+		p.Flush()
+		p.lock.Lock()
+		for id := range p.unrouted {
+			p.config.Router.AddMember(id)
+			delete(p.unrouted, id)
+		}
+		p.retryCond.Broadcast()
+		p.lock.Unlock()
+	}
+}
+
+//Number of payloads waiting to be written across the pool's connections
+//Payloads waiting to be resent (PreserveTokenOrder) are included
+func (p *APNSPool) QueueDepth() int {
+	depth := 0
+	for _, member := range p.snapshotMembers() {
+		depth += member.conn.QueueDepth()
+	}
+	p.lock.Lock()
+	if p.retryPayloads != nil {
+		depth += p.retryPayloads.Len()
+	}
+	p.lock.Unlock()
+	return depth
+}
+
+//How long the longest waiting payload on any pool connection has been queued
+func (p *APNSPool) OldestQueuedAge() time.Duration {
+	var age time.Duration
+	for _, member := range p.snapshotMembers() {
+		if memberAge := member.conn.OldestQueuedAge(); memberAge > age {
+			age = memberAge
+		}
+	}
+	return age
+}
+
+//Iterate over metadata for the payloads queued on every pool connection
+//Each connection's payloads are in the order they'll be written
+func (p *APNSPool) QueueSnapshot() *QueueIterator {
+	var infos []QueuedPayloadInfo
+	for _, member := range p.snapshotMembers() {
+		infos = append(infos, member.conn.sendQueue.snapshot()...)
+	}
+	return &QueueIterator{infos: infos, current: -1}
+}
+
+//Current members, so they can be used without holding the lock
+func (p *APNSPool) snapshotMembers() []*poolMember {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	members := make([]*poolMember, 0, len(p.members))
+	for _, member := range p.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+//Disconnect every connection in the pool
+//Each connection flushes its unsent messages before disconnecting
+func (p *APNSPool) Disconnect() {
+	p.lock.Lock()
+	if p.disconnecting {
+		p.lock.Unlock()
+		return
+	}
+	p.disconnecting = true
+	close(p.stopChannel)
+	if p.retryCond != nil {
+		p.retryCond.Broadcast()
+	}
+	members := make([]*poolMember, 0, len(p.members))
+	for _, member := range p.members {
+		members = append(members, member)
+		p.removeMember(member)
+	}
+	p.lock.Unlock()
+
+	for _, member := range members {
+		member.conn.Disconnect()
+	}
+
+	go func() {
+		p.watchers.Wait()
+		close(p.CloseChannel)
+	}()
+}
+
+//go-routine to grow the pool up to MaxSize while it's busy and shrink it
+//back towards Size once it's idle
+//Only connections it added are removed, newest first
+func (p *APNSPool) scaleListener() {
+	ticker := p.clock.NewTicker(time.Duration(p.config.ScaleInterval) * time.Millisecond)
+	defer ticker.Stop()
+	scaleUpQueueAge := time.Duration(p.config.ScaleUpQueueAge) * time.Millisecond
+	scaleDownIdleTime := time.Duration(p.config.ScaleDownIdleTime) * time.Millisecond
+	//ids of the connections added for being busy, oldest first
+	var added []string
+	lastBusy := p.clock.Now()
+
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-p.stopChannel:
+			return
+		}
+
+		p.lock.Lock()
+		//a paused pool's queue grows however many connections it has
+		skip := !p.connected || p.paused
+		p.lock.Unlock()
+		if skip {
+			lastBusy = p.clock.Now()
+			continue
+		}
+
+		depth := p.QueueDepth()
+		if depth > 0 {
+			lastBusy = p.clock.Now()
+		}
+		busy := depth >= p.config.ScaleUpQueueDepth ||
+			(scaleUpQueueAge > 0 && p.OldestQueuedAge() >= scaleUpQueueAge)
+		if busy && p.Len() < p.config.MaxSize {
+			if id, err := p.Add(); err == nil {
+				added = append(added, id)
+			}
+			continue
+		}
+
+		if depth == 0 && p.Len() > p.config.Size && p.clock.Now().Sub(lastBusy) >= scaleDownIdleTime {
+			//connections which closed by themselves are already gone
+			for len(added) > 0 {
+				id := added[len(added)-1]
+				added = added[:len(added)-1]
+				if p.Remove(id) {
+					break
+				}
+			}
+			//wait another idle period before removing the next
+			lastBusy = p.clock.Now()
+		}
+	}
+}
+
+//NOT THREADSAFE (need to acquire lock before calling)
+//Take a member out of the routing table
+func (p *APNSPool) removeMember(member *poolMember) {
+	if p.members[member.id] != member {
+		return
+	}
+	delete(p.members, member.id)
+	if p.unrouted[member.id] {
+		delete(p.unrouted, member.id)
+		return
+	}
+	p.config.Router.RemoveMember(member.id)
+}
+
+//go-routine to wait for a member's connection to close
+//Removes the member from the pool and forwards the close on
+func (p *APNSPool) watchMember(member *poolMember) {
+	defer p.watchers.Done()
+
+	connectionClose := <-member.conn.CloseChannel
+
+	p.lock.Lock()
+	p.removeMember(member)
+	if p.retryPayloads != nil && !p.disconnecting && connectionClose.UnsentPayloads != nil {
+		//queue the unsent payloads before anyone waiting on this member
+		//gets a chance to route a newer payload
+		//they were sent before anything already waiting so they go in front of it
+		for i := len(connectionClose.UnsentPayloads) - 1; i >= 0; i-- {
+			p.queueRetry(connectionClose.UnsentPayloads[i], true)
+		}
+		connectionClose.UnsentPayloads = []*Payload{}
+		connectionClose.UnsentPayloadIDs = []uint32{}
+	}
+	p.lock.Unlock()
+	close(member.closed)
+
+	p.CloseChannel <- connectionClose
+}
+
+//NOT THREADSAFE (need to acquire lock before calling)
+//Add a payload to the resend queue
+func (p *APNSPool) queueRetry(payload *Payload, front bool) {
+	if front {
+		p.retryPayloads.PushFront(payload)
+	} else {
+		p.retryPayloads.PushBack(payload)
+	}
+	p.retryTokens[payload.Token]++
+	p.retryCond.Broadcast()
+}
+
+//go-routine to resend payloads in the order they were queued (PreserveTokenOrder only)
+//Waits for a member to be added if the pool is empty
+//On disconnect any payloads still waiting are returned on CloseChannel
+func (p *APNSPool) retryListener() {
+	defer p.watchers.Done()
+
+	p.lock.Lock()
+	for {
+		for !p.disconnecting &&
+			(p.retryPayloads.Len() == 0 || len(p.members) == len(p.unrouted)) {
+			p.retryCond.Wait()
+		}
+		if p.disconnecting {
+			break
+		}
+
+		//leave the payload in the queue while it's being resent
+		//so its token stays blocked for newer payloads
+		e := p.retryPayloads.Front()
+		payload := e.Value.(*Payload)
+		p.lock.Unlock()
+		err := p.send(payload, true)
+		p.lock.Lock()
+
+		if err == ErrPoolEmpty {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		p.retryPayloads.Remove(e)
+		p.retryTokens[payload.Token]--
+		if p.retryTokens[payload.Token] == 0 {
+			delete(p.retryTokens, payload.Token)
+		}
+	}
+	unsentPayloads := make([]*Payload, 0, p.retryPayloads.Len())
+	for e := p.retryPayloads.Front(); e != nil; e = e.Next() {
+		unsentPayloads = append(unsentPayloads, e.Value.(*Payload))
+	}
+	p.retryPayloads = list.New()
+	p.retryTokens = make(map[string]int)
+	p.lock.Unlock()
+
+	if len(unsentPayloads) > 0 {
+		p.CloseChannel <- &ConnectionClose{
+			UnsentPayloads:       unsentPayloads,
+			ErrorPayloadPosition: -1,
+			//none of them were written by the connection they were resent on
+			UnsentPayloadIDs: make([]uint32, len(unsentPayloads)),
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package apns
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+//Strategy for choosing which pool connection a payload is sent on
+//Routers are only called while the owning pool holds its lock
+//so implementations don't need to do their own locking
+type PoolRouter interface {
+	//Called when a connection joins the pool
+	AddMember(id string)
+	//Called when a connection leaves the pool
+	RemoveMember(id string)
+	//Returns the id of the connection the payload should be sent on
+	//or an empty string if there are no connections to choose from
+	Route(payload *Payload) string
+}
+
+//Router which cycles through the pool connections in turn
+type RoundRobinRouter struct {
+	members []string
+	next    int
+}
+
+//Create a new round robin router
+func NewRoundRobinRouter() *RoundRobinRouter {
+	return &RoundRobinRouter{}
+}
+
+func (r *RoundRobinRouter) AddMember(id string) {
+	r.members = append(r.members, id)
+}
+
+func (r *RoundRobinRouter) RemoveMember(id string) {
+	for i, member := range r.members {
+		if member == id {
+			r.members = append(r.members[:i], r.members[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *RoundRobinRouter) Route(payload *Payload) string {
+	if len(r.members) == 0 {
+		return ""
+	}
+	if r.next >= len(r.members) {
+		r.next = 0
+	}
+	id := r.members[r.next]
+	r.next++
+	return id
+}
+
+//Default number of points each connection gets on the hash ring
+const DEFAULT_HASH_RING_REPLICAS = 100
+
+//Router which maps device tokens onto a hash ring of the pool connections
+//All payloads for a token go to the same connection, and adding or removing
+//a connection only moves the tokens which hash next to that connection's points
+type ConsistentHashRouter struct {
+	replicas int
+	//sorted hash ring points
+	ring []uint32
+	//owner of each ring point
+	owners map[uint32]string
+}
+
+//Create a new consistent hash router with the given number of points per
+//connection on the hash ring, replicas <= 0 uses DEFAULT_HASH_RING_REPLICAS
+func NewConsistentHashRouter(replicas int) *ConsistentHashRouter {
+	if replicas <= 0 {
+		replicas = DEFAULT_HASH_RING_REPLICAS
+	}
+	return &ConsistentHashRouter{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
+
+func (r *ConsistentHashRouter) AddMember(id string) {
+	for i := 0; i < r.replicas; i++ {
+		point := hashKey(id + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			//first member to claim a point keeps it
+			continue
+		}
+		r.owners[point] = id
+		r.ring = append(r.ring, point)
+	}
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i] < r.ring[j] })
+}
+
+func (r *ConsistentHashRouter) RemoveMember(id string) {
+	ring := r.ring[:0]
+	for _, point := range r.ring {
+		if r.owners[point] == id {
+			delete(r.owners, point)
+			continue
+		}
+		ring = append(ring, point)
+	}
+	r.ring = ring
+}
+
+func (r *ConsistentHashRouter) Route(payload *Payload) string {
+	if len(r.ring) == 0 {
+		return ""
+	}
+	point := hashKey(payload.Token)
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i] >= point })
+	if i == len(r.ring) {
+		//wrap around the ring
+		i = 0
+	}
+	return r.owners[r.ring[i]]
+}
+
+//Hash a key onto the ring
+//md5 spreads similar keys (like sequential member ids) much more evenly than fnv
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
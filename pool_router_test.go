@@ -0,0 +1,128 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testTokens(n int) []*Payload {
+	payloads := make([]*Payload, n)
+	for i := 0; i < n; i++ {
+		payloads[i] = &Payload{
+			Token: fmt.Sprintf("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede%08x", i),
+		}
+	}
+	return payloads
+}
+
+func TestRoundRobinRouterCyclesMembers(t *testing.T) {
+	r := NewRoundRobinRouter()
+
+	if r.Route(&Payload{}) != "" {
+		t.Error("Expected no route without members")
+	}
+
+	r.AddMember("a")
+	r.AddMember("b")
+	r.AddMember("c")
+
+	routes := ""
+	for i := 0; i < 6; i++ {
+		routes += r.Route(&Payload{})
+	}
+	if routes != "abcabc" {
+		t.Errorf("Expected routes abcabc but got %v", routes)
+	}
+
+	r.RemoveMember("b")
+	routes = ""
+	for i := 0; i < 4; i++ {
+		routes += r.Route(&Payload{})
+	}
+	if routes != "acac" && routes != "caca" {
+		t.Errorf("Expected routes to alternate a and c but got %v", routes)
+	}
+}
+
+func TestConsistentHashRouterIsStablePerToken(t *testing.T) {
+	r := NewConsistentHashRouter(0)
+	r.AddMember("a")
+	r.AddMember("b")
+	r.AddMember("c")
+
+	for _, p := range testTokens(100) {
+		first := r.Route(p)
+		if first == "" {
+			t.Fatal("Expected a route")
+		}
+		for i := 0; i < 3; i++ {
+			if r.Route(p) != first {
+				t.Fatalf("Expected token %v to always route to %v", p.Token, first)
+			}
+		}
+	}
+}
+
+func TestConsistentHashRouterSpreadsTokens(t *testing.T) {
+	r := NewConsistentHashRouter(0)
+	r.AddMember("a")
+	r.AddMember("b")
+	r.AddMember("c")
+
+	counts := make(map[string]int)
+	for _, p := range testTokens(3000) {
+		counts[r.Route(p)]++
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if counts[id] < 500 {
+			t.Errorf("Expected member %v to get a fair share of tokens but got %v", id, counts[id])
+		}
+	}
+}
+
+func TestConsistentHashRouterMinimallyMovesTokens(t *testing.T) {
+	r := NewConsistentHashRouter(0)
+	r.AddMember("a")
+	r.AddMember("b")
+	r.AddMember("c")
+
+	payloads := testTokens(3000)
+	before := make([]string, len(payloads))
+	for i, p := range payloads {
+		before[i] = r.Route(p)
+	}
+
+	r.AddMember("d")
+	moved := 0
+	for i, p := range payloads {
+		after := r.Route(p)
+		if after != before[i] {
+			if after != "d" {
+				t.Fatalf("Token moved from %v to %v instead of to the new member", before[i], after)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(payloads)/2 {
+		t.Errorf("Expected roughly a quarter of tokens to move but %v of %v moved", moved, len(payloads))
+	}
+
+	r.RemoveMember("d")
+	for i, p := range payloads {
+		if r.Route(p) != before[i] {
+			t.Fatalf("Expected removing a member to restore the original routes")
+		}
+	}
+
+	r.RemoveMember("b")
+	for i, p := range payloads {
+		after := r.Route(p)
+		if before[i] != "b" && after != before[i] {
+			t.Fatalf("Token moved from %v to %v but only tokens of the removed member should move", before[i], after)
+		}
+		if after == "b" {
+			t.Fatal("Token routed to removed member")
+		}
+	}
+}
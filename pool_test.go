@@ -0,0 +1,792 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * Socket that records writes and blocks reads until closed
+ */
+type MockConnPool struct {
+	lock         *sync.Mutex
+	WrittenBytes *bytes.Buffer
+	CloseChannel chan bool
+	closeOnce    *sync.Once
+}
+
+func newMockConnPool() MockConnPool {
+	return MockConnPool{
+		lock:         new(sync.Mutex),
+		WrittenBytes: new(bytes.Buffer),
+		CloseChannel: make(chan bool),
+		closeOnce:    new(sync.Once),
+	}
+}
+
+func (conn MockConnPool) Read(b []byte) (n int, err error) {
+	<-conn.CloseChannel
+	return 0, errors.New("Socket Closed")
+}
+func (conn MockConnPool) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.WrittenBytes.Write(b)
+}
+func (conn MockConnPool) Close() error {
+	conn.closeOnce.Do(func() { close(conn.CloseChannel) })
+	return nil
+}
+func (conn MockConnPool) Written() int {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.WrittenBytes.Len()
+}
+func (conn MockConnPool) LocalAddr() net.Addr {
+	return nil
+}
+func (conn MockConnPool) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn MockConnPool) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnPool) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnPool) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func testPoolConfig(sockets *[]MockConnPool, lock *sync.Mutex) *APNSPoolConfig {
+	return &APNSPoolConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		},
+		Dial: func(config *APNSConfig) (*APNSConnection, error) {
+			socket := newMockConnPool()
+			lock.Lock()
+			*sockets = append(*sockets, socket)
+			lock.Unlock()
+			return socketAPNSConnection(socket, config), nil
+		},
+	}
+}
+
+func TestPoolShouldOpenConfiguredConnections(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.Size = 3
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	if pool.Len() != 3 || len(sockets) != 3 {
+		t.Errorf("Expected 3 connections but pool has %v and dialed %v", pool.Len(), len(sockets))
+	}
+}
+
+func TestPoolShouldFailOnDialError(t *testing.T) {
+	dials := 0
+	pool, err := NewAPNSPool(&APNSPoolConfig{
+		ConnectionConfig: &APNSConfig{},
+		Size:             2,
+		Dial: func(config *APNSConfig) (*APNSConnection, error) {
+			dials++
+			if dials == 2 {
+				return nil, errors.New("Dial failed")
+			}
+			return socketAPNSConnection(newMockConnPool(), &APNSConfig{FramingTimeout: 10}), nil
+		},
+	})
+
+	if err == nil || pool != nil {
+		t.Errorf("Expected dial error but got pool %v and error %v", pool, err)
+	}
+}
+
+func TestPoolShouldSpreadPayloadsAcrossConnections(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.Size = 2
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range testTokens(4) {
+		if err := pool.Send(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool.Disconnect()
+	for range pool.CloseChannel {
+	}
+
+	for i, socket := range sockets {
+		if socket.Written() == 0 {
+			t.Errorf("Expected socket %v to have payloads written", i)
+		}
+	}
+}
+
+func TestPoolShouldRemoveClosedConnections(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.Size = 2
+	config.Router = NewConsistentHashRouter(0)
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	//socket dies out from under the pool
+	sockets[0].Close()
+
+	connectionClose := <-pool.CloseChannel
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != CONNECTION_CLOSED_UNKNOWN {
+		t.Errorf("Expected CONNECTION_CLOSED_UNKNOWN but got %v", connectionClose.Error)
+	}
+
+	if pool.Len() != 1 {
+		t.Fatalf("Expected closed connection to be removed but pool has %v connections", pool.Len())
+	}
+
+	for _, p := range testTokens(10) {
+		if err := pool.Send(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPoolShouldCancelOnAnyConnection(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.Size = 2
+	config.ConnectionConfig.FramingTimeout = 10000
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	payloads := testTokens(2)
+	for i, p := range payloads {
+		p.UUID = "uuid-" + string(rune('a'+i))
+		pool.Send(p)
+	}
+
+	if !pool.Cancel("uuid-b") || !pool.Cancel("uuid-a") {
+		t.Error("Expected payloads queued on either connection to be cancelled")
+	}
+	if pool.Cancel("uuid-c") {
+		t.Error("Expected unknown uuid not to be cancelled")
+	}
+}
+
+func TestPoolShouldPauseNewConnections(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	pool.Pause()
+	pool.Add()
+	for _, p := range testTokens(4) {
+		pool.Send(p)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sockets[0].Written() != 0 || sockets[1].Written() != 0 || pool.QueueDepth() != 4 {
+		t.Fatalf("Expected payloads to be held on every connection while paused but %v are queued", pool.QueueDepth())
+	}
+
+	pool.Resume()
+	deadline := time.Now().Add(time.Second)
+	for sockets[0].Written() == 0 || sockets[1].Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for payloads to be written after resuming")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolSendShouldFailWhenEmpty(t *testing.T) {
+	var sockets []MockConnPool
+	pool, err := NewAPNSPool(testPoolConfig(&sockets, new(sync.Mutex)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sockets[0].Close()
+	<-pool.CloseChannel
+
+	if err := pool.Send(testTokens(1)[0]); err != ErrPoolEmpty {
+		t.Errorf("Expected ErrPoolEmpty but got %v", err)
+	}
+
+	pool.Disconnect()
+	if err := pool.Send(testTokens(1)[0]); err != ErrPoolDisconnected {
+		t.Errorf("Expected ErrPoolDisconnected but got %v", err)
+	}
+}
+
+/**
+ * Socket that returns an apple error once a number of notifications are written
+ */
+type MockConnAppleError struct {
+	*MockConnPool
+	//number of notifications to write before the error is returned
+	ErrorAfter int
+	//message id and error code to return
+	ErrorID   uint32
+	ErrorCode uint8
+	written   *int
+	errorChan chan bool
+}
+
+func newMockConnAppleError(errorAfter int, errorID uint32, errorCode uint8) MockConnAppleError {
+	socket := newMockConnPool()
+	return MockConnAppleError{
+		MockConnPool: &socket,
+		ErrorAfter:   errorAfter,
+		ErrorID:      errorID,
+		ErrorCode:    errorCode,
+		written:      new(int),
+		errorChan:    make(chan bool, 1),
+	}
+}
+
+func (conn MockConnAppleError) Read(b []byte) (n int, err error) {
+	select {
+	case <-conn.errorChan:
+		b[0] = 8
+		b[1] = conn.ErrorCode
+		binary.BigEndian.PutUint32(b[2:], conn.ErrorID)
+		return 6, nil
+	case <-conn.CloseChannel:
+		return 0, errors.New("Socket Closed")
+	}
+}
+func (conn MockConnAppleError) Write(b []byte) (n int, err error) {
+	n, err = conn.MockConnPool.Write(b)
+	conn.lock.Lock()
+	before := *conn.written
+	*conn.written += len(parseNotifications(b))
+	if before < conn.ErrorAfter && *conn.written >= conn.ErrorAfter {
+		conn.errorChan <- true
+	}
+	conn.lock.Unlock()
+	return n, err
+}
+
+//Decode the JSON payload and id of every notification in written bytes
+type writtenNotification struct {
+	ID      uint32
+	Payload string
+}
+
+func parseNotifications(b []byte) []writtenNotification {
+	var notifications []writtenNotification
+	for len(b) >= 5 {
+		frameLen := int(binary.BigEndian.Uint32(b[1:5]))
+		items := b[5 : 5+frameLen]
+		b = b[5+frameLen:]
+		notification := writtenNotification{}
+		for len(items) >= 3 {
+			itemLen := int(binary.BigEndian.Uint16(items[1:3]))
+			data := items[3 : 3+itemLen]
+			switch items[0] {
+			case 2:
+				notification.Payload = string(data)
+			case 3:
+				notification.ID = binary.BigEndian.Uint32(data)
+			}
+			items = items[3+itemLen:]
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+func TestPoolShouldResendUnsentInTokenOrder(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = -1
+	config.PreserveTokenOrder = true
+	dialDefault := config.Dial
+	dials := 0
+	config.Dial = func(config *APNSConfig) (*APNSConnection, error) {
+		dials++
+		if dials == 1 {
+			//error on the first payload once three have been written
+			return socketAPNSConnection(newMockConnAppleError(3, 1, 8), config), nil
+		}
+		return dialDefault(config)
+	}
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := testTokens(1)[0].Token
+	for i := 1; i <= 3; i++ {
+		pool.Send(&Payload{Token: token, AlertText: fmt.Sprintf("p%v", i)})
+	}
+
+	connectionClose := <-pool.CloseChannel
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.AlertText != "p1" {
+		t.Fatalf("Expected p1 to be the error payload but got %v", connectionClose.ErrorPayload)
+	}
+	if len(connectionClose.UnsentPayloads) != 0 {
+		t.Errorf("Expected unsent payloads to be kept for resending but got %v", len(connectionClose.UnsentPayloads))
+	}
+
+	//pool is empty, but this should queue up behind p2 and p3
+	if err := pool.Send(&Payload{Token: token, AlertText: "p4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Add(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		written := sockets[0].Written()
+		lock.Unlock()
+		if written > 0 && len(parseNotifications(sockets[0].WrittenBytes.Bytes())) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for payloads to be resent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.Disconnect()
+	for range pool.CloseChannel {
+	}
+
+	order := ""
+	for _, n := range parseNotifications(sockets[0].WrittenBytes.Bytes()) {
+		order += n.Payload
+	}
+	expected := `{"aps":{"alert":"p2"}}{"aps":{"alert":"p3"}}{"aps":{"alert":"p4"}}`
+	if order != expected {
+		t.Errorf("Expected payloads resent in order %v but got %v", expected, order)
+	}
+}
+
+func TestPoolShouldFlushQueuedPayloadsBeforeAddingInTokenOrder(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = 1000
+	config.PreserveTokenOrder = true
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+
+	//waits for the framing timeout on the only connection
+	for _, p := range testTokens(10) {
+		pool.Send(p)
+	}
+	if _, err := pool.Add(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	written := len(parseNotifications(sockets[0].WrittenBytes.Bytes()))
+	lock.Unlock()
+	if written != 10 {
+		t.Fatalf("Expected queued payloads to be written before the new connection took their tokens but %v were", written)
+	}
+
+	//flushing does nothing while paused, so the new connection waits for Resume
+	pool.Pause()
+	for _, p := range testTokens(10) {
+		pool.Send(p)
+	}
+	if _, err := pool.Add(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range testTokens(10) {
+		pool.Send(p)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sockets[2].Written() != 0 || pool.QueueDepth() != 20 {
+		t.Fatalf("Expected payloads to stay on the routed connections while paused but %v are queued", pool.QueueDepth())
+	}
+	pool.Resume()
+	lock.Lock()
+	written = len(parseNotifications(sockets[0].WrittenBytes.Bytes())) +
+		len(parseNotifications(sockets[1].WrittenBytes.Bytes()))
+	lock.Unlock()
+	if written != 30 || len(pool.Members()) != 3 {
+		t.Errorf("Expected payloads queued while paused to be written before routing to the new connection but %v were", written)
+	}
+}
+
+func TestPoolShouldRejectConfigBreakingTokenOrder(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.PreserveTokenOrder = true
+	config.Router = NewRoundRobinRouter()
+	if _, err := NewAPNSPool(config); err == nil || !strings.Contains(err.Error(), "Router") {
+		t.Errorf("Expected a Router error but got %v", err)
+	}
+
+	config = testPoolConfig(&sockets, new(sync.Mutex))
+	config.PreserveTokenOrder = true
+	config.ConnectionConfig.QueueOrder = QUEUE_ORDER_PRIORITY
+	if _, err := NewAPNSPool(config); err == nil || !strings.Contains(err.Error(), "QueueOrder") {
+		t.Errorf("Expected a QueueOrder error but got %v", err)
+	}
+}
+
+func TestLazyPoolShouldDialOnFirstSend(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.Size = 2
+	config.Lazy = true
+	dial := config.Dial
+	failDial := true
+	config.Dial = func(config *APNSConfig) (*APNSConnection, error) {
+		if failDial {
+			return nil, errors.New("Gateway unavailable")
+		}
+		return dial(config)
+	}
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	if pool.Len() != 0 {
+		t.Fatalf("Expected lazy pool not to dial but it has %v connections", pool.Len())
+	}
+
+	if err := pool.Send(testTokens(1)[0]); err == nil || err.Error() != "Gateway unavailable" {
+		t.Errorf("Expected the dial error from the first send but got %v", err)
+	}
+
+	failDial = false
+	if err := pool.Send(testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Len() != 2 || len(sockets) != 2 {
+		t.Errorf("Expected 2 connections once connected but pool has %v and dialed %v", pool.Len(), len(sockets))
+	}
+}
+
+func TestPoolReplaceShouldOpenNewConnectionBeforeClosingOld(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = 1000
+	dial := config.Dial
+	dialErr := error(nil)
+	config.Dial = func(config *APNSConfig) (*APNSConnection, error) {
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return dial(config)
+	}
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	oldId := pool.Members()[0]
+
+	//waits for the framing timeout on the old connection
+	if err := pool.Send(testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	newId, err := pool.Replace(oldId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if members := pool.Members(); len(members) != 1 || members[0] != newId || newId == oldId {
+		t.Fatalf("Expected only the new member %v but got %v", newId, members)
+	}
+
+	lock.Lock()
+	if len(sockets) != 2 || sockets[0].Written() == 0 {
+		t.Errorf("Expected the old connection to flush its queued payload before closing")
+	}
+	lock.Unlock()
+	connectionClose := <-pool.CloseChannel
+	if connectionClose.UnsentPayloadBufferOverflow || len(connectionClose.UnsentPayloads) != 0 {
+		t.Errorf("Expected a clean disconnect of the old connection but got %+v", connectionClose)
+	}
+
+	dialErr = errors.New("Gateway unavailable")
+	if _, err := pool.Replace(newId); err != dialErr {
+		t.Errorf("Expected the dial error but got %v", err)
+	}
+	if members := pool.Members(); len(members) != 1 || members[0] != newId {
+		t.Errorf("Expected the member to stay when its replacement fails but got %v", members)
+	}
+	if _, err := pool.Replace(oldId); err != ErrUnknownMember {
+		t.Errorf("Expected ErrUnknownMember but got %v", err)
+	}
+}
+
+func TestPoolReplaceShouldKeepTokenOrder(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = 1000
+	config.PreserveTokenOrder = true
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range pool.CloseChannel {
+		}
+	}()
+
+	token := testTokens(1)[0].Token
+	pool.Send(&Payload{Token: token, AlertText: "p1"})
+	id, err := pool.Replace(pool.Members()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockets[0].Written() == 0 {
+		t.Fatal("Expected the old connection to write its queued payload before the new one took its token")
+	}
+
+	//the paused connection hands its queue back to be resent on the new one
+	pool.Pause()
+	pool.Send(&Payload{Token: token, AlertText: "p2"})
+	if _, err := pool.Replace(id); err != nil {
+		t.Fatal(err)
+	}
+	pool.Send(&Payload{Token: token, AlertText: "p3"})
+	pool.Resume()
+
+	//p2 and p3 are resent in the background
+	order := ""
+	deadline := time.Now().Add(time.Second)
+	for len(order) < 3*len(`{"aps":{"alert":"p1"}}`) && time.Now().Before(deadline) {
+		pool.Flush()
+		order = ""
+		lock.Lock()
+		for _, socket := range sockets {
+			socket.lock.Lock()
+			for _, n := range parseNotifications(socket.WrittenBytes.Bytes()) {
+				order += n.Payload
+			}
+			socket.lock.Unlock()
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	pool.Disconnect()
+	expected := `{"aps":{"alert":"p1"}}{"aps":{"alert":"p2"}}{"aps":{"alert":"p3"}}`
+	if order != expected {
+		t.Errorf("Expected payloads written in order %v but got %v", expected, order)
+	}
+}
+
+func TestPoolShouldRotateCredentialsOneConnectionAtATime(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.Size = 3
+	config.ConnectionConfig.CertificateBytes = []byte("old")
+	dial := config.Dial
+	var dialed []string
+	flakyDials := 0
+	config.Dial = func(config *APNSConfig) (*APNSConnection, error) {
+		cert := string(config.CertificateBytes)
+		dialed = append(dialed, cert)
+		if cert == "flaky" {
+			flakyDials++
+		}
+		if cert == "bad" || (cert == "flaky" && flakyDials > 1) {
+			return nil, errors.New("Bad certificate")
+		}
+		return dial(config)
+	}
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	go func() {
+		for range pool.CloseChannel {
+		}
+	}()
+	oldMembers := pool.Members()
+
+	var progress []RotationProgress
+	onProgress := func(p *RotationProgress) {
+		progress = append(progress, *p)
+	}
+	if err := pool.RotateCredentials([]byte("new"), []byte("key"), onProgress); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 3 || progress[0] != (RotationProgress{Done: 1, Total: 3}) ||
+		progress[2] != (RotationProgress{Done: 3, Total: 3}) {
+		t.Errorf("Expected progress after each of 3 swaps but got %v", progress)
+	}
+	newMembers := pool.Members()
+	for _, id := range oldMembers {
+		for _, newId := range newMembers {
+			if id == newId {
+				t.Errorf("Expected %v to be replaced but it's still in %v", id, newMembers)
+			}
+		}
+	}
+	if _, err := pool.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(dialed, ",") != "old,old,old,new,new,new,new" {
+		t.Errorf("Expected new connections to use the new credentials but dialed %v", dialed)
+	}
+
+	//fails on the first swap so nothing needs rolling back
+	dialed = nil
+	progress = nil
+	if err := pool.RotateCredentials([]byte("bad"), []byte("key"), onProgress); err == nil {
+		t.Error("Expected an error rotating to a bad certificate")
+	}
+	if len(progress) != 0 || len(pool.Members()) != 4 || strings.Join(dialed, ",") != "bad" {
+		t.Errorf("Expected nothing to be swapped but got %v and dialed %v", progress, dialed)
+	}
+
+	//fails on the second swap so the first is swapped back
+	dialed = nil
+	if err := pool.RotateCredentials([]byte("flaky"), []byte("key"), onProgress); err == nil ||
+		!strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("Expected a rolled back error but got %v", err)
+	}
+	if len(progress) != 2 || progress[0] != (RotationProgress{Done: 1, Total: 4}) ||
+		progress[1] != (RotationProgress{Done: 0, Total: 4, RollingBack: true}) {
+		t.Errorf("Expected a swap then a rollback but got %v", progress)
+	}
+	if _, err := pool.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(dialed, ",") != "flaky,flaky,new,new" || len(pool.Members()) != 5 {
+		t.Errorf("Expected the old credentials to be restored but dialed %v", dialed)
+	}
+}
+
+func TestPoolShouldRotateCredentialsWhileScaling(t *testing.T) {
+	var sockets []MockConnPool
+	config := testPoolConfig(&sockets, new(sync.Mutex))
+	config.MaxSize = 2
+	config.ScaleInterval = 1
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	go func() {
+		for range pool.CloseChannel {
+		}
+	}()
+
+	//scaling runs alongside the rotation, -race checks they don't share ConnectionConfig
+	if err := pool.RotateCredentials([]byte("new"), []byte("key"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolShouldScaleWithQueueDepth(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = 100
+	config.MaxSize = 3
+	config.ScaleUpQueueDepth = 5
+	config.ScaleDownIdleTime = 30
+	config.ScaleInterval = 5
+
+	pool, err := NewAPNSPool(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	go func() {
+		for range pool.CloseChannel {
+		}
+	}()
+
+	//payloads wait for the framing timeout, backing up the queue
+	for _, p := range testTokens(10) {
+		if err := pool.Send(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPoolLen(t, pool, 3)
+	time.Sleep(20 * time.Millisecond)
+	if pool.Len() != 3 {
+		t.Errorf("Expected the pool not to grow past MaxSize but has %v connections", pool.Len())
+	}
+
+	//shrinks back once the queue has been flushed
+	waitForPoolLen(t, pool, 1)
+	time.Sleep(50 * time.Millisecond)
+	if pool.Len() != 1 {
+		t.Errorf("Expected the pool not to shrink below Size but has %v connections", pool.Len())
+	}
+
+	config = testPoolConfig(&sockets, lock)
+	config.Size = 2
+	config.MaxSize = 1
+	if _, err := NewAPNSPool(config); err == nil || !strings.Contains(err.Error(), "MaxSize") {
+		t.Errorf("Expected a MaxSize error but got %v", err)
+	}
+}
+
+func waitForPoolLen(t *testing.T, pool *APNSPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for pool.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v connections, pool has %v", n, pool.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+package apns
+
+//Payload showing an alert with a title and body
+func NewAlertPush(token string, title string, body string) *Payload {
+	return &Payload{
+		Token:     token,
+		AlertBody: APSAlertBody{Title: title, Body: body},
+		PushType:  PUSH_TYPE_ALERT,
+		Priority:  PRIORITY_IMMEDIATE,
+	}
+}
+
+//Background push waking the app to fetch content, without an alert, sound or badge
+//Apple requires these be sent at PRIORITY_CONSERVE_POWER
+func NewSilentPush(token string) *Payload {
+	return &Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		PushType:         PUSH_TYPE_BACKGROUND,
+		Priority:         PRIORITY_CONSERVE_POWER,
+	}
+}
+
+//Payload setting the app icon's badge to n, 0 to clear it
+func NewBadgePush(token string, n int) *Payload {
+	return &Payload{
+		Token:    token,
+		Badge:    NewBadgeNumber(n),
+		PushType: PUSH_TYPE_ALERT,
+		Priority: PRIORITY_IMMEDIATE,
+	}
+}
+
+//Incoming call push with data as its custom fields
+//Must be sent on a connection using a VoIP Services certificate
+func NewVoIPPush(token string, data map[string]interface{}) *Payload {
+	return &Payload{
+		Token:        token,
+		CustomFields: data,
+		PushType:     PUSH_TYPE_VOIP,
+		Priority:     PRIORITY_IMMEDIATE,
+	}
+}
@@ -0,0 +1,35 @@
+package apns
+
+import (
+	"testing"
+)
+
+func TestPresetsShouldMarshal(t *testing.T) {
+	token := testTokens(1)[0].Token
+	tests := []struct {
+		payload  *Payload
+		pushType PushType
+		priority uint8
+		json     string
+	}{
+		{NewAlertPush(token, "Hi", "Hello there"), PUSH_TYPE_ALERT, 10,
+			`{"aps":{"alert":{"body":"Hello there","title":"Hi"}}}`},
+		{NewSilentPush(token), PUSH_TYPE_BACKGROUND, 5, `{"aps":{"content-available":1}}`},
+		{NewBadgePush(token, 0), PUSH_TYPE_ALERT, 10, `{"aps":{"badge":0}}`},
+		{NewVoIPPush(token, map[string]interface{}{"caller": "Ann"}), PUSH_TYPE_VOIP, 10,
+			`{"aps":{},"caller":"Ann"}`},
+	}
+	for _, test := range tests {
+		if test.payload.Token != token || test.payload.PushType != test.pushType ||
+			test.payload.Priority != test.priority {
+			t.Errorf("Expected %v push at priority %v but got %+v", test.pushType, test.priority, test.payload)
+		}
+		json, err := test.payload.Marshal(2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(json) != test.json {
+			t.Errorf("Expected %v but got %v", test.json, string(json))
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	//Leave the priority out of the frame, Apple treats it as PRIORITY_IMMEDIATE
+	PRIORITY_DEFAULT uint8 = 0
+	//Send the push immediately, for alerts, sounds and badges
+	PRIORITY_IMMEDIATE uint8 = 10
+	//Send the push at a time that conserves power on the device,
+	//required for background (ContentAvailable only) pushes
+	PRIORITY_CONSERVE_POWER uint8 = 5
+)
+
+//Returned when a payload's priority isn't 0, 5 or 10
+var ErrInvalidPriority = errors.New("Invalid priority")
+
+//Check a priority is PRIORITY_DEFAULT, PRIORITY_IMMEDIATE or PRIORITY_CONSERVE_POWER
+func ValidatePriority(priority uint8) error {
+	switch priority {
+	case PRIORITY_DEFAULT, PRIORITY_IMMEDIATE, PRIORITY_CONSERVE_POWER:
+		return nil
+	}
+	return fmt.Errorf("%w. Was %v but should be 10, 5 or 0 to leave it out", ErrInvalidPriority, priority)
+}
@@ -0,0 +1,44 @@
+package apns
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestValidatePriority(t *testing.T) {
+	for _, priority := range []uint8{PRIORITY_DEFAULT, PRIORITY_IMMEDIATE, PRIORITY_CONSERVE_POWER} {
+		if err := ValidatePriority(priority); err != nil {
+			t.Errorf("Expected %v to be valid but got %v", priority, err)
+		}
+	}
+	for _, priority := range []uint8{1, 6, 11, 255} {
+		if err := ValidatePriority(priority); !errors.Is(err, ErrInvalidPriority) {
+			t.Errorf("Expected %v to be invalid but got %v", priority, err)
+		}
+	}
+}
+
+func TestInvalidPriorityShouldFailWithoutChangingThePayload(t *testing.T) {
+	p := &Payload{AlertText: "Testing", Priority: 7}
+	if _, err := p.Marshal(256); !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("Expected ErrInvalidPriority but got %v", err)
+	}
+	if p.Priority != 7 {
+		t.Errorf("Expected the payload's priority to be left alone but got %v", p.Priority)
+	}
+
+	var sockets []MockConnPool
+	pool, err := NewAPNSPool(testPoolConfig(&sockets, new(sync.Mutex)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Disconnect()
+	p.Token = testTokens(1)[0].Token
+	if err := pool.Send(p); !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("Expected Send to return ErrInvalidPriority but got %v", err)
+	}
+	if p.Priority != 7 {
+		t.Errorf("Expected the payload's priority to be left alone but got %v", p.Priority)
+	}
+}
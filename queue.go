@@ -0,0 +1,332 @@
+package apns
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Reason recorded in the outbox for payloads replaced by a newer payload
+//with the same token and CollapseID before they were sent
+var ErrPayloadCollapsed = errors.New("Payload replaced by a newer payload with the same CollapseID")
+
+//Reason recorded in the outbox for payloads cancelled before they were sent
+var ErrPayloadCancelled = errors.New("Payload cancelled before being sent")
+
+//Order queued payloads are written in
+//QUEUE_ORDER_PRIORITY and QUEUE_ORDER_EXPIRATION can be combined with |,
+//in which case payloads are ordered by priority and then expiration
+type QueueOrder int
+
+const (
+	//Payloads are written in the order they were sent
+	QUEUE_ORDER_FIFO QueueOrder = 0
+	//Priority 10 and default priority payloads are written ahead of priority 5 ones,
+	//otherwise payloads are written in the order they were sent
+	QUEUE_ORDER_PRIORITY QueueOrder = 1
+	//Payloads closest to their ExpirationTime are written first (ExpireImmediately
+	//ones before any), then payloads without one or with just a TimeToLive,
+	//otherwise payloads are written in the order they were sent
+	QUEUE_ORDER_EXPIRATION QueueOrder = 2
+)
+
+//Payloads waiting to be framed and written to the socket
+//THREADSAFE (so it can be inspected while the send listener is writing)
+type sendQueue struct {
+	//Mutex to sync access to everything below
+	lock *sync.Mutex
+	//queued payloads as a heap, in the order they're popped
+	items sendQueueItems
+	//queued payloads with a CollapseID, by token and CollapseID
+	collapsible map[string]*sendQueueItem
+	//queued payloads with a UUID, by UUID
+	byUUID map[string]*sendQueueItem
+	//Stateful counter recording the order payloads were pushed in
+	sequence uint64
+	//Source of the times payloads are queued at
+	clock Clock
+}
+
+//Queued payload
+type sendQueueItem struct {
+	payload *Payload
+	//when the payload was pushed relative to the others
+	sequence uint64
+	//when the payload was pushed
+	queuedAt time.Time
+	//index in the heap, kept up to date by the heap
+	index int
+	//Receives why the payload left the queue, nil if it's being written
+	//nil unless the payload is being watched
+	dequeued chan error
+}
+
+func newSendQueue(order QueueOrder, clock Clock) *sendQueue {
+	q := &sendQueue{
+		lock:        new(sync.Mutex),
+		clock:       clock,
+		collapsible: make(map[string]*sendQueueItem),
+		byUUID:      make(map[string]*sendQueueItem),
+	}
+	q.items.order = order
+	return q
+}
+
+//Key identifying payloads which collapse into each other on the device
+//Empty if the payload has no CollapseID
+func collapseKey(p *Payload) string {
+	if p.CollapseID == "" {
+		return ""
+	}
+	return p.Token + "|" + p.CollapseID
+}
+
+//Add a payload to the queue
+//If a payload with the same token and CollapseID is already queued it's
+//removed and returned, the device would only have shown the newest one
+func (q *sendQueue) push(p *Payload) *Payload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var collapsed *Payload
+	key := collapseKey(p)
+	if key != "" {
+		if item, ok := q.collapsible[key]; ok {
+			q.remove(item)
+			item.notify(ErrPayloadCollapsed)
+			collapsed = item.payload
+		}
+	}
+	item := &sendQueueItem{payload: p, sequence: q.sequence, queuedAt: q.clock.Now()}
+	q.sequence++
+	heap.Push(&q.items, item)
+	if key != "" {
+		q.collapsible[key] = item
+	}
+	if p.UUID != "" {
+		q.byUUID[p.UUID] = item
+	}
+	return collapsed
+}
+
+//Remove and return the next payload to write, nil if the queue is empty
+func (q *sendQueue) pop() *Payload {
+	p, dequeued, _ := q.popWatched()
+	if dequeued != nil {
+		dequeued <- nil
+	}
+	return p
+}
+
+//Remove and return the next payload, which won't be written because the
+//connection closed, nil if the queue is empty
+func (q *sendQueue) popUnsent() *Payload {
+	p, dequeued, _ := q.popWatched()
+	if dequeued != nil {
+		dequeued <- ErrConnectionClosed
+	}
+	return p
+}
+
+//Remove and return the next payload to write, nil if the queue is empty,
+//the channel watching it (see watch), nil if it isn't watched, and when it was queued
+//The caller sends the watcher the payload's PayloadError, or nil, once it's been framed
+func (q *sendQueue) popWatched() (*Payload, chan error, time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.items.items) == 0 {
+		return nil, nil, time.Time{}
+	}
+	item := q.items.items[0]
+	q.remove(item)
+	return item.payload, item.dequeued, item.queuedAt
+}
+
+//Remove and return the queued payload with a UUID, nil if there isn't one
+func (q *sendQueue) cancel(uuid string) *Payload {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item, ok := q.byUUID[uuid]
+	if !ok {
+		return nil
+	}
+	q.remove(item)
+	item.notify(ErrPayloadCancelled)
+	return item.payload
+}
+
+//Channel receiving why the queued payload with a UUID leaves the queue:
+//nil once it's framed to be written, its PayloadError if it can't be,
+//ErrPayloadCollapsed, ErrPayloadCancelled or ErrConnectionClosed
+//nil if there's no such payload queued
+func (q *sendQueue) watch(uuid string) <-chan error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item, ok := q.byUUID[uuid]
+	if !ok {
+		return nil
+	}
+	if item.dequeued == nil {
+		item.dequeued = make(chan error, 1)
+	}
+	return item.dequeued
+}
+
+//Tell the item's watcher, if any, why it left the queue
+func (item *sendQueueItem) notify(reason error) {
+	if item.dequeued != nil {
+		item.dequeued <- reason
+	}
+}
+
+//NOT THREADSAFE (need to acquire lock before calling)
+//Take an item out of the heap and indexes
+func (q *sendQueue) remove(item *sendQueueItem) {
+	heap.Remove(&q.items, item.index)
+	if key := collapseKey(item.payload); key != "" && q.collapsible[key] == item {
+		delete(q.collapsible, key)
+	}
+	if uuid := item.payload.UUID; uuid != "" && q.byUUID[uuid] == item {
+		delete(q.byUUID, uuid)
+	}
+}
+
+//Number of queued payloads
+func (q *sendQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items.items)
+}
+
+//How long the longest waiting payload has been queued, 0 if the queue is empty
+func (q *sendQueue) oldestAge(now time.Time) time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var age time.Duration
+	for _, item := range q.items.items {
+		if itemAge := now.Sub(item.queuedAt); itemAge > age {
+			age = itemAge
+		}
+	}
+	return age
+}
+
+//Metadata for every queued payload, in the order they'll be written
+func (q *sendQueue) snapshot() []QueuedPayloadInfo {
+	q.lock.Lock()
+	items := sendQueueItems{
+		order: q.items.order,
+		items: append([]*sendQueueItem(nil), q.items.items...),
+	}
+	q.lock.Unlock()
+
+	//sort a copy so the heap's indexes aren't touched
+	sort.Slice(items.items, items.Less)
+	infos := make([]QueuedPayloadInfo, len(items.items))
+	for i, item := range items.items {
+		infos[i] = QueuedPayloadInfo{
+			UUID:           item.payload.UUID,
+			Token:          item.payload.Token,
+			CollapseID:     item.payload.CollapseID,
+			Priority:       item.payload.Priority,
+			ExpirationTime: item.payload.ExpirationTime,
+			QueuedAt:       item.queuedAt,
+		}
+	}
+	return infos
+}
+
+//Metadata about a payload waiting to be written
+type QueuedPayloadInfo struct {
+	//Payload fields
+	UUID           string
+	Token          string
+	CollapseID     string
+	Priority       uint8
+	ExpirationTime uint32
+	//When the connection queued the payload
+	QueuedAt time.Time
+}
+
+//Iterator over a snapshot of queued payloads, in the order they'll be written
+type QueueIterator struct {
+	infos []QueuedPayloadInfo
+	//index of the current info, -1 before Next is called
+	current int
+}
+
+//Advance to the next payload, returns false when done
+func (i *QueueIterator) Next() bool {
+	if i.current+1 >= len(i.infos) {
+		i.current = len(i.infos)
+		return false
+	}
+	i.current++
+	return true
+}
+
+//The current payload's metadata
+func (i *QueueIterator) Info() QueuedPayloadInfo {
+	return i.infos[i.current]
+}
+
+//Number of payloads in the snapshot
+func (i *QueueIterator) Len() int {
+	return len(i.infos)
+}
+
+//heap.Interface over queued payloads
+type sendQueueItems struct {
+	order QueueOrder
+	items []*sendQueueItem
+}
+
+func (s *sendQueueItems) Len() int {
+	return len(s.items)
+}
+
+func (s *sendQueueItems) Less(i, j int) bool {
+	a, b := s.items[i], s.items[j]
+	if s.order&QUEUE_ORDER_PRIORITY != 0 {
+		//Apple treats PRIORITY_DEFAULT as PRIORITY_IMMEDIATE
+		aHigh := a.payload.Priority != PRIORITY_CONSERVE_POWER
+		bHigh := b.payload.Priority != PRIORITY_CONSERVE_POWER
+		if aHigh != bHigh {
+			return aHigh
+		}
+	}
+	if s.order&QUEUE_ORDER_EXPIRATION != 0 {
+		aExpires, bExpires := a.payload.queueExpiration(), b.payload.queueExpiration()
+		if aExpires != bExpires {
+			//payloads without an expiration never expire so they can wait
+			return bExpires == 0 || (aExpires != 0 && aExpires < bExpires)
+		}
+	}
+	return a.sequence < b.sequence
+}
+
+func (s *sendQueueItems) Swap(i, j int) {
+	s.items[i], s.items[j] = s.items[j], s.items[i]
+	s.items[i].index = i
+	s.items[j].index = j
+}
+
+func (s *sendQueueItems) Push(x interface{}) {
+	item := x.(*sendQueueItem)
+	item.index = len(s.items)
+	s.items = append(s.items, item)
+}
+
+func (s *sendQueueItems) Pop() interface{} {
+	last := len(s.items) - 1
+	item := s.items[last]
+	s.items[last] = nil
+	s.items = s.items[:last]
+	return item
+}
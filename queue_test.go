@@ -0,0 +1,445 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendQueueShouldKeepNewestCollapsedPayload(t *testing.T) {
+	q := newSendQueue(QUEUE_ORDER_FIFO, SystemClock)
+	payloads := testTokens(2)
+
+	first := &Payload{Token: payloads[0].Token, CollapseID: "score"}
+	other := &Payload{Token: payloads[1].Token, CollapseID: "score"}
+	plain := &Payload{Token: payloads[0].Token}
+	newest := &Payload{Token: payloads[0].Token, CollapseID: "score"}
+
+	for _, p := range []*Payload{first, other, plain} {
+		if collapsed := q.push(p); collapsed != nil {
+			t.Fatalf("Expected nothing to collapse pushing %v but got %v", p, collapsed)
+		}
+	}
+	if collapsed := q.push(newest); collapsed != first {
+		t.Fatalf("Expected first payload to be collapsed but got %v", collapsed)
+	}
+
+	expected := []*Payload{other, plain, newest}
+	for i, e := range expected {
+		if p := q.pop(); p != e {
+			t.Errorf("Expected payload %v to be %v but got %v", i, e, p)
+		}
+	}
+	if q.pop() != nil || q.len() != 0 || len(q.collapsible) != 0 {
+		t.Error("Expected queue to be empty")
+	}
+}
+
+func TestSendQueueShouldPopHighPriorityFirst(t *testing.T) {
+	q := newSendQueue(QUEUE_ORDER_PRIORITY, SystemClock)
+	payloads := testTokens(5)
+	payloads[1].Priority = 10
+	payloads[2].Priority = 5
+	payloads[3].Priority = 10
+	for _, p := range payloads {
+		q.push(p)
+	}
+
+	expected := []*Payload{payloads[0], payloads[1], payloads[3], payloads[4], payloads[2]}
+	for i, e := range expected {
+		if p := q.pop(); p != e {
+			t.Errorf("Expected payload %v to be %v but got %v", i, e.Token, p.Token)
+		}
+	}
+}
+
+func TestSendQueueShouldPopDefaultPriorityBeforeBackground(t *testing.T) {
+	q := newSendQueue(QUEUE_ORDER_PRIORITY, SystemClock)
+	payloads := testTokens(3)
+	payloads[0].Priority = PRIORITY_CONSERVE_POWER
+	payloads[1].Priority = PRIORITY_CONSERVE_POWER
+	payloads[2].Priority = PRIORITY_DEFAULT
+	for _, p := range payloads {
+		q.push(p)
+	}
+
+	//Apple treats the default priority as immediate
+	expected := []*Payload{payloads[2], payloads[0], payloads[1]}
+	for i, e := range expected {
+		if p := q.pop(); p != e {
+			t.Errorf("Expected payload %v to be %v but got %v", i, e.Token, p.Token)
+		}
+	}
+}
+
+func TestSendQueueShouldPopClosestExpirationFirst(t *testing.T) {
+	q := newSendQueue(QUEUE_ORDER_PRIORITY|QUEUE_ORDER_EXPIRATION, SystemClock)
+	payloads := testTokens(5)
+	for _, p := range payloads {
+		p.Priority = PRIORITY_CONSERVE_POWER
+	}
+	payloads[1].ExpirationTime = 2000
+	payloads[2].ExpirationTime = 1000
+	payloads[3].ExpirationTime = 3000
+	payloads[3].Priority = 10
+	payloads[4].ExpirationTime = 1000
+	for _, p := range payloads {
+		q.push(p)
+	}
+
+	expected := []*Payload{payloads[3], payloads[2], payloads[4], payloads[1], payloads[0]}
+	for i, e := range expected {
+		if p := q.pop(); p != e {
+			t.Errorf("Expected payload %v to be %v but got %v", i, e.Token, p.Token)
+		}
+	}
+}
+
+func TestConnectionShouldOnlySendNewestCollapsedPayload(t *testing.T) {
+	socket := newMockConnPool()
+	store := NewMemoryOutboxStore()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            50,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OutboxStore:               store,
+		})
+
+	token := testTokens(1)[0].Token
+	for _, text := range []string{"1-0", "2-0", "2-1"} {
+		apn.SendChannel <- &Payload{Token: token, AlertText: text, CollapseID: "score"}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the queue to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 1 || written[0].Payload != `{"aps":{"alert":"2-1"}}` {
+		t.Errorf("Expected only the newest payload to be written but got %v", written)
+	}
+	if apn.PayloadsCollapsed() != 2 {
+		t.Errorf("Expected 2 payloads to be collapsed but got %v", apn.PayloadsCollapsed())
+	}
+	failed := store.Failed()
+	if len(failed) != 2 {
+		t.Fatalf("Expected collapsed payloads to be marked failed in the outbox but got %v", failed)
+	}
+	for _, reason := range failed {
+		if !errors.Is(reason, ErrPayloadCollapsed) {
+			t.Errorf("Expected ErrPayloadCollapsed but got %v", reason)
+		}
+	}
+}
+
+func TestConnectionShouldReturnQueuedPayloadsAsUnsent(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10000,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	payloads := testTokens(2)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	socket.Close()
+
+	connectionClose := <-apn.CloseChannel
+	if len(connectionClose.UnsentPayloads) != 2 ||
+		connectionClose.UnsentPayloads[0] != payloads[0] ||
+		connectionClose.UnsentPayloads[1] != payloads[1] {
+		t.Errorf("Expected queued payloads to be returned in order but got %v", connectionClose.UnsentPayloads)
+	}
+	if connectionClose.UnsentPayloadBufferOverflow {
+		t.Error("Expected queued payloads not to count as lost from the in-flight buffer")
+	}
+	if socket.Written() != 0 {
+		t.Error("Expected queued payloads not to be written")
+	}
+}
+
+func TestConnectionShouldWriteHighPriorityPayloadsFirst(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            50,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			QueueOrder:                QUEUE_ORDER_PRIORITY,
+		})
+
+	payloads := testTokens(3)
+	payloads[0].AlertText = "background"
+	payloads[0].Priority = PRIORITY_CONSERVE_POWER
+	payloads[1].AlertText = "background"
+	payloads[1].Priority = PRIORITY_CONSERVE_POWER
+	payloads[2].AlertText = "urgent"
+	payloads[2].Priority = 10
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the queue to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 3 || written[0].Payload != `{"aps":{"alert":"urgent"}}` {
+		t.Errorf("Expected the priority 10 payload to be written first but got %v", written)
+	}
+}
+
+func TestConnectionShouldKeepSendOrderAcrossFrameFlushes(t *testing.T) {
+	for _, framingTimeout := range []int{-1, 10000} {
+		socket := newMockConnPool()
+		apn := socketAPNSConnection(socket,
+			&APNSConfig{
+				InFlightPayloadBufferSize: 10000,
+				FramingTimeout:            framingTimeout,
+				//a few notifications per frame, so buffering flushes part way through
+				MaxOutboundTCPFrameSize: 400,
+				MaxPayloadSize:          2048,
+				StrictOrdering:          true,
+			})
+
+		payloads := testTokens(50)
+		for i, p := range payloads {
+			p.AlertText = fmt.Sprintf("%v %v", i, strings.Repeat("x", i*37%150))
+			apn.SendChannel <- p
+		}
+		apn.Flush()
+		apn.Disconnect()
+		<-apn.CloseChannel
+
+		written := parseNotifications(socket.WrittenBytes.Bytes())
+		if len(written) != len(payloads) {
+			t.Fatalf("Expected %v notifications but got %v", len(payloads), len(written))
+		}
+		for i, n := range written {
+			if n.ID != uint32(i+1) || !strings.HasPrefix(n.Payload, fmt.Sprintf(`{"aps":{"alert":"%v `, i)) {
+				t.Fatalf("Expected payload %v at position %v with framing timeout %v but got %v",
+					i, i, framingTimeout, n)
+			}
+		}
+	}
+}
+
+func TestStrictOrderingShouldRequireFIFO(t *testing.T) {
+	config := &APNSConfig{CertificateBytes: []byte{1}, KeyBytes: []byte{1},
+		StrictOrdering: true, QueueOrder: QUEUE_ORDER_PRIORITY}
+	if err := applyConfigDefaults(config); err == nil || !strings.Contains(err.Error(), "StrictOrdering") {
+		t.Errorf("Expected a QueueOrder error but got %v", err)
+	}
+}
+
+func TestConnectionShouldCancelQueuedPayload(t *testing.T) {
+	socket := newMockConnPool()
+	store := NewMemoryOutboxStore()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10000,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OutboxStore:               store,
+			GeneratePayloadUUIDs:      true,
+		})
+
+	payloads := testTokens(2)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+
+	if !apn.Cancel(payloads[0].UUID) {
+		t.Error("Expected queued payload to be cancelled")
+	}
+	if apn.Cancel(payloads[0].UUID) {
+		t.Error("Expected payload to only be cancelled once")
+	}
+	if !errors.Is(store.Failed()[payloads[0].OutboxID], ErrPayloadCancelled) {
+		t.Errorf("Expected cancelled payload to be marked failed but got %v", store.Failed())
+	}
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := parseNotifications(socket.WrittenBytes.Bytes())
+	if len(written) != 1 || written[0].ID != 1 {
+		t.Errorf("Expected only the second payload to be written but got %v", written)
+	}
+	if apn.Cancel(payloads[1].UUID) {
+		t.Error("Expected nothing to be cancelled after the connection closed")
+	}
+}
+
+func TestConnectionShouldReportQueueDepthAndAge(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10000,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			QueueOrder:                QUEUE_ORDER_PRIORITY,
+		})
+	defer apn.Disconnect()
+
+	if apn.QueueDepth() != 0 || apn.OldestQueuedAge() != 0 {
+		t.Error("Expected empty queue")
+	}
+
+	payloads := testTokens(3)
+	payloads[0].Priority = PRIORITY_CONSERVE_POWER
+	payloads[1].Priority = PRIORITY_CONSERVE_POWER
+	payloads[2].Priority = 10
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	//wait for the last payload to be queued
+	apn.Cancel("none")
+	time.Sleep(5 * time.Millisecond)
+
+	if apn.QueueDepth() != 3 {
+		t.Errorf("Expected 3 queued payloads but got %v", apn.QueueDepth())
+	}
+	if age := apn.OldestQueuedAge(); age < 5*time.Millisecond || age > time.Second {
+		t.Errorf("Expected oldest payload to have waited at least 5ms but got %v", age)
+	}
+
+	iter := apn.QueueSnapshot()
+	var tokens []string
+	for iter.Next() {
+		tokens = append(tokens, iter.Info().Token)
+	}
+	if iter.Len() != 3 || len(tokens) != 3 || tokens[0] != payloads[2].Token || tokens[1] != payloads[0].Token {
+		t.Errorf("Expected snapshot in write order but got %v", tokens)
+	}
+}
+
+func TestConnectionShouldHoldPayloadsWhilePaused(t *testing.T) {
+	socket := newMockConnPool()
+	store := NewMemoryOutboxStore()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			OutboxStore:               store,
+		})
+
+	apn.Pause()
+	for _, p := range testTokens(2) {
+		apn.SendChannel <- p
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if socket.Written() != 0 || apn.QueueDepth() != 2 || store.PendingLen() != 2 {
+		t.Fatalf("Expected payloads to be persisted and queued while paused but %v bytes were written", socket.Written())
+	}
+
+	apn.Resume()
+	deadline := time.Now().Add(time.Second)
+	for socket.Written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for payloads to be written after resuming")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if n := len(parseNotifications(socket.WrittenBytes.Bytes())); n != 2 {
+		t.Errorf("Expected both payloads to be written after resuming but %v were", n)
+	}
+}
+
+func TestConnectionShouldReturnPausedPayloadsOnDisconnect(t *testing.T) {
+	socket := newMockConnPool()
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	apn.Pause()
+	payloads := testTokens(2)
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	apn.Disconnect()
+	connectionClose := <-apn.CloseChannel
+
+	if socket.Written() != 0 || len(connectionClose.UnsentPayloads) != 2 {
+		t.Errorf("Expected paused payloads to be returned unsent but got %v", len(connectionClose.UnsentPayloads))
+	}
+}
+
+func TestSendQueueShouldTellWatchersWhyPayloadsLeft(t *testing.T) {
+	q := newSendQueue(QUEUE_ORDER_FIFO, SystemClock)
+	token := testTokens(1)[0].Token
+	collapsed := &Payload{Token: token, CollapseID: "score", UUID: "collapsed"}
+	cancelled := &Payload{Token: token, UUID: "cancelled"}
+	popped := &Payload{Token: token, UUID: "popped"}
+	unsent := &Payload{Token: token, UUID: "unsent"}
+
+	watchers := map[string]<-chan error{}
+	for _, p := range []*Payload{collapsed, cancelled, popped, unsent} {
+		q.push(p)
+		watchers[p.UUID] = q.watch(p.UUID)
+	}
+	if q.watch("missing") != nil {
+		t.Error("Expected no watcher for a payload which isn't queued")
+	}
+
+	q.push(&Payload{Token: token, CollapseID: "score"})
+	q.cancel("cancelled")
+	q.pop()
+	q.popUnsent()
+
+	for uuid, expected := range map[string]error{
+		"collapsed": ErrPayloadCollapsed,
+		"cancelled": ErrPayloadCancelled,
+		"popped":    nil,
+		"unsent":    ErrConnectionClosed,
+	} {
+		select {
+		case err := <-watchers[uuid]:
+			if err != expected {
+				t.Errorf("Expected %v to leave with %v but got %v", uuid, expected, err)
+			}
+		default:
+			t.Errorf("Expected the %v watcher to be told", uuid)
+		}
+	}
+}
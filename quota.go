@@ -0,0 +1,175 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Length of a quota period
+type QuotaPeriod int
+
+const (
+	//Quotas reset at the start of every day
+	QUOTA_PERIOD_DAY QuotaPeriod = iota
+	//Quotas reset at the start of every hour
+	QUOTA_PERIOD_HOUR
+)
+
+//Config for enforcing absolute quotas on the number of payloads sent
+type QuotaConfig struct {
+	//max number of payloads per key per Period : required
+	Limit int
+	//limits for specific keys, overriding Limit
+	KeyLimits map[string]int
+	//returns the key a payload counts against, e.g. the app it's for
+	//defaults to every payload counting against the same quota
+	Key func(payload *Payload) string
+	//how often quotas reset, defaults to QUOTA_PERIOD_DAY
+	Period QuotaPeriod
+	//time zone periods start in, defaults to UTC
+	Location *time.Location
+	//where counts are kept, use a persistent store (e.g. the sqlitequota package's)
+	//for quotas to survive restarts, defaults to a MemoryQuotaStore
+	Store QuotaStore
+	//called with payloads dropped because their key's quota is used up, defaults to none
+	//called from the sending go-routine so it must not block on the connection
+	OnQuotaExceeded func(payload *Payload, key string)
+	//source of the time payloads are counted at, defaults to SystemClock
+	Clock Clock
+}
+
+//Counts of payloads sent against each quota
+//Implementations must be safe for use from multiple go-routines at once
+type QuotaStore interface {
+	//Count a payload against key for the period starting at periodStart,
+	//unless limit payloads have already been counted
+	//Returns false if the quota was already used up
+	Take(key string, periodStart time.Time, limit int) (bool, error)
+}
+
+//Enforces absolute limits like "at most N notifications per app per day"
+//Use Middleware as a SendMiddleware, on an APNSConfig or around pool.Send
+type Quota struct {
+	//config
+	config *QuotaConfig
+	//Number of payloads dropped
+	exceeded atomic.Uint64
+}
+
+//Create a quota with the supplied config
+//If invalid config an error will be returned
+func NewQuota(config *QuotaConfig) (*Quota, error) {
+	errorStrs := ""
+
+	if config.Limit <= 0 {
+		errorStrs += "Invalid Limit. Should be > 0\n"
+	}
+	for key, limit := range config.KeyLimits {
+		if limit < 0 {
+			errorStrs += "Invalid KeyLimits for " + key + ". Should be >= 0\n"
+		}
+	}
+	if config.Period != QUOTA_PERIOD_DAY && config.Period != QUOTA_PERIOD_HOUR {
+		errorStrs += "Invalid Period. Should be QUOTA_PERIOD_DAY or QUOTA_PERIOD_HOUR\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Key == nil {
+		config.Key = func(payload *Payload) string { return "" }
+	}
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryQuotaStore()
+	}
+	config.Clock = configClock(config.Clock)
+
+	return &Quota{
+		config: config,
+	}, nil
+}
+
+//SendMiddleware which drops payloads once their key's quota is used up
+//Dropped payloads are passed to OnQuotaExceeded and aren't errors to the sender
+//Errors from the QuotaStore are returned, so payloads aren't sent when
+//their quota can't be checked
+func (q *Quota) Middleware(next SendFunc) SendFunc {
+	return func(payload *Payload) error {
+		key := q.config.Key(payload)
+		limit := q.config.Limit
+		if keyLimit, ok := q.config.KeyLimits[key]; ok {
+			limit = keyLimit
+		}
+
+		allowed, err := q.config.Store.Take(key, q.periodStart(q.config.Clock.Now()), limit)
+		if err != nil {
+			return fmt.Errorf("Error checking quota for %v : %v", key, err)
+		}
+		if !allowed {
+			q.exceeded.Add(1)
+			if q.config.OnQuotaExceeded != nil {
+				q.config.OnQuotaExceeded(payload, key)
+			}
+			return nil
+		}
+		return next(payload)
+	}
+}
+
+//Number of payloads dropped because their quota was used up
+func (q *Quota) Exceeded() uint64 {
+	return q.exceeded.Load()
+}
+
+//Start of the quota period t falls in
+func (q *Quota) periodStart(t time.Time) time.Time {
+	t = t.In(q.config.Location)
+	if q.config.Period == QUOTA_PERIOD_HOUR {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, q.config.Location)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.config.Location)
+}
+
+//QuotaStore held in memory
+//Counts are lost when the process exits
+type MemoryQuotaStore struct {
+	lock *sync.Mutex
+	//counts for each key's current period
+	counts map[string]*memoryQuotaCount
+}
+
+type memoryQuotaCount struct {
+	periodStart time.Time
+	count       int
+}
+
+//Create a new empty in memory quota store
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		lock:   new(sync.Mutex),
+		counts: make(map[string]*memoryQuotaCount),
+	}
+}
+
+func (s *MemoryQuotaStore) Take(key string, periodStart time.Time, limit int) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := s.counts[key]
+	if count == nil || !count.periodStart.Equal(periodStart) {
+		count = &memoryQuotaCount{periodStart: periodStart}
+		s.counts[key] = count
+	}
+	if count.count >= limit {
+		return false, nil
+	}
+	count.count++
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package apns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaShouldDropPayloadsOverLimit(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	var exceeded []string
+	store := NewMemoryQuotaStore()
+	config := &QuotaConfig{
+		Limit:     2,
+		KeyLimits: map[string]int{"small": 1},
+		Key:       func(payload *Payload) string { return payload.Category },
+		Store:     store,
+		OnQuotaExceeded: func(payload *Payload, key string) {
+			exceeded = append(exceeded, key)
+		},
+		Clock: fixedClock{now: &now},
+	}
+	quota, err := NewQuota(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(map[string]int)
+	send := quota.Middleware(func(payload *Payload) error {
+		sent[payload.Category]++
+		return nil
+	})
+	for _, key := range []string{"app", "app", "app", "small", "small"} {
+		if err := send(&Payload{Category: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sent["app"] != 2 || sent["small"] != 1 {
+		t.Errorf("Expected keys to be held to their quotas but sent %v", sent)
+	}
+	if len(exceeded) != 2 || exceeded[0] != "app" || exceeded[1] != "small" || quota.Exceeded() != 2 {
+		t.Errorf("Expected OnQuotaExceeded for each dropped payload but got %v", exceeded)
+	}
+
+	//a restart with the same store keeps the counts
+	restarted, _ := NewQuota(config)
+	restarted.Middleware(func(payload *Payload) error {
+		sent[payload.Category]++
+		return nil
+	})(&Payload{Category: "app"})
+	if sent["app"] != 2 {
+		t.Error("Expected quota to persist in the store")
+	}
+
+	now = now.Add(time.Minute)
+	send(&Payload{Category: "app"})
+	if sent["app"] != 3 {
+		t.Error("Expected quota to reset the next day")
+	}
+}
+
+func TestQuotaShouldUseHourlyPeriodsInLocation(t *testing.T) {
+	location := time.FixedZone("UTC+5:30", 5*3600+1800)
+	quota, err := NewQuota(&QuotaConfig{
+		Limit:    1,
+		Period:   QUOTA_PERIOD_HOUR,
+		Location: location,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := quota.periodStart(time.Date(2024, 3, 1, 10, 45, 0, 0, time.UTC))
+	if !start.Equal(time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected hour to start on the half hour in UTC+5:30 but got %v", start.UTC())
+	}
+}
+
+type failingQuotaStore struct{}
+
+func (s failingQuotaStore) Take(key string, periodStart time.Time, limit int) (bool, error) {
+	return false, errors.New("Database unavailable")
+}
+
+func TestQuotaShouldNotSendWhenStoreFails(t *testing.T) {
+	quota, err := NewQuota(&QuotaConfig{Limit: 10, Store: failingQuotaStore{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := false
+	err = quota.Middleware(func(payload *Payload) error {
+		sent = true
+		return nil
+	})(&Payload{})
+	if err == nil || sent {
+		t.Error("Expected store error to be returned and the payload not sent")
+	}
+}
@@ -0,0 +1,44 @@
+package apns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+//How device tokens are shown in log lines, error strings and summaries the
+//library produces, for deployments that treat tokens as personal data
+type TokenRedaction int
+
+const (
+	//Tokens are shown in full
+	TOKEN_REDACTION_NONE TokenRedaction = 0
+	//Only the first 6 characters are shown, the rest are masked with *
+	TOKEN_REDACTION_PREFIX TokenRedaction = 1
+	//Tokens are replaced with a short hash, so lines about the same token can
+	//be matched up without showing it
+	TOKEN_REDACTION_HASH TokenRedaction = 2
+)
+
+//Number of token characters TOKEN_REDACTION_PREFIX shows
+const TOKEN_REDACTION_PREFIX_SIZE = 6
+
+//Token as the policy shows it, for apps logging tokens the same way
+func (r TokenRedaction) Redact(token string) string {
+	switch r {
+	case TOKEN_REDACTION_PREFIX:
+		if len(token) <= TOKEN_REDACTION_PREFIX_SIZE {
+			return token
+		}
+		return token[:TOKEN_REDACTION_PREFIX_SIZE] + strings.Repeat("*", len(token)-TOKEN_REDACTION_PREFIX_SIZE)
+	case TOKEN_REDACTION_HASH:
+		sum := sha256.Sum256([]byte(strings.ToLower(token)))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return token
+}
+
+//Whether the policy is one of the TOKEN_REDACTION constants
+func (r TokenRedaction) valid() bool {
+	return r == TOKEN_REDACTION_NONE || r == TOKEN_REDACTION_PREFIX || r == TOKEN_REDACTION_HASH
+}
@@ -0,0 +1,77 @@
+package apns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenRedactionShouldRedactTokens(t *testing.T) {
+	token := testTokens(1)[0].Token
+
+	if redacted := TOKEN_REDACTION_NONE.Redact(token); redacted != token {
+		t.Errorf("Expected token in full but got %v", redacted)
+	}
+	if redacted := TOKEN_REDACTION_PREFIX.Redact(token); redacted != "4ec500"+strings.Repeat("*", 58) {
+		t.Errorf("Expected token masked after 6 characters but got %v", redacted)
+	}
+	hashed := TOKEN_REDACTION_HASH.Redact(token)
+	if !strings.HasPrefix(hashed, "sha256:") || len(hashed) != 19 || strings.Contains(hashed, token[:6]) {
+		t.Errorf("Expected a short hash but got %v", hashed)
+	}
+	if TOKEN_REDACTION_HASH.Redact(strings.ToUpper(token)) != hashed {
+		t.Error("Expected the hash to ignore case")
+	}
+	if TOKEN_REDACTION_HASH.Redact(testTokens(2)[1].Token) == hashed {
+		t.Error("Expected different tokens to hash differently")
+	}
+}
+
+func TestConnectionShouldRedactPayloadErrors(t *testing.T) {
+	payloadErrors := make(chan *PayloadError, 1)
+	apn := socketAPNSConnection(newMockConnPool(),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			TokenRedaction:            TOKEN_REDACTION_PREFIX,
+			OnPayloadError: func(err *PayloadError) {
+				payloadErrors <- err
+			},
+		})
+	defer apn.Disconnect()
+
+	badLength := &Payload{Token: "4ec500020d83"}
+	apn.SendChannel <- badLength
+	err := <-payloadErrors
+	if err.Payload != badLength || !strings.Contains(err.Error(), "token 4ec500****** :") {
+		t.Errorf("Expected the token to be redacted but got %v", err)
+	}
+}
+
+func TestWebhookShouldRedactTokens(t *testing.T) {
+	server, recorder := newWebhookServer(0)
+	defer server.Close()
+
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:            server.URL,
+		TokenRedaction: TOKEN_REDACTION_HASH,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := testTokens(1)[0]
+	emitter.ReportPayloadError(&PayloadError{Payload: payload, Err: ErrBadTokenLength})
+	emitter.Close()
+
+	if len(recorder.batches) != 1 || recorder.batches[0][0].Token != TOKEN_REDACTION_HASH.Redact(payload.Token) {
+		t.Errorf("Expected a hashed token but got %v", recorder.batches)
+	}
+}
+
+func TestConfigShouldRejectUnknownTokenRedaction(t *testing.T) {
+	config := &APNSConfig{CertificateBytes: []byte{1}, KeyBytes: []byte{1}, TokenRedaction: 3}
+	if err := applyConfigDefaults(config); err == nil || !strings.Contains(err.Error(), "Invalid TokenRedaction") {
+		t.Errorf("Expected invalid TokenRedaction error but got %v", err)
+	}
+}
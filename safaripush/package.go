@@ -0,0 +1,215 @@
+//Package for Safari website push: building and signing the push packages
+//Safari downloads when a user allows notifications, serving the web service
+//Safari calls, and building the notifications, which are sent with an
+//apns.APNSConnection using the Website Push ID certificate
+package safaripush
+
+import (
+	"archive/zip"
+	"crypto"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Icon file names a push package needs, keys of PackagerConfig.Icons
+var IconNames = []string{
+	"icon_16x16.png",
+	"icon_16x16@2x.png",
+	"icon_32x32.png",
+	"icon_32x32@2x.png",
+	"icon_128x128.png",
+	"icon_128x128@2x.png",
+}
+
+//The website.json of a push package
+type Website struct {
+	//Shown in Safari's notification prompt and Notification Center
+	WebsiteName string `json:"websiteName"`
+	//Website Push ID registered with Apple, e.g. web.com.example
+	WebsitePushID string `json:"websitePushID"`
+	//Origins allowed to ask the user for permission, e.g. https://example.com
+	AllowedDomains []string `json:"allowedDomains"`
+	//URL opened when a notification is clicked, with a %@ placeholder
+	//for each of the notification's url args
+	URLFormatString string `json:"urlFormatString"`
+	//Identifies the user to the web service, at least 16 characters
+	//Safari sends it back when registering the device
+	AuthenticationToken string `json:"authenticationToken"`
+	//https URL the web service (see Handler) is served at
+	WebServiceURL string `json:"webServiceURL"`
+}
+
+//Config for creating a Packager
+type PackagerConfig struct {
+	//PEM bytes of the Website Push ID certificate and its private key : required
+	CertificateBytes []byte
+	KeyBytes         []byte
+	//PEM bytes of the Apple WWDR intermediate certificate the push
+	//certificate was issued by, included in the signature
+	IntermediateBytes []byte
+	//PNG bytes of each of IconNames : required
+	Icons map[string][]byte
+}
+
+//Builds signed push packages
+type Packager struct {
+	certificate   *x509.Certificate
+	intermediates []*x509.Certificate
+	key           crypto.Signer
+	icons         map[string][]byte
+	//time the signature is dated, time.Now outside of tests
+	now func() time.Time
+}
+
+//Create a packager, checking the icons and loading the signing certificate
+func NewPackager(config *PackagerConfig) (*Packager, error) {
+	errorStrs := ""
+	for _, name := range IconNames {
+		if len(config.Icons[name]) == 0 {
+			errorStrs += "Invalid Icons. Should have " + name + "\n"
+		}
+	}
+	for name := range config.Icons {
+		if !contains(IconNames, name) {
+			errorStrs += "Invalid Icons. " + name + " should be one of " + strings.Join(IconNames, ", ") + "\n"
+		}
+	}
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	keyPair, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Invalid KeyBytes. Should be an RSA or ECDSA private key")
+	}
+	p := &Packager{
+		certificate: certificate,
+		key:         key,
+		icons:       config.Icons,
+		now:         time.Now,
+	}
+	for rest := config.IntermediateBytes; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		intermediate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		p.intermediates = append(p.intermediates, intermediate)
+	}
+	return p, nil
+}
+
+//Check the website.json values Safari rejects packages for
+func (w *Website) validate() error {
+	errorStrs := ""
+	if w.WebsiteName == "" {
+		errorStrs += "Invalid WebsiteName. Should not be empty\n"
+	}
+	if !strings.HasPrefix(w.WebsitePushID, "web.") {
+		errorStrs += "Invalid WebsitePushID. Should start with web.\n"
+	}
+	if len(w.AllowedDomains) == 0 {
+		errorStrs += "Invalid AllowedDomains. Should have at least one origin\n"
+	}
+	//not parsed as a URL since %@ isn't a valid escape
+	if !strings.HasPrefix(w.URLFormatString, "http://") && !strings.HasPrefix(w.URLFormatString, "https://") {
+		errorStrs += "Invalid URLFormatString. Should be an http or https URL\n"
+	}
+	if len(w.AuthenticationToken) < 16 {
+		errorStrs += "Invalid AuthenticationToken. Should be at least 16 characters\n"
+	}
+	if u, err := url.Parse(w.WebServiceURL); err != nil || u.Scheme != "https" {
+		errorStrs += "Invalid WebServiceURL. Should be an https URL\n"
+	}
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+	return nil
+}
+
+//Write a signed push package for website, a zip file, to w
+func (p *Packager) Build(w io.Writer, website *Website) error {
+	if err := website.validate(); err != nil {
+		return err
+	}
+	websiteJSON, err := json.Marshal(website)
+	if err != nil {
+		return err
+	}
+
+	files := map[string][]byte{"website.json": websiteJSON}
+	for name, icon := range p.icons {
+		files["icon.iconset/"+name] = icon
+	}
+	//version 2 manifests hash each file with sha512
+	type fileHash struct {
+		HashType  string `json:"hashType"`
+		HashValue string `json:"hashValue"`
+	}
+	manifest := make(map[string]*fileHash, len(files))
+	for name, b := range files {
+		sum := sha512.Sum512(b)
+		manifest[name] = &fileHash{HashType: "sha512", HashValue: hex.EncodeToString(sum[:])}
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	signature, err := signDetached(manifestJSON, p.certificate, p.intermediates, p.key, p.now())
+	if err != nil {
+		return err
+	}
+	files["manifest.json"] = manifestJSON
+	files["signature"] = signature
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
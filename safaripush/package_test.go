@@ -0,0 +1,179 @@
+package safaripush
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Packager with a self signed certificate and placeholder icons
+func testPackager(t *testing.T) *Packager {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Website Push ID: web.com.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	icons := map[string][]byte{}
+	for _, name := range IconNames {
+		icons[name] = []byte("png " + name)
+	}
+	packager, err := NewPackager(&PackagerConfig{
+		CertificateBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyBytes:         pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Icons:            icons,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packager
+}
+
+func testWebsite() *Website {
+	return &Website{
+		WebsiteName:         "Example",
+		WebsitePushID:       "web.com.example",
+		AllowedDomains:      []string{"https://example.com"},
+		URLFormatString:     "https://example.com/%@",
+		AuthenticationToken: "0123456789abcdef",
+		WebServiceURL:       "https://example.com/safari",
+	}
+}
+
+//Files of a zip archive by name
+func unzip(t *testing.T, b []byte) map[string][]byte {
+	archive, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestBuildShouldWriteSignedPackage(t *testing.T) {
+	packager := testPackager(t)
+	var b bytes.Buffer
+	if err := packager.Build(&b, testWebsite()); err != nil {
+		t.Fatal(err)
+	}
+	files := unzip(t, b.Bytes())
+
+	var website Website
+	if err := json.Unmarshal(files["website.json"], &website); err != nil || website.WebsitePushID != "web.com.example" {
+		t.Errorf("Expected website.json for web.com.example but got %s, %v", files["website.json"], err)
+	}
+	var manifest map[string]struct {
+		HashType  string
+		HashValue string
+	}
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != len(IconNames)+1 {
+		t.Errorf("Expected the icons and website.json in the manifest but got %v", manifest)
+	}
+	for name, hash := range manifest {
+		sum := sha512.Sum512(files[name])
+		if hash.HashType != "sha512" || hash.HashValue != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected the sha512 of %v but got %+v", name, hash)
+		}
+	}
+
+	var outer contentInfo
+	if _, err := asn1.Unmarshal(files["signature"], &outer); err != nil {
+		t.Fatal(err)
+	}
+	var signed signedData
+	if _, err := asn1.Unmarshal(outer.Content.Bytes, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if !outer.ContentType.Equal(oidSignedData) || len(signed.SignerInfos) != 1 || len(signed.ContentInfo.Content.Bytes) != 0 {
+		t.Fatalf("Expected a detached signature with one signer but got %+v", signed)
+	}
+	signer := signed.SignerInfos[0]
+	if signer.SID.SerialNumber.Int64() != 42 {
+		t.Errorf("Expected the certificate's serial number but got %v", signer.SID.SerialNumber)
+	}
+	certificate, err := x509.ParseCertificate(signed.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedBytes, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signer.SignedAttributes.Bytes})
+	if err := certificate.CheckSignature(x509.ECDSAWithSHA256, signedBytes, signer.Signature); err != nil {
+		t.Errorf("Expected the signed attributes to verify but got %v", err)
+	}
+	manifestDigest := sha256Sum(files["manifest.json"])
+	if !bytes.Contains(signer.SignedAttributes.Bytes, manifestDigest) {
+		t.Error("Expected the signed attributes to hold the manifest's digest")
+	}
+}
+
+func TestBuildShouldValidate(t *testing.T) {
+	packager := testPackager(t)
+	website := testWebsite()
+	website.WebsitePushID = "com.example"
+	website.AuthenticationToken = "short"
+	err := packager.Build(io.Discard, website)
+	if err == nil || !strings.Contains(err.Error(), "WebsitePushID") || !strings.Contains(err.Error(), "AuthenticationToken") {
+		t.Errorf("Expected errors for the push id and token but got %v", err)
+	}
+
+	if _, err := NewPackager(&PackagerConfig{Icons: map[string][]byte{"icon.png": {1}}}); err == nil ||
+		!strings.Contains(err.Error(), "icon_16x16.png") || !strings.Contains(err.Error(), "icon.png") {
+		t.Errorf("Expected errors for missing and unknown icons but got %v", err)
+	}
+}
+
+func TestNewPayloadShouldMarshalForSafari(t *testing.T) {
+	p := NewPayload(strings.Repeat("ab", 32), "Sale", "Everything half off", "View")
+	b, err := p.Marshal(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"aps":{"alert":{"body":"Everything half off","title":"Sale","action":"View"},"url-args":[]}}` {
+		t.Errorf("Unexpected payload %s", b)
+	}
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
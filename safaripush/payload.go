@@ -0,0 +1,24 @@
+package safaripush
+
+import (
+	apns "github.com/joekarl/go-libapns"
+)
+
+//Notification for a Safari website push, opening the website's
+//urlFormatString with its placeholders filled in from urlArgs
+//action labels the notification's button, "" for Safari's default
+//Send it on a connection using the Website Push ID certificate, to the
+//production gateway (Safari doesn't use the sandbox)
+func NewPayload(token string, title string, body string, action string, urlArgs ...string) *apns.Payload {
+	if urlArgs == nil {
+		//Safari requires url-args even if there are no placeholders
+		urlArgs = []string{}
+	}
+	return &apns.Payload{
+		Token:     token,
+		AlertBody: apns.APSAlertBody{Title: title, Body: body, Action: action},
+		URLArgs:   urlArgs,
+		PushType:  apns.PUSH_TYPE_ALERT,
+		Priority:  apns.PRIORITY_IMMEDIATE,
+	}
+}
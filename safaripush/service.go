@@ -0,0 +1,131 @@
+package safaripush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//Returned by ServiceConfig callbacks to answer Safari with 401 Unauthorized,
+//e.g. for an authentication token that isn't recognized
+var ErrUnauthorized = errors.New("Authentication token not recognized")
+
+//Config for the web service Safari calls at Website.WebServiceURL
+type ServiceConfig struct {
+	//Packager the push packages are built with : required
+	Packager *Packager
+	//Website to build a push package for, with the AuthenticationToken of the
+	//user asking, userInfo is the data the page passed to
+	//window.safari.pushNotification.requestPermission : required
+	Website func(ctx context.Context, websitePushID string, userInfo map[string]interface{}) (*Website, error)
+	//Called when the user allows notifications, with the device token to send them to
+	//and the AuthenticationToken from the user's package : required
+	Register func(ctx context.Context, deviceToken string, websitePushID string, authenticationToken string) error
+	//Called when the user turns notifications off for the site : required
+	Unregister func(ctx context.Context, deviceToken string, websitePushID string, authenticationToken string) error
+	//Errors Safari ran into with the push package or web service, discarded if nil
+	Log func(ctx context.Context, logs []string)
+}
+
+//http.Handler serving the web service Safari calls
+type service struct {
+	config *ServiceConfig
+}
+
+//Create a handler for the web service, serve it at Website.WebServiceURL,
+//using http.StripPrefix if that has a path, e.g.
+//
+//	http.Handle("/safari/", http.StripPrefix("/safari", handler))
+func NewHandler(config *ServiceConfig) (http.Handler, error) {
+	errorStrs := ""
+	if config.Packager == nil {
+		errorStrs += "Invalid Packager. Should not be nil\n"
+	}
+	if config.Website == nil {
+		errorStrs += "Invalid Website. Should not be nil\n"
+	}
+	if config.Register == nil {
+		errorStrs += "Invalid Register. Should not be nil\n"
+	}
+	if config.Unregister == nil {
+		errorStrs += "Invalid Unregister. Should not be nil\n"
+	}
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+	return &service{config: config}, nil
+}
+
+//Routes, relative to the web service URL:
+//
+//	POST   /v2/pushPackages/{websitePushID}
+//	POST   /v2/devices/{deviceToken}/registrations/{websitePushID}
+//	DELETE /v2/devices/{deviceToken}/registrations/{websitePushID}
+//	POST   /v2/log
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "pushPackages" && r.Method == http.MethodPost:
+		s.servePushPackage(w, r, parts[2])
+	case len(parts) == 5 && parts[0] == "v2" && parts[1] == "devices" && parts[3] == "registrations" &&
+		(r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		s.serveRegistration(w, r, parts[2], parts[4])
+	case len(parts) == 2 && parts[0] == "v2" && parts[1] == "log" && r.Method == http.MethodPost:
+		s.serveLog(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *service) servePushPackage(w http.ResponseWriter, r *http.Request, websitePushID string) {
+	var userInfo map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&userInfo); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	website, err := s.config.Website(r.Context(), websitePushID, userInfo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	if err := s.config.Packager.Build(w, website); err != nil {
+		//nothing has been written if the website was invalid
+		writeError(w, err)
+	}
+}
+
+func (s *service) serveRegistration(w http.ResponseWriter, r *http.Request, deviceToken string, websitePushID string) {
+	authenticationToken := strings.TrimPrefix(r.Header.Get("Authorization"), "ApplePushNotifications ")
+	register := s.config.Register
+	if r.Method == http.MethodDelete {
+		register = s.config.Unregister
+	}
+	if err := register(r.Context(), deviceToken, websitePushID, authenticationToken); err != nil {
+		writeError(w, err)
+	}
+}
+
+func (s *service) serveLog(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Logs []string `json:"logs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.config.Log != nil {
+		s.config.Log(r.Context(), body.Logs)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnauthorized) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,85 @@
+package safaripush
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerShouldServeWebService(t *testing.T) {
+	registrations := map[string]string{}
+	var logs []string
+	handler, err := NewHandler(&ServiceConfig{
+		Packager: testPackager(t),
+		Website: func(ctx context.Context, websitePushID string, userInfo map[string]interface{}) (*Website, error) {
+			if userInfo["user"] != "ann" {
+				return nil, ErrUnauthorized
+			}
+			return testWebsite(), nil
+		},
+		Register: func(ctx context.Context, deviceToken string, websitePushID string, authenticationToken string) error {
+			if authenticationToken != testWebsite().AuthenticationToken {
+				return ErrUnauthorized
+			}
+			registrations[deviceToken] = websitePushID
+			return nil
+		},
+		Unregister: func(ctx context.Context, deviceToken string, websitePushID string, authenticationToken string) error {
+			delete(registrations, deviceToken)
+			return nil
+		},
+		Log: func(ctx context.Context, l []string) {
+			logs = append(logs, l...)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.StripPrefix("/safari", handler))
+	defer server.Close()
+
+	do := func(method string, path string, body string, authorization string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+"/safari"+path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", "ApplePushNotifications "+authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("POST", "/v2/pushPackages/web.com.example", `{"user":"ann"}`, "")
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" || unzip(t, b)["signature"] == nil {
+		t.Errorf("Expected a push package but got %v %s", resp.Status, b)
+	}
+	if resp := do("POST", "/v2/pushPackages/web.com.example", `{"user":"bo"}`, ""); resp.StatusCode != 401 {
+		t.Errorf("Expected 401 for an unknown user but got %v", resp.Status)
+	}
+
+	path := "/v2/devices/abcd/registrations/web.com.example"
+	if resp := do("POST", path, "", "wrong token"); resp.StatusCode != 401 || len(registrations) != 0 {
+		t.Errorf("Expected 401 for the wrong token but got %v", resp.Status)
+	}
+	if resp := do("POST", path, "", testWebsite().AuthenticationToken); resp.StatusCode != 200 ||
+		registrations["abcd"] != "web.com.example" {
+		t.Errorf("Expected the device to be registered but got %v, %v", resp.Status, registrations)
+	}
+	if resp := do("DELETE", path, "", testWebsite().AuthenticationToken); resp.StatusCode != 200 || len(registrations) != 0 {
+		t.Errorf("Expected the device to be unregistered but got %v, %v", resp.Status, registrations)
+	}
+
+	if resp := do("POST", "/v2/log", `{"logs":["Signature verification failed"]}`, ""); resp.StatusCode != 200 ||
+		len(logs) != 1 {
+		t.Errorf("Expected the log to be passed on but got %v, %v", resp.Status, logs)
+	}
+	if resp := do("GET", "/v2/log", "", ""); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 for an unknown route but got %v", resp.Status)
+	}
+}
@@ -0,0 +1,45 @@
+package apns
+
+import (
+	"time"
+)
+
+//Protocol a payload was sent to Apple with
+type Transport string
+
+const (
+	//Apple's binary provider protocol, the only transport this library implements
+	TRANSPORT_BINARY Transport = "binary"
+)
+
+//Where and when a payload was sent, for comparing latency across connections
+//and transports
+type SendMetadata struct {
+	//Transport the payload was sent with
+	Transport Transport
+	//Id of the connection that took the payload (see APNSConnection.ID)
+	ConnectionID string
+	//When the payload was queued, zero if it was rejected before being queued
+	QueuedAt time.Time
+	//When the frame holding the payload was written to the socket, zero if it wasn't
+	FlushedAt time.Time
+	//When the payload's outcome was known: when it was rejected, or when
+	//Apple's error response for it was read
+	RespondedAt time.Time
+}
+
+//How long the payload waited to be written, 0 if it wasn't
+func (m *SendMetadata) QueueTime() time.Duration {
+	if m.QueuedAt.IsZero() || m.FlushedAt.IsZero() {
+		return 0
+	}
+	return m.FlushedAt.Sub(m.QueuedAt)
+}
+
+//How long Apple took to respond once the payload was written, 0 if it wasn't
+func (m *SendMetadata) ResponseTime() time.Duration {
+	if m.FlushedAt.IsZero() {
+		return 0
+	}
+	return m.RespondedAt.Sub(m.FlushedAt)
+}
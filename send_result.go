@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Channels SendR callers receive their payload's result on, by payload
+//THREADSAFE (results are settled from the send go-routine and acceptance timers)
+type resultWaiters struct {
+	//Mutex to sync access to waiting
+	lock *sync.Mutex
+	//result channel of each payload still waiting for its result
+	waiting map[*Payload]chan error
+	//length of waiting, so payloads can be settled without locking when
+	//nobody is using SendR
+	count atomic.Int64
+	//Source of the acceptance window timers
+	clock Clock
+}
+
+func newResultWaiters(clock Clock) *resultWaiters {
+	return &resultWaiters{
+		lock:    new(sync.Mutex),
+		waiting: make(map[*Payload]chan error),
+		clock:   clock,
+	}
+}
+
+//Channel receiving a payload's result
+//Buffered so settling never blocks, even if nobody reads it
+func (w *resultWaiters) add(p *Payload) <-chan error {
+	result := make(chan error, 1)
+	w.lock.Lock()
+	w.waiting[p] = result
+	w.count.Store(int64(len(w.waiting)))
+	w.lock.Unlock()
+	return result
+}
+
+//Whether a payload is waiting for its result
+func (w *resultWaiters) has(p *Payload) bool {
+	if w.count.Load() == 0 {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, ok := w.waiting[p]
+	return ok
+}
+
+//Send a payload's result, nil for accepted
+//Only the first result for a payload is sent, later ones are ignored
+func (w *resultWaiters) settle(p *Payload, reason error) {
+	if w.count.Load() == 0 {
+		return
+	}
+	w.lock.Lock()
+	result, ok := w.waiting[p]
+	if ok {
+		delete(w.waiting, p)
+		w.count.Store(int64(len(w.waiting)))
+	}
+	w.lock.Unlock()
+	if ok {
+		result <- reason
+	}
+}
+
+//Send nil for a written payload once Apple has had window to reject it,
+//unless it's settled some other way first
+func (w *resultWaiters) settleAfter(p *Payload, window time.Duration) {
+	if !w.has(p) {
+		return
+	}
+	if window <= 0 {
+		w.settle(p, nil)
+		return
+	}
+	w.clock.AfterFunc(window, func() { w.settle(p, nil) })
+}
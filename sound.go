@@ -0,0 +1,35 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	//Plays the device's default alert sound
+	SoundDefault = "default"
+	//Leave Payload.Sound empty to omit the sound key, e.g. for silent pushes
+	SoundNone = ""
+	//Max number of bytes in a sound file name
+	MAX_SOUND_NAME_LENGTH = 255
+)
+
+//Returned when a payload's sound isn't a plain file name in the app bundle
+var ErrInvalidSoundName = errors.New("Invalid sound name")
+
+//Check a sound is SoundDefault, SoundNone or the name of a sound file
+//in the app bundle or Library/Sounds (no directories)
+func ValidateSoundName(name string) error {
+	if len(name) > MAX_SOUND_NAME_LENGTH {
+		return fmt.Errorf("%w. Was %v bytes but should be at most %v bytes",
+			ErrInvalidSoundName, len(name), MAX_SOUND_NAME_LENGTH)
+	}
+	if strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("%w. %q should be a file name without a path", ErrInvalidSoundName, name)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("%w. %q is not a file name", ErrInvalidSoundName, name)
+	}
+	return nil
+}
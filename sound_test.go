@@ -0,0 +1,42 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateSoundName(t *testing.T) {
+	valid := []string{SoundDefault, SoundNone, "chime.caf", "alert sound.aiff"}
+	for _, name := range valid {
+		if err := ValidateSoundName(name); err != nil {
+			t.Errorf("Expected %q to be valid but got %v", name, err)
+		}
+	}
+
+	invalid := []string{"sounds/chime.caf", "..\\chime.caf", "..", strings.Repeat("a", MAX_SOUND_NAME_LENGTH+1)}
+	for _, name := range invalid {
+		if err := ValidateSoundName(name); !errors.Is(err, ErrInvalidSoundName) {
+			t.Errorf("Expected %q to be invalid but got %v", name, err)
+		}
+	}
+}
+
+func TestMarshalShouldRejectInvalidSound(t *testing.T) {
+	p := Payload{AlertText: "Testing", Sound: "../chime.caf"}
+
+	if _, err := p.Marshal(256); !errors.Is(err, ErrInvalidSoundName) {
+		t.Errorf("Expected ErrInvalidSoundName but got %v", err)
+	}
+
+	p.Sound = SoundNone
+	p.AlertText = ""
+	p.ContentAvailable = 1
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(json) != `{"aps":{"content-available":1}}` {
+		t.Errorf("Expected silent payload without a sound but got %v", string(json))
+	}
+}
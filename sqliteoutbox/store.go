@@ -0,0 +1,272 @@
+//Package providing an apns.OutboxStore in a SQLite database, for single
+//node deployments that want durable sends without running a separate queue
+//
+//The store works with any database/sql SQLite driver, import one
+//(github.com/mattn/go-sqlite3, modernc.org/sqlite, etc) and sql.Open the
+//database file before passing it to New
+package sqliteoutbox
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+//Config for a SQLite outbox
+type Config struct {
+	//number of seconds between clearing out delivered records, defaults to 3600, < 0 disables
+	VacuumInterval int
+	//number of seconds delivered and failed records are kept before being cleared out, defaults to 0
+	DeliveredRetention int
+	//where vacuum errors are logged (at apns.LOG_LEVEL_ERROR), defaults to apns.StdoutLogger
+	Logger apns.Logger
+	//how payloads are compressed when they're appended, defaults to
+	//apns.OUTBOX_COMPRESSION_NONE
+	//records are read whatever they were written with
+	Compression apns.OutboxCompression
+}
+
+//Outbox store in a SQLite database
+//Delivered and failed records are kept until they're vacuumed
+type Store struct {
+	db     *sql.DB
+	config *Config
+	//closed to stop the vacuum go-routine
+	stopChannel chan bool
+	closeOnce   *sync.Once
+}
+
+//Record statuses
+const (
+	statusPending = 0
+	statusSent    = 1
+	statusFailed  = 2
+)
+
+//Schema migrations, applied in order
+//PRAGMA user_version records how many have been applied
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS apns_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payload BLOB NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS apns_outbox_status ON apns_outbox (status, id);`,
+}
+
+//Use an already open SQLite database as an outbox
+//Creates or migrates the outbox table as needed and starts the periodic vacuum
+//A nil config uses the defaults
+//The caller is responsible for closing the database
+func New(db *sql.DB, config *Config) (*Store, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.DeliveredRetention < 0 {
+		return nil, errors.New("Invalid DeliveredRetention. Should be >= 0")
+	}
+	if config.Compression > apns.OUTBOX_COMPRESSION_GZIP {
+		return nil, errors.New("Invalid Compression. Should be OUTBOX_COMPRESSION_NONE or OUTBOX_COMPRESSION_GZIP")
+	}
+	if config.VacuumInterval == 0 {
+		config.VacuumInterval = 3600
+	}
+	if config.Logger == nil {
+		config.Logger = apns.StdoutLogger{}
+	}
+
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		db:          db,
+		config:      config,
+		stopChannel: make(chan bool),
+		closeOnce:   new(sync.Once),
+	}
+
+	if config.VacuumInterval > 0 {
+		go s.vacuumListener()
+	}
+
+	return s, nil
+}
+
+//Bring the outbox schema up to date
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("Outbox schema version %v is newer than supported version %v",
+			version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("Error migrating outbox schema to version %v : %v", version+1, err)
+		}
+	}
+
+	//pragmas don't take bind parameters
+	if _, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) Append(payload *apns.Payload) (string, error) {
+	payloadBytes, err := apns.MarshalOutboxPayloadCompressed(payload, s.config.Compression)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	result, err := s.db.Exec(
+		"INSERT INTO apns_outbox (payload, status, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		payloadBytes, statusPending, now, now)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (s *Store) MarkSent(id string) error {
+	return s.mark(id, statusSent, nil)
+}
+
+func (s *Store) MarkFailed(id string, reason error) error {
+	return s.mark(id, statusFailed, reason)
+}
+
+func (s *Store) mark(id string, status int, reason error) error {
+	var reasonStr sql.NullString
+	if reason != nil {
+		reasonStr = sql.NullString{String: reason.Error(), Valid: true}
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE apns_outbox SET status = ?, error = ?, updated_at = ? WHERE id = ? AND status = ?",
+		status, reasonStr, time.Now().Unix(), id, statusPending)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("Unknown or already marked outbox record " + id)
+	}
+	return nil
+}
+
+func (s *Store) PendingIterator() (apns.OutboxIterator, error) {
+	rows, err := s.db.Query(
+		"SELECT id, payload FROM apns_outbox WHERE status = ? ORDER BY id",
+		statusPending)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingIterator{rows: rows}, nil
+}
+
+//Delete delivered and failed records past their retention and reclaim the space
+//Called periodically unless VacuumInterval < 0
+func (s *Store) Vacuum() error {
+	cutoff := time.Now().Add(-time.Duration(s.config.DeliveredRetention) * time.Second).Unix()
+	_, err := s.db.Exec(
+		"DELETE FROM apns_outbox WHERE status != ? AND updated_at <= ?",
+		statusPending, cutoff)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("VACUUM")
+	return err
+}
+
+//Stop the periodic vacuum
+//The database itself is left open for the caller to close
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() { close(s.stopChannel) })
+	return nil
+}
+
+//go-routine to periodically vacuum delivered records
+func (s *Store) vacuumListener() {
+	ticker := time.NewTicker(time.Duration(s.config.VacuumInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Vacuum(); err != nil {
+				s.config.Logger.Logf(apns.LOG_LEVEL_ERROR, "Error vacuuming outbox %v", err)
+			}
+		case <-s.stopChannel:
+			return
+		}
+	}
+}
+
+type pendingIterator struct {
+	rows    *sql.Rows
+	payload *apns.Payload
+	err     error
+}
+
+func (i *pendingIterator) Next() bool {
+	if i.err != nil || !i.rows.Next() {
+		return false
+	}
+
+	var id int64
+	var payloadBytes []byte
+	if i.err = i.rows.Scan(&id, &payloadBytes); i.err != nil {
+		return false
+	}
+	if i.payload, i.err = apns.UnmarshalOutboxPayload(payloadBytes); i.err != nil {
+		i.err = fmt.Errorf("Error decoding outbox record %v : %v", id, i.err)
+		return false
+	}
+	i.payload.OutboxID = strconv.FormatInt(id, 10)
+	return true
+}
+
+func (i *pendingIterator) Payload() *apns.Payload {
+	return i.payload
+}
+
+func (i *pendingIterator) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.rows.Err()
+}
+
+func (i *pendingIterator) Close() error {
+	return i.rows.Close()
+}
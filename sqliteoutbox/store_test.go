@@ -0,0 +1,231 @@
+//go:build cgo
+
+//go-sqlite3 needs cgo, so the tests only run in cgo builds
+
+package sqliteoutbox
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func openTestStore(t *testing.T, config *Config) *Store {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "outbox.db"))
+	t.Cleanup(func() { db.Close() })
+	if config == nil {
+		config = &Config{VacuumInterval: -1}
+	}
+	s, err := New(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func countRecords(t *testing.T, s *Store) int {
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM apns_outbox").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStoreTracksPendingPayloads(t *testing.T) {
+	s := openTestStore(t, nil)
+	defer s.Close()
+
+	ids := make([]string, 3)
+	for i := range ids {
+		var err error
+		ids[i], err = s.Append(&apns.Payload{AlertText: string(rune('a' + i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.MarkSent(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkSent(ids[0]); err == nil {
+		t.Error("Expected error marking a record twice")
+	}
+	if err := s.MarkFailed("1000", errors.New("INVALID_TOKEN")); err == nil {
+		t.Error("Expected error marking an unknown record")
+	}
+	if err := s.MarkFailed(ids[1], errors.New("INVALID_TOKEN")); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := s.PendingIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []*apns.Payload
+	for iter.Next() {
+		pending = append(pending, iter.Payload())
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+	iter.Close()
+
+	if len(pending) != 1 || pending[0].AlertText != "c" || pending[0].OutboxID != ids[2] {
+		t.Errorf("Expected only payload c pending but got %+v", pending)
+	}
+
+	var reason string
+	if err := s.db.QueryRow("SELECT error FROM apns_outbox WHERE id = ?", ids[1]).Scan(&reason); err != nil {
+		t.Fatal(err)
+	}
+	if reason != "INVALID_TOKEN" {
+		t.Errorf("Expected the failure reason to be kept but got %v", reason)
+	}
+}
+
+func TestStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	db := openTestDB(t, path)
+	s, err := New(db, &Config{VacuumInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.Append(&apns.Payload{AlertText: "durable"})
+	s.Close()
+	db.Close()
+
+	db = openTestDB(t, path)
+	defer db.Close()
+	s, err = New(db, &Config{VacuumInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var replayed []*apns.Payload
+	n, err := apns.ReplayOutbox(s, func(p *apns.Payload) error {
+		replayed = append(replayed, p)
+		return nil
+	})
+	if err != nil || n != 1 || replayed[0].OutboxID != id || replayed[0].AlertText != "durable" {
+		t.Errorf("Expected durable payload to be replayed but got %v, %v", replayed, err)
+	}
+}
+
+func TestStoreShouldMigrateSchema(t *testing.T) {
+	s := openTestStore(t, nil)
+	defer s.Close()
+
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %v but got %v", len(migrations), version)
+	}
+
+	//opening an up to date database again is a no-op
+	if _, err := New(s.db, &Config{VacuumInterval: -1}); err != nil {
+		t.Errorf("Expected an up to date schema to open but got %v", err)
+	}
+
+	if _, err := s.db.Exec("PRAGMA user_version = 99"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(s.db, &Config{VacuumInterval: -1}); err == nil ||
+		!strings.Contains(err.Error(), "newer than supported") {
+		t.Errorf("Expected an error opening a newer schema but got %v", err)
+	}
+}
+
+func TestStoreShouldVacuumDeliveredRecords(t *testing.T) {
+	s := openTestStore(t, nil)
+	defer s.Close()
+
+	sentID, _ := s.Append(&apns.Payload{AlertText: "sent"})
+	failedID, _ := s.Append(&apns.Payload{AlertText: "failed"})
+	s.Append(&apns.Payload{AlertText: "pending"})
+	s.MarkSent(sentID)
+	s.MarkFailed(failedID, errors.New("INVALID_TOKEN"))
+
+	//kept while within DeliveredRetention
+	s.config.DeliveredRetention = 3600
+	if err := s.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRecords(t, s); n != 3 {
+		t.Errorf("Expected records within retention to be kept but %v remain", n)
+	}
+
+	s.config.DeliveredRetention = 0
+	if err := s.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRecords(t, s); n != 1 {
+		t.Errorf("Expected only the pending record to remain but %v remain", n)
+	}
+}
+
+func TestStoreShouldVacuumPeriodically(t *testing.T) {
+	s := openTestStore(t, &Config{VacuumInterval: 1})
+	defer s.Close()
+
+	id, _ := s.Append(&apns.Payload{AlertText: "sent"})
+	s.MarkSent(id)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for countRecords(t, s) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the delivered record to be vacuumed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStoreShouldReadRecordsWhateverTheirCompression(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer db.Close()
+	plain, err := New(db, &Config{VacuumInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	compressed, err := New(db, &Config{VacuumInterval: -1, Compression: apns.OUTBOX_COMPRESSION_GZIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+
+	plainID, _ := plain.Append(&apns.Payload{AlertText: "plain"})
+	compressedID, _ := compressed.Append(&apns.Payload{AlertText: "compressed"})
+
+	var replayed []*apns.Payload
+	if _, err := apns.ReplayOutbox(plain, func(p *apns.Payload) error {
+		replayed = append(replayed, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0].OutboxID != plainID || replayed[0].AlertText != "plain" ||
+		replayed[1].OutboxID != compressedID || replayed[1].AlertText != "compressed" {
+		t.Errorf("Expected both pending payloads to be replayed but got %v", replayed)
+	}
+
+	if _, err := New(db, &Config{Compression: apns.OUTBOX_COMPRESSION_GZIP + 1}); err == nil {
+		t.Error("Expected an error for an unknown compression")
+	}
+}
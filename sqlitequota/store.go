@@ -0,0 +1,73 @@
+//Package providing an apns.QuotaStore in a SQLite database, so quotas
+//survive restarts
+//
+//Like the sqliteoutbox package's store it works with any database/sql SQLite
+//driver (github.com/mattn/go-sqlite3, modernc.org/sqlite, etc) and can share
+//a database with the outbox
+package sqlitequota
+
+import (
+	"database/sql"
+	"time"
+)
+
+//apns.QuotaStore backed by a SQLite database
+type Store struct {
+	db *sql.DB
+}
+
+//Open a SQLite quota store in the given database
+//Creates the quota table if needed
+func New(db *sql.DB) (*Store, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS apns_quota (
+		key TEXT NOT NULL,
+		period_start INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (key, period_start)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Take(key string, periodStart time.Time, limit int) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	period := periodStart.Unix()
+	result, err := tx.Exec(
+		"INSERT OR IGNORE INTO apns_quota (key, period_start, count) VALUES (?, ?, 0)",
+		key, period)
+	if err != nil {
+		return false, err
+	}
+	started, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if started > 0 {
+		//first payload of a new period, earlier periods are done with
+		if _, err := tx.Exec(
+			"DELETE FROM apns_quota WHERE key = ? AND period_start < ?",
+			key, period); err != nil {
+			return false, err
+		}
+	}
+
+	result, err = tx.Exec(
+		"UPDATE apns_quota SET count = count + 1 WHERE key = ? AND period_start = ? AND count < ?",
+		key, period, limit)
+	if err != nil {
+		return false, err
+	}
+	taken, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return taken > 0, tx.Commit()
+}
@@ -0,0 +1,124 @@
+//go:build cgo
+
+//go-sqlite3 needs cgo, so the tests only run in cgo builds
+
+package sqlitequota
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T, path string) (*sql.DB, *Store) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := New(db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db, store
+}
+
+func takeQuota(t *testing.T, store apns.QuotaStore, key string, periodStart time.Time, limit int) bool {
+	t.Helper()
+	taken, err := store.Take(key, periodStart, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taken
+}
+
+func TestStoreShouldEnforceLimits(t *testing.T) {
+	db, store := openTestDB(t, filepath.Join(t.TempDir(), "quota.db"))
+	defer db.Close()
+
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, expected := range []bool{true, true, false, false} {
+		if takeQuota(t, store, "app", day, 2) != expected {
+			t.Errorf("Expected take %v to return %v", i+1, expected)
+		}
+	}
+	//keys are counted separately
+	if !takeQuota(t, store, "other", day, 2) {
+		t.Error("Expected another key to have its own quota")
+	}
+	//a higher limit lets more through in the same period
+	if !takeQuota(t, store, "app", day, 3) || takeQuota(t, store, "app", day, 3) {
+		t.Error("Expected exactly one more payload under a limit of 3")
+	}
+}
+
+func TestStoreShouldResetEachPeriod(t *testing.T) {
+	db, store := openTestDB(t, filepath.Join(t.TempDir(), "quota.db"))
+	defer db.Close()
+
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	takeQuota(t, store, "app", day, 1)
+	takeQuota(t, store, "other", day, 1)
+	if takeQuota(t, store, "app", day, 1) {
+		t.Fatal("Expected the quota to be used up")
+	}
+
+	nextDay := day.AddDate(0, 0, 1)
+	if !takeQuota(t, store, "app", nextDay, 1) {
+		t.Error("Expected the quota to reset the next day")
+	}
+
+	//the key's earlier periods are deleted, other keys are left alone
+	var periods int
+	if err := db.QueryRow("SELECT COUNT(*) FROM apns_quota WHERE key = ?", "app").Scan(&periods); err != nil {
+		t.Fatal(err)
+	}
+	if periods != 1 {
+		t.Errorf("Expected only the current period to be kept but found %v", periods)
+	}
+	if takeQuota(t, store, "other", day, 1) {
+		t.Error("Expected another key's period to be kept")
+	}
+}
+
+func TestStoreShouldSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.db")
+	db, store := openTestDB(t, path)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	takeQuota(t, store, "app", day, 2)
+	takeQuota(t, store, "app", day, 2)
+	db.Close()
+
+	db, store = openTestDB(t, path)
+	defer db.Close()
+	if takeQuota(t, store, "app", day, 2) {
+		t.Error("Expected the quota to still be used up after reopening")
+	}
+
+	var exceeded []string
+	quota, err := apns.NewQuota(&apns.QuotaConfig{
+		Limit: 2,
+		Key:   func(payload *apns.Payload) string { return payload.Category },
+		Store: store,
+		OnQuotaExceeded: func(payload *apns.Payload, key string) {
+			exceeded = append(exceeded, key)
+		},
+		Clock: apnstest.NewFakeClock(day.Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	quota.Middleware(func(payload *apns.Payload) error {
+		sent++
+		return nil
+	})(&apns.Payload{Category: "app"})
+	if sent != 0 || len(exceeded) != 1 {
+		t.Errorf("Expected the reopened store to hold the payload to its quota but sent %v", sent)
+	}
+}
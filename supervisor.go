@@ -0,0 +1,372 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//A reconnect attempt, passed to OnReconnect
+type ReconnectAttempt struct {
+	//Attempt number, counting from 1 for the first attempt after a connection closes
+	//or the last successful reconnect
+	Attempt int
+	//How long the supervisor waited before the attempt, 0 for the first
+	Backoff time.Duration
+	//Why the attempt was made: the *AppleError the connection closed with
+	//(CONNECTION_CLOSED_UNKNOWN if the socket broke), or the previous attempt's error
+	//nil when replacing connections closed for being idle
+	Cause error
+	//Error the attempt failed with, nil if it opened a connection
+	Err error
+}
+
+//Returned by Send, and passed to OnReconnectError, once MaxReconnectAttempts
+//reconnects in a row have failed
+//The supervisor stops reconnecting for good, see Supervisor.Err
+type ReconnectError struct {
+	//Number of failed attempts in a row
+	Attempts int
+	//Error from the last attempt
+	Err error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("Gave up reconnecting after %v attempts : %v", e.Attempts, e.Err)
+}
+
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+//Config for creating a supervisor
+type SupervisorConfig struct {
+	//config used for every connection : required
+	ConnectionConfig *APNSConfig
+	//number of connections to keep open, defaults to 1
+	Size int
+	//function used to open connections, defaults to NewAPNSConnection
+	Dial func(config *APNSConfig) (*APNSConnection, error)
+	//number of milliseconds to wait before retrying a failed reconnect, defaults to 1000
+	//doubles on each failure up to MaxRetryInterval
+	RetryInterval int
+	//max number of milliseconds to wait between reconnect attempts, defaults to 60000
+	MaxRetryInterval int
+	//percentage of each wait between reconnect attempts taken off at random, so
+	//connections dropped together don't all redial together, defaults to 50, -1 for none
+	RetryJitter int
+	//number of failed reconnect attempts in a row after which the supervisor gives up
+	//and marks itself unhealthy (see Err), defaults to 0 (retry forever)
+	MaxReconnectAttempts int
+	//called when a reconnect attempt fails, defaults to none
+	OnReconnectError func(err error)
+	//called after every reconnect attempt, failed or not, defaults to none
+	//use it to alert on flapping connections
+	OnReconnect func(attempt *ReconnectAttempt)
+	//don't open connections until the first Send (or Connect), defaults to false
+	//dial errors are returned from that Send instead of NewSupervisor
+	Lazy bool
+}
+
+//Owns the lifecycle of a set of connections
+//
+//When a connection closes the supervisor opens a replacement and resends the
+//closed connection's unsent payloads on it, in order and ahead of any newer
+//payloads for the same token. Only closes with something the app needs to
+//handle (see CloseChannel) are passed on.
+//Connections closed after APNSConfig.IdleTimeout are replaced on the next Send
+//instead of straight away.
+//It's an APNSPool with PreserveTokenOrder set that replaces its own members
+type Supervisor struct {
+	//Channel that closes with unrecoverable payloads are received on:
+	//closes with an ErrorPayload Apple rejected, closes where in flight
+	//payloads were lost (UnsentPayloadBufferOverflow), and on Disconnect any
+	//payloads still waiting to be resent. UnsentPayloads has already been
+	//resent for every other close
+	//Closed once the supervisor has been disconnected
+	CloseChannel chan *ConnectionClose
+	//config
+	config *SupervisorConfig
+	//the supervised connections
+	pool *APNSPool
+	//Mutex to sync access to the reconnected condition
+	lock *sync.Mutex
+	//Signalled when a connection is added or the supervisor disconnects
+	reconnected *sync.Cond
+	//Boolean saying we're disconnecting
+	disconnecting bool
+	//Closed to stop reconnecting
+	stopChannel chan bool
+	//Send uses to have connections closed for being idle replaced
+	redialChannel chan bool
+	//Terminal error once reconnecting has been given up on
+	err error
+	//source of retry jitter, only used by superviseListener
+	random *rand.Rand
+}
+
+//Create a supervisor and open its connections
+//If invalid config or if any connection fails to open (unless Lazy) an error will be returned
+func NewSupervisor(config *SupervisorConfig) (*Supervisor, error) {
+	errorStrs := ""
+
+	if config.ConnectionConfig == nil {
+		errorStrs += "Invalid ConnectionConfig. Must be supplied\n"
+	}
+	if config.Size < 0 {
+		errorStrs += "Invalid Size. Should be > 0\n"
+	}
+	if config.RetryInterval < 0 {
+		errorStrs += "Invalid RetryInterval. Should be > 0\n"
+	}
+	if config.MaxRetryInterval < 0 {
+		errorStrs += "Invalid MaxRetryInterval. Should be > 0\n"
+	}
+	if config.RetryJitter < -1 || config.RetryJitter > 100 {
+		errorStrs += "Invalid RetryJitter. Should be between 0 and 100, or -1\n"
+	}
+	if config.MaxReconnectAttempts < 0 {
+		errorStrs += "Invalid MaxReconnectAttempts. Should be >= 0\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Size == 0 {
+		config.Size = 1
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 1000
+	}
+	if config.MaxRetryInterval == 0 {
+		config.MaxRetryInterval = 60000
+	}
+	if config.RetryJitter == 0 {
+		config.RetryJitter = 50
+	}
+
+	pool, err := NewAPNSPool(&APNSPoolConfig{
+		ConnectionConfig:   config.ConnectionConfig,
+		Size:               config.Size,
+		Dial:               config.Dial,
+		PreserveTokenOrder: true,
+		Lazy:               config.Lazy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Supervisor{
+		CloseChannel: make(chan *ConnectionClose),
+		config:       config,
+		pool:         pool,
+		lock:         new(sync.Mutex),
+		stopChannel:  make(chan bool),
+		//one pending redial covers any number of sends
+		redialChannel: make(chan bool, 1),
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.reconnected = sync.NewCond(s.lock)
+
+	go s.superviseListener()
+
+	return s, nil
+}
+
+//Send a payload on one of the supervised connections
+//Blocks until a connection accepts the payload, waiting for a replacement
+//if every connection has closed
+//Once the supervisor has given up reconnecting (see Err) and every connection
+//has closed, returns its *ReconnectError
+func (s *Supervisor) Send(payload *Payload) error {
+	//connections aren't replaced until the first have been opened
+	if err := s.pool.Connect(); err != nil {
+		return err
+	}
+	if s.pool.Len() < s.config.Size {
+		s.redial()
+	}
+
+	for {
+		err := s.pool.Send(payload)
+		if err != ErrPoolEmpty {
+			return err
+		}
+
+		//every connection might have closed for being idle
+		s.redial()
+		s.lock.Lock()
+		for !s.disconnecting && s.err == nil && s.pool.Len() == 0 {
+			s.reconnected.Wait()
+		}
+		err = s.err
+		s.lock.Unlock()
+		if err != nil && s.pool.Len() == 0 {
+			return err
+		}
+	}
+}
+
+//Terminal *ReconnectError once MaxReconnectAttempts reconnects in a row have
+//failed, nil while the supervisor is healthy
+//Connections still open keep sending, but closed ones are no longer replaced
+func (s *Supervisor) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+//Open the supervised connections, for Lazy supervisors which should dial up front
+//See APNSPool.Connect
+func (s *Supervisor) Connect() error {
+	return s.pool.Connect()
+}
+
+//Have connections closed for being idle replaced, without blocking
+func (s *Supervisor) redial() {
+	select {
+	case s.redialChannel <- true:
+	default:
+	}
+}
+
+//The pool of supervised connections, for Pause, Cancel, QueueDepth, Replace, etc
+//Connections shouldn't be added or removed directly
+func (s *Supervisor) Pool() *APNSPool {
+	return s.pool
+}
+
+//Stop reconnecting and disconnect every connection
+func (s *Supervisor) Disconnect() {
+	s.lock.Lock()
+	if s.disconnecting {
+		s.lock.Unlock()
+		return
+	}
+	s.disconnecting = true
+	close(s.stopChannel)
+	s.reconnected.Broadcast()
+	s.lock.Unlock()
+
+	s.pool.Disconnect()
+}
+
+//go-routine to replace closed connections and pass on unrecoverable closes
+func (s *Supervisor) superviseListener() {
+	defer close(s.CloseChannel)
+
+	for {
+		select {
+		case connectionClose, ok := <-s.pool.CloseChannel:
+			if !ok {
+				return
+			}
+			if connectionClose.ErrorPayload != nil ||
+				connectionClose.UnsentPayloadBufferOverflow ||
+				len(connectionClose.UnsentPayloads) > 0 {
+				s.CloseChannel <- connectionClose
+			}
+			if connectionClose.Idle {
+				//replaced on the next Send
+				break
+			}
+			var cause error
+			if connectionClose.Error != nil {
+				cause = connectionClose.Error
+			}
+			s.reconnectUnlessDisconnecting(cause)
+		case <-s.redialChannel:
+			s.reconnectUnlessDisconnecting(nil)
+		}
+	}
+}
+
+func (s *Supervisor) reconnectUnlessDisconnecting(cause error) {
+	s.lock.Lock()
+	stopped := s.disconnecting || s.err != nil
+	s.lock.Unlock()
+	if !stopped {
+		s.reconnect(cause)
+	}
+}
+
+//Add connections until the pool is back to Size, retrying with a jittered
+//exponential backoff
+//Gives up if the supervisor disconnects or MaxReconnectAttempts is reached
+func (s *Supervisor) reconnect(cause error) {
+	retryInterval := time.Duration(s.config.RetryInterval) * time.Millisecond
+	maxRetryInterval := time.Duration(s.config.MaxRetryInterval) * time.Millisecond
+	attempts := 0
+	var backoff time.Duration
+	closeCause := cause
+
+	for s.pool.Len() < s.config.Size {
+		_, err := s.pool.Add()
+		if err == ErrPoolDisconnected {
+			return
+		}
+		attempts++
+		if s.config.OnReconnect != nil {
+			s.config.OnReconnect(&ReconnectAttempt{
+				Attempt: attempts,
+				Backoff: backoff,
+				Cause:   cause,
+				Err:     err,
+			})
+		}
+		if err == nil {
+			attempts = 0
+			backoff = 0
+			cause = closeCause
+			retryInterval = time.Duration(s.config.RetryInterval) * time.Millisecond
+			s.lock.Lock()
+			s.reconnected.Broadcast()
+			s.lock.Unlock()
+			continue
+		}
+
+		cause = err
+		if s.config.MaxReconnectAttempts > 0 && attempts >= s.config.MaxReconnectAttempts {
+			s.giveUp(&ReconnectError{Attempts: attempts, Err: err})
+			return
+		}
+		if s.config.OnReconnectError != nil {
+			s.config.OnReconnectError(fmt.Errorf("Error reconnecting : %v", err))
+		}
+		backoff = s.jitter(retryInterval)
+		timer := configClock(s.config.ConnectionConfig.Clock).NewTimer(backoff)
+		select {
+		case <-timer.Chan():
+		case <-s.stopChannel:
+			timer.Stop()
+			return
+		}
+		retryInterval *= 2
+		if retryInterval > maxRetryInterval {
+			retryInterval = maxRetryInterval
+		}
+	}
+}
+
+//Take up to RetryJitter percent off a wait at random
+func (s *Supervisor) jitter(wait time.Duration) time.Duration {
+	maxJitter := int64(wait) * int64(s.config.RetryJitter) / 100
+	if maxJitter <= 0 {
+		return wait
+	}
+	return wait - time.Duration(s.random.Int63n(maxJitter+1))
+}
+
+//Mark the supervisor unhealthy, waking any Send waiting for a replacement
+func (s *Supervisor) giveUp(err *ReconnectError) {
+	s.lock.Lock()
+	s.err = err
+	s.reconnected.Broadcast()
+	s.lock.Unlock()
+	if s.config.OnReconnectError != nil {
+		s.config.OnReconnectError(err)
+	}
+}
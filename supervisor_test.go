@@ -0,0 +1,292 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisorShouldReconnectAndResendUnsent(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	dials := 0
+	supervisor, err := NewSupervisor(&SupervisorConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		},
+		Dial: func(config *APNSConfig) (*APNSConnection, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			dials++
+			if dials == 1 {
+				//error on the first payload once three have been written
+				return socketAPNSConnection(newMockConnAppleError(3, 1, 8), config), nil
+			}
+			socket := newMockConnPool()
+			sockets = append(sockets, socket)
+			return socketAPNSConnection(socket, config), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := testTokens(1)[0].Token
+	for i := 1; i <= 3; i++ {
+		if err := supervisor.Send(&Payload{Token: token, AlertText: fmt.Sprintf("p%v", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connectionClose := <-supervisor.CloseChannel
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.AlertText != "p1" ||
+		len(connectionClose.UnsentPayloads) != 0 {
+		t.Fatalf("Expected only the rejected payload to be passed on but got %+v", connectionClose)
+	}
+
+	if err := supervisor.Send(&Payload{Token: token, AlertText: "p4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		var written []writtenNotification
+		if len(sockets) == 1 {
+			sockets[0].lock.Lock()
+			written = parseNotifications(sockets[0].WrittenBytes.Bytes())
+			sockets[0].lock.Unlock()
+		}
+		lock.Unlock()
+		if len(written) == 3 {
+			if written[0].Payload != `{"aps":{"alert":"p2"}}` || written[2].Payload != `{"aps":{"alert":"p4"}}` {
+				t.Errorf("Expected unsent payloads to be resent ahead of p4 but got %v", written)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for payloads on the replacement connection, got %v", written)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	supervisor.Disconnect()
+	for range supervisor.CloseChannel {
+	}
+}
+
+func TestSupervisorShouldRetryFailedReconnects(t *testing.T) {
+	socket := newMockConnPool()
+	lock := new(sync.Mutex)
+	dials := 0
+	reconnected := make(chan bool)
+	var reconnectErrors []error
+	var attempts []*ReconnectAttempt
+	supervisor, err := NewSupervisor(&SupervisorConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		},
+		RetryInterval: 1,
+		Dial: func(config *APNSConfig) (*APNSConnection, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			dials++
+			switch dials {
+			case 1:
+				return socketAPNSConnection(socket, config), nil
+			case 2, 3:
+				return nil, errors.New("Gateway unavailable")
+			}
+			close(reconnected)
+			return socketAPNSConnection(newMockConnPool(), config), nil
+		},
+		OnReconnectError: func(err error) {
+			reconnectErrors = append(reconnectErrors, err)
+		},
+		OnReconnect: func(attempt *ReconnectAttempt) {
+			attempts = append(attempts, attempt)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the supervisor to reconnect")
+	}
+
+	//waits for the replacement connection
+	if err := supervisor.Send(testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(reconnectErrors) != 2 {
+		t.Errorf("Expected 2 reconnect errors but got %v", reconnectErrors)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("Expected 3 reconnect attempts but got %v", attempts)
+	}
+	if cause, ok := attempts[0].Cause.(*AppleError); attempts[0].Attempt != 1 || attempts[0].Backoff != 0 ||
+		!ok || cause.ErrorCode != CONNECTION_CLOSED_UNKNOWN || attempts[0].Err == nil {
+		t.Errorf("Expected a failed first attempt caused by the close but got %+v", attempts[0])
+	}
+	if attempts[1].Attempt != 2 || attempts[1].Backoff <= 0 || attempts[1].Backoff > time.Millisecond ||
+		attempts[1].Cause != attempts[0].Err {
+		t.Errorf("Expected a second attempt after a backoff caused by the first failure but got %+v", attempts[1])
+	}
+	if attempts[2].Attempt != 3 || attempts[2].Backoff <= 0 || attempts[2].Backoff > 2*time.Millisecond ||
+		attempts[2].Err != nil {
+		t.Errorf("Expected a successful third attempt but got %+v", attempts[2])
+	}
+
+	supervisor.Disconnect()
+	for range supervisor.CloseChannel {
+	}
+	if err := supervisor.Send(testTokens(1)[0]); err != ErrPoolDisconnected {
+		t.Errorf("Expected ErrPoolDisconnected after disconnect but got %v", err)
+	}
+}
+
+func TestSupervisorShouldGiveUpAfterMaxReconnectAttempts(t *testing.T) {
+	socket := newMockConnPool()
+	lock := new(sync.Mutex)
+	dials := 0
+	var reconnectErrors []error
+	supervisor, err := NewSupervisor(&SupervisorConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		},
+		RetryInterval:        1,
+		MaxReconnectAttempts: 3,
+		Dial: func(config *APNSConfig) (*APNSConnection, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			dials++
+			if dials == 1 {
+				return socketAPNSConnection(socket, config), nil
+			}
+			return nil, errors.New("Gateway unavailable")
+		},
+		OnReconnectError: func(err error) {
+			lock.Lock()
+			reconnectErrors = append(reconnectErrors, err)
+			lock.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Disconnect()
+	if supervisor.Err() != nil {
+		t.Errorf("Expected a healthy supervisor but got %v", supervisor.Err())
+	}
+
+	socket.Close()
+	deadline := time.Now().Add(time.Second)
+	for supervisor.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the supervisor to give up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//fails instead of waiting for a replacement forever
+	err = supervisor.Send(testTokens(1)[0])
+	reconnectErr, ok := err.(*ReconnectError)
+	if !ok || reconnectErr.Attempts != 3 || reconnectErr.Err.Error() != "Gateway unavailable" {
+		t.Fatalf("Expected a ReconnectError after 3 attempts but got %v", err)
+	}
+	if supervisor.Err() != err {
+		t.Errorf("Expected Err to be the terminal error but got %v", supervisor.Err())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if dials != 4 {
+		t.Errorf("Expected no more dials after giving up but got %v", dials)
+	}
+	if len(reconnectErrors) != 3 || reconnectErrors[2] != err {
+		t.Errorf("Expected 2 reconnect errors then the terminal error but got %v", reconnectErrors)
+	}
+}
+
+func TestSupervisorRetryJitterShouldShortenWaits(t *testing.T) {
+	supervisor, err := NewSupervisor(&SupervisorConfig{
+		ConnectionConfig: &APNSConfig{},
+		Lazy:             true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Disconnect()
+
+	for i := 0; i < 100; i++ {
+		if wait := supervisor.jitter(time.Second); wait < 500*time.Millisecond || wait > time.Second {
+			t.Fatalf("Expected a wait between 500ms and 1s but got %v", wait)
+		}
+	}
+	supervisor.config.RetryJitter = -1
+	if wait := supervisor.jitter(time.Second); wait != time.Second {
+		t.Errorf("Expected no jitter but got %v", wait)
+	}
+
+	_, err = NewSupervisor(&SupervisorConfig{ConnectionConfig: &APNSConfig{}, RetryJitter: 101, MaxReconnectAttempts: -1})
+	if err == nil || !strings.Contains(err.Error(), "RetryJitter") || !strings.Contains(err.Error(), "MaxReconnectAttempts") {
+		t.Errorf("Expected RetryJitter and MaxReconnectAttempts errors but got %v", err)
+	}
+}
+
+func TestSupervisorShouldRedialIdleConnectionsOnSend(t *testing.T) {
+	var sockets []MockConnPool
+	lock := new(sync.Mutex)
+	config := testPoolConfig(&sockets, lock)
+	config.ConnectionConfig.FramingTimeout = -1
+	config.ConnectionConfig.IdleTimeout = 20
+
+	supervisor, err := NewSupervisor(&SupervisorConfig{
+		ConnectionConfig: config.ConnectionConfig,
+		Dial:             config.Dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer supervisor.Disconnect()
+
+	deadline := time.Now().Add(time.Second)
+	for supervisor.Pool().Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the idle connection to close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	dials := len(sockets)
+	lock.Unlock()
+	if dials != 1 {
+		t.Fatalf("Expected idle connection not to be replaced until the next send but dialed %v", dials)
+	}
+
+	if err := supervisor.Send(testTokens(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sockets) != 2 {
+		t.Fatalf("Expected a new connection to be dialed for the send but dialed %v", len(sockets))
+	}
+}
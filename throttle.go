@@ -0,0 +1,169 @@
+package apns
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Reason given to OnDrop for payloads over their topic's Limit
+var ErrThrottled = errors.New("Payload dropped, topic is over its limit")
+
+//Reason given to OnDrop for payloads left out by sampling
+var ErrSampledOut = errors.New("Payload dropped by sampling")
+
+//Config for capping and sampling payloads per topic
+type ThrottleConfig struct {
+	//returns the topic a payload is counted under, e.g. the tenant it's for : required
+	Topic func(payload *Payload) string
+	//max number of payloads sent per topic in each Window, defaults to 0 (no limit)
+	Limit int
+	//limits for specific topics, overriding Limit, 0 for no limit
+	TopicLimits map[string]int
+	//number of milliseconds in each window, defaults to 1000
+	Window int
+	//percentage of each topic's payloads to send, defaults to 100
+	SamplePercent int
+	//sample percentages for specific topics, overriding SamplePercent
+	TopicSamplePercents map[string]int
+	//called with payloads which are dropped and why (ErrThrottled or ErrSampledOut), defaults to none
+	//called from the sending go-routine so it must not block on the connection
+	OnDrop func(payload *Payload, reason error)
+	//source of the time windows start at, defaults to SystemClock
+	Clock Clock
+}
+
+//Caps and samples payloads per topic so one topic can't flood a shared connection
+//Use Middleware as a SendMiddleware, on an APNSConfig or around pool.Send
+type Throttle struct {
+	//config
+	config *ThrottleConfig
+	//length of each window
+	window time.Duration
+	//Mutex to sync access to counts and random
+	lock *sync.Mutex
+	//payloads sent in the current window, by topic
+	counts map[string]*throttleCount
+	//source of sampling decisions
+	random *rand.Rand
+	//Number of payloads dropped
+	dropped atomic.Uint64
+}
+
+//Payloads sent for a topic in its current window
+type throttleCount struct {
+	windowStart time.Time
+	sent        int
+}
+
+//Create a throttle with the supplied config
+//If invalid config an error will be returned
+func NewThrottle(config *ThrottleConfig) (*Throttle, error) {
+	errorStrs := ""
+
+	if config.Topic == nil {
+		errorStrs += "Invalid Topic. Must be supplied\n"
+	}
+	if config.Limit < 0 {
+		errorStrs += "Invalid Limit. Should be >= 0\n"
+	}
+	for topic, limit := range config.TopicLimits {
+		if limit < 0 {
+			errorStrs += "Invalid TopicLimits for " + topic + ". Should be >= 0\n"
+		}
+	}
+	if config.Window < 0 {
+		errorStrs += "Invalid Window. Should be > 0\n"
+	}
+	if config.SamplePercent < 0 || config.SamplePercent > 100 {
+		errorStrs += "Invalid SamplePercent. Should be between 0 and 100\n"
+	}
+	for topic, percent := range config.TopicSamplePercents {
+		if percent < 0 || percent > 100 {
+			errorStrs += "Invalid TopicSamplePercents for " + topic + ". Should be between 0 and 100\n"
+		}
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Window == 0 {
+		config.Window = 1000
+	}
+	if config.SamplePercent == 0 {
+		config.SamplePercent = 100
+	}
+	config.Clock = configClock(config.Clock)
+
+	return &Throttle{
+		config: config,
+		window: time.Duration(config.Window) * time.Millisecond,
+		lock:   new(sync.Mutex),
+		counts: make(map[string]*throttleCount),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+//SendMiddleware which drops payloads that are sampled out or over their topic's limit
+//Dropped payloads are passed to OnDrop and aren't errors to the sender
+func (t *Throttle) Middleware(next SendFunc) SendFunc {
+	return func(payload *Payload) error {
+		if reason := t.allow(payload); reason != nil {
+			t.dropped.Add(1)
+			if t.config.OnDrop != nil {
+				t.config.OnDrop(payload, reason)
+			}
+			return nil
+		}
+		return next(payload)
+	}
+}
+
+//Number of payloads dropped by the throttle
+func (t *Throttle) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+//Decide whether a payload can be sent, counting it if so
+//Returns why it can't otherwise
+func (t *Throttle) allow(payload *Payload) error {
+	topic := t.config.Topic(payload)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	percent := t.config.SamplePercent
+	if topicPercent, ok := t.config.TopicSamplePercents[topic]; ok {
+		percent = topicPercent
+	}
+	if percent < 100 && t.random.Intn(100) >= percent {
+		return ErrSampledOut
+	}
+
+	limit := t.config.Limit
+	if topicLimit, ok := t.config.TopicLimits[topic]; ok {
+		limit = topicLimit
+	}
+	if limit == 0 {
+		return nil
+	}
+
+	now := t.config.Clock.Now()
+	count := t.counts[topic]
+	if count == nil {
+		count = &throttleCount{}
+		t.counts[topic] = count
+	}
+	if now.Sub(count.windowStart) >= t.window {
+		count.windowStart = now
+		count.sent = 0
+	}
+	if count.sent >= limit {
+		return ErrThrottled
+	}
+	count.sent++
+	return nil
+}
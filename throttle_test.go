@@ -0,0 +1,90 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleShouldCapTopicsPerWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dropped := make(map[string]int)
+	throttle, err := NewThrottle(&ThrottleConfig{
+		Topic:       func(payload *Payload) string { return payload.Category },
+		Limit:       2,
+		TopicLimits: map[string]int{"noisy": 1, "trusted": 0},
+		OnDrop: func(payload *Payload, reason error) {
+			if reason == ErrThrottled {
+				dropped[payload.Category]++
+			}
+		},
+		Clock: fixedClock{now: &now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(map[string]int)
+	send := throttle.Middleware(func(payload *Payload) error {
+		sent[payload.Category]++
+		return nil
+	})
+	for _, topic := range []string{"a", "a", "a", "noisy", "noisy", "trusted", "trusted", "trusted"} {
+		if err := send(&Payload{Category: topic}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sent["a"] != 2 || sent["noisy"] != 1 || sent["trusted"] != 3 {
+		t.Errorf("Expected topics to be capped at their limits but sent %v", sent)
+	}
+	if dropped["a"] != 1 || dropped["noisy"] != 1 || throttle.Dropped() != 2 {
+		t.Errorf("Expected capped payloads to be reported but dropped %v", dropped)
+	}
+
+	now = now.Add(time.Second)
+	send(&Payload{Category: "a"})
+	if sent["a"] != 3 {
+		t.Error("Expected limit to reset in the next window")
+	}
+}
+
+func TestThrottleShouldSampleTopics(t *testing.T) {
+	throttle, err := NewThrottle(&ThrottleConfig{
+		Topic:               func(payload *Payload) string { return payload.Category },
+		SamplePercent:       50,
+		TopicSamplePercents: map[string]int{"off": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(map[string]int)
+	send := throttle.Middleware(func(payload *Payload) error {
+		sent[payload.Category]++
+		return nil
+	})
+	for i := 0; i < 1000; i++ {
+		send(&Payload{Category: "half"})
+		send(&Payload{Category: "off"})
+	}
+
+	if sent["off"] != 0 {
+		t.Errorf("Expected topic sampled at 0 percent to be dropped but sent %v", sent["off"])
+	}
+	if sent["half"] < 400 || sent["half"] > 600 {
+		t.Errorf("Expected about half of the payloads to be sent but sent %v", sent["half"])
+	}
+}
+
+func TestThrottleShouldValidateConfig(t *testing.T) {
+	_, err := NewThrottle(&ThrottleConfig{
+		Topic:         func(payload *Payload) string { return "" },
+		SamplePercent: 101,
+	})
+	if err == nil {
+		t.Error("Expected error for SamplePercent over 100")
+	}
+	if _, err := NewThrottle(&ThrottleConfig{}); err == nil {
+		t.Error("Expected error for missing Topic")
+	}
+}
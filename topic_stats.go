@@ -0,0 +1,155 @@
+package apns
+
+import (
+	"errors"
+	"sync"
+)
+
+//Error for a payload, tagged with the topic it was counted under (see TopicStats)
+type TopicError struct {
+	Topic string
+	Err   error
+}
+
+func (e *TopicError) Error() string {
+	return "[" + e.Topic + "] " + e.Err.Error()
+}
+
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+//Config for counting what becomes of payloads per topic
+type TopicStatsConfig struct {
+	//returns the topic a payload is counted under, e.g. the tenant it's for : required
+	Topic func(payload *Payload) string
+	//where rejected payloads and Apple errors are logged at LOG_LEVEL_WARN,
+	//prefixed with their topic, defaults to none
+	Logger Logger
+}
+
+//Counts for one topic
+type TopicCounts struct {
+	//payloads passed on to be sent
+	Sent uint64
+	//payloads reported to Accepted
+	Accepted uint64
+	//payloads rejected before being written (see PayloadError)
+	PayloadErrors uint64
+	//payloads Apple returned an error for, by error code
+	AppleErrors map[uint8]uint64
+	//payloads Apple returned INVALID_TOKEN for, also counted in AppleErrors
+	InvalidTokens uint64
+}
+
+//Counts and tags what becomes of payloads per topic, so one tenant's
+//invalid token storm on a shared connection or pool can be told apart
+//from another's in dashboards, logs and error callbacks
+//Use Middleware as a SendMiddleware and Interceptor as a ResultInterceptor
+//on the APNSConfig, and call Accepted from OnAccepted
+//THREADSAFE (so one instance can be shared by a pool's connections)
+type TopicStats struct {
+	//config
+	config *TopicStatsConfig
+	//Mutex to sync access to counts
+	lock *sync.Mutex
+	//counts by topic
+	counts map[string]*TopicCounts
+}
+
+//Create topic stats with the supplied config
+//If invalid config an error will be returned
+func NewTopicStats(config *TopicStatsConfig) (*TopicStats, error) {
+	if config.Topic == nil {
+		return nil, errors.New("Invalid Topic. Must be supplied")
+	}
+	return &TopicStats{
+		config: config,
+		lock:   new(sync.Mutex),
+		counts: make(map[string]*TopicCounts),
+	}, nil
+}
+
+//SendMiddleware counting the payloads passed on to be sent by topic
+func (s *TopicStats) Middleware(next SendFunc) SendFunc {
+	return func(payload *Payload) error {
+		err := next(payload)
+		if err == nil {
+			topic := s.config.Topic(payload)
+			s.lock.Lock()
+			s.topicCounts(topic).Sent++
+			s.lock.Unlock()
+		}
+		return err
+	}
+}
+
+//ResultInterceptor counting payload errors and Apple errors by topic
+//Payload errors are passed on with their Err wrapped in a TopicError, so
+//OnPayloadError can tell which topic they're for
+func (s *TopicStats) Interceptor(next ResultFunc) ResultFunc {
+	return func(result *Result) {
+		if result.PayloadError != nil && result.PayloadError.Payload != nil {
+			topic := s.config.Topic(result.PayloadError.Payload)
+			s.lock.Lock()
+			s.topicCounts(topic).PayloadErrors++
+			s.lock.Unlock()
+			if s.config.Logger != nil {
+				s.config.Logger.Logf(LOG_LEVEL_WARN, "[%v] %v", topic, result.PayloadError)
+			}
+			result.PayloadError.Err = &TopicError{Topic: topic, Err: result.PayloadError.Err}
+		}
+		if result.Close != nil && result.Close.Error != nil && result.Close.ErrorPayload != nil {
+			topic := s.config.Topic(result.Close.ErrorPayload)
+			code := result.Close.Error.ErrorCode
+			s.lock.Lock()
+			counts := s.topicCounts(topic)
+			counts.AppleErrors[code]++
+			//8 is INVALID_TOKEN
+			if code == 8 {
+				counts.InvalidTokens++
+			}
+			s.lock.Unlock()
+			if s.config.Logger != nil {
+				s.config.Logger.Logf(LOG_LEVEL_WARN, "[%v] Apple returned %v for a payload",
+					topic, result.Close.Error.ErrorString)
+			}
+		}
+		next(result)
+	}
+}
+
+//Count a payload Apple accepted, for calling from APNSConfig.OnAccepted
+func (s *TopicStats) Accepted(payload *Payload) {
+	topic := s.config.Topic(payload)
+	s.lock.Lock()
+	s.topicCounts(topic).Accepted++
+	s.lock.Unlock()
+}
+
+//Copy of the counts for every topic seen so far
+func (s *TopicStats) Counts() map[string]TopicCounts {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counts := make(map[string]TopicCounts, len(s.counts))
+	for topic, c := range s.counts {
+		copied := *c
+		copied.AppleErrors = make(map[uint8]uint64, len(c.AppleErrors))
+		for code, n := range c.AppleErrors {
+			copied.AppleErrors[code] = n
+		}
+		counts[topic] = copied
+	}
+	return counts
+}
+
+//Counts for a topic, created the first time it's seen
+//NOT THREADSAFE (need to acquire lock before calling)
+func (s *TopicStats) topicCounts(topic string) *TopicCounts {
+	c, ok := s.counts[topic]
+	if !ok {
+		c = &TopicCounts{AppleErrors: make(map[uint8]uint64)}
+		s.counts[topic] = c
+	}
+	return c
+}
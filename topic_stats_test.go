@@ -0,0 +1,68 @@
+package apns
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopicStatsShouldSegregateOutcomesByTopic(t *testing.T) {
+	logger := newTestLogger()
+	stats, err := NewTopicStats(&TopicStatsConfig{
+		Topic:  func(p *Payload) string { return p.ExtraData.(string) },
+		Logger: logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadErrors := make(chan *PayloadError, 1)
+	//the third payload buffered (id 3) is rejected as an invalid token
+	apn := socketAPNSConnection(newMockConnAppleError(3, 3, 8), &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		SendMiddleware:            []SendMiddleware{stats.Middleware},
+		ResultInterceptors:        []ResultInterceptor{stats.Interceptor},
+		OnAccepted:                stats.Accepted,
+		OnPayloadError: func(err *PayloadError) {
+			payloadErrors <- err
+		},
+	})
+	payloads := testTokens(4)
+	payloads[0].Token = "zz"
+	for i, tenant := range []string{"tenant-a", "tenant-a", "tenant-b", "tenant-b"} {
+		payloads[i].ExtraData = tenant
+	}
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.ErrorPayload != payloads[2] {
+		t.Fatalf("Expected the third payload to be rejected but got %+v", connectionClose)
+	}
+
+	var topicErr *TopicError
+	if err := <-payloadErrors; !errors.As(err, &topicErr) || topicErr.Topic != "tenant-a" ||
+		!errors.Is(err, ErrBadTokenEncoding) {
+		t.Errorf("Expected the payload error to be tagged with tenant-a but got %v", err)
+	}
+	counts := stats.Counts()
+	a, b := counts["tenant-a"], counts["tenant-b"]
+	if a.Sent != 2 || a.PayloadErrors != 1 || a.Accepted != 1 || a.InvalidTokens != 0 || len(a.AppleErrors) != 0 {
+		t.Errorf("Expected tenant-a to have one rejected and one accepted payload but got %+v", a)
+	}
+	if b.Sent != 2 || b.InvalidTokens != 1 || !reflect.DeepEqual(b.AppleErrors, map[uint8]uint64{8: 1}) ||
+		b.Accepted != 0 || b.PayloadErrors != 0 {
+		t.Errorf("Expected tenant-b to have one invalid token but got %+v", b)
+	}
+	if output := logger.output(); !strings.Contains(output, "[tenant-a] ") ||
+		!strings.Contains(output, "[tenant-b] Apple returned INVALID_TOKEN") {
+		t.Errorf("Expected log lines tagged with each tenant but got %v", output)
+	}
+
+	if _, err := NewTopicStats(&TopicStatsConfig{}); err == nil {
+		t.Error("Expected an error without a Topic")
+	}
+}
@@ -0,0 +1,51 @@
+package apns
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewUUIDShouldBeVersion4(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		u, err := newUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(u) {
+			t.Fatalf("Expected a version 4 UUID but got %v", u)
+		}
+		if seen[u] {
+			t.Fatalf("Generated %v twice", u)
+		}
+		seen[u] = true
+	}
+}
+
+func TestConnectionShouldGenerateUUIDsAndReportThemOnError(t *testing.T) {
+	apn := socketAPNSConnection(newMockConnAppleError(2, 1, 8),
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			GeneratePayloadUUIDs:      true,
+		})
+
+	payloads := testTokens(2)
+	payloads[1].UUID = "my-own-id"
+	for _, p := range payloads {
+		apn.SendChannel <- p
+	}
+
+	connectionClose := <-apn.CloseChannel
+
+	if payloads[0].UUID == "" || payloads[1].UUID != "my-own-id" {
+		t.Errorf("Expected a UUID to be generated only for the payload without one but got %v and %v",
+			payloads[0].UUID, payloads[1].UUID)
+	}
+	if connectionClose.Error == nil || connectionClose.Error.PayloadUUID != payloads[0].UUID {
+		t.Errorf("Expected error to carry UUID %v but got %+v", payloads[0].UUID, connectionClose.Error)
+	}
+}
@@ -0,0 +1,327 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Config for posting delivery failures to a webhook
+type WebhookConfig struct {
+	//url events are POSTed to : required
+	URL string
+	//max number of events per POST, defaults to 100
+	BatchSize int
+	//number of milliseconds to wait for a batch to fill before posting it, defaults to 1000
+	FlushInterval int
+	//number of times to retry a failed POST, defaults to 3, -1 for none
+	MaxRetries int
+	//number of milliseconds to wait before retrying a failed POST, defaults to 1000
+	//doubles on each retry
+	RetryInterval int
+	//number of events to hold while waiting to post, defaults to 10000
+	//events reported while the queue is full are dropped
+	QueueSize int
+	//client used to POST, defaults to a client with a 10 second timeout
+	Client *http.Client
+	//called when a batch is dropped after its retries run out, defaults to none
+	OnError func(err error)
+	//how device tokens are shown in events, defaults to TOKEN_REDACTION_NONE (in full)
+	//the receiver can't act on a token (e.g. remove an invalid one) unless it's in full
+	TokenRedaction TokenRedaction
+	//source of event timestamps and of the flush and retry timers, defaults to SystemClock
+	Clock Clock
+}
+
+//Event POSTed to the webhook
+type WebhookEvent struct {
+	//"payload_failed" or "invalid_token"
+	Type string `json:"type"`
+	//Device push token
+	Token string `json:"token"`
+	//UUID of the failed payload, if it had one
+	UUID string `json:"uuid,omitempty"`
+	//Error code returned by Apple for failed payloads with an Apple error
+	ErrorCode uint8 `json:"error_code,omitempty"`
+	//Description of why the payload failed
+	Error string `json:"error,omitempty"`
+	//Where an invalid token was reported from
+	Source string `json:"source,omitempty"`
+	//When the event happened
+	Timestamp time.Time `json:"timestamp"`
+}
+
+//Body of each webhook POST
+type webhookBatch struct {
+	Events []*WebhookEvent `json:"events"`
+}
+
+const (
+	WEBHOOK_EVENT_PAYLOAD_FAILED = "payload_failed"
+	WEBHOOK_EVENT_INVALID_TOKEN  = "invalid_token"
+)
+
+//Batches delivery failures and invalid tokens and POSTs them as JSON to a webhook
+//Report methods match the APNSConfig callbacks so they can be plugged in directly:
+//	OnPayloadError:   emitter.ReportPayloadError,
+//	ErrorHandlers:    map[uint8]AppleErrorHandler{8: emitter.ReportAppleError},
+type WebhookEmitter struct {
+	//config
+	config *WebhookConfig
+	//Channel events are queued on
+	eventChannel chan *WebhookEvent
+	//Closed to flush and stop posting
+	closeChannel chan bool
+	//Closed once the post go-routine has exited
+	doneChannel chan bool
+	//Makes Close safe to call more than once
+	closeOnce *sync.Once
+	//Number of events dropped because the queue was full
+	dropped atomic.Uint64
+}
+
+//Create a webhook emitter with the supplied config and start posting
+func NewWebhookEmitter(config *WebhookConfig) (*WebhookEmitter, error) {
+	errorStrs := ""
+
+	if config.URL == "" {
+		errorStrs += "Invalid URL. Must be supplied\n"
+	}
+	if config.BatchSize < 0 {
+		errorStrs += "Invalid BatchSize. Should be > 0\n"
+	}
+	if config.FlushInterval < 0 {
+		errorStrs += "Invalid FlushInterval. Should be > 0\n"
+	}
+	if config.MaxRetries < -1 {
+		errorStrs += "Invalid MaxRetries. Should be >= 0, or -1\n"
+	}
+	if config.RetryInterval < 0 {
+		errorStrs += "Invalid RetryInterval. Should be > 0\n"
+	}
+	if config.QueueSize < 0 {
+		errorStrs += "Invalid QueueSize. Should be > 0\n"
+	}
+	if !config.TokenRedaction.valid() {
+		errorStrs += "Invalid TokenRedaction. Should be TOKEN_REDACTION_NONE, TOKEN_REDACTION_PREFIX or TOKEN_REDACTION_HASH\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.BatchSize == 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = 1000
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = 1000
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 10000
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	config.Clock = configClock(config.Clock)
+
+	w := &WebhookEmitter{
+		config:       config,
+		eventChannel: make(chan *WebhookEvent, config.QueueSize),
+		closeChannel: make(chan bool),
+		doneChannel:  make(chan bool),
+		closeOnce:    new(sync.Once),
+	}
+
+	go w.postListener()
+
+	return w, nil
+}
+
+//Report a payload rejected before being sent
+func (w *WebhookEmitter) ReportPayloadError(err *PayloadError) {
+	w.Report(&WebhookEvent{
+		Type:      WEBHOOK_EVENT_PAYLOAD_FAILED,
+		Token:     err.Payload.Token,
+		UUID:      err.Payload.UUID,
+		Error:     err.Err.Error(),
+		Timestamp: w.config.Clock.Now(),
+	})
+}
+
+//Report a payload Apple returned an error for
+func (w *WebhookEmitter) ReportAppleError(err *AppleError, payload *Payload) {
+	if payload == nil {
+		return
+	}
+	w.Report(&WebhookEvent{
+		Type:      WEBHOOK_EVENT_PAYLOAD_FAILED,
+		Token:     payload.Token,
+		UUID:      payload.UUID,
+		ErrorCode: err.ErrorCode,
+		Error:     err.ErrorString,
+		Timestamp: w.config.Clock.Now(),
+	})
+}
+
+//Report a token from an InvalidTokenFeed
+func (w *WebhookEmitter) ReportInvalidToken(token InvalidToken) {
+	w.Report(&WebhookEvent{
+		Type:      WEBHOOK_EVENT_INVALID_TOKEN,
+		Token:     token.Token,
+		Source:    token.Source.String(),
+		Timestamp: token.Timestamp,
+	})
+}
+
+//Queue an event to be posted
+//Never blocks, the event is dropped if the queue is full or the emitter is closed
+//The event's token is redacted in place (see WebhookConfig.TokenRedaction)
+func (w *WebhookEmitter) Report(event *WebhookEvent) {
+	event.Token = w.config.TokenRedaction.Redact(event.Token)
+	select {
+	case <-w.closeChannel:
+		w.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case w.eventChannel <- event:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+//Number of events dropped because the queue was full or the emitter was closed
+func (w *WebhookEmitter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+//Post any queued events and stop
+//Failed POSTs aren't retried once the emitter is closing
+func (w *WebhookEmitter) Close() {
+	w.closeOnce.Do(func() { close(w.closeChannel) })
+	<-w.doneChannel
+}
+
+//go-routine to gather events into batches and post them
+func (w *WebhookEmitter) postListener() {
+	defer close(w.doneChannel)
+
+	flushInterval := time.Duration(w.config.FlushInterval) * time.Millisecond
+	batch := make([]*WebhookEvent, 0, w.config.BatchSize)
+	flushTimer := w.config.Clock.NewTimer(flushInterval)
+	flushTimer.Stop()
+
+	for {
+		select {
+		case event := <-w.eventChannel:
+			if len(batch) == 0 {
+				flushTimer.Reset(flushInterval)
+			}
+			batch = append(batch, event)
+			if len(batch) >= w.config.BatchSize {
+				flushTimer.Stop()
+				w.post(batch)
+				batch = batch[:0]
+			}
+		case <-flushTimer.Chan():
+			w.post(batch)
+			batch = batch[:0]
+		case <-w.closeChannel:
+			flushTimer.Stop()
+			//drain anything reported before the close
+			for {
+				select {
+				case event := <-w.eventChannel:
+					batch = append(batch, event)
+					if len(batch) >= w.config.BatchSize {
+						w.post(batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if len(batch) > 0 {
+				w.post(batch)
+			}
+			return
+		}
+	}
+}
+
+//POST a batch, retrying on failure until the emitter is closed
+//Reports an error if the retries run out
+func (w *WebhookEmitter) post(batch []*WebhookEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(webhookBatch{Events: batch})
+	if err != nil {
+		w.reportError(err)
+		return
+	}
+
+	retryInterval := time.Duration(w.config.RetryInterval) * time.Millisecond
+	attempts := 0
+	for {
+		err = w.postOnce(body)
+		attempts++
+		if err == nil {
+			return
+		}
+		if attempts > w.config.MaxRetries || !w.waitToRetry(retryInterval) {
+			break
+		}
+		retryInterval *= 2
+	}
+	w.reportError(fmt.Errorf("Dropped %v webhook events after %v attempts : %v",
+		len(batch), attempts, err))
+}
+
+//Wait before retrying a POST
+//Returns false if the emitter is closed first
+func (w *WebhookEmitter) waitToRetry(wait time.Duration) bool {
+	timer := w.config.Clock.NewTimer(wait)
+	select {
+	case <-timer.Chan():
+		return true
+	case <-w.closeChannel:
+		timer.Stop()
+		return false
+	}
+}
+
+//POST a body once
+//Any non 2xx response is an error
+func (w *WebhookEmitter) postOnce(body []byte) error {
+	response, err := w.config.Client.Post(w.config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with status %v", response.Status)
+	}
+	return nil
+}
+
+//Report an error to OnError
+func (w *WebhookEmitter) reportError(err error) {
+	if w.config.OnError != nil {
+		w.config.OnError(err)
+	}
+}
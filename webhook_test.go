@@ -0,0 +1,234 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (r *webhookRecorder) posted() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.batches)
+}
+
+func (r *webhookRecorder) remainingFailures() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.failures
+}
+
+type webhookRecorder struct {
+	lock    *sync.Mutex
+	batches [][]*WebhookEvent
+	//number of requests to fail before succeeding
+	failures int
+}
+
+func newWebhookServer(failures int) (*httptest.Server, *webhookRecorder) {
+	recorder := &webhookRecorder{lock: new(sync.Mutex), failures: failures}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+		if recorder.failures > 0 {
+			recorder.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch webhookBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		recorder.batches = append(recorder.batches, batch.Events)
+	}))
+	return server, recorder
+}
+
+func TestWebhookShouldBatchEvents(t *testing.T) {
+	server, recorder := newWebhookServer(0)
+	defer server.Close()
+
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     2,
+		FlushInterval: 10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := testTokens(2)
+	emitter.ReportPayloadError(&PayloadError{Payload: payloads[0], Err: ErrBadTokenLength})
+	emitter.ReportAppleError(&AppleError{ErrorCode: 8, ErrorString: "INVALID_TOKEN"}, payloads[1])
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa", Source: INVALID_TOKEN_SOURCE_FEEDBACK})
+	emitter.Close()
+
+	if len(recorder.batches) != 2 || len(recorder.batches[0]) != 2 || len(recorder.batches[1]) != 1 {
+		t.Fatalf("Expected a full batch of 2 then the remaining event on close but got %v", recorder.batches)
+	}
+	failed := recorder.batches[0][1]
+	if failed.Type != WEBHOOK_EVENT_PAYLOAD_FAILED || failed.Token != payloads[1].Token || failed.ErrorCode != 8 {
+		t.Errorf("Expected failed payload event for code 8 but got %+v", failed)
+	}
+	invalid := recorder.batches[1][0]
+	if invalid.Type != WEBHOOK_EVENT_INVALID_TOKEN || invalid.Token != "aa" || invalid.Source != "FEEDBACK" {
+		t.Errorf("Expected invalid token event from feedback but got %+v", invalid)
+	}
+}
+
+func TestWebhookShouldFlushAfterInterval(t *testing.T) {
+	server, recorder := newWebhookServer(0)
+	defer server.Close()
+
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		FlushInterval: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa"})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		recorder.lock.Lock()
+		posted := len(recorder.batches)
+		recorder.lock.Unlock()
+		if posted == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the batch to be posted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookShouldRetryFailedPosts(t *testing.T) {
+	server, recorder := newWebhookServer(2)
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     1,
+		RetryInterval: 1,
+		OnError:       func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa"})
+	//retries stop once the emitter is closed, so wait for the post first
+	for recorder.posted() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	emitter.Close()
+
+	if len(errs) != 0 || len(recorder.batches) != 1 {
+		t.Errorf("Expected batch to be posted after 2 failures but got batches %v and %v errors", recorder.batches, len(errs))
+	}
+}
+
+func TestWebhookShouldReportDroppedBatch(t *testing.T) {
+	server, recorder := newWebhookServer(10)
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     1,
+		MaxRetries:    1,
+		RetryInterval: 1,
+		OnError:       func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emitter.ReportPayloadError(&PayloadError{Payload: testTokens(1)[0], Err: errors.New("Too long")})
+	dropped := <-errs
+	emitter.Close()
+
+	if len(errs) != 0 || len(recorder.batches) != 0 || recorder.failures != 8 ||
+		!strings.Contains(dropped.Error(), "after 2 attempts") {
+		t.Errorf("Expected batch to be dropped after 2 attempts but got batches %v and error %v", recorder.batches, dropped)
+	}
+
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa"})
+	if emitter.Dropped() != 1 {
+		t.Errorf("Expected event reported after close to be dropped")
+	}
+}
+
+func TestWebhookShouldNotRetryWithMaxRetriesNone(t *testing.T) {
+	server, recorder := newWebhookServer(10)
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     1,
+		MaxRetries:    -1,
+		RetryInterval: 1,
+		OnError:       func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa"})
+	if err := <-errs; !strings.Contains(err.Error(), "after 1 attempts") {
+		t.Errorf("Expected batch to be dropped after 1 attempt but got %v", err)
+	}
+	if failures := recorder.remainingFailures(); failures != 9 {
+		t.Errorf("Expected a single POST but got %v", 10-failures)
+	}
+
+	_, err = NewWebhookEmitter(&WebhookConfig{URL: server.URL, MaxRetries: -2})
+	if err == nil {
+		t.Error("Expected MaxRetries below -1 to be rejected")
+	}
+}
+
+func TestWebhookCloseShouldNotWaitToRetry(t *testing.T) {
+	server, recorder := newWebhookServer(10)
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	emitter, err := NewWebhookEmitter(&WebhookConfig{
+		URL:           server.URL,
+		BatchSize:     1,
+		RetryInterval: 60000,
+		OnError:       func(err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emitter.ReportInvalidToken(InvalidToken{Token: "aa"})
+	//the first POST fails and the emitter starts waiting to retry
+	for recorder.remainingFailures() == 10 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan bool)
+	go func() {
+		emitter.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close to stop waiting for the retry")
+	}
+	if len(errs) != 1 {
+		t.Errorf("Expected the batch to be reported dropped but got %v errors", len(errs))
+	}
+}
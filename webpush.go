@@ -0,0 +1,141 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//Value of web_push marking a declarative Web Push payload, the number of the
+//RFC (Generic Event Delivery Using HTTP Push) it builds on
+const WEB_PUSH_DECLARATIVE = 8030
+
+//Returned when a web push payload is missing a field the browser needs
+var ErrWebPushMissingField = errors.New("Web push is missing a required field")
+
+//Returned when a web push payload has fields only other pushes can have, or
+//WebPush is set on a payload which isn't a web push
+var ErrWebPushField = errors.New("Field not allowed on a web push")
+
+//Notification the browser shows for a declarative Web Push, without
+//needing a service worker to build it
+type WebPushNotification struct {
+	//Title of the notification : required
+	Title string `json:"title"`
+	//URL opened when the notification is clicked, on the site that
+	//subscribed : required
+	Navigate string `json:"navigate"`
+	Body     string `json:"body,omitempty"`
+	//Language tag and direction (auto, ltr or rtl) of the title and body
+	Lang string `json:"lang,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+	//Notifications with the same tag replace each other
+	Tag    string `json:"tag,omitempty"`
+	Icon   string `json:"icon,omitempty"`
+	Image  string `json:"image,omitempty"`
+	Silent bool   `json:"silent,omitempty"`
+	//Value passed to the service worker, if it handles the push
+	Data interface{} `json:"data,omitempty"`
+	//Buttons shown with the notification
+	Actions []WebPushAction `json:"actions,omitempty"`
+}
+
+//Button of a WebPushNotification
+type WebPushAction struct {
+	//Identifies the action to the service worker
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	//URL opened when the button is clicked
+	Navigate string `json:"navigate,omitempty"`
+}
+
+//Check a web push has what the browser needs, and nothing it would ignore
+func (p *Payload) validateWebPush() error {
+	if p.PushType != PUSH_TYPE_WEBPUSH {
+		if p.WebPush != nil {
+			return fmt.Errorf("%w : WebPush", ErrWebPushField)
+		}
+		if p.WebPushMutable {
+			return fmt.Errorf("%w : WebPushMutable", ErrWebPushField)
+		}
+		return nil
+	}
+
+	if p.WebPush == nil {
+		return fmt.Errorf("%w : WebPush", ErrWebPushMissingField)
+	}
+	if p.WebPush.Title == "" {
+		return fmt.Errorf("%w : WebPush.Title", ErrWebPushMissingField)
+	}
+	if u, err := url.Parse(p.WebPush.Navigate); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("%w : WebPush.Navigate should be an https URL", ErrWebPushMissingField)
+	}
+	//the aps dictionary isn't sent, so its fields would be silently dropped
+	switch {
+	case p.AlertText != "" || !p.isSimple():
+		return fmt.Errorf("%w : use WebPush.Title and Body instead of an alert", ErrWebPushField)
+	case p.Sound != "":
+		return fmt.Errorf("%w : Sound, use WebPush.Silent", ErrWebPushField)
+	case p.ContentAvailable != 0 || p.Category != "" || p.TargetContentID != "" ||
+		p.FilterCriteria != "" || p.URLArgs != nil:
+		return fmt.Errorf("%w : aps fields aren't sent with web pushes", ErrWebPushField)
+	case p.CustomFields != nil:
+		return fmt.Errorf("%w : CustomFields, use WebPush.Data", ErrWebPushField)
+	}
+	return nil
+}
+
+//Top level of a declarative Web Push payload, in place of the aps dictionary
+//Badge is sent as the app_badge
+func (p *Payload) webPushMap() map[string]interface{} {
+	webPush := map[string]interface{}{
+		"web_push":     WEB_PUSH_DECLARATIVE,
+		"notification": p.WebPush,
+	}
+	if p.Badge.IsSet() {
+		webPush["app_badge"] = p.Badge.Number()
+	}
+	if p.WebPushMutable {
+		webPush["mutable"] = true
+	}
+	return webPush
+}
+
+//Marshal a web push, truncating the notification's body to fit maxPayloadSize
+func (p *Payload) marshalWebPush(encoder JSONEncoder, maxPayloadSize int) ([]byte, error) {
+	webPush := p.webPushMap()
+	jsonStr, err := encoder.Marshal(webPush)
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonStr) > maxPayloadSize {
+		clipSize := len(jsonStr) - maxPayloadSize + 3 //need extra characters for ellipse
+		if clipSize > len(p.WebPush.Body) {
+			return nil, fmt.Errorf("Payload was too long to successfully marshall %v or less bytes", maxPayloadSize)
+		}
+		notification := *p.WebPush
+		notification.Body = notification.Body[:len(notification.Body)-clipSize] + "..."
+		webPush["notification"] = &notification
+		return encoder.Marshal(webPush)
+	}
+	return jsonStr, nil
+}
+
+//Website Push ID style topic for an origin: web. and the origin's host
+//reversed, e.g. web.com.example.news for https://news.example.com
+//Pushes are sent on a connection using the certificate for this topic
+func WebPushTopic(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return "", errors.New("Invalid origin. Should be an https URL, e.g. https://example.com")
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return "web." + strings.Join(labels, "."), nil
+}
@@ -0,0 +1,83 @@
+package apns
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWebPushShouldMarshalDeclarativePayload(t *testing.T) {
+	p := Payload{
+		PushType: PUSH_TYPE_WEBPUSH,
+		Badge:    NewBadgeNumber(3),
+		WebPush: &WebPushNotification{
+			Title:    "Sale",
+			Body:     "Everything half off",
+			Navigate: "https://example.com/sale",
+			Actions:  []WebPushAction{{Action: "later", Title: "Remind me"}},
+		},
+		WebPushMutable: true,
+	}
+
+	json, err := p.Marshal(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"app_badge":3,"mutable":true,"notification":{"title":"Sale","navigate":"https://example.com/sale",` +
+		`"body":"Everything half off","actions":[{"action":"later","title":"Remind me"}]},"web_push":8030}`
+	if string(json) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(json))
+	}
+	if size, _ := p.EstimateSize(); size != len(expected) {
+		t.Errorf("Expected an estimate of %v but got %v", len(expected), size)
+	}
+
+	p.WebPush.Body = strings.Repeat("a", 300)
+	json, err = p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(json) > 256 || !strings.Contains(string(json), `a...",`) {
+		t.Errorf("Expected the body to be truncated to fit but got %v", string(json))
+	}
+	if len(p.WebPush.Body) != 300 {
+		t.Error("Expected the payload's body to be left alone")
+	}
+}
+
+func TestWebPushShouldValidateFields(t *testing.T) {
+	valid := func() *Payload {
+		return &Payload{
+			PushType: PUSH_TYPE_WEBPUSH,
+			WebPush:  &WebPushNotification{Title: "Hi", Navigate: "https://example.com"},
+		}
+	}
+	tests := []struct {
+		change func(p *Payload)
+		err    error
+	}{
+		{func(p *Payload) { p.WebPush = nil }, ErrWebPushMissingField},
+		{func(p *Payload) { p.WebPush.Title = "" }, ErrWebPushMissingField},
+		{func(p *Payload) { p.WebPush.Navigate = "http://example.com" }, ErrWebPushMissingField},
+		{func(p *Payload) { p.AlertText = "Hi" }, ErrWebPushField},
+		{func(p *Payload) { p.Sound = SoundDefault }, ErrWebPushField},
+		{func(p *Payload) { p.CustomFields = map[string]interface{}{"id": 1} }, ErrWebPushField},
+		{func(p *Payload) { p.PushType = PUSH_TYPE_ALERT }, ErrWebPushField},
+	}
+	for i, test := range tests {
+		p := valid()
+		test.change(p)
+		if _, err := p.Marshal(2048); !errors.Is(err, test.err) {
+			t.Errorf("Expected %v for change %v but got %v", test.err, i, err)
+		}
+	}
+}
+
+func TestWebPushTopic(t *testing.T) {
+	if topic, err := WebPushTopic("https://news.example.com"); err != nil || topic != "web.com.example.news" {
+		t.Errorf("Expected web.com.example.news but got %v, %v", topic, err)
+	}
+	if _, err := WebPushTopic("http://example.com"); err == nil {
+		t.Error("Expected an error for an http origin")
+	}
+}